@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var backfill = &cli.Command{
+	Usage:     "Run the rollup at a stride across a range of past epochs",
+	Name:      "backfill",
+	ArgsUsage: "  [<rollup flags>...] <eligible project list> <restore client list>",
+	Description: `Runs rollup, passing it the given arguments, at every --stride-epochs epochs from
+--from-epoch up to --to-epoch, each into its own epoch directory within --root.
+Heights falling on a null round are rolled up at the tipset before them. The node
+must still hold the state at every sampled epoch, which for any but the most recent
+ones takes an archival node. Example:
+
+   backfill --root /data/history --from-epoch 166560 --stride-epochs 20160 -- projects.json restore.json
+
+Unless a --phase or --phasestart-epoch is passed, every epoch is rolled up within
+the phase it falls in, of the --phase-schedule or else of the built-in schedule of
+the --network.
+
+Epochs already rolled up in --root are skipped, so an interrupted backfill picks up
+where it left off when run again. A failed rollup is logged and the backfill carries
+on with the next epoch, failing at the end.
+
+The resulting directories can be passed on to 'trend'.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "root",
+			Usage:    "Directory to write the rollup of every sampled epoch into",
+			Required: true,
+		},
+		&cli.Int64Flag{
+			Name:     "from-epoch",
+			Usage:    "First epoch to roll up at",
+			Required: true,
+		},
+		&cli.Int64Flag{
+			Name:        "to-epoch",
+			Usage:       "Last epoch to roll up at, unless the stride steps over it",
+			DefaultText: "the latest final epoch",
+		},
+		&cli.Int64Flag{
+			Name:  "stride-epochs",
+			Usage: "Number of epochs between successive rollups",
+			Value: int64(builtin.EpochsInDay),
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		args := cctx.Args().Slice()
+		if len(args) < 2 {
+			return xerrors.New("must supply at least the project list and restore client list to pass to rollup")
+		}
+		if err := refusePassedFlags(args, "backfill", "stdout", "tipset", "allow-existing-dir", "overwrite"); err != nil {
+			return err
+		}
+
+		from := abi.ChainEpoch(cctx.Int64("from-epoch"))
+		stride := abi.ChainEpoch(cctx.Int64("stride-epochs"))
+		if from < 0 {
+			return xerrors.Errorf("invalid --from-epoch %d", from)
+		}
+		if stride <= 0 {
+			return xerrors.New("--stride-epochs must be positive")
+		}
+
+		// without a fixed window, each epoch gets the one of its phase
+		var phases phaseSchedule
+		_, fixedPhase := passedFlag(args, "phase")
+		_, fixedStart := passedFlag(args, "phasestart-epoch")
+		if !fixedPhase && !fixedStart {
+			networkName, passed := passedFlag(args, "network")
+			if !passed {
+				networkName = "mainnet"
+			}
+			network, err := lookupNetwork(networkName)
+			if err != nil {
+				return err
+			}
+			phases = network.phases
+
+			if scheduleName, passed := passedFlag(args, "phase-schedule"); passed {
+				sched, err := loadPhaseSchedule(rollupContext(cctx), scheduleName)
+				if err != nil {
+					return xerrors.Errorf("loading phase schedule failed: %w", err)
+				}
+				phases = sched.Phases
+			}
+		}
+
+		root := cctx.String("root")
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return err
+		}
+		ctx := rollupContext(cctx)
+
+		api, apiCloser, err := getFullNodeAPI(cctx)
+		if err != nil {
+			return err
+		}
+		defer apiCloser()
+
+		head, err := api.ChainHead(ctx)
+		if err != nil {
+			return err
+		}
+		lastFinal := head.Height() - policy.ChainFinality
+		to := lastFinal
+		if cctx.IsSet("to-epoch") {
+			if to = abi.ChainEpoch(cctx.Int64("to-epoch")); to > lastFinal {
+				return xerrors.Errorf("--to-epoch %d is within %d epochs of the current head at %d and may still be reorganized", to, policy.ChainFinality, head.Height())
+			}
+		}
+		if to < from {
+			return xerrors.Errorf("--to-epoch %d is before --from-epoch %d", to, from)
+		}
+
+		samples := int((to-from)/stride) + 1
+		var failed []abi.ChainEpoch
+		var prevHeight abi.ChainEpoch = -1
+		for i := 0; i < samples; i++ {
+			h := from + abi.ChainEpoch(i)*stride
+
+			ts, err := api.ChainGetTipSetByHeight(ctx, h, head.Key())
+			if err != nil {
+				return xerrors.Errorf("loading the tipset at epoch %d: %w", h, err)
+			}
+			if ts.Height() != h {
+				log.Infof("epoch %d is a null round, rolling up at the tipset at %d instead", h, ts.Height())
+			}
+			if ts.Height() == prevHeight {
+				continue
+			}
+			prevHeight = ts.Height()
+
+			epochDir := strconv.FormatInt(int64(ts.Height()), 10)
+			if _, err := os.Stat(filepath.Join(root, epochDir)); err == nil {
+				log.Infof("rollup at epoch %s exists already, skipping it", epochDir)
+				continue
+			}
+
+			rollupFlags := []string{"--tipset", tipSetKeyArg(ts.Cids())}
+			if phase := phases.containing(ts.Height()); phase != nil {
+				rollupFlags = append(rollupFlags, "--phase", strconv.Itoa(phase.ID))
+			}
+
+			log.Infof("backfilling epoch %s (%d/%d)", epochDir, i+1, samples)
+			if err := backfillRollup(ctx, cctx, root, rollupFlags, args); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Errorf("rollup at epoch %s failed, carrying on: %s", epochDir, err)
+				failed = append(failed, ts.Height())
+			}
+		}
+
+		if len(failed) > 0 {
+			return xerrors.Errorf("%d of the rollups failed, at epochs %v: run the backfill again to retry them", len(failed), failed)
+		}
+		log.Infof("backfilled epochs %d to %d into %s", from, to, root)
+		return nil
+	},
+}
+
+// Moves the rollup into root only once complete, so that a rollup left behind by an
+// interrupted run is never mistaken for a finished one
+func backfillRollup(ctx context.Context, cctx *cli.Context, root string, rollupFlags, args []string) error {
+	staging, err := ioutil.TempDir(root, ".incoming-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging) //nolint:errcheck
+
+	epochDir, err := runRollupProcess(ctx, cctx, staging, rollupFlags, args)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(staging, epochDir), filepath.Join(root, epochDir))
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	bigQueryScope           = "https://www.googleapis.com/auth/bigquery"
+	bigQueryAPIBase         = "https://bigquery.googleapis.com/bigquery/v2"
+	bigQueryStorageEndpoint = "bigquerystorage.googleapis.com:443"
+
+	// well under the 10MB per AppendRows request limit
+	bigQueryBatchBytes = 4 << 20
+)
+
+// Streams the results of a rollup into the BigQuery tables <dataset>.<prefix><table>,
+// creating missing tables and adding missing columns through the REST API as needed.
+//
+// Rows go through the Storage Write API. Each table gets a pending write stream the
+// rows are appended to, and Commit finalizes and commits the streams: the rows of a
+// table show up all at once, and not at all when the run fails before. Tables are
+// committed one after the other, and a later rerun over the same epoch commits a
+// second copy of its rows.
+//
+// As for the gRPC API of serve, there is no protoc step in the build: the messages
+// of the write API are described in bigQueryWriteProto with just the fields used.
+// Rows are encoded against a proto2 descriptor built from the table columns, so that
+// zero values are sent as such instead of standing for NULL.
+type bigQuerySink struct {
+	ctx     context.Context
+	auth    *gcpTokenSource
+	conn    *grpc.ClientConn
+	project string
+	dataset string
+	prefix  string
+	epoch   int64
+	writers map[string]*bigQueryWriter
+}
+
+// The pending write stream of a table
+type bigQueryWriter struct {
+	table        sinkTable
+	row          protoreflect.MessageDescriptor
+	schema       []byte // the DescriptorProto of row, sent along with the first append
+	stream       string // "" until the first append
+	appends      grpc.ClientStream
+	offset       int64 // rows appended so far
+	pending      [][]byte
+	pendingBytes int
+}
+
+type bigQueryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// Dataset is given as project.dataset
+func openBigQuerySink(ctx context.Context, dataset, prefix, credentialsFile string, ts rollupTipSet) (*bigQuerySink, error) {
+	parts := strings.SplitN(dataset, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, xerrors.Errorf("BigQuery dataset must be given as project.dataset, got '%s'", dataset)
+	}
+
+	auth, err := newGCPTokenSource(credentialsFile, bigQueryScope)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.DialContext(ctx, bigQueryStorageEndpoint,
+		grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, "")),
+		grpc.WithPerRPCCredentials(gcpRPCCredentials{auth}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bq := &bigQuerySink{
+		ctx:     ctx,
+		auth:    auth,
+		conn:    conn,
+		project: parts[0],
+		dataset: parts[1],
+		prefix:  prefix,
+		epoch:   int64(ts.Height()),
+		writers: make(map[string]*bigQueryWriter, len(sinkTables)),
+	}
+
+	for _, t := range sinkTables {
+		if err := bq.ensureTable(t); err != nil {
+			conn.Close() //nolint:errcheck
+			return nil, xerrors.Errorf("preparing BigQuery table %s%s: %w", prefix, t.name, err)
+		}
+		if bq.writers[t.name], err = newBigQueryWriter(t); err != nil {
+			conn.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+
+	return bq, nil
+}
+
+// Attaches an access token to every call
+type gcpRPCCredentials struct {
+	auth *gcpTokenSource
+}
+
+func (c gcpRPCCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	token, err := c.auth.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (gcpRPCCredentials) RequireTransportSecurity() bool { return true }
+
+func newBigQueryWriter(t sinkTable) (*bigQueryWriter, error) {
+	kinds := t.columnKinds()
+	mdp := &descriptorpb.DescriptorProto{Name: proto.String("Row")}
+	for i, c := range t.columns() {
+		typ := descriptorpb.FieldDescriptorProto_TYPE_INT64
+		switch kinds[c] {
+		case reflect.String:
+			typ = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		case reflect.Bool:
+			typ = descriptorpb.FieldDescriptorProto_TYPE_BOOL
+		case reflect.Float32, reflect.Float64:
+			typ = descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+		}
+		mdp.Field = append(mdp.Field, protoField(c, int32(i+1), typ, ""))
+	}
+
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("slingshot/bigquery/" + t.name + ".proto"),
+		Syntax:      proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{mdp},
+	}, new(protoregistry.Files))
+	if err != nil {
+		return nil, xerrors.Errorf("row descriptor of BigQuery table %s: %w", t.name, err)
+	}
+	schema, err := proto.Marshal(mdp)
+	if err != nil {
+		return nil, err
+	}
+	return &bigQueryWriter{table: t, row: fd.Messages().Get(0), schema: schema}, nil
+}
+
+func (bq *bigQuerySink) tablePath(t sinkTable) string {
+	return fmt.Sprintf("projects/%s/datasets/%s/tables/%s%s", bq.project, bq.dataset, bq.prefix, t.name)
+}
+
+func (bq *bigQuerySink) tableURL(t sinkTable) string {
+	return bigQueryAPIBase + "/" + bq.tablePath(t)
+}
+
+func (bq *bigQuerySink) ensureTable(t sinkTable) error {
+	kinds := t.columnKinds()
+	var fields []bigQueryField
+	for _, c := range t.columns() {
+		f := bigQueryField{Name: c, Type: "INT64", Mode: "NULLABLE"}
+		switch kinds[c] {
+		case reflect.String:
+			f.Type = "STRING"
+		case reflect.Bool:
+			f.Type = "BOOL"
+		case reflect.Float32, reflect.Float64:
+			f.Type = "FLOAT64"
+		}
+		fields = append(fields, f)
+	}
+
+	var existing struct {
+		Schema struct {
+			Fields []bigQueryField `json:"fields"`
+		} `json:"schema"`
+	}
+	status, err := bq.call("GET", bq.tableURL(t), nil, &existing)
+	if status == http.StatusNotFound {
+		_, err := bq.call("POST", fmt.Sprintf("%s/projects/%s/datasets/%s/tables", bigQueryAPIBase, bq.project, bq.dataset), map[string]interface{}{
+			"tableReference": map[string]string{
+				"projectId": bq.project,
+				"datasetId": bq.dataset,
+				"tableId":   bq.prefix + t.name,
+			},
+			"schema": map[string]interface{}{"fields": fields},
+		}, nil)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	// columns can only be appended: keep the existing ones in their order
+	have := make(map[string]bool, len(existing.Schema.Fields))
+	for _, f := range existing.Schema.Fields {
+		have[f.Name] = true
+	}
+	merged := existing.Schema.Fields
+	for _, f := range fields {
+		if !have[f.Name] {
+			merged = append(merged, f)
+		}
+	}
+	if len(merged) == len(existing.Schema.Fields) {
+		return nil
+	}
+	_, err = bq.call("PATCH", bq.tableURL(t), map[string]interface{}{
+		"schema": map[string]interface{}{"fields": merged},
+	}, nil)
+	return err
+}
+
+func (bq *bigQuerySink) add(t sinkTable, keyVals []interface{}, row interface{}) error {
+	w := bq.writers[t.name]
+	_, vals := t.row(keyVals, row)
+
+	msg := dynamicpb.NewMessage(w.row)
+	fields := w.row.Fields()
+	for i, val := range vals {
+		fd, v := fields.Get(i), reflect.ValueOf(val)
+		switch fd.Kind() {
+		case protoreflect.StringKind:
+			msg.Set(fd, protoreflect.ValueOfString(v.String()))
+		case protoreflect.BoolKind:
+			msg.Set(fd, protoreflect.ValueOfBool(v.Bool()))
+		case protoreflect.DoubleKind:
+			msg.Set(fd, protoreflect.ValueOfFloat64(v.Float()))
+		default:
+			switch v.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				msg.Set(fd, protoreflect.ValueOfInt64(v.Int()))
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				msg.Set(fd, protoreflect.ValueOfInt64(int64(v.Uint())))
+			}
+		}
+	}
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	w.pending = append(w.pending, raw)
+	if w.pendingBytes += len(raw); w.pendingBytes >= bigQueryBatchBytes {
+		return bq.flush(w)
+	}
+	return nil
+}
+
+// Appends the buffered rows of w to its write stream, opening the stream first
+func (bq *bigQuerySink) flush(w *bigQueryWriter) error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	table := bq.prefix + w.table.name
+
+	data := newBigQueryWriteMessage("ProtoData")
+	if w.stream == "" {
+		req := newBigQueryWriteMessage("CreateWriteStreamRequest")
+		protoSet(req, "parent", protoreflect.ValueOfString(bq.tablePath(w.table)))
+		ws := newBigQueryWriteMessage("WriteStream")
+		protoSet(ws, "type", protoreflect.ValueOfInt32(bigQueryPendingStream))
+		protoSet(req, "write_stream", protoreflect.ValueOfMessage(ws))
+		resp, err := bq.invoke("CreateWriteStream", "parent", bq.tablePath(w.table), req, "WriteStream")
+		if err != nil {
+			return xerrors.Errorf("creating a write stream for %s: %w", table, err)
+		}
+		w.stream = protoGet(resp, "name").String()
+
+		ctx := metadata.AppendToOutgoingContext(bq.ctx, "x-goog-request-params", "write_stream="+url.QueryEscape(w.stream))
+		if w.appends, err = bq.conn.NewStream(ctx, &grpc.StreamDesc{StreamName: "AppendRows", ServerStreams: true, ClientStreams: true}, bigQueryWriteMethod("AppendRows")); err != nil {
+			return xerrors.Errorf("appending to %s: %w", table, err)
+		}
+
+		// the first request on a connection carries the row descriptor
+		schema := newBigQueryWriteMessage("ProtoSchema")
+		protoSet(schema, "proto_descriptor", protoreflect.ValueOfBytes(w.schema))
+		protoSet(data, "writer_schema", protoreflect.ValueOfMessage(schema))
+	}
+
+	rows := newBigQueryWriteMessage("ProtoRows")
+	serialized := rows.Mutable(rows.Descriptor().Fields().ByName("serialized_rows")).List()
+	for _, r := range w.pending {
+		serialized.Append(protoreflect.ValueOfBytes(r))
+	}
+	protoSet(data, "rows", protoreflect.ValueOfMessage(rows))
+
+	// with the offset given, BigQuery refuses an append that is not where expected
+	// rather than adding its rows twice
+	offset := newBigQueryWriteMessage("Int64Value")
+	protoSet(offset, "value", protoreflect.ValueOfInt64(w.offset))
+
+	req := newBigQueryWriteMessage("AppendRowsRequest")
+	protoSet(req, "write_stream", protoreflect.ValueOfString(w.stream))
+	protoSet(req, "offset", protoreflect.ValueOfMessage(offset))
+	protoSet(req, "proto_rows", protoreflect.ValueOfMessage(data))
+	if err := w.appends.SendMsg(req); err != nil {
+		return xerrors.Errorf("appending to %s: %w", table, err)
+	}
+	resp := newBigQueryWriteMessage("AppendRowsResponse")
+	if err := w.appends.RecvMsg(resp); err != nil {
+		return xerrors.Errorf("appending to %s: %w", table, err)
+	}
+	if rowErrs := protoGet(resp, "row_errors").List(); rowErrs.Len() > 0 {
+		re := rowErrs.Get(0).Message().Interface().(*dynamicpb.Message)
+		return xerrors.Errorf("appending to %s: %d rows rejected, first at index %d: %s", table, rowErrs.Len(), protoGet(re, "index").Int(), protoGet(re, "message").String())
+	}
+	if errField := resp.Descriptor().Fields().ByName("error"); resp.Has(errField) {
+		st := resp.Get(errField).Message().Interface().(*dynamicpb.Message)
+		return xerrors.Errorf("appending to %s: %s (code %d)", table, protoGet(st, "message").String(), protoGet(st, "code").Int())
+	}
+
+	w.offset += int64(len(w.pending))
+	w.pending, w.pendingBytes = w.pending[:0], 0
+	return nil
+}
+
+// Returns the HTTP status along with an error for anything but a 2xx
+func (bq *bigQuerySink) call(method, url string, body interface{}, out interface{}) (int, error) {
+	token, err := bq.auth.Token(bq.ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var reqBody []byte
+	if body != nil {
+		if reqBody, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequestWithContext(bq.ctx, method, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, xerrors.Errorf("%s %s: non-2xx response %d: %s", method, url, resp.StatusCode, respBody)
+	}
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(respBody, out)
+	}
+	return resp.StatusCode, nil
+}
+
+func (bq *bigQuerySink) addDeals(dl []*individualDeal) error {
+	for _, d := range dl {
+		if err := bq.add(sinkDeals, []interface{}{bq.epoch}, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bq *bigQuerySink) addRecoveredDeals(rl []recoveredDeal) error {
+	for _, d := range rl {
+		if err := bq.add(sinkRecoveredDeals, []interface{}{bq.epoch}, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bq *bigQuerySink) addTotals(totals *competitionTotal) error {
+	return bq.add(sinkCompetitionTotals, []interface{}{bq.epoch}, totals)
+}
+
+func (bq *bigQuerySink) addProjectStats(projStats map[string]*projectAggregateStats, clients *clientSpill) error {
+	for projID, ps := range projStats {
+		if err := bq.add(sinkProjectStats, []interface{}{bq.epoch}, ps); err != nil {
+			return err
+		}
+		if err := clients.ForEachClient(ps, func(cs *clientAggregateStats) error {
+			return bq.add(sinkClientStats, []interface{}{bq.epoch, projID}, cs)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends off whatever is still buffered, then finalizes the write streams and commits
+// them table by table
+func (bq *bigQuerySink) Commit() error {
+	for _, t := range sinkTables {
+		w := bq.writers[t.name]
+		if err := bq.flush(w); err != nil {
+			return err
+		}
+		if w.stream == "" {
+			continue
+		}
+		if err := w.appends.CloseSend(); err != nil {
+			return err
+		}
+
+		req := newBigQueryWriteMessage("FinalizeWriteStreamRequest")
+		protoSet(req, "name", protoreflect.ValueOfString(w.stream))
+		resp, err := bq.invoke("FinalizeWriteStream", "name", w.stream, req, "FinalizeWriteStreamResponse")
+		if err != nil {
+			return xerrors.Errorf("finalizing the write stream of %s%s: %w", bq.prefix, t.name, err)
+		}
+		if n := protoGet(resp, "row_count").Int(); n != w.offset {
+			return xerrors.Errorf("write stream of %s%s holds %d rows, %d were appended", bq.prefix, t.name, n, w.offset)
+		}
+	}
+
+	for _, t := range sinkTables {
+		w := bq.writers[t.name]
+		if w.stream == "" {
+			continue
+		}
+		req := newBigQueryWriteMessage("BatchCommitWriteStreamsRequest")
+		protoSet(req, "parent", protoreflect.ValueOfString(bq.tablePath(t)))
+		req.Mutable(req.Descriptor().Fields().ByName("write_streams")).List().Append(protoreflect.ValueOfString(w.stream))
+		resp, err := bq.invoke("BatchCommitWriteStreams", "parent", bq.tablePath(t), req, "BatchCommitWriteStreamsResponse")
+		if err != nil {
+			return xerrors.Errorf("committing the rows of %s%s: %w", bq.prefix, t.name, err)
+		}
+		if errs := protoGet(resp, "stream_errors").List(); errs.Len() > 0 {
+			se := errs.Get(0).Message().Interface().(*dynamicpb.Message)
+			return xerrors.Errorf("committing the rows of %s%s: %s (code %d)", bq.prefix, t.name, protoGet(se, "error_message").String(), protoGet(se, "code").Int())
+		}
+	}
+	return nil
+}
+
+// Write streams left uncommitted are discarded by BigQuery
+func (bq *bigQuerySink) Close() error { return bq.conn.Close() }
+
+// The messages of google.cloud.bigquery.storage.v1 the sink exchanges, with just the
+// fields it sets or reads, under their numbers in the published .proto. Messages of
+// other packages are declared here by the fields used, or as bytes when only passed
+// through, which is the same on the wire.
+const (
+	bigQueryWritePackage = "google.cloud.bigquery.storage.v1"
+
+	bigQueryPendingStream = 2 // WriteStream.Type PENDING
+)
+
+var bigQueryWriteProto = buildBigQueryWriteProto()
+
+func buildBigQueryWriteProto() protoreflect.FileDescriptor {
+	const (
+		str     = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		int32T  = descriptorpb.FieldDescriptorProto_TYPE_INT32
+		int64T  = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		bytesT  = descriptorpb.FieldDescriptorProto_TYPE_BYTES
+		message = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	)
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, msg string) *descriptorpb.FieldDescriptorProto {
+		f := protoField(name, number, typ, "")
+		if msg != "" {
+			f.TypeName = proto.String("." + bigQueryWritePackage + "." + msg)
+		}
+		return f
+	}
+	msg := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("slingshot/bigquery/write.proto"),
+		Package: proto.String(bigQueryWritePackage),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			msg("WriteStream",
+				field("name", 1, str, ""),
+				field("type", 2, int32T, "")),
+			msg("CreateWriteStreamRequest",
+				field("parent", 1, str, ""),
+				field("write_stream", 2, message, "WriteStream")),
+			msg("Int64Value", // google.protobuf.Int64Value
+				field("value", 1, int64T, "")),
+			msg("ProtoSchema",
+				field("proto_descriptor", 1, bytesT, "")), // google.protobuf.DescriptorProto
+			msg("ProtoRows",
+				protoRepeated(field("serialized_rows", 1, bytesT, ""))),
+			msg("ProtoData", // AppendRowsRequest.ProtoData
+				field("writer_schema", 1, message, "ProtoSchema"),
+				field("rows", 2, message, "ProtoRows")),
+			msg("AppendRowsRequest",
+				field("write_stream", 1, str, ""),
+				field("offset", 2, message, "Int64Value"),
+				field("proto_rows", 4, message, "ProtoData")),
+			msg("Status", // google.rpc.Status
+				field("code", 1, int32T, ""),
+				field("message", 2, str, "")),
+			msg("RowError",
+				field("index", 1, int64T, ""),
+				field("code", 2, int32T, ""),
+				field("message", 3, str, "")),
+			msg("AppendRowsResponse",
+				field("append_result", 1, bytesT, ""), // AppendRowsResponse.AppendResult
+				field("error", 2, message, "Status"),
+				protoRepeated(field("row_errors", 4, message, "RowError"))),
+			msg("FinalizeWriteStreamRequest",
+				field("name", 1, str, "")),
+			msg("FinalizeWriteStreamResponse",
+				field("row_count", 1, int64T, "")),
+			msg("BatchCommitWriteStreamsRequest",
+				field("parent", 1, str, ""),
+				protoRepeated(field("write_streams", 2, str, ""))),
+			msg("StorageError",
+				field("code", 1, int32T, ""),
+				field("entity", 2, str, ""),
+				field("error_message", 3, str, "")),
+			msg("BatchCommitWriteStreamsResponse",
+				field("commit_time", 1, bytesT, ""), // google.protobuf.Timestamp
+				protoRepeated(field("stream_errors", 2, message, "StorageError"))),
+		},
+	}
+
+	fd, err := protodesc.NewFile(fdp, new(protoregistry.Files))
+	if err != nil {
+		panic(fmt.Sprintf("invalid BigQuery write API descriptor: %s", err))
+	}
+	return fd
+}
+
+func newBigQueryWriteMessage(name string) *dynamicpb.Message {
+	return dynamicpb.NewMessage(bigQueryWriteProto.Messages().ByName(protoreflect.Name(name)))
+}
+
+func bigQueryWriteMethod(method string) string {
+	return "/" + bigQueryWritePackage + ".BigQueryWrite/" + method
+}
+
+// A unary call of the write API, routed by the request field given
+func (bq *bigQuerySink) invoke(method, routingField, routingValue string, req *dynamicpb.Message, respType string) (*dynamicpb.Message, error) {
+	ctx := metadata.AppendToOutgoingContext(bq.ctx, "x-goog-request-params", routingField+"="+url.QueryEscape(routingValue))
+	resp := newBigQueryWriteMessage(respType)
+	if err := bq.conn.Invoke(ctx, bigQueryWriteMethod(method), req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
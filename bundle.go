@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Packages a finished output directory into a single .tar.gz, manifest first. The
+// bundle manifest also covers the fingerprint, and replaces the one in the directory.
+// The archive is assembled under a temporary name, so that an existing bundle path
+// always holds a complete archive.
+func writeBundle(outDirName, bundlePath string, epoch int64, fp *runFingerprint) error {
+	manifest, err := newRollupManifest(outDirName, epoch, fp)
+	if err != nil {
+		return err
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := bundlePath + ".tmp"
+	fh, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) //nolint:errcheck
+	defer fh.Close()         //nolint:errcheck
+
+	gz := gzip.NewWriter(fh)
+	tw := tar.NewWriter(gz)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(manifestJSON)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return err
+	}
+
+	for _, f := range manifest.Files {
+		if err := addBundleFile(tw, filepath.Join(outDirName, filepath.FromSlash(f.Name)), f); err != nil {
+			return xerrors.Errorf("adding %s to bundle: %w", f.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, bundlePath)
+}
+
+func addBundleFile(tw *tar.Writer, path string, f manifestFile) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close() //nolint:errcheck
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    f.Name,
+		Mode:    0644,
+		Size:    f.Size,
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, src)
+	return err
+}
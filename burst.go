@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+type onboardingBurstOutput struct {
+	Epoch         int64              `json:"epoch"`
+	TipSetKey     []cid.Cid          `json:"tipset_key"`
+	Endpoint      string             `json:"endpoint"`
+	Phase         int                `json:"phase,omitempty"`
+	SchemaVersion string             `json:"schema_version"`
+	Payload       []*onboardingBurst `json:"payload"`
+}
+
+// A project that had an unusually large share of its qualifying data activated within
+// a short window right before the measurement deadline: a signal of possible gaming
+// worth a closer look at its deal list, not a verdict in itself.
+type onboardingBurst struct {
+	ProjectID        string  `json:"project_id"`
+	WindowStartEpoch int64   `json:"window_start_epoch"`
+	WindowEndEpoch   int64   `json:"window_end_epoch"`
+	WindowDataSize   int64   `json:"window_data_size"`
+	WindowNumDeals   int     `json:"window_num_deals"`
+	TotalDataSize    int64   `json:"total_data_size"`
+	WindowShare      float64 `json:"window_share"`
+}
+
+// Tallies qualifying deals activated within [windowStart, deadline)
+type burstDetector struct {
+	windowStart abi.ChainEpoch
+	deadline    abi.ChainEpoch
+	minShare    float64
+	minDataSize int64
+
+	windowBytes map[string]int64
+	windowDeals map[string]int
+}
+
+// The deadline is the end of the phase, or the rollup epoch for a phase still running
+func newBurstDetector(ts abi.ChainEpoch, phaseEnd abi.ChainEpoch, window abi.ChainEpoch, minShare float64, minDataSize int64) *burstDetector {
+	deadline := ts
+	if phaseEnd > 0 && phaseEnd < deadline {
+		deadline = phaseEnd
+	}
+	return &burstDetector{
+		windowStart: deadline - window,
+		deadline:    deadline,
+		minShare:    minShare,
+		minDataSize: minDataSize,
+		windowBytes: make(map[string]int64),
+		windowDeals: make(map[string]int),
+	}
+}
+
+func (bd *burstDetector) observe(projID string, sectorStart abi.ChainEpoch, size int64) {
+	if sectorStart >= bd.windowStart && sectorStart < bd.deadline {
+		bd.windowBytes[projID] += size
+		bd.windowDeals[projID]++
+	}
+}
+
+// Lists the flagged projects, largest share first
+func (bd *burstDetector) bursts(projStats map[string]*projectAggregateStats) []*onboardingBurst {
+	ret := make([]*onboardingBurst, 0)
+	for projID, windowBytes := range bd.windowBytes {
+		ps := projStats[projID]
+		if ps == nil || ps.DataSize < bd.minDataSize || ps.DataSize == 0 {
+			continue
+		}
+		share := float64(windowBytes) / float64(ps.DataSize)
+		if share < bd.minShare {
+			continue
+		}
+		ret = append(ret, &onboardingBurst{
+			ProjectID:        projID,
+			WindowStartEpoch: int64(bd.windowStart),
+			WindowEndEpoch:   int64(bd.deadline),
+			WindowDataSize:   windowBytes,
+			WindowNumDeals:   bd.windowDeals[projID],
+			TotalDataSize:    ps.DataSize,
+			WindowShare:      share,
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].WindowShare != ret[j].WindowShare {
+			return ret[i].WindowShare > ret[j].WindowShare
+		}
+		return ret[i].ProjectID < ret[j].ProjectID
+	})
+	return ret
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Per-provider deal lists are named after the provider ID alone
+const minerDealListFmt = "deals_by_miner_%s"
+
+// contents of deals_by_miner_{{minerid}}.json
+type minerDealListOutput struct {
+	Epoch         int64             `json:"epoch"`
+	TipSetKey     []cid.Cid         `json:"tipset_key"`
+	Endpoint      string            `json:"endpoint"`
+	Phase         int               `json:"phase,omitempty"`
+	SchemaVersion string            `json:"schema_version"`
+	Payload       []*individualDeal `json:"payload"`
+}
+
+// Writes the qualifying deals of every provider into a list of its own, for providers
+// to verify their participation. Pending deals are never part of these.
+func writeMinerDealLists(outDirName string, ts rollupTipSet, lists dealListStore, formats map[string]bool, failures *outputFailures) error {
+	for _, minerID := range lists.Projects() {
+		// complete already
+		if formats["ndjson"] && !formats["csv"] {
+			continue
+		}
+
+		dl, err := lists.Load(minerID)
+		if err != nil {
+			return err
+		}
+		sort.Slice(dl, func(i, j int) bool {
+			return dl[j].PaddedSize < dl[i].PaddedSize
+		})
+
+		if !formats["ndjson"] {
+			listName := filepath.Join(outDirName, fmt.Sprintf(minerDealListFmt+".json", minerID))
+			if err := failures.check(listName, writeDealListJSON(
+				listName,
+				minerDealListOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "MINER_DEAL_LIST",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+				},
+				dl,
+			)); err != nil {
+				return err
+			}
+		}
+		if formats["csv"] {
+			listName := filepath.Join(outDirName, fmt.Sprintf(minerDealListFmt+".csv", minerID))
+			if err := failures.check(listName, writeDealListCSV(listName, dl)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return lists.Close()
+}
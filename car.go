@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+const carOutputName = "rollup.car"
+
+// Records per list chunk, keeping every block well below the customary 1MiB limit
+const carChunkSize = 1000
+
+// With --format car the complete results are also written as a DAG-CBOR DAG into a
+// CARv1 file, rooted at a Rollup. Every map holds the same keys as the corresponding
+// JSON output, and long lists are split into linked chunks, so that any project or
+// deal range can be retrieved and verified without fetching the rest:
+//
+//	type Rollup struct {
+//	  epoch           Int
+//	  tipset_key      [String]
+//	  phase           Int
+//	  schema_version  String
+//	  totals          {String:Any}        # payload of basic_stats.json
+//	  projects        {String:&Project}   # by project id
+//	  recovered_deals [&Chunk]            # payload of recovery_deallist.json
+//	}
+//	type Project struct {
+//	  stats   {String:Any}                # client_stats.json project entry, without clients
+//	  clients [&Chunk]                    # the clients of the project entry
+//	  deals   [&Chunk]                    # payload of deals_list_{projid}.json
+//	}
+//	type Chunk [{String:Any}]             # up to 1000 records
+//
+// Blocks are written out as soon as they are complete, the root last.
+type carBuilder struct {
+	path      string
+	body      *os.File
+	bw        *bufio.Writer
+	projDeals map[string][]cid.Cid
+	root      map[string]interface{}
+}
+
+func newCarBuilder(outDirName string) (*carBuilder, error) {
+	body, err := ioutil.TempFile(outDirName, ".car_blocks_")
+	if err != nil {
+		return nil, err
+	}
+	return &carBuilder{
+		path:      filepath.Join(outDirName, carOutputName),
+		body:      body,
+		bw:        bufio.NewWriterSize(body, 1<<20),
+		projDeals: make(map[string][]cid.Cid),
+		root:      make(map[string]interface{}),
+	}, nil
+}
+
+func (cb *carBuilder) put(obj interface{}) (cid.Cid, error) {
+	nd, err := cbor.WrapObject(obj, mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := util.LdWrite(cb.bw, nd.Cid().Bytes(), nd.RawData()); err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// Stores the records in chunks, returning the links to them in order
+func (cb *carBuilder) putChunked(records []interface{}) ([]cid.Cid, error) {
+	links := make([]cid.Cid, 0, (len(records)+carChunkSize-1)/carChunkSize)
+	for len(records) > 0 {
+		n := len(records)
+		if n > carChunkSize {
+			n = carChunkSize
+		}
+		c, err := cb.put(records[:n])
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, c)
+		records = records[n:]
+	}
+	return links, nil
+}
+
+func (cb *carBuilder) addDeals(projID string, dl []*individualDeal) error {
+	records, err := ipldRecords(dl)
+	if err != nil {
+		return err
+	}
+	links, err := cb.putChunked(records)
+	if err != nil {
+		return err
+	}
+	cb.projDeals[projID] = links
+	return nil
+}
+
+func (cb *carBuilder) setRecoveredDeals(rl []recoveredDeal) error {
+	records, err := ipldRecords(rl)
+	if err != nil {
+		return err
+	}
+	links, err := cb.putChunked(records)
+	if err != nil {
+		return err
+	}
+	cb.root["recovered_deals"] = links
+	return nil
+}
+
+func (cb *carBuilder) setTotals(totals *competitionTotal) error {
+	v, err := ipldValue(totals)
+	if err != nil {
+		return err
+	}
+	cb.root["totals"] = v
+	return nil
+}
+
+// Needs to come after all deal lists were added, so the projects can link to them
+func (cb *carBuilder) setProjects(projStats map[string]*projectAggregateStats, clients *clientSpill) error {
+	projIDs := make([]string, 0, len(projStats))
+	for p := range projStats {
+		projIDs = append(projIDs, p)
+	}
+	sort.Strings(projIDs)
+
+	projects := make(map[string]interface{}, len(projIDs))
+	for _, projID := range projIDs {
+		// shadowing the clients the same way the JSON output does
+		stats, err := ipldValue(struct {
+			*projectAggregateStats
+			ClientStats *struct{} `json:"clients,omitempty"`
+		}{projectAggregateStats: projStats[projID]})
+		if err != nil {
+			return err
+		}
+
+		// the clients are chunked as they come, spilled ones need not fit in memory
+		var clientLinks []cid.Cid
+		chunk := make([]interface{}, 0, carChunkSize)
+		flush := func() error {
+			if len(chunk) == 0 {
+				return nil
+			}
+			c, err := cb.put(chunk)
+			if err != nil {
+				return err
+			}
+			clientLinks = append(clientLinks, c)
+			chunk = chunk[:0]
+			return nil
+		}
+		if err := clients.ForEachClient(projStats[projID], func(ca *clientAggregateStats) error {
+			v, err := ipldValue(ca)
+			if err != nil {
+				return err
+			}
+			chunk = append(chunk, v)
+			if len(chunk) == carChunkSize {
+				return flush()
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		deals := cb.projDeals[projID]
+		if deals == nil {
+			deals = []cid.Cid{}
+		}
+		if clientLinks == nil {
+			clientLinks = []cid.Cid{}
+		}
+		c, err := cb.put(map[string]interface{}{
+			"stats":   stats,
+			"clients": clientLinks,
+			"deals":   deals,
+		})
+		if err != nil {
+			return err
+		}
+		projects[projID] = c
+	}
+
+	cb.root["projects"] = projects
+	return nil
+}
+
+// Writes the root, then assembles the CAR under a temporary name: header first,
+// followed by every block written so far
+func (cb *carBuilder) finish(ts rollupTipSet) error {
+	cb.root["epoch"] = int64(ts.Height())
+	cb.root["tipset_key"] = cidStrings(ts.Cids())
+	cb.root["phase"] = int64(currentPhaseID)
+	cb.root["schema_version"] = outputSchemaVersion
+	for _, k := range []string{"projects", "recovered_deals"} {
+		if _, set := cb.root[k]; !set {
+			return xerrors.Errorf("%s missing from rollup DAG", k)
+		}
+	}
+
+	root, err := cb.put(cb.root)
+	if err != nil {
+		return err
+	}
+	if err := cb.bw.Flush(); err != nil {
+		return err
+	}
+	if _, err := cb.body.Seek(0, 0); err != nil {
+		return err
+	}
+
+	tmpPath := cb.path + ".tmp"
+	fh, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) //nolint:errcheck
+	defer fh.Close()         //nolint:errcheck
+
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1}, fh); err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, cb.body); err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, cb.path); err != nil {
+		return err
+	}
+
+	log.Infof("rollup DAG rooted at %s written to %s", root, carOutputName)
+	return nil
+}
+
+func (cb *carBuilder) Close() error {
+	cb.body.Close() //nolint:errcheck
+	if err := os.Remove(cb.body.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// The generic IPLD form of what v encodes to as JSON, with integral numbers kept as
+// integers
+func ipldValue(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return ipldNumbers(generic), nil
+}
+
+func ipldNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = ipldNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = ipldNumbers(e)
+		}
+	}
+	return v
+}
+
+func ipldRecords(list interface{}) ([]interface{}, error) {
+	v, err := ipldValue(list)
+	if err != nil {
+		return nil, err
+	}
+	records, isList := v.([]interface{})
+	if !isList && v != nil {
+		return nil, xerrors.Errorf("expected a list, got %T", v)
+	}
+	return records, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/xerrors"
+)
+
+const (
+	checkpointStateName       = "checkpoint.json"
+	checkpointDealsName       = "deals.ndjson.zst"
+	checkpointResolutionsName = "resolutions.db"
+)
+
+// What an interrupted run leaves in the --checkpoint directory for the next one to
+// resume from: the tipset it rolls up at, the market deals at that tipset and the
+// client addresses resolved so far, which make up most of the time a run takes
+// against a slow node. All of them are facts about the chain that hold whatever the
+// flags of the resumed run. The aggregates are computed again from them instead,
+// which only takes a fraction of the time.
+type runCheckpoint struct {
+	dir   string
+	state checkpointState
+}
+
+type checkpointState struct {
+	TipSetKey []cid.Cid `json:"tipset_key"`
+	Epoch     int64     `json:"epoch"`
+	Lookback  int64     `json:"lookback"`
+}
+
+type checkpointDeal struct {
+	ID   string           `json:"id"`
+	Deal storedMarketDeal `json:"deal"`
+}
+
+func openRunCheckpoint(dir string) (*runCheckpoint, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	cp := &runCheckpoint{dir: dir}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, checkpointStateName))
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &cp.state); err != nil {
+		return nil, xerrors.Errorf("parsing checkpoint '%s': %w", dir, err)
+	}
+	if len(cp.state.TipSetKey) == 0 {
+		return nil, xerrors.Errorf("checkpoint '%s' names no tipset", dir)
+	}
+	return cp, nil
+}
+
+func (cp *runCheckpoint) resuming() bool {
+	return len(cp.state.TipSetKey) > 0
+}
+
+// The tipset a resumed run must roll up at, as a --tipset argument
+func (cp *runCheckpoint) tipSetRef() string {
+	return tipSetKeyArg(cp.state.TipSetKey)
+}
+
+// Records the tipset of a new run, or checks a resumed one is still at the same and
+// returns the lookback the original run picked it with
+func (cp *runCheckpoint) pin(ts rollupTipSet, lookback abi.ChainEpoch) (abi.ChainEpoch, error) {
+	if cp.resuming() {
+		if ts.Key() != types.NewTipSetKey(cp.state.TipSetKey...) {
+			return 0, xerrors.Errorf("checkpoint '%s' is of a run at tipset %s, not at %s: remove it to start over", cp.dir, cp.tipSetRef(), tipSetKeyArg(ts.Cids()))
+		}
+		log.Infof("resuming the run at epoch %d from checkpoint '%s'", cp.state.Epoch, cp.dir)
+		return abi.ChainEpoch(cp.state.Lookback), nil
+	}
+
+	cp.state = checkpointState{
+		TipSetKey: ts.Cids(),
+		Epoch:     int64(ts.Height()),
+		Lookback:  int64(lookback),
+	}
+	buf, err := json.Marshal(cp.state)
+	if err != nil {
+		return 0, err
+	}
+	tmp := filepath.Join(cp.dir, "."+checkpointStateName+".tmp")
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return 0, err
+	}
+	return lookback, os.Rename(tmp, filepath.Join(cp.dir, checkpointStateName))
+}
+
+// Holds the client addresses resolved so far
+func (cp *runCheckpoint) resolutions() (*stateStore, error) {
+	return openStateStore(filepath.Join(cp.dir, checkpointResolutionsName))
+}
+
+// Done with once the run completes
+func (cp *runCheckpoint) remove() error {
+	return os.RemoveAll(cp.dir)
+}
+
+// Hands out the deals kept in the checkpoint when there are, otherwise those of src,
+// keeping a copy of them along the way for the next run
+func (cp *runCheckpoint) deals(src dealSource) dealSource {
+	return &checkpointDealSource{src: src, path: filepath.Join(cp.dir, checkpointDealsName)}
+}
+
+type checkpointDealSource struct {
+	src  dealSource
+	path string
+}
+
+func (s *checkpointDealSource) ForEachDeal(ctx context.Context, ts rollupTipSet, cb func(dealID string, d *api.MarketDeal) error) error {
+	fh, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return s.keep(ctx, ts, cb)
+	}
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	zr, err := zstd.NewReader(bufio.NewReaderSize(fh, 1<<20))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	log.Infof("reading the market deals kept in '%s'", s.path)
+	dec := json.NewDecoder(zr)
+	for {
+		var cd checkpointDeal
+		if err := dec.Decode(&cd); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return xerrors.Errorf("reading checkpointed deals '%s': %w", s.path, err)
+		}
+		md, err := cd.Deal.marketDeal()
+		if err != nil {
+			return xerrors.Errorf("reading checkpointed deal %s: %w", cd.ID, err)
+		}
+		if err := cb(cd.ID, &md); err != nil {
+			return err
+		}
+	}
+}
+
+// Only renamed into place once all deals made it, so that a partial copy is never
+// taken for the whole
+func (s *checkpointDealSource) keep(ctx context.Context, ts rollupTipSet, cb func(dealID string, d *api.MarketDeal) error) error {
+	fh, err := os.Create(filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name()) //nolint:errcheck
+	defer fh.Close()           //nolint:errcheck
+
+	buf := bufio.NewWriterSize(fh, 1<<20)
+	zw, err := zstd.NewWriter(buf)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(zw)
+
+	if err := s.src.ForEachDeal(ctx, ts, func(dealID string, d *api.MarketDeal) error {
+		if err := enc.Encode(checkpointDeal{ID: dealID, Deal: newStoredMarketDeal(d)}); err != nil {
+			return err
+		}
+		return cb(dealID, d)
+	}); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), s.path)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+	"golang.org/x/xerrors"
+)
+
+// How the payload and piece CIDs in the deal lists and cid_index.json are rendered.
+// A nil rendering writes them as go-cid does, and as rollups always did: CIDv0 in
+// base58btc, CIDv1 in base32.
+type cidRendering struct {
+	v1      bool
+	base    multibase.Encoding
+	hasBase bool
+}
+
+// A multibase other than base58btc can only be applied to CIDv1, and so implies v1
+func newCidRendering(v1 bool, baseName string) (*cidRendering, error) {
+	if !v1 && baseName == "" {
+		return nil, nil
+	}
+
+	cr := &cidRendering{v1: v1}
+	if baseName != "" {
+		enc, err := multibase.EncoderByName(baseName)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid --cid-multibase '%s': %w", baseName, err)
+		}
+		cr.base, cr.hasBase = enc.Encoding(), true
+		if cr.base != multibase.Base58BTC {
+			cr.v1 = true
+		}
+	}
+	return cr, nil
+}
+
+func (cr *cidRendering) render(c cid.Cid) string {
+	if cr == nil || !c.Defined() {
+		return c.String()
+	}
+	if cr.v1 && c.Version() == 0 {
+		c = cid.NewCidV1(c.Type(), c.Hash())
+	}
+	if !cr.hasBase || c.Version() == 0 {
+		return c.String()
+	}
+	s, err := c.StringOfBase(cr.base)
+	if err != nil {
+		return c.String()
+	}
+	return s
+}
+
+func (cr *cidRendering) renderAll(cids []cid.Cid) []string {
+	if len(cids) == 0 {
+		return nil
+	}
+	ret := make([]string, len(cids))
+	for i, c := range cids {
+		ret[i] = cr.render(c)
+	}
+	return ret
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/ipfs/go-cid"
+)
+
+type cidIndexOutput struct {
+	Epoch         int64            `json:"epoch"`
+	TipSetKey     []cid.Cid        `json:"tipset_key"`
+	Endpoint      string           `json:"endpoint"`
+	Phase         int              `json:"phase,omitempty"`
+	SchemaVersion string           `json:"schema_version"`
+	Payload       []*cidIndexEntry `json:"payload"`
+}
+
+// Where a payload CID is stored among the qualifying deals, for retrieval checks to
+// know what to expect behind it. Every root of a deal label gets an entry. Deals
+// whose label is not a CID are indexed by their piece CID alone, with an empty
+// payload CID.
+type cidIndexEntry struct {
+	PayloadCID string   `json:"payload_cid"`
+	PieceCIDs  []string `json:"piece_cids"`
+	Projects   []string `json:"projects"`
+	Datasets   []string `json:"datasets"` // curated datasets registered by the clients making the deals
+	DealIDs    []string `json:"deal_ids"`
+
+	pieces   map[string]struct{}
+	projects map[string]struct{}
+	datasets map[string]struct{}
+}
+
+type cidIndex map[string]*cidIndexEntry
+
+// Roots and piece CID come rendered as they are to appear in the index
+func (ci cidIndex) observe(roots []string, pieceCid string, projID string, datasets []string, dealID string) {
+	keys := roots
+	if len(keys) == 0 {
+		keys = []string{"piece:" + pieceCid}
+	}
+
+	for _, key := range keys {
+		e, ok := ci[key]
+		if !ok {
+			e = &cidIndexEntry{
+				pieces:   make(map[string]struct{}),
+				projects: make(map[string]struct{}),
+				datasets: make(map[string]struct{}),
+			}
+			if len(roots) > 0 {
+				e.PayloadCID = key
+			}
+			ci[key] = e
+		}
+		e.pieces[pieceCid] = struct{}{}
+		e.projects[projID] = struct{}{}
+		for _, d := range datasets {
+			e.datasets[d] = struct{}{}
+		}
+		e.DealIDs = append(e.DealIDs, dealID)
+	}
+}
+
+// Lists all entries by payload CID, those without one by piece CID last
+func (ci cidIndex) list() []*cidIndexEntry {
+	sortedKeys := func(set map[string]struct{}) []string {
+		ret := make([]string, 0, len(set))
+		for k := range set {
+			ret = append(ret, k)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	ret := make([]*cidIndexEntry, 0, len(ci))
+	for _, e := range ci {
+		e.PieceCIDs = sortedKeys(e.pieces)
+		e.Projects = sortedKeys(e.projects)
+		e.Datasets = sortedKeys(e.datasets)
+		sort.Slice(e.DealIDs, func(i, j int) bool {
+			if len(e.DealIDs[i]) != len(e.DealIDs[j]) {
+				return len(e.DealIDs[i]) < len(e.DealIDs[j])
+			}
+			return e.DealIDs[i] < e.DealIDs[j]
+		})
+		ret = append(ret, e)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if (ret[i].PayloadCID == "") != (ret[j].PayloadCID == "") {
+			return ret[i].PayloadCID != ""
+		}
+		if ret[i].PayloadCID != ret[j].PayloadCID {
+			return ret[i].PayloadCID < ret[j].PayloadCID
+		}
+		return ret[i].PieceCIDs[0] < ret[j].PieceCIDs[0]
+	})
+	return ret
+}
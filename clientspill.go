@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+)
+
+// Number of files the clients of a single spilled project are partitioned into. When
+// assembling the output only one partition is aggregated in memory at a time.
+const clientSpillPartitions = 64
+
+// Once a project has more clients than the threshold, the qualifying deals of any
+// further clients are spilled to disk as raw rows instead of being aggregated in
+// memory. Clients aggregated in memory so far stay there, so that every client is
+// either entirely in memory or entirely spilled.
+type clientSpill struct {
+	parentDir string
+	threshold int
+	dir       string
+	projects  map[string]*spilledClients
+}
+
+type spilledClients struct {
+	files   [clientSpillPartitions]*os.File
+	writers [clientSpillPartitions]*bufio.Writer
+	encs    [clientSpillPartitions]*json.Encoder
+}
+
+type clientSpillRow struct {
+	Client   string `json:"c"`
+	Provider string `json:"p"`
+	PieceCID string `json:"x"`
+	Size     int64  `json:"s"`
+	Verified bool   `json:"v,omitempty"`
+}
+
+func newClientSpill(parentDir string, threshold int) *clientSpill {
+	return &clientSpill{
+		parentDir: parentDir,
+		threshold: threshold,
+		projects:  make(map[string]*spilledClients),
+	}
+}
+
+// Whether the deals of a client not yet aggregated in memory should be spilled
+func (cs *clientSpill) shouldSpill(ps *projectAggregateStats) bool {
+	if _, spilled := cs.projects[ps.ProjectID]; spilled {
+		return true
+	}
+	return cs.threshold > 0 && len(ps.ClientStats) >= cs.threshold
+}
+
+func (cs *clientSpill) Append(projID string, client address.Address, provider address.Address, pieceCid cid.Cid, size int64, verified bool) error {
+	if cs.dir == "" {
+		dir, err := ioutil.TempDir(cs.parentDir, ".client_stats_")
+		if err != nil {
+			return err
+		}
+		cs.dir = dir
+	}
+
+	sc, ok := cs.projects[projID]
+	if !ok {
+		log.Infof("project %s has more than %d clients, spilling further client stats to disk", projID, cs.threshold)
+		sc = new(spilledClients)
+		cs.projects[projID] = sc
+	}
+
+	h := fnv.New32a()
+	h.Write(client.Bytes()) //nolint:errcheck
+	part := h.Sum32() % clientSpillPartitions
+
+	if sc.writers[part] == nil {
+		fh, err := os.Create(filepath.Join(cs.dir, fmt.Sprintf("%s_%02d.ndjson", projID, part)))
+		if err != nil {
+			return err
+		}
+		sc.files[part] = fh
+		sc.writers[part] = bufio.NewWriterSize(fh, 64<<10)
+		sc.encs[part] = json.NewEncoder(sc.writers[part])
+	}
+
+	return sc.encs[part].Encode(clientSpillRow{
+		Client:   client.String(),
+		Provider: provider.String(),
+		PieceCID: pieceCid.String(),
+		Size:     size,
+		Verified: verified,
+	})
+}
+
+// Visits the stats of every client of a project, whether held in memory or spilled.
+// In-memory clients come first in address order, followed by the spilled ones in
+// address order within each partition.
+func (cs *clientSpill) ForEachClient(ps *projectAggregateStats, cb func(*clientAggregateStats) error) error {
+	clients := make([]string, 0, len(ps.ClientStats))
+	for c := range ps.ClientStats {
+		clients = append(clients, c)
+	}
+	sort.Strings(clients)
+	for _, c := range clients {
+		if err := cb(ps.ClientStats[c]); err != nil {
+			return err
+		}
+	}
+
+	sc, spilled := cs.projects[ps.ProjectID]
+	if !spilled {
+		return nil
+	}
+
+	for part := range sc.files {
+		if sc.files[part] == nil {
+			continue
+		}
+		if err := sc.writers[part].Flush(); err != nil {
+			return err
+		}
+		if _, err := sc.files[part].Seek(0, 0); err != nil {
+			return err
+		}
+
+		agg := make(map[string]*clientAggregateStats)
+		cids := make(map[string]map[string]struct{})
+		providers := make(map[string]map[string]struct{})
+
+		dec := json.NewDecoder(bufio.NewReaderSize(sc.files[part], 64<<10))
+		for {
+			var row clientSpillRow
+			if err := dec.Decode(&row); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			ca, ok := agg[row.Client]
+			if !ok {
+				ca = &clientAggregateStats{Client: row.Client}
+				agg[row.Client] = ca
+				cids[row.Client] = make(map[string]struct{})
+				providers[row.Client] = make(map[string]struct{})
+			}
+			ca.DataSize += row.Size
+			ca.NumDeals++
+			if row.Verified {
+				ca.FilplusNumDeals++
+				ca.FilplusDataSize += row.Size
+			}
+			cids[row.Client][row.PieceCID] = struct{}{}
+			providers[row.Client][row.Provider] = struct{}{}
+		}
+
+		clients := make([]string, 0, len(agg))
+		for c, ca := range agg {
+			ca.NumCids = len(cids[c])
+			ca.NumProviders = len(providers[c])
+			clients = append(clients, c)
+		}
+		sort.Strings(clients)
+		for _, c := range clients {
+			if err := cb(agg[c]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (cs *clientSpill) Close() error {
+	for _, sc := range cs.projects {
+		for _, fh := range sc.files {
+			if fh != nil {
+				fh.Close() //nolint:errcheck
+			}
+		}
+	}
+	cs.projects = nil
+
+	if cs.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(cs.dir)
+}
+
+// Writes the same document as encoding a projectAggregateStatsOutput would, except
+// that the clients of each project are streamed one by one (and come last within
+// the project object), so that spilled clients never need to be held in memory at once
+func writeClientStatsJSON(w io.Writer, epoch int64, tsk []cid.Cid, phase int, projStats map[string]*projectAggregateStats, clients *clientSpill) error {
+	bw := bufio.NewWriterSize(w, 1<<20)
+
+	head, err := json.Marshal(struct {
+		Epoch         int64     `json:"epoch"`
+		TipSetKey     []cid.Cid `json:"tipset_key"`
+		Endpoint      string    `json:"endpoint"`
+		Phase         int       `json:"phase,omitempty"`
+		SchemaVersion string    `json:"schema_version"`
+	}{epoch, tsk, "PROJECT_DEAL_STATS", phase, outputSchemaVersion})
+	if err != nil {
+		return err
+	}
+	bw.Write(head[:len(head)-1])   //nolint:errcheck
+	bw.WriteString(`,"payload":{`) //nolint:errcheck
+
+	projIDs := make([]string, 0, len(projStats))
+	for p := range projStats {
+		projIDs = append(projIDs, p)
+	}
+	sort.Strings(projIDs)
+
+	for i, projID := range projIDs {
+		if i > 0 {
+			bw.WriteByte(',') //nolint:errcheck
+		}
+
+		key, err := json.Marshal(projID)
+		if err != nil {
+			return err
+		}
+		bw.Write(key)     //nolint:errcheck
+		bw.WriteByte(':') //nolint:errcheck
+
+		// the outer ClientStats shadows the embedded one, leaving it out of the marshaled project
+		proj, err := json.Marshal(struct {
+			*projectAggregateStats
+			ClientStats *struct{} `json:"clients,omitempty"`
+		}{projectAggregateStats: projStats[projID]})
+		if err != nil {
+			return err
+		}
+		bw.Write(proj[:len(proj)-1])   //nolint:errcheck
+		bw.WriteString(`,"clients":{`) //nolint:errcheck
+
+		first := true
+		if err := clients.ForEachClient(projStats[projID], func(ca *clientAggregateStats) error {
+			if !first {
+				bw.WriteByte(',') //nolint:errcheck
+			}
+			first = false
+
+			key, err := json.Marshal(ca.Client)
+			if err != nil {
+				return err
+			}
+			val, err := json.Marshal(ca)
+			if err != nil {
+				return err
+			}
+			bw.Write(key)     //nolint:errcheck
+			bw.WriteByte(':') //nolint:errcheck
+			_, err = bw.Write(val)
+			return err
+		}); err != nil {
+			return err
+		}
+
+		bw.WriteString("}}") //nolint:errcheck
+	}
+
+	bw.WriteString("}}\n") //nolint:errcheck
+	return bw.Flush()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var checkCompat = &cli.Command{
+	Usage:     "Check the output schema of this binary against that of an earlier rollup",
+	Name:      "check-compat",
+	ArgsUsage: "  <previous rollup directory | schema file>",
+	Description: `Compares the JSON Schema of every output document against the schema.json
+of a previous rollup (or a file previously written by the schema command), and
+fails when the differences are not covered by the schema version:
+
+   - removed fields or documents, changed types, and fields no longer always
+     present are breaking, and require a MAJOR bump
+   - added fields or documents require at least a MINOR bump`,
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return xerrors.New("expected a single previous rollup directory or schema file")
+		}
+
+		prevPath := cctx.Args().First()
+		if fi, err := os.Stat(prevPath); err != nil {
+			return err
+		} else if fi.IsDir() {
+			prevPath = filepath.Join(prevPath, schemaFileName)
+		}
+
+		raw, err := ioutil.ReadFile(prevPath)
+		if os.IsNotExist(err) {
+			return xerrors.Errorf("'%s' not found: rollups predating embedded schemas can only be checked against the output of the schema command of the binary that produced them", prevPath)
+		} else if err != nil {
+			return err
+		}
+		var prevDocs map[string]interface{}
+		if err := json.Unmarshal(raw, &prevDocs); err != nil {
+			return xerrors.Errorf("parsing %s: %w", prevPath, err)
+		}
+
+		// round-trip through JSON, so that both sides are made of the same types
+		cur, err := outputSchemas(schemaDocumentNames())
+		if err != nil {
+			return err
+		}
+		if raw, err = json.Marshal(cur); err != nil {
+			return err
+		}
+		var curDocs map[string]interface{}
+		if err := json.Unmarshal(raw, &curDocs); err != nil {
+			return err
+		}
+
+		var prevVersion string
+		for _, d := range prevDocs {
+			if v, ok := asSchema(d)["x-schema-version"].(string); ok {
+				prevVersion = v
+				break
+			}
+		}
+		if prevVersion == "" {
+			return xerrors.Errorf("%s records no x-schema-version", prevPath)
+		}
+		prevMajor, _, err := parseSchemaVersion(prevVersion)
+		if err != nil {
+			return err
+		}
+		curMajor, _, err := parseSchemaVersion(outputSchemaVersion)
+		if err != nil {
+			return err
+		}
+
+		var cc compatChanges
+		for _, name := range sortedKeys(prevDocs) {
+			if _, ok := curDocs[name]; !ok {
+				cc.breaking = append(cc.breaking, name+": document removed")
+				continue
+			}
+			cc.compare(name, asSchema(prevDocs[name]), asSchema(curDocs[name]))
+		}
+		for _, name := range sortedKeys(curDocs) {
+			if _, ok := prevDocs[name]; !ok {
+				cc.additive = append(cc.additive, name+": document added")
+			}
+		}
+
+		fmt.Printf("schema version %s => %s\n", prevVersion, outputSchemaVersion)
+		for _, c := range cc.breaking {
+			fmt.Printf("  BREAKING  %s\n", c)
+		}
+		for _, c := range cc.additive {
+			fmt.Printf("  additive  %s\n", c)
+		}
+
+		switch {
+		case len(cc.breaking) > 0 && curMajor == prevMajor:
+			return xerrors.Errorf("%d breaking changes without a MAJOR schema version bump", len(cc.breaking))
+		case len(cc.additive) > 0 && outputSchemaVersion == prevVersion:
+			return xerrors.Errorf("%d additions without a schema version bump", len(cc.additive))
+		}
+		fmt.Println("compatible")
+		return nil
+	},
+}
+
+type compatChanges struct {
+	breaking []string
+	additive []string
+}
+
+// Walks two JSON Schema (sub)documents as produced by jsonSchemaOf, from the point
+// of view of a consumer of the old one
+func (cc *compatChanges) compare(path string, prev, cur map[string]interface{}) {
+	prevTypes, curTypes := schemaTypes(prev), schemaTypes(cur)
+	if prevTypes != nil {
+		if curTypes == nil {
+			cc.breaking = append(cc.breaking, fmt.Sprintf("%s: type %s no longer constrained", path, strings.Join(prevTypes, "|")))
+		} else if !stringSubset(curTypes, prevTypes) {
+			cc.breaking = append(cc.breaking, fmt.Sprintf("%s: type changed from %s to %s", path, strings.Join(prevTypes, "|"), strings.Join(curTypes, "|")))
+			return
+		}
+	}
+	if pc, hasConst := prev["const"]; hasConst && fmt.Sprint(pc) != fmt.Sprint(cur["const"]) {
+		cc.breaking = append(cc.breaking, fmt.Sprintf("%s: constant changed from %v to %v", path, pc, cur["const"]))
+	}
+
+	prevProps, _ := prev["properties"].(map[string]interface{})
+	curProps, _ := cur["properties"].(map[string]interface{})
+	for _, name := range sortedKeys(prevProps) {
+		cp, ok := curProps[name]
+		if !ok {
+			cc.breaking = append(cc.breaking, fmt.Sprintf("%s.%s: field removed", path, name))
+			continue
+		}
+		cc.compare(path+"."+name, asSchema(prevProps[name]), asSchema(cp))
+	}
+	for _, name := range sortedKeys(curProps) {
+		if _, ok := prevProps[name]; !ok {
+			cc.additive = append(cc.additive, fmt.Sprintf("%s.%s: field added", path, name))
+		}
+	}
+
+	curRequired := make(map[string]bool)
+	for _, r := range asStrings(cur["required"]) {
+		curRequired[r] = true
+	}
+	for _, r := range asStrings(prev["required"]) {
+		if _, stillThere := curProps[r]; stillThere && !curRequired[r] {
+			cc.breaking = append(cc.breaking, fmt.Sprintf("%s.%s: no longer always present", path, r))
+		}
+	}
+
+	for _, sub := range []struct{ key, suffix string }{{"items", "[]"}, {"additionalProperties", "{}"}} {
+		ps, hasPrev := prev[sub.key].(map[string]interface{})
+		cs, hasCur := cur[sub.key].(map[string]interface{})
+		if hasPrev && hasCur {
+			cc.compare(path+sub.suffix, ps, cs)
+		}
+	}
+}
+
+// nil when unconstrained
+func schemaTypes(s map[string]interface{}) []string {
+	switch t := s["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		return asStrings(t)
+	}
+	return nil
+}
+
+func asSchema(v interface{}) map[string]interface{} {
+	s, _ := v.(map[string]interface{})
+	return s
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func asStrings(v interface{}) []string {
+	l, _ := v.([]interface{})
+	ret := make([]string, 0, len(l))
+	for _, e := range l {
+		if s, ok := e.(string); ok {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func stringSubset(sub, of []string) bool {
+	for _, s := range sub {
+		found := false
+		for _, o := range of {
+			found = found || s == o
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
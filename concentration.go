@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// How much of a project rests on few client wallets: the share of the qualifying
+// bytes coming from the single largest client, and the fewest clients that together
+// account for 90% of them. Projects that are essentially a single wallet show up as a
+// share close to 1 and a count of 1.
+func clientConcentration(total int64, dataPerClient map[address.Address]int64) (float64, int) {
+	if total <= 0 || len(dataPerClient) == 0 {
+		return 0, 0
+	}
+
+	sizes := make([]int64, 0, len(dataPerClient))
+	for _, s := range dataPerClient {
+		sizes = append(sizes, s)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] > sizes[j] })
+
+	var n int
+	var cumulative int64
+	for _, s := range sizes {
+		cumulative += s
+		n++
+		// integer comparison, sparing float rounding at the exact boundary
+		if cumulative*10 >= total*9 {
+			break
+		}
+	}
+
+	return float64(sizes[0]) / float64(total), n
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Optional rollup configuration, supplied via --config as a local file or URL:
+//
+//	{
+//		"tags": [
+//			{ "name": "large-verified", "expr": "size >= 32GiB && verified" }
+//		],
+//		"phases": [
+//			{ "id": 10, "name": "autumn", "start_epoch": 1900000 }
+//		],
+//		"rules": [
+//			{ "rule": "min_duration", "days": 540 }
+//		]
+//	}
+type rollupConfig struct {
+	Tags   []*tagDefinition  `json:"tags,omitempty"`
+	Phases []phaseDefinition `json:"phases,omitempty"`
+	Rules  []ruleDefinition  `json:"rules,omitempty"`
+}
+
+func (cfg *rollupConfig) definesRule(name string) bool {
+	for _, def := range cfg.Rules {
+		if def.Rule == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens either a http(s):// URL or a local file for reading
+func openSource(ctx context.Context, name string) (io.ReadCloser, error) {
+
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		req, err := http.NewRequestWithContext(ctx, "GET", name, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close() //nolint:errcheck
+			return nil, xerrors.Errorf("non-200 response: %d", resp.StatusCode)
+		}
+
+		return resp.Body, nil
+	}
+
+	inputFh, err := os.Open(name)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open '%s': %w", name, err)
+	}
+	return inputFh, nil
+}
+
+// Loads and validates the rollup config, saving a verbatim copy as rollup_config.json
+func getAndParseConfig(ctx context.Context, saveToDir, configName string) (*rollupConfig, error) {
+	cfg := new(rollupConfig)
+	if configName == "" {
+		return cfg, nil
+	}
+
+	src, err := openSource(ctx, configName)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close() //nolint:errcheck
+
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read config from %s: %w", configName, err)
+	}
+
+	if err := ioutil.WriteFile(saveToDir+"/rollup_config.json", raw, 0644); err != nil {
+		return nil, err
+	}
+
+	relaxed, err := relaxedJSON(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse config %s: %w", configName, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(relaxed))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, xerrors.Errorf("failed to parse config %s: %w", configName, err)
+	}
+
+	if err := compileTags(cfg.Tags); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// A classic 5 field cron schedule: minute hour day-of-month month day-of-week. Fields
+// take *, single values, ranges a-b, lists a,b and steps */n or a-b/n. As with cron,
+// when both day fields are restricted a day matching either of them qualifies.
+type cronSchedule struct {
+	minute, hour, dom, month, dow [64]bool
+	domAny, dowAny                bool
+}
+
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, xerrors.Errorf("cron expression '%s' must have 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+
+	cs := &cronSchedule{
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+	for i, f := range []struct {
+		set      *[64]bool
+		min, max int
+	}{
+		{&cs.minute, 0, 59},
+		{&cs.hour, 0, 23},
+		{&cs.dom, 1, 31},
+		{&cs.month, 1, 12},
+		{&cs.dow, 0, 7},
+	} {
+		if err := parseCronField(fields[i], f.min, f.max, f.set); err != nil {
+			return nil, xerrors.Errorf("cron expression '%s': %w", expr, err)
+		}
+	}
+	// both 0 and 7 are Sunday
+	cs.dow[0] = cs.dow[0] || cs.dow[7]
+
+	return cs, nil
+}
+
+func parseCronField(field string, min, max int, set *[64]bool) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if slash := strings.IndexByte(part, '/'); slash >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step <= 0 {
+				return xerrors.Errorf("invalid step in '%s'", part)
+			}
+			rng = part[:slash]
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return xerrors.Errorf("invalid value in '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return xerrors.Errorf("invalid range in '%s'", part)
+				}
+			} else if step > 1 {
+				// a/n runs from a to the end of the range
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return xerrors.Errorf("'%s' is outside of %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// The first minute strictly after t matching the schedule, in t's location
+func (cs *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// every schedule matches at least once within a few years (Feb 29th)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		if !cs.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	// only reachable with impossible dates such as 31 2 *
+	return time.Time{}
+}
+
+func (cs *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := cs.dom[t.Day()], cs.dow[int(t.Weekday())]
+	switch {
+	case cs.domAny && cs.dowAny:
+		return true
+	case cs.domAny:
+		return dow
+	case cs.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
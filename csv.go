@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CSV outputs are derived from the json tags of the very same structs that make up the
+// JSON outputs, so that both stay in sync. Only scalar fields are emitted, nested maps
+// and slices are left to the JSON variant.
+
+func csvColumns(t reflect.Type) []string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	cols := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := csvFieldName(t.Field(i)); ok {
+			cols = append(cols, name)
+		}
+	}
+	return cols
+}
+
+func csvValues(v reflect.Value) []string {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	vals := make([]string, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		if _, ok := csvFieldName(v.Type().Field(i)); ok {
+			vals = append(vals, fmt.Sprint(v.Field(i).Interface()))
+		}
+	}
+	return vals
+}
+
+func csvFieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" {
+		return "", false
+	}
+	switch f.Type.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Struct, reflect.Ptr, reflect.Interface:
+		return "", false
+	}
+
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return "", false
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return name, true
+}
+
+func writeCSV(path string, header []string, rows [][]string) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	w := csv.NewWriter(fh)
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+
+	return fh.Close()
+}
+
+func writeBasicStatsCSV(path string, epoch int64, totals *competitionTotal) error {
+	return writeCSV(
+		path,
+		append([]string{"epoch"}, csvColumns(reflect.TypeOf(totals))...),
+		[][]string{append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(totals))...)},
+	)
+}
+
+// One row per project+client pair, project level columns are prefixed with `project_`.
+// Projects without any qualifying clients still get a row with empty client columns.
+func writeClientStatsCSV(path string, epoch int64, projStats map[string]*projectAggregateStats, clients *clientSpill) error {
+	projCols := csvColumns(reflect.TypeOf(projectAggregateStats{}))
+	clientCols := csvColumns(reflect.TypeOf(clientAggregateStats{}))
+
+	header := []string{"epoch"}
+	for _, c := range projCols {
+		if !strings.HasPrefix(c, "project_") {
+			c = "project_" + c
+		}
+		header = append(header, c)
+	}
+	header = append(header, clientCols...)
+
+	projIDs := make([]string, 0, len(projStats))
+	for p := range projStats {
+		projIDs = append(projIDs, p)
+	}
+	sort.Strings(projIDs)
+
+	var rows [][]string
+	for _, p := range projIDs {
+		ps := projStats[p]
+		prefix := append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(ps))...)
+
+		seenClients := false
+		if err := clients.ForEachClient(ps, func(cs *clientAggregateStats) error {
+			seenClients = true
+			rows = append(rows, append(append([]string{}, prefix...), csvValues(reflect.ValueOf(cs))...))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if !seenClients {
+			rows = append(rows, append(prefix, make([]string, len(clientCols))...))
+		}
+	}
+
+	return writeCSV(path, header, rows)
+}
+
+func writeDealListCSV(path string, dl []*individualDeal) error {
+	rows := make([][]string, 0, len(dl))
+	for _, d := range dl {
+		rows = append(rows, csvValues(reflect.ValueOf(d)))
+	}
+	return writeCSV(path, csvColumns(reflect.TypeOf(individualDeal{})), rows)
+}
+
+func writeRecoveryListCSV(path string, rl []recoveredDeal) error {
+	rows := make([][]string, 0, len(rl))
+	for _, d := range rl {
+		rows = append(rows, csvValues(reflect.ValueOf(d)))
+	}
+	return writeCSV(path, csvColumns(reflect.TypeOf(recoveredDeal{})), rows)
+}
+
+func writeProviderFaultsCSV(path string, epoch int64, pf []*providerFaultHistory) error {
+	rows := make([][]string, 0, len(pf))
+	for _, p := range pf {
+		rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(p))...))
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(providerFaultHistory{}))...), rows)
+}
+
+func writeRemovedDealsCSV(path string, rl []*removedDeal) error {
+	rows := make([][]string, 0, len(rl))
+	for _, d := range rl {
+		rows = append(rows, csvValues(reflect.ValueOf(d)))
+	}
+	return writeCSV(path, csvColumns(reflect.TypeOf(removedDeal{})), rows)
+}
+
+func writeBurstReportCSV(path string, epoch int64, bl []*onboardingBurst) error {
+	rows := make([][]string, 0, len(bl))
+	for _, b := range bl {
+		rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(b))...))
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(onboardingBurst{}))...), rows)
+}
+
+func writeMinerStatsCSV(path string, epoch int64, ml []*minerStats) error {
+	rows := make([][]string, 0, len(ml))
+	for _, m := range ml {
+		rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(m))...))
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(minerStats{}))...), rows)
+}
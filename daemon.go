@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// Within the daemon root, the symlink pointing at the latest completed rollup
+const currentRollupLink = "current"
+
+var daemon = &cli.Command{
+	Usage:     "Keep re-running the rollup on a schedule, publishing each completed one atomically",
+	Name:      "daemon",
+	ArgsUsage: "  [<rollup flags>...] <eligible project list> <restore client list>",
+	Description: `Runs rollup every --every-epochs epochs or on a --cron schedule, passing it
+the given arguments. Every rollup is assembled in a hidden directory within --root,
+renamed to its epoch once complete, after which the current symlink is swapped
+over to it. Consumers reading through current therefore never see a partial rollup.
+Example:
+
+   daemon --root /data/slingshot --every-epochs 240 -- --format csv projects.json restore.json
+
+A failed rollup is logged and retried at the next scheduled time.
+
+With --events-listen, subscribers to /events on that address are notified of every
+newly published rollup as a Server-Sent Event carrying its totals.
+
+With --metrics-listen, Prometheus metrics are exposed at /metrics on that address:
+the outcome and time of the latest successful run, the duration, deal counts, node
+API calls and address resolution cache hits of the latest run, and the totals of
+the current rollup.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "root",
+			Usage:    "Directory holding the successive rollups and the current symlink",
+			Required: true,
+		},
+		&cli.Int64Flag{
+			Name:  "every-epochs",
+			Usage: "Re-run once the chain head advanced this many epochs past the previous run",
+		},
+		&cli.StringFlag{
+			Name:  "cron",
+			Usage: "Re-run on a 5 field cron schedule in UTC instead, e.g. '0 */6 * * *'",
+		},
+		&cli.StringFlag{
+			Name:  "events-listen",
+			Usage: "Address to serve the Server-Sent Events stream of published rollups on, at /events",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "Address to expose Prometheus metrics of the scheduled runs on, at /metrics",
+		},
+		&cli.IntFlag{
+			Name:  "keep",
+			Usage: "Number of completed rollups to keep, older ones are removed. 0 keeps all",
+			Value: 3,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		args := cctx.Args().Slice()
+		if len(args) < 2 {
+			return xerrors.New("must supply at least the project list and restore client list to pass to rollup")
+		}
+		if err := refusePassedFlags(args, "daemon", "stdout", "tipset", "allow-existing-dir", "overwrite"); err != nil {
+			return err
+		}
+
+		if cctx.IsSet("every-epochs") == cctx.IsSet("cron") {
+			return xerrors.New("exactly one of --every-epochs and --cron must be given")
+		}
+		var sched *cronSchedule
+		if cctx.IsSet("cron") {
+			var err error
+			if sched, err = parseCronSchedule(cctx.String("cron")); err != nil {
+				return err
+			}
+		} else if cctx.Int64("every-epochs") <= 0 {
+			return xerrors.New("--every-epochs must be positive")
+		}
+
+		root := cctx.String("root")
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return err
+		}
+		unlock, err := lockDaemonRoot(root)
+		if err != nil {
+			return err
+		}
+		defer unlock() //nolint:errcheck
+
+		ctx := rollupContext(cctx)
+
+		// the events and metrics may share an address
+		muxes := make(map[string]*http.ServeMux)
+		handle := func(addr, path string, h http.Handler) {
+			if muxes[addr] == nil {
+				muxes[addr] = http.NewServeMux()
+			}
+			muxes[addr].Handle(path, h)
+		}
+		cur, curErr := os.Readlink(filepath.Join(root, currentRollupLink))
+
+		var events *rollupEvents
+		if addr := cctx.String("events-listen"); addr != "" {
+			events = newRollupEvents()
+			if curErr == nil {
+				if err := events.publish(filepath.Join(root, cur)); err != nil {
+					log.Warnf("announcing the current rollup failed: %s", err)
+				}
+			}
+			go func() {
+				<-ctx.Done()
+				events.close()
+			}()
+			handle(addr, "/events", events)
+			log.Infof("announcing published rollups at http://%s/events", addr)
+		}
+
+		var metrics *daemonMetrics
+		if addr := cctx.String("metrics-listen"); addr != "" {
+			metrics = newDaemonMetrics()
+			if curErr == nil {
+				metrics.restore(filepath.Join(root, cur))
+			}
+			handle(addr, "/metrics", metrics)
+			log.Infof("exposing metrics at http://%s/metrics", addr)
+		}
+
+		for addr, mux := range muxes {
+			srv := &http.Server{Addr: addr, Handler: mux}
+			go func() {
+				<-ctx.Done()
+				srv.Close() //nolint:errcheck
+			}()
+			go func(addr string) {
+				if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+					log.Errorf("server on %s stopped: %s", addr, err)
+				}
+			}(addr)
+		}
+
+		api, apiCloser, err := getFullNodeAPI(cctx)
+		if err != nil {
+			return err
+		}
+		defer apiCloser()
+
+		var lastRunHead abi.ChainEpoch
+		for {
+			head, err := api.ChainHead(ctx)
+			if err != nil {
+				return err
+			}
+
+			var metricsOut string
+			if metrics != nil {
+				metricsOut = runMetricsPath(root)
+				os.Remove(metricsOut) //nolint:errcheck
+			}
+			published, err := runScheduledRollup(ctx, cctx, root, args, metricsOut)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if metrics != nil {
+				rm, rmErr := readRunMetrics(metricsOut)
+				if rmErr != nil {
+					log.Warnf("the rollup run left no metrics: %s", rmErr)
+				}
+				metrics.observe(rm, filepath.Join(root, published), err)
+			}
+			if published != "" && events != nil {
+				if err := events.publish(filepath.Join(root, published)); err != nil {
+					log.Warnf("announcing rollup at epoch %s failed: %s", published, err)
+				}
+			}
+			if err != nil {
+				log.Errorf("scheduled rollup failed, retrying at the next scheduled time: %s", err)
+			}
+			lastRunHead = head.Height()
+
+			if sched != nil {
+				next := sched.next(time.Now().UTC())
+				if next.IsZero() {
+					return xerrors.Errorf("cron schedule '%s' never fires", cctx.String("cron"))
+				}
+				log.Infof("next rollup scheduled at %s", next.Format(time.RFC3339))
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(time.Until(next)):
+				}
+				continue
+			}
+
+			nextEpoch := lastRunHead + abi.ChainEpoch(cctx.Int64("every-epochs"))
+			log.Infof("next rollup scheduled once the chain reaches epoch %d", nextEpoch)
+			for head.Height() < nextEpoch {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(time.Duration(build.BlockDelaySecs) * time.Second):
+				}
+				if polled, err := api.ChainHead(ctx); err != nil {
+					log.Warnf("polling chain head failed: %s", err)
+				} else {
+					head = polled
+				}
+			}
+		}
+	},
+}
+
+// Runs a single rollup in a child process, then publishes it. Returns the epoch
+// directory once published.
+func runScheduledRollup(ctx context.Context, cctx *cli.Context, root string, args []string, metricsOut string) (string, error) {
+	staging, err := ioutil.TempDir(root, ".incoming-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging) //nolint:errcheck
+
+	var rollupFlags []string
+	if metricsOut != "" {
+		rollupFlags = append(rollupFlags, "--metrics-out", metricsOut)
+	}
+	epochDir, err := runRollupProcess(ctx, cctx, staging, rollupFlags, args)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(filepath.Join(root, epochDir)); err == nil {
+		log.Infof("rollup at epoch %s exists already, keeping the earlier one", epochDir)
+	} else if err := os.Rename(filepath.Join(staging, epochDir), filepath.Join(root, epochDir)); err != nil {
+		return "", err
+	}
+
+	if err := swapCurrentRollup(root, epochDir); err != nil {
+		return "", xerrors.Errorf("publishing rollup at epoch %s: %w", epochDir, err)
+	}
+	log.Infof("published rollup at epoch %s as %s", epochDir, filepath.Join(root, currentRollupLink))
+
+	return epochDir, pruneRollups(root, epochDir, cctx.Int("keep"))
+}
+
+// Runs rollup in a child process against the same node, so that no state lingers
+// between runs, with rollupFlags in front of the passed through args. The rollup is
+// written into the empty staging directory, and the name of the epoch directory it
+// left there returned.
+func runRollupProcess(ctx context.Context, cctx *cli.Context, staging string, rollupFlags, args []string) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	// the output directory goes in front of the two trailing positional arguments
+	outDir := filepath.Join(staging, "{{epoch}}")
+	childArgs, childEnv := nodeConnectionArgs(cctx)
+	childArgs = append(childArgs, "rollup")
+	childArgs = append(childArgs, rollupFlags...)
+	childArgs = append(childArgs, args[:len(args)-2]...)
+	childArgs = append(childArgs, outDir, args[len(args)-2], args[len(args)-1])
+
+	child := exec.CommandContext(ctx, self, childArgs...)
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	if childEnv != nil {
+		child.Env = append(os.Environ(), childEnv...)
+	}
+	if err := child.Run(); err != nil {
+		return "", xerrors.Errorf("rollup run: %w", err)
+	}
+
+	entries, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 {
+		return "", xerrors.Errorf("expected the rollup to leave a single output directory in '%s', found %d entries", staging, len(entries))
+	}
+	epochDir := entries[0].Name()
+	if _, err := strconv.ParseInt(epochDir, 10, 64); err != nil {
+		return "", xerrors.Errorf("unexpected rollup output directory '%s'", epochDir)
+	}
+	return epochDir, nil
+}
+
+// The value of a flag among those passed through to rollup, if it is there
+func passedFlag(args []string, name string) (string, bool) {
+	for i, a := range args {
+		if a == "--"+name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if strings.HasPrefix(a, "--"+name+"=") {
+			return a[len(name)+3:], true
+		}
+	}
+	return "", false
+}
+
+func refusePassedFlags(args []string, runner string, refused ...string) error {
+	for _, a := range args {
+		for _, r := range refused {
+			if a == "--"+r || strings.HasPrefix(a, "--"+r+"=") {
+				return xerrors.Errorf("--%s can not be passed to rollups run by the %s", r, runner)
+			}
+		}
+	}
+	return nil
+}
+
+// A rename over the existing symlink replaces it atomically
+func swapCurrentRollup(root, epochDir string) error {
+	tmpLink := filepath.Join(root, "."+currentRollupLink+".tmp")
+	os.Remove(tmpLink) //nolint:errcheck
+	if err := os.Symlink(epochDir, tmpLink); err != nil {
+		return err
+	}
+	return os.Rename(tmpLink, filepath.Join(root, currentRollupLink))
+}
+
+// Removes all but the newest keep rollups, never touching the current one
+func pruneRollups(root, current string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	var epochs []int64
+	for _, e := range entries {
+		if ep, err := strconv.ParseInt(e.Name(), 10, 64); err == nil && e.IsDir() {
+			epochs = append(epochs, ep)
+		}
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] > epochs[j] })
+
+	for i := keep; i < len(epochs); i++ {
+		name := strconv.FormatInt(epochs[i], 10)
+		if name == current {
+			continue
+		}
+		log.Infof("removing old rollup at epoch %s", name)
+		if err := os.RemoveAll(filepath.Join(root, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Only one daemon may manage a root at a time. The lock is released by the kernel
+// should the daemon die, so there are no stale lockfiles to clean up.
+func lockDaemonRoot(root string) (func() error, error) {
+	fh, err := os.OpenFile(filepath.Join(root, ".daemon.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fh.Close() //nolint:errcheck
+		return nil, xerrors.Errorf("another daemon is already running against '%s': %w", root, err)
+	}
+	return fh.Close, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+type datacapStatsOutput struct {
+	Epoch         int64             `json:"epoch"`
+	TipSetKey     []cid.Cid         `json:"tipset_key"`
+	Endpoint      string            `json:"endpoint"`
+	Phase         int               `json:"phase,omitempty"`
+	SchemaVersion string            `json:"schema_version"`
+	Payload       []*projectDatacap `json:"payload"`
+}
+
+// The datacap left to the registered clients of a project in the verified registry,
+// next to what its qualifying deals used up
+type projectDatacap struct {
+	ProjectID        string           `json:"project_id"`
+	DatacapRemaining int64            `json:"datacap_remaining"`
+	DatacapUsed      int64            `json:"datacap_used"` // padded size of the qualifying verified deals
+	Clients          []*clientDatacap `json:"clients"`
+}
+
+type clientDatacap struct {
+	ProjectID        string `json:"project_id"`
+	Client           string `json:"client"`
+	Verified         bool   `json:"verified"` // false once the allocation is used up, as the registry then drops the client
+	DatacapRemaining int64  `json:"datacap_remaining"`
+	DatacapUsed      int64  `json:"datacap_used"`
+}
+
+// Padded size of the qualifying verified deals, by project and client
+type datacapUsage map[string]map[address.Address]int64
+
+func (du datacapUsage) observe(projID string, client address.Address, size int64) {
+	if du[projID] == nil {
+		du[projID] = make(map[address.Address]int64)
+	}
+	du[projID][client] += size
+}
+
+// Looks up the remaining datacap of every registered client, one node query each
+func collectDatacap(ctx context.Context, api api.FullNode, ts rollupTipSet, registered map[address.Address]string, used datacapUsage, progress *progressReporter) ([]*projectDatacap, error) {
+	clients := make([]address.Address, 0, len(registered))
+	for a := range registered {
+		clients = append(clients, a)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].String() < clients[j].String() })
+
+	byProject := make(map[string]*projectDatacap)
+	progress.start("querying_datacap", len(clients))
+	for i, client := range clients {
+		if err := progress.step(i); err != nil {
+			return nil, err
+		}
+
+		projID := registered[client]
+		pd, found := byProject[projID]
+		if !found {
+			pd = &projectDatacap{ProjectID: projID, Clients: []*clientDatacap{}}
+			byProject[projID] = pd
+		}
+
+		cd := &clientDatacap{
+			ProjectID:   projID,
+			Client:      client.String(),
+			DatacapUsed: used[projID][client],
+		}
+		remaining, err := api.StateVerifiedClientStatus(ctx, client, ts.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("looking up the datacap of %s: %w", client, err)
+		}
+		if remaining != nil {
+			if !remaining.IsInt64() {
+				return nil, xerrors.Errorf("datacap of %s out of range: %s", client, remaining)
+			}
+			cd.Verified = true
+			cd.DatacapRemaining = remaining.Int64()
+		}
+
+		pd.Clients = append(pd.Clients, cd)
+		pd.DatacapRemaining += cd.DatacapRemaining
+		pd.DatacapUsed += cd.DatacapUsed
+	}
+
+	ret := make([]*projectDatacap, 0, len(byProject))
+	for _, pd := range byProject {
+		ret = append(ret, pd)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ProjectID < ret[j].ProjectID })
+	return ret, nil
+}
+
+// One row per client, the project totals are left to the reader
+func writeDatacapStatsCSV(path string, epoch int64, pl []*projectDatacap) error {
+	var rows [][]string
+	for _, p := range pl {
+		for _, c := range p.Clients {
+			rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(c))...))
+		}
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(clientDatacap{}))...), rows)
+}
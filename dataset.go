@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+)
+
+type datasetStatsOutput struct {
+	Epoch         int64           `json:"epoch"`
+	TipSetKey     []cid.Cid       `json:"tipset_key"`
+	Endpoint      string          `json:"endpoint"`
+	Phase         int             `json:"phase,omitempty"`
+	SchemaVersion string          `json:"schema_version"`
+	Payload       []*datasetStats `json:"payload"`
+}
+
+// Qualifying deals of the clients registering a curated dataset. A client registering
+// several datasets has each of its deals counted towards all of them, as nothing on
+// chain tells which dataset a deal stores.
+type datasetStats struct {
+	DatasetID      string             `json:"dataset_id"`
+	DataSize       int64              `json:"total_data_size"`
+	UniqueDataSize int64              `json:"unique_data_size"` // counting each piece once, however many copies of it are stored
+	NumDeals       int                `json:"total_num_deals"`
+	NumPieceCids   int                `json:"total_num_unique_piece_cids"`
+	FilplusSize    int64              `json:"filplus_total_data_size"`
+	Projects       []string           `json:"projects"`
+	Providers      []*datasetProvider `json:"providers"` // most data first
+
+	pieces    map[cid.Cid]int64
+	projects  map[string]struct{}
+	providers map[address.Address]*datasetProvider
+}
+
+type datasetProvider struct {
+	DatasetID  string `json:"dataset_id"`
+	ProviderID string `json:"provider_id"`
+	DataSize   int64  `json:"total_data_size"`
+	NumDeals   int    `json:"total_num_deals"`
+}
+
+type datasetStatsCollector map[string]*datasetStats
+
+func (dc datasetStatsCollector) observe(datasets []string, projID string, provider address.Address, pieceCid cid.Cid, size int64, verified bool) {
+	for _, dsetID := range datasets {
+		ds, ok := dc[dsetID]
+		if !ok {
+			ds = &datasetStats{
+				DatasetID: dsetID,
+				pieces:    make(map[cid.Cid]int64),
+				projects:  make(map[string]struct{}),
+				providers: make(map[address.Address]*datasetProvider),
+			}
+			dc[dsetID] = ds
+		}
+		ds.DataSize += size
+		ds.NumDeals++
+		if verified {
+			ds.FilplusSize += size
+		}
+		ds.pieces[pieceCid] = size
+		ds.projects[projID] = struct{}{}
+
+		dp, ok := ds.providers[provider]
+		if !ok {
+			dp = &datasetProvider{DatasetID: dsetID, ProviderID: provider.String()}
+			ds.providers[provider] = dp
+		}
+		dp.DataSize += size
+		dp.NumDeals++
+	}
+}
+
+// Lists all datasets with any qualifying deal, by name
+func (dc datasetStatsCollector) list() []*datasetStats {
+	ret := make([]*datasetStats, 0, len(dc))
+	for _, ds := range dc {
+		ds.NumPieceCids = len(ds.pieces)
+		for _, size := range ds.pieces {
+			ds.UniqueDataSize += size
+		}
+
+		ds.Projects = make([]string, 0, len(ds.projects))
+		for projID := range ds.projects {
+			ds.Projects = append(ds.Projects, projID)
+		}
+		sort.Strings(ds.Projects)
+
+		ds.Providers = make([]*datasetProvider, 0, len(ds.providers))
+		for _, dp := range ds.providers {
+			ds.Providers = append(ds.Providers, dp)
+		}
+		sort.Slice(ds.Providers, func(i, j int) bool {
+			if ds.Providers[i].DataSize != ds.Providers[j].DataSize {
+				return ds.Providers[i].DataSize > ds.Providers[j].DataSize
+			}
+			return ds.Providers[i].ProviderID < ds.Providers[j].ProviderID
+		})
+
+		ret = append(ret, ds)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].DatasetID < ret[j].DatasetID })
+	return ret
+}
+
+// One row per dataset and provider, the dataset totals are left to the reader
+func writeDatasetStatsCSV(path string, epoch int64, dl []*datasetStats) error {
+	var rows [][]string
+	for _, d := range dl {
+		for _, p := range d.Providers {
+			rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(p))...))
+		}
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(datasetProvider{}))...), rows)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/market"
+)
+
+// The economic terms of a deal, as found in its on-chain proposal. Token amounts are
+// attoFIL, and like the weights are written as decimal strings since they overflow
+// the integer range of most JSON readers.
+type dealEconomics struct {
+	DealEndEpoch         int64  `json:"deal_end_epoch"`
+	StoragePricePerEpoch string `json:"storage_price_per_epoch"`
+	TotalStorageFee      string `json:"total_storage_fee"`
+	ProviderCollateral   string `json:"provider_collateral"`
+	ClientCollateral     string `json:"client_collateral"`
+	VerifiedDeal         bool   `json:"verified_deal"`
+	DealWeight           string `json:"deal_weight"`          // padded size x duration in epochs
+	VerifiedDealWeight   string `json:"verified_deal_weight"` // same as deal_weight for verified deals, 0 otherwise
+}
+
+// How much more a verified deal weighs than its size in the quality-adjusted power of
+// its provider, as the network counts it
+const verifiedDealQualityMultiplier = 10
+
+// The quality-adjusted size of a deal: its padded size, times 10 for FIL+ deals
+func qualityAdjustedSize(p *market.DealProposal) int64 {
+	if p.VerifiedDeal {
+		return int64(p.PieceSize) * verifiedDealQualityMultiplier
+	}
+	return int64(p.PieceSize)
+}
+
+// What the client pays the provider over the full deal term
+func totalStorageFee(p *market.DealProposal) big.Int {
+	return big.Mul(p.StoragePricePerEpoch, big.NewInt(int64(p.EndEpoch-p.StartEpoch)))
+}
+
+func newDealEconomics(p *market.DealProposal) *dealEconomics {
+	duration := big.NewInt(int64(p.EndEpoch - p.StartEpoch))
+	weight := big.Mul(big.NewIntUnsigned(uint64(p.PieceSize)), duration)
+	verifiedWeight := big.Zero()
+	if p.VerifiedDeal {
+		verifiedWeight = weight
+	}
+
+	return &dealEconomics{
+		DealEndEpoch:         int64(p.EndEpoch),
+		StoragePricePerEpoch: p.StoragePricePerEpoch.String(),
+		TotalStorageFee:      totalStorageFee(p).String(),
+		ProviderCollateral:   p.ProviderCollateral.String(),
+		ClientCollateral:     p.ClientCollateral.String(),
+		VerifiedDeal:         p.VerifiedDeal,
+		DealWeight:           weight.String(),
+		VerifiedDealWeight:   verifiedWeight.String(),
+	}
+}
+
+// Sums the price terms of the deals of a project or provider, as evidence of whether
+// they are made at or near zero price
+type dealPricing struct {
+	numDeals   int64
+	numFree    int
+	price      big.Int
+	fee        big.Int
+	collateral big.Int
+}
+
+func (dp *dealPricing) observe(p *market.DealProposal) {
+	if dp.numDeals == 0 {
+		dp.price, dp.fee, dp.collateral = big.Zero(), big.Zero(), big.Zero()
+	}
+	dp.numDeals++
+	if p.StoragePricePerEpoch.IsZero() {
+		dp.numFree++
+	}
+	dp.price = big.Add(dp.price, p.StoragePricePerEpoch)
+	dp.fee = big.Add(dp.fee, totalStorageFee(p))
+	dp.collateral = big.Add(dp.collateral, p.ProviderCollateral)
+}
+
+// The total fee, mean price per epoch (rounded down) and total provider collateral, in
+// attoFIL, along with the number of deals made at zero price
+func (dp *dealPricing) totals() (fee, avgPrice, collateral string, numFree int) {
+	if dp.numDeals == 0 {
+		return "0", "0", "0", 0
+	}
+	return dp.fee.String(), big.Div(dp.price, big.NewInt(dp.numDeals)).String(), dp.collateral.String(), dp.numFree
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/adt"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	"github.com/filecoin-project/lotus/chain/types"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// Supplies the market deals a rollup is computed over. cb is called once per deal,
+// in no particular order, and must not hold on to d past the call.
+type dealSource interface {
+	ForEachDeal(ctx context.Context, ts rollupTipSet, cb func(dealID string, d *api.MarketDeal) error) error
+}
+
+// Reads the deals through StateMarketDeals, from a node or anything standing in for
+// one. With a stream the response is decoded one deal at a time as it arrives, and
+// the whole map is only ever held when the stream can not be used.
+type rpcDealSource struct {
+	api    api.FullNode
+	stream *rpcDealStream
+}
+
+func (s *rpcDealSource) ForEachDeal(ctx context.Context, ts rollupTipSet, cb func(dealID string, d *api.MarketDeal) error) error {
+	if s.stream != nil {
+		started, err := s.stream.forEach(ctx, ts.Key(), cb)
+		if err == nil || started {
+			return err
+		}
+		log.Warnf("unable to stream market deals over %s, fetching them all at once: %s", s.stream.url, err)
+	}
+
+	deals, err := s.api.StateMarketDeals(ctx, ts.Key())
+	if err != nil {
+		return err
+	}
+	return forEachMarketDeal(deals, cb)
+}
+
+func forEachMarketDeal(deals map[string]*api.MarketDeal, cb func(dealID string, d *api.MarketDeal) error) error {
+	for dealID, d := range deals {
+		if err := cb(dealID, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls StateMarketDeals over plain HTTP instead of through the JSON-RPC client,
+// which only hands out the result once it is decoded as a whole
+type rpcDealStream struct {
+	url    string
+	header http.Header
+	budget *rpcBudget
+	retry  *rpcRetryPolicy
+}
+
+// Reports whether cb was called at all, as until then the call can still be retried
+// some other way.
+//
+// The stream is timed out and restarted as the retry policy has it for any other
+// call. The node encodes the deals by ascending ID, so a restarted stream picks up
+// after the last deal handed to cb. Should they come in any other order, a stream
+// broken off after its first deal is not restarted.
+func (s *rpcDealStream) forEach(ctx context.Context, tsk types.TipSetKey, cb func(dealID string, d *api.MarketDeal) error) (started bool, err error) {
+	const method = "StateMarketDeals"
+	timeout := s.retry.timeoutOf(method)
+
+	var last string
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		var transient bool
+		last, transient, err = s.stream(callCtx, tsk, last, cb)
+		transient = transient || (ctx.Err() == nil && callCtx.Err() == context.DeadlineExceeded)
+		cancel()
+
+		started = last != ""
+		if err == nil || !transient || attempt >= s.retry.retries || ctx.Err() != nil {
+			return started, err
+		}
+		wait := s.retry.backoff(attempt)
+		log.Warnf("streaming market deals failed, restarting after deal '%s' in %s (%d/%d): %s", last, wait, attempt+1, s.retry.retries, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return started, err
+		}
+	}
+}
+
+// A single StateMarketDeals call, skipping the deals up to and including after.
+// Returns the last deal handed to cb, and whether a failure is worth a restart.
+func (s *rpcDealStream) stream(ctx context.Context, tsk types.TipSetKey, after string, cb func(dealID string, d *api.MarketDeal) error) (last string, transient bool, err error) {
+	last = after
+	if err := s.budget.spend("StateMarketDeals"); err != nil {
+		s.budget.failed("StateMarketDeals")
+		return last, false, err
+	}
+	defer func() {
+		if err != nil {
+			s.budget.failed("StateMarketDeals")
+		}
+	}()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "Filecoin.StateMarketDeals",
+		"params":  []interface{}{tsk},
+	})
+	if err != nil {
+		return last, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return last, false, err
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return last, true, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return last, resp.StatusCode >= 500, xerrors.Errorf("non-200 response: %d", resp.StatusCode)
+	}
+
+	// only a read cut short is worth another attempt, not a malformed response, and
+	// only if the deals handed out so far can be told apart from the rest
+	ordered := true
+	readFailed := func(err error) (string, bool, error) {
+		var netErr net.Error
+		cutShort := errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+		return last, cutShort && (ordered || last == after), err
+	}
+
+	dec := json.NewDecoder(bufio.NewReaderSize(resp.Body, 1<<20))
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return readFailed(err)
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return readFailed(err)
+		}
+		switch key {
+		case "result":
+			if err := expectJSONDelim(dec, '{'); err != nil {
+				return readFailed(err)
+			}
+			var prev string
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return readFailed(err)
+				}
+				dealID := tok.(string)
+				if prev != "" && dealID <= prev {
+					ordered = false
+				}
+				prev = dealID
+
+				if after != "" && dealID <= after {
+					if !ordered {
+						return last, false, xerrors.New("restarted stream of market deals is not ordered by deal ID, unable to resume it")
+					}
+					var skip json.RawMessage
+					if err := dec.Decode(&skip); err != nil {
+						return readFailed(err)
+					}
+					continue
+				}
+
+				var md api.MarketDeal
+				if err := dec.Decode(&md); err != nil {
+					return readFailed(xerrors.Errorf("decoding deal %s: %w", dealID, err))
+				}
+				if err := cb(dealID, &md); err != nil {
+					return last, false, err
+				}
+				last = dealID
+			}
+			if err := expectJSONDelim(dec, '}'); err != nil {
+				return readFailed(err)
+			}
+		case "error":
+			var rpcErr struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := dec.Decode(&rpcErr); err != nil {
+				return readFailed(err)
+			}
+			return last, false, xerrors.Errorf("StateMarketDeals failed: %s (code %d)", rpcErr.Message, rpcErr.Code)
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return readFailed(err)
+			}
+		}
+	}
+	return last, false, nil
+}
+
+func expectJSONDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return xerrors.Errorf("unexpected %v in JSON-RPC response, expected '%s'", tok, want)
+	}
+	return nil
+}
+
+// Keeps the market deals of the previous run in the state store, and brings them to
+// the rollup tipset by diffing the market actor state between the two, which only
+// reads the parts of it that changed. All deals are pulled through StateMarketDeals
+// when none are stored yet, or when the node no longer holds the previous state.
+type incrementalDealSource struct {
+	api   api.FullNode
+	store *stateStore
+}
+
+func (s *incrementalDealSource) ForEachDeal(ctx context.Context, ts rollupTipSet, cb func(dealID string, d *api.MarketDeal) error) error {
+	deals, err := s.marketDeals(ctx, ts)
+	if err != nil {
+		return err
+	}
+	return forEachMarketDeal(deals, cb)
+}
+
+func (s *incrementalDealSource) marketDeals(ctx context.Context, ts rollupTipSet) (map[string]*api.MarketDeal, error) {
+	prevTsk, err := s.store.marketDealsTipSet()
+	if err != nil {
+		return nil, err
+	}
+
+	if prevTsk != nil {
+		deals, err := s.store.marketDeals()
+		if err != nil {
+			return nil, err
+		}
+		if *prevTsk == ts.Key() {
+			log.Infof("reusing the %d market deals stored for this tipset", len(deals))
+			return deals, nil
+		}
+
+		updated, removed, err := diffMarketDeals(ctx, s.api, *prevTsk, ts.Key())
+		if err == nil {
+			for _, dealID := range removed {
+				delete(deals, dealID)
+			}
+			for dealID, md := range updated {
+				deals[dealID] = md
+			}
+			if err := s.store.putMarketDeals(ts.Key(), updated, removed, false); err != nil {
+				return nil, xerrors.Errorf("storing market deals: %w", err)
+			}
+			log.Infof("brought the stored market deals from %s up to date: %d added or changed, %d removed", prevTsk, len(updated), len(removed))
+			return deals, nil
+		}
+		log.Warnf("unable to diff market state against the previous run at %s, pulling all deals: %s", prevTsk, err)
+	}
+
+	deals, err := s.api.StateMarketDeals(ctx, ts.Key())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.putMarketDeals(ts.Key(), deals, nil, true); err != nil {
+		return nil, xerrors.Errorf("storing market deals: %w", err)
+	}
+	return deals, nil
+}
+
+// The deals whose proposal or state differs between the market actor states at from
+// and to, as StateMarketDeals would return them at to, and the ones no longer there
+func diffMarketDeals(ctx context.Context, node api.FullNode, from, to types.TipSetKey) (map[string]*api.MarketDeal, []string, error) {
+	store := adt.WrapStore(ctx, cbor.NewCborStore(blockstore.NewAPIBlockstore(node)))
+	load := func(tsk types.TipSetKey) (market.DealProposals, market.DealStates, error) {
+		act, err := node.StateGetActor(ctx, market.Address, tsk)
+		if err != nil {
+			return nil, nil, err
+		}
+		st, err := market.Load(store, act)
+		if err != nil {
+			return nil, nil, err
+		}
+		proposals, err := st.Proposals()
+		if err != nil {
+			return nil, nil, err
+		}
+		states, err := st.States()
+		return proposals, states, err
+	}
+
+	prevProposals, prevStates, err := load(from)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("loading market state at %s: %w", from, err)
+	}
+	curProposals, curStates, err := load(to)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("loading market state at %s: %w", to, err)
+	}
+
+	proposalChanges, err := market.DiffDealProposals(prevProposals, curProposals)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("diffing deal proposals: %w", err)
+	}
+	stateChanges, err := market.DiffDealStates(prevStates, curStates)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("diffing deal states: %w", err)
+	}
+
+	changed := make(map[abi.DealID]struct{})
+	for _, p := range proposalChanges.Added {
+		changed[p.ID] = struct{}{}
+	}
+	for _, ds := range stateChanges.Added {
+		changed[ds.ID] = struct{}{}
+	}
+	for _, ds := range stateChanges.Modified {
+		changed[ds.ID] = struct{}{}
+	}
+	for _, ds := range stateChanges.Removed {
+		changed[ds.ID] = struct{}{}
+	}
+
+	removed := make([]string, 0, len(proposalChanges.Removed))
+	for _, p := range proposalChanges.Removed {
+		removed = append(removed, strconv.FormatUint(uint64(p.ID), 10))
+		delete(changed, p.ID)
+	}
+
+	updated := make(map[string]*api.MarketDeal, len(changed))
+	for dealID := range changed {
+		proposal, found, err := curProposals.Get(dealID)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("loading proposal of deal %d: %w", dealID, err)
+		}
+		if !found {
+			// a state left behind without its proposal is not listed by StateMarketDeals
+			removed = append(removed, strconv.FormatUint(uint64(dealID), 10))
+			continue
+		}
+		state, found, err := curStates.Get(dealID)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("loading state of deal %d: %w", dealID, err)
+		}
+		if !found {
+			state = market.EmptyDealState()
+		}
+		updated[strconv.FormatUint(uint64(dealID), 10)] = &api.MarketDeal{Proposal: *proposal, State: *state}
+	}
+
+	return updated, removed, nil
+}
+
+// How a market deal takes part in a rollup, before its client is resolved to a project
+type dealEligibility int
+
+const (
+	// not counted or listed anywhere
+	dealIneligible dealEligibility = iota
+	// active at the rollup tipset: counts towards the totals if its project qualifies
+	dealActive
+	// not activated yet: only shows up in the deal list of its project
+	dealPending
+)
+
+// Decides the eligibility of every market deal a rollup sees
+type eligibilityFilter interface {
+	Eligibility(d *api.MarketDeal, ts rollupTipSet) dealEligibility
+}
+
+// Deals whose sectors have started by the rollup tipset and are not terminated, along
+// with the ones still waiting to start when includePending is set
+type activeDealFilter struct {
+	includePending bool
+}
+
+func (f activeDealFilter) Eligibility(d *api.MarketDeal, ts rollupTipSet) dealEligibility {
+	// Deals that are published but not yet activated, and can still be activated
+	// in the future, are optionally tracked separately: they never count towards
+	// any totals, but do show up in the deal lists of the owning project
+	if f.includePending &&
+		d.State.SectorStartEpoch <= 0 &&
+		d.State.SlashEpoch == -1 &&
+		d.Proposal.StartEpoch > ts.Height() {
+		return dealPending
+	}
+
+	// Only count deals whose sectors have properly started, not past/future ones
+	// https://github.com/filecoin-project/specs-actors/blob/v0.9.9/actors/builtin/market/deal.go#L81-L85
+	// Bail on 0 as well in case SectorStartEpoch is uninitialized due to some bug
+	//
+	// Additionally if the SlashEpoch is set this means the underlying sector is
+	// terminated for whatever reason ( not just slashed ), and the deal record
+	// will soon be removed from the state entirely
+	if d.State.SectorStartEpoch <= 0 ||
+		d.State.SectorStartEpoch > ts.Height() ||
+		d.State.SlashEpoch > -1 {
+		return dealIneligible
+	}
+
+	return dealActive
+}
+
+// What a rollup gets its deals from, resolves their clients with and filters them by.
+// The resolver is wrapped in a cachingResolver by the rollup itself.
+type rollupBackends struct {
+	deals       dealSource
+	resolver    addressResolver
+	eligibility eligibilityFilter
+}
+
+// Assembles the backends of a rollup run from the chain openRollupChain opened, the
+// budget calls to it are metered against, the policy they are retried by, and the
+// --state-db store when given. Test doubles and alternative backends are plugged in
+// by replacing it.
+var newRollupBackends = defaultRollupBackends
+
+func defaultRollupBackends(cctx *cli.Context, node api.FullNode, ts rollupTipSet, budget *rpcBudget, retry *rpcRetryPolicy, store *stateStore) (*rollupBackends, error) {
+	resolver, err := newAddressResolver(cctx.StringSlice("resolver"), node, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	var deals dealSource
+	switch {
+	case cctx.Bool("incremental"):
+		deals = &incrementalDealSource{api: node, store: store}
+	case cctx.Bool("stream-deals") && cctx.String("lily") == "" && cctx.String("deals-snapshot") == "":
+		src := &rpcDealSource{api: node}
+		if url, header, err := nodeHTTPEndpoint(cctx); err != nil {
+			log.Warnf("market deals can not be streamed, fetching them all at once: %s", err)
+		} else {
+			src.stream = &rpcDealStream{url: url, header: header, budget: budget, retry: retry}
+		}
+		deals = src
+	default:
+		deals = &rpcDealSource{api: node}
+	}
+
+	return &rollupBackends{
+		deals:       deals,
+		resolver:    resolver,
+		eligibility: activeDealFilter{includePending: cctx.Bool("include-pending")},
+	}, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+const estuaryTokenEnv = "ESTUARY_API_TOKEN"
+
+// What the Estuary node making the repair deals knows of one of them, attached to its
+// recovery list entry
+type estuaryDealRecord struct {
+	ContentID   int64  `json:"content_id"`
+	ContentCID  string `json:"content_cid"`
+	Replication int    `json:"replication"` // copies of the content Estuary is asked to keep
+	Replicas    int    `json:"replicas"`    // deals of the content Estuary has seen make it on chain, not failed since
+}
+
+// The contents of the Estuary account the token in $ESTUARY_API_TOKEN belongs to, and
+// their deals, by on-chain deal id. Deals Estuary made but that never got an id are
+// left out, as there is nothing to match them with.
+func fetchEstuaryDeals(ctx context.Context, apiBase string, progress *progressReporter) (map[string]*estuaryDealRecord, error) {
+	token := os.Getenv(estuaryTokenEnv)
+	if token == "" {
+		return nil, xerrors.Errorf("no API token: %s is not set", estuaryTokenEnv)
+	}
+	apiBase = strings.TrimRight(apiBase, "/")
+
+	var contents []struct {
+		ID          int64           `json:"id"`
+		Cid         json.RawMessage `json:"cid"`
+		Replication int             `json:"replication"`
+	}
+	if err := estuaryGet(ctx, apiBase, "/content/list", token, &contents); err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]*estuaryDealRecord)
+	progress.start("fetching_estuary_deals", len(contents))
+	for i, content := range contents {
+		if err := progress.step(i); err != nil {
+			return nil, err
+		}
+
+		var status struct {
+			Deals []struct {
+				Deal struct {
+					DealID int64 `json:"dealId"`
+					Failed bool  `json:"failed"`
+				} `json:"deal"`
+			} `json:"deals"`
+		}
+		if err := estuaryGet(ctx, apiBase, "/content/status/"+strconv.FormatInt(content.ID, 10), token, &status); err != nil {
+			return nil, err
+		}
+
+		contentCid, err := estuaryCid(content.Cid)
+		if err != nil {
+			return nil, xerrors.Errorf("content %d: %w", content.ID, err)
+		}
+		replicas := 0
+		for _, d := range status.Deals {
+			if d.Deal.DealID > 0 && !d.Deal.Failed {
+				replicas++
+			}
+		}
+		for _, d := range status.Deals {
+			if d.Deal.DealID <= 0 {
+				continue
+			}
+			records[strconv.FormatInt(d.Deal.DealID, 10)] = &estuaryDealRecord{
+				ContentID:   content.ID,
+				ContentCID:  contentCid,
+				Replication: content.Replication,
+				Replicas:    replicas,
+			}
+		}
+	}
+
+	return records, nil
+}
+
+func estuaryGet(ctx context.Context, apiBase, path, token string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiBase+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return xerrors.Errorf("non-2xx response %d from %s%s: %s", resp.StatusCode, apiBase, path, body)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return xerrors.Errorf("unexpected response from %s%s: %w", apiBase, path, err)
+	}
+	return nil
+}
+
+// Estuary writes content CIDs as IPLD links, older versions as plain strings
+func estuaryCid(raw json.RawMessage) (string, error) {
+	var c cid.Cid
+	if err := json.Unmarshal(raw, &c); err == nil {
+		return c.String(), nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", xerrors.Errorf("unparseable content cid %s", raw)
+	}
+	if _, err := cid.Parse(s); err != nil {
+		return "", xerrors.Errorf("invalid content cid '%s': %w", s, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Comment lines keep idle connections from being reaped by proxies in between
+const eventKeepaliveInterval = 30 * time.Second
+
+// Announces newly published rollups as Server-Sent Events, so that dashboards need
+// not poll. Every event carries the totals of the rollup, and the latest one is
+// replayed to each new subscriber right away. Subscribers only ever care about the
+// latest rollup: a slow one skips the events it could not keep up with.
+type rollupEvents struct {
+	mu     sync.Mutex
+	last   *rollupEvent
+	subs   map[chan *rollupEvent]struct{}
+	closed bool
+}
+
+type rollupEvent struct {
+	id   string
+	data []byte
+}
+
+// data of the rollup events
+type rollupEventData struct {
+	Epoch         int64            `json:"epoch"`
+	TipSetKey     []cid.Cid        `json:"tipset_key"`
+	SchemaVersion string           `json:"schema_version"`
+	Rollup        string           `json:"rollup"` // directory name within the daemon root
+	Totals        competitionTotal `json:"totals"`
+}
+
+func newRollupEvents() *rollupEvents {
+	return &rollupEvents{subs: make(map[chan *rollupEvent]struct{})}
+}
+
+// Announces the completed rollup in dir
+func (re *rollupEvents) publish(dir string) error {
+	basic, err := loadBasicStats(dir)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rollupEventData{
+		Epoch:         basic.Epoch,
+		TipSetKey:     basic.TipSetKey,
+		SchemaVersion: basic.SchemaVersion,
+		Rollup:        filepath.Base(dir),
+		Totals:        basic.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	ev := &rollupEvent{id: strconv.FormatInt(basic.Epoch, 10), data: data}
+
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	re.last = ev
+	for sub := range re.subs {
+		// replace whatever the subscriber has not picked up yet
+		select {
+		case <-sub:
+		default:
+		}
+		sub <- ev
+	}
+	return nil
+}
+
+// Ends all subscriptions
+func (re *rollupEvents) close() {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	re.closed = true
+	for sub := range re.subs {
+		close(sub)
+		delete(re.subs, sub)
+	}
+}
+
+func (re *rollupEvents) subscribe() (chan *rollupEvent, bool) {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if re.closed {
+		return nil, false
+	}
+	sub := make(chan *rollupEvent, 1)
+	if re.last != nil {
+		sub <- re.last
+	}
+	re.subs[sub] = struct{}{}
+	return sub, true
+}
+
+func (re *rollupEvents) unsubscribe(sub chan *rollupEvent) {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if _, subscribed := re.subs[sub]; subscribed {
+		delete(re.subs, sub)
+		close(sub)
+	}
+}
+
+func (re *rollupEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, open := re.subscribe()
+	if !open {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer re.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// a reconnecting client has seen the rollup it names already
+	seen := r.Header.Get("Last-Event-ID")
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case ev, open := <-sub:
+			if !open {
+				return
+			}
+			if ev.id == seen {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: rollup\nid: %s\ndata: %s\n\n", ev.id, ev.data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
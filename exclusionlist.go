@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"golang.org/x/xerrors"
+)
+
+const exclusionListSavedName = "exclusion_list.json"
+
+// Policy decisions keeping deals out of the competition, supplied via --exclusion-list
+// as a local file or URL:
+//
+//	{
+//		"clients": [
+//			{ "address": "f17ia7m5mvizrdug3sqtevqw3tifiqvxqr3kdaeuq", "from_epoch": 1381920 }
+//		],
+//		"datasets": [ "landsat-8" ],
+//		"deals": [ "2345678" ]
+//	}
+//
+// Deals of the clients activated from their from_epoch on do not count, projects
+// registering any of the datasets are disqualified as a whole, and the deals listed
+// by id never count. Without the flag, defaultExclusionList applies.
+type exclusionList struct {
+	Clients  []excludedClient `json:"clients,omitempty"`
+	Datasets []string         `json:"datasets,omitempty"`
+	Deals    []string         `json:"deals,omitempty"`
+
+	clients  map[address.Address]abi.ChainEpoch
+	datasets map[string]bool
+	deals    map[string]bool
+}
+
+type excludedClient struct {
+	Address   string `json:"address"`
+	FromEpoch int64  `json:"from_epoch,omitempty"` // 0 for all deals of the client
+}
+
+// The exclusions in force before they were made configurable: the wallet driving the
+// recovery effort does not count once recovery started, whether its deals make the
+// recovery list or not, and landsat-8 is not an eligible dataset
+func defaultExclusionList(recoveryStart abi.ChainEpoch) *exclusionList {
+	el := &exclusionList{
+		Clients:  []excludedClient{{Address: "f17ia7m5mvizrdug3sqtevqw3tifiqvxqr3kdaeuq", FromEpoch: int64(recoveryStart)}},
+		Datasets: []string{"landsat-8"},
+	}
+	if err := el.index(); err != nil {
+		panic(err)
+	}
+	return el
+}
+
+// Loads and validates an exclusion list, saving a verbatim copy as exclusion_list.json,
+// or returns the default one when name is empty
+func getAndParseExclusionList(ctx context.Context, saveToDir, name string, recoveryStart abi.ChainEpoch) (*exclusionList, error) {
+	if name == "" {
+		return defaultExclusionList(recoveryStart), nil
+	}
+
+	src, err := openSource(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close() //nolint:errcheck
+
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read exclusion list from %s: %w", name, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(saveToDir, exclusionListSavedName), raw, 0644); err != nil {
+		return nil, err
+	}
+	relaxed, err := relaxedJSON(raw)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse exclusion list %s: %w", name, err)
+	}
+
+	el := new(exclusionList)
+	dec := json.NewDecoder(bytes.NewReader(relaxed))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(el); err != nil {
+		return nil, xerrors.Errorf("failed to parse exclusion list %s: %w", name, err)
+	}
+	if err := el.index(); err != nil {
+		return nil, xerrors.Errorf("invalid exclusion list %s: %w", name, err)
+	}
+	return el, nil
+}
+
+func (el *exclusionList) index() error {
+	el.clients = make(map[address.Address]abi.ChainEpoch, len(el.Clients))
+	for _, c := range el.Clients {
+		addr, err := address.NewFromString(c.Address)
+		if err != nil {
+			return xerrors.Errorf("invalid client address '%s': %w", c.Address, err)
+		}
+		if addr.Protocol() == address.ID {
+			return xerrors.Errorf("client '%s' is an ID address: list the wallet address projects register", c.Address)
+		}
+		if c.FromEpoch < 0 {
+			return xerrors.Errorf("client '%s' excluded from negative epoch %d", c.Address, c.FromEpoch)
+		}
+		if _, dup := el.clients[addr]; dup {
+			return xerrors.Errorf("client '%s' listed more than once", c.Address)
+		}
+		el.clients[addr] = abi.ChainEpoch(c.FromEpoch)
+	}
+
+	el.datasets = make(map[string]bool, len(el.Datasets))
+	for _, d := range el.Datasets {
+		if d == "" {
+			return xerrors.New("empty dataset name")
+		}
+		el.datasets[d] = true
+	}
+
+	el.deals = make(map[string]bool, len(el.Deals))
+	for _, d := range el.Deals {
+		if _, err := strconv.ParseUint(d, 10, 64); err != nil {
+			return xerrors.Errorf("invalid deal id '%s'", d)
+		}
+		el.deals[d] = true
+	}
+	return nil
+}
+
+// The exclusion reason when the deal is kept out by its id or client, "" otherwise.
+// A nil list excludes nothing.
+func (el *exclusionList) excludes(dealID string, clientAddr address.Address, deal *api.MarketDeal) string {
+	if el == nil {
+		return ""
+	}
+	if el.deals[dealID] {
+		return exclusionListedDeal
+	}
+	if from, listed := el.clients[clientAddr]; listed && deal.State.SectorStartEpoch >= from {
+		return exclusionListedClient
+	}
+	return ""
+}
+
+// The first of the datasets the exclusion list disqualifies, "" when none is
+func (el *exclusionList) disqualifyingDataset(datasets []string) string {
+	if el == nil {
+		return ""
+	}
+	for _, d := range datasets {
+		if el.datasets[d] {
+			return d
+		}
+	}
+	return ""
+}
+
+// The listed client addresses, sorted
+func (el *exclusionList) clientAddresses() []string {
+	ret := make([]string, 0, len(el.clients))
+	for a := range el.clients {
+		ret = append(ret, a.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+)
+
+const (
+	// the deal has not been activated at the rollup tipset
+	exclusionNotStarted = "sector_not_started"
+	// published and still due to start, listed as pending with --include-pending
+	exclusionPending = "pending"
+	// the sector holding the deal got terminated
+	exclusionSlashed = "slashed"
+	// the client ID could not be resolved to the wallet address the project registered
+	exclusionUnresolvedClient = "unresolved_client"
+	// made by a restore or repair client, with --exclude-recoveries-from-competition
+	exclusionRecovery = "recovery_excluded"
+	// activated before the start of the phase window
+	exclusionBeforePhase = "pre_phase"
+	// activated after the end of a past phase selected with --phase
+	exclusionAfterPhase = "post_phase"
+	// shorter than the minimum qualifying duration
+	exclusionShortDuration = "short_duration"
+	// beyond the qualifying deals allowed for the same piece within a project, or with
+	// the same provider within a project
+	exclusionReplicaLimit = "piece_cid_cap"
+	// the project registers a dataset of the exclusion list
+	exclusionListedDataset = "listed_dataset"
+	// the client is on the exclusion list
+	exclusionListedClient = "listed_client"
+	// the deal is on the exclusion list
+	exclusionListedDeal = "listed_deal"
+	// made with a provider left out by --only-provider or --exclude-provider
+	exclusionProviderFiltered = "provider_filtered"
+)
+
+// One line of exclusions.ndjson
+type dealExclusion struct {
+	DealID     string `json:"deal_id"`
+	ProjectID  string `json:"project_id"`
+	Client     string `json:"client"` // ID address
+	ProviderID string `json:"provider_id"`
+	PieceCID   string `json:"piece_cid"`
+	PieceSize  int64  `json:"piece_size"`
+	Reason     string `json:"reason"`
+}
+
+// Records why each deal of a registered project did not count towards the totals,
+// for settling disputes over the numbers of a project. Deals of clients no project
+// registered are left out, as they would make up nearly all of the market. A nil log
+// records nothing.
+type exclusionLog struct {
+	fh  *os.File
+	buf *bufio.Writer
+	enc *json.Encoder
+
+	projects     map[address.Address]string // by client ID address
+	disqualified map[address.Address]string // same, of the projects the exclusion list disqualifies
+	counts       map[string]int
+}
+
+func openExclusionLog(path string, projects, disqualified map[address.Address]string) (*exclusionLog, error) {
+	fh, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(fh)
+	return &exclusionLog{
+		fh:           fh,
+		buf:          buf,
+		enc:          json.NewEncoder(buf),
+		projects:     projects,
+		disqualified: disqualified,
+		counts:       make(map[string]int),
+	}, nil
+}
+
+// Takes every market deal before any project rules apply, recording those that never
+// get to them
+func (el *exclusionLog) screen(dealID string, d *api.MarketDeal, eligibility dealEligibility) error {
+	if el == nil {
+		return nil
+	}
+	if projID, disqualified := el.disqualified[d.Proposal.Client]; disqualified {
+		return el.record(dealID, projID, d, exclusionListedDataset)
+	}
+	projID, known := el.projects[d.Proposal.Client]
+	if !known {
+		return nil
+	}
+	switch {
+	case eligibility == dealPending:
+		return el.record(dealID, projID, d, exclusionPending)
+	case eligibility == dealActive:
+		return nil
+	case d.State.SlashEpoch > -1:
+		return el.record(dealID, projID, d, exclusionSlashed)
+	default:
+		return el.record(dealID, projID, d, exclusionNotStarted)
+	}
+}
+
+// Records a deal of a registered project dropped before its client is resolved
+func (el *exclusionLog) recordByClientID(dealID string, d *api.MarketDeal, reason string) error {
+	if el == nil {
+		return nil
+	}
+	projID, known := el.projects[d.Proposal.Client]
+	if !known {
+		return nil
+	}
+	return el.record(dealID, projID, d, reason)
+}
+
+func (el *exclusionLog) record(dealID, projID string, d *api.MarketDeal, reason string) error {
+	if el == nil {
+		return nil
+	}
+	el.counts[reason]++
+	return el.enc.Encode(dealExclusion{
+		DealID:     dealID,
+		ProjectID:  projID,
+		Client:     d.Proposal.Client.String(),
+		ProviderID: d.Proposal.Provider.String(),
+		PieceCID:   d.Proposal.PieceCID.String(),
+		PieceSize:  int64(d.Proposal.PieceSize),
+		Reason:     reason,
+	})
+}
+
+// Can be called again, doing nothing
+func (el *exclusionLog) Close() error {
+	if el == nil || el.fh == nil {
+		return nil
+	}
+	fh := el.fh
+	el.fh = nil
+
+	if len(el.counts) > 0 {
+		reasons := make([]string, 0, len(el.counts))
+		for reason, cnt := range el.counts {
+			reasons = append(reasons, reason+"="+strconv.Itoa(cnt))
+		}
+		sort.Strings(reasons)
+		log.Infof("excluded deals of registered projects: %s", strings.Join(reasons, " "))
+	}
+	if err := el.buf.Flush(); err != nil {
+		fh.Close() //nolint:errcheck
+		return err
+	}
+	return fh.Close()
+}
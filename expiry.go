@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+type expiringDealsOutput struct {
+	Epoch         int64            `json:"epoch"`
+	TipSetKey     []cid.Cid        `json:"tipset_key"`
+	Endpoint      string           `json:"endpoint"`
+	Phase         int              `json:"phase,omitempty"`
+	SchemaVersion string           `json:"schema_version"`
+	HorizonDays   []int            `json:"horizon_days"`
+	Payload       []*projectExpiry `json:"payload"`
+}
+
+// The qualifying deals of a project ending within the longest of the horizons, by
+// the provider storing them
+type projectExpiry struct {
+	ProjectID string            `json:"project_id"`
+	Horizons  []*expiryHorizon  `json:"horizons"`
+	Providers []*providerExpiry `json:"providers"` // by provider id
+}
+
+type providerExpiry struct {
+	ProviderID string           `json:"provider_id"`
+	Horizons   []*expiryHorizon `json:"horizons"`
+	Deals      []*expiringDeal  `json:"deals"` // soonest ending first
+}
+
+// Deals ending within the given number of days of the rollup, those ending within a
+// shorter horizon included
+type expiryHorizon struct {
+	Days     int   `json:"days"`
+	DataSize int64 `json:"data_size"`
+	NumDeals int   `json:"num_deals"`
+}
+
+type expiringDeal struct {
+	ProjectID   string `json:"project_id"`
+	ProviderID  string `json:"provider_id"`
+	DealID      string `json:"deal_id"`
+	PieceCID    string `json:"piece_cid"`
+	PieceSize   int64  `json:"piece_size"`
+	EndEpoch    int64  `json:"end_epoch"`
+	DaysLeft    int    `json:"days_left"`    // whole days until end_epoch
+	HorizonDays int    `json:"horizon_days"` // the shortest horizon the deal ends within
+}
+
+type expiryCollector struct {
+	epoch    abi.ChainEpoch
+	horizons []int // ascending
+
+	byProject map[string]map[address.Address][]*expiringDeal
+}
+
+func newExpiryCollector(epoch abi.ChainEpoch, horizonDays []int) (*expiryCollector, error) {
+	horizons := append([]int(nil), horizonDays...)
+	sort.Ints(horizons)
+	for _, h := range horizons {
+		if h <= 0 {
+			return nil, xerrors.Errorf("expiry horizons must be a positive amount of days, got %d", h)
+		}
+	}
+	return &expiryCollector{
+		epoch:     epoch,
+		horizons:  horizons,
+		byProject: make(map[string]map[address.Address][]*expiringDeal),
+	}, nil
+}
+
+func (ec *expiryCollector) observe(projID, dealID string, deal *api.MarketDeal) {
+	if len(ec.horizons) == 0 {
+		return
+	}
+	left := deal.Proposal.EndEpoch - ec.epoch
+	if left < 0 || left > abi.ChainEpoch(ec.horizons[len(ec.horizons)-1])*builtin.EpochsInDay {
+		return
+	}
+
+	ed := &expiringDeal{
+		ProjectID:  projID,
+		ProviderID: deal.Proposal.Provider.String(),
+		DealID:     dealID,
+		PieceCID:   deal.Proposal.PieceCID.String(),
+		PieceSize:  int64(deal.Proposal.PieceSize),
+		EndEpoch:   int64(deal.Proposal.EndEpoch),
+		DaysLeft:   int(left / builtin.EpochsInDay),
+	}
+	for _, h := range ec.horizons {
+		if left <= abi.ChainEpoch(h)*builtin.EpochsInDay {
+			ed.HorizonDays = h
+			break
+		}
+	}
+
+	if ec.byProject[projID] == nil {
+		ec.byProject[projID] = make(map[address.Address][]*expiringDeal)
+	}
+	ec.byProject[projID][deal.Proposal.Provider] = append(ec.byProject[projID][deal.Proposal.Provider], ed)
+}
+
+func tallyExpiry(horizons []*expiryHorizon, ed *expiringDeal) {
+	for _, eh := range horizons {
+		if ed.HorizonDays <= eh.Days {
+			eh.DataSize += ed.PieceSize
+			eh.NumDeals++
+		}
+	}
+}
+
+func (ec *expiryCollector) newHorizons() []*expiryHorizon {
+	ret := make([]*expiryHorizon, len(ec.horizons))
+	for i, h := range ec.horizons {
+		ret[i] = &expiryHorizon{Days: h}
+	}
+	return ret
+}
+
+// Lists the projects with any deal ending within the horizons, by project id
+func (ec *expiryCollector) list() []*projectExpiry {
+	ret := make([]*projectExpiry, 0, len(ec.byProject))
+	for projID, byProvider := range ec.byProject {
+		pe := &projectExpiry{ProjectID: projID, Horizons: ec.newHorizons()}
+		for provider, deals := range byProvider {
+			sort.Slice(deals, func(i, j int) bool {
+				if deals[i].EndEpoch != deals[j].EndEpoch {
+					return deals[i].EndEpoch < deals[j].EndEpoch
+				}
+				return deals[i].DealID < deals[j].DealID
+			})
+			pv := &providerExpiry{ProviderID: provider.String(), Horizons: ec.newHorizons(), Deals: deals}
+			for _, ed := range deals {
+				tallyExpiry(pv.Horizons, ed)
+				tallyExpiry(pe.Horizons, ed)
+			}
+			pe.Providers = append(pe.Providers, pv)
+		}
+		sort.Slice(pe.Providers, func(i, j int) bool { return pe.Providers[i].ProviderID < pe.Providers[j].ProviderID })
+		ret = append(ret, pe)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ProjectID < ret[j].ProjectID })
+	return ret
+}
+
+// One row per deal
+func writeExpiringDealsCSV(path string, epoch int64, pl []*projectExpiry) error {
+	var rows [][]string
+	for _, p := range pl {
+		for _, pv := range p.Providers {
+			for _, d := range pv.Deals {
+				rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(d))...))
+			}
+		}
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(expiringDeal{}))...), rows)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var explain = &cli.Command{
+	Usage:     "Show how every eligibility rule applies to a single deal",
+	Name:      "explain",
+	ArgsUsage: "  <deal id> [<eligible project list> [<restore client list>]]",
+	Description: `Looks up the deal on the node and goes through the rules a rollup at the same
+tipset applies to it, in the same order, printing the values each of them looks at.
+Without the project list, the rules that depend on the deal's project are skipped,
+and without the restore client list so are those of the recovery list. The rules
+follow the "rules" section of the --config, as in a rollup.
+
+The cap on qualifying deals per piece CID depends on all the other deals of the
+project, and is only reported on: the deal list of the project in a rollup shows
+which of its deals counted.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "tipset",
+			Usage:       "Tipset to evaluate the deal at, as comma separated array of cids or @height",
+			DefaultText: fmt.Sprintf("%d epochs behind current", defaultEpochLookback),
+		},
+		&cli.StringFlag{
+			Name:  "network",
+			Usage: "Network the node follows, mainnet or calibnet",
+			Value: "mainnet",
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "Local file or URL of a rollup config whose phases and rules to evaluate with",
+		},
+		&cli.StringSliceFlag{
+			Name:  "only-provider",
+			Usage: "Evaluate as a rollup only counting deals made with this provider",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-provider",
+			Usage: "Evaluate as a rollup not counting deals made with this provider",
+		},
+		&cli.StringFlag{
+			Name:        "exclusion-list",
+			Usage:       "Local file or URL of the clients, datasets and deal ids kept out of the competition, as for rollup",
+			DefaultText: "the built-in list",
+		},
+		&cli.StringFlag{
+			Name:  "phase-schedule",
+			Usage: "Local file or URL of a JSON or YAML phase schedule, as for rollup",
+		},
+		&cli.StringFlag{
+			Name:  "phase",
+			Usage: "Evaluate against the phase window with this id or name, instead of the last phase",
+		},
+		&cli.Int64Flag{
+			Name:  "phasestart-epoch",
+			Usage: "Evaluate against a phase window starting at this epoch",
+		},
+		&cli.StringSliceFlag{
+			Name:  "repair-client",
+			Usage: "Wallet address making repair deals, as for rollup",
+		},
+		&cli.Int64Flag{
+			Name:  "min-deal-duration-days",
+			Usage: "Minimum duration of qualifying deals, as for rollup",
+		},
+		&cli.Int64Flag{
+			Name:  "recovery-min-duration-days",
+			Usage: "Deals by restore and repair clients must last strictly longer than this to make the recovery list, as for rollup",
+		},
+		&cli.IntFlag{
+			Name:        "max-deals-per-piece",
+			Usage:       "Cap on qualifying deals of the same piece CID within a project, as for rollup",
+			DefaultText: fmt.Sprint(maxQualifyingDealsPerPiece),
+		},
+		&cli.BoolFlag{
+			Name:  "piece-cap-per-provider",
+			Usage: "Apply the piece CID cap with each provider separately, as for rollup",
+		},
+		&cli.BoolFlag{
+			Name:  "exclude-recoveries-from-competition",
+			Usage: "Evaluate as a rollup keeping recovery list deals out of the competition",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		args := cctx.Args().Slice()
+		if len(args) < 1 || len(args) > 3 {
+			return xerrors.New("expected a deal id, optionally followed by the project list and the restore client list")
+		}
+		dealID, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return xerrors.Errorf("invalid deal id '%s': %w", args[0], err)
+		}
+		ctx := cctx.Context
+
+		network, err := lookupNetwork(cctx.String("network"))
+		if err != nil {
+			return err
+		}
+		network.apply()
+		if cctx.String("phase-schedule") != "" {
+			sched, err := loadPhaseSchedule(ctx, cctx.String("phase-schedule"))
+			if err != nil {
+				return xerrors.Errorf("loading phase schedule failed: %w", err)
+			}
+			sched.apply()
+		}
+		if cctx.IsSet("phase") && cctx.IsSet("phasestart-epoch") {
+			return xerrors.New("--phase and --phasestart-epoch are mutually exclusive")
+		}
+		if cctx.Int64("phasestart-epoch") > 0 {
+			currentPhaseStart = abi.ChainEpoch(cctx.Int64("phasestart-epoch"))
+		}
+
+		// the config and list parsers keep a copy of what they read, which is of no use here
+		scratch, err := ioutil.TempDir("", "slingshot-explain-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(scratch) //nolint:errcheck
+
+		cfg, err := getAndParseConfig(ctx, scratch, cctx.String("config"))
+		if err != nil {
+			return xerrors.Errorf("loading rollup config failed: %s", err)
+		}
+		phases, err := newPhaseSchedule(cfg.Phases)
+		if err != nil {
+			return err
+		}
+		if cctx.String("phase") != "" {
+			phase, end, err := phases.resolve(cctx.String("phase"))
+			if err != nil {
+				return err
+			}
+			currentPhaseStart = abi.ChainEpoch(phase.StartEpoch)
+			currentPhaseEnd = end
+		}
+
+		recoveryMinDays := network.recoveryMinDurationDays
+		if cctx.IsSet("recovery-min-duration-days") {
+			recoveryMinDays = cctx.Int64("recovery-min-duration-days")
+		}
+		if err := checkMinDurationDays("recovery minimum duration", recoveryMinDays, true); err != nil {
+			return err
+		}
+		ex := &dealExplanation{
+			recovery: &recoveryRules{
+				StartEpoch:             recoveryStart,
+				MinDuration:            recoveryMinDurationEpochs(recoveryMinDays),
+				ExcludeFromCompetition: cctx.Bool("exclude-recoveries-from-competition"),
+				RepairClients:          make(map[address.Address]struct{}),
+			},
+		}
+		for _, a := range cctx.StringSlice("repair-client") {
+			addr, err := address.NewFromString(a)
+			if err != nil {
+				return xerrors.Errorf("invalid repair client address '%s': %w", a, err)
+			}
+			ex.recovery.RepairClients[addr] = struct{}{}
+		}
+		if err := applyRuleFlags(cctx, cfg); err != nil {
+			return err
+		}
+		if ex.rules, err = newEligibilityRules(cfg.Rules, ex.recovery); err != nil {
+			return xerrors.Errorf("loading rollup config failed: %s", err)
+		}
+		excludeList, err := getAndParseExclusionList(ctx, scratch, cctx.String("exclusion-list"), ex.recovery.StartEpoch)
+		if err != nil {
+			return xerrors.Errorf("loading exclusion list failed: %w", err)
+		}
+		ex.rules.useExclusionList(excludeList)
+		if ex.providers, err = newProviderFilter(cctx.StringSlice("only-provider"), cctx.StringSlice("exclude-provider")); err != nil {
+			return err
+		}
+
+		if len(args) > 1 {
+			projects, err := getAndParseProjectList(ctx, scratch, args[1], nil, excludeList)
+			if err != nil {
+				return xerrors.Errorf("determining registered project failed: %s", err)
+			}
+			ex.projects, ex.excludedProjects = projects.byAddr, projects.excluded
+			if len(args) > 2 {
+				if ex.restoreClients, err = getAndParseRestore(ctx, scratch, args[2]); err != nil {
+					return xerrors.Errorf("determining restore clients failed: %s", err)
+				}
+			}
+		}
+
+		node, closer, err := getFullNodeAPI(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+		if err := network.checkNode(ctx, node, cctx.String("network")); err != nil {
+			return err
+		}
+
+		ts, _, err := resolveRollupTipSet(ctx, node, cctx.String("tipset"))
+		if err != nil {
+			return err
+		}
+		deal, err := node.StateMarketStorageDeal(ctx, abi.DealID(dealID), ts.Key())
+		if err != nil {
+			return xerrors.Errorf("looking up deal %d at epoch %d: %w", dealID, ts.Height(), err)
+		}
+
+		fmt.Printf("deal %d at epoch %d (tipset %s)\n", dealID, ts.Height(), tipSetKeyArg(ts.Cids()))
+		fmt.Printf("  client %s, provider %s, piece %s of %d bytes, epochs %d to %d\n\n",
+			deal.Proposal.Client, deal.Proposal.Provider, deal.Proposal.PieceCID, deal.Proposal.PieceSize, deal.Proposal.StartEpoch, deal.Proposal.EndEpoch)
+
+		switch counts := ex.evaluate(ctx, node, ts, strconv.FormatUint(dealID, 10), deal, os.Stdout); {
+		case !counts:
+			fmt.Println("\nthe deal does not count towards the totals")
+		case ex.projects == nil:
+			fmt.Println("\nthe deal passes the rules checked, whether it counts depends on the project list")
+		default:
+			fmt.Println("\nthe deal counts towards the totals of its project, unless over the piece CID cap")
+		}
+		return nil
+	},
+}
+
+// The inputs of a rollup a single deal is evaluated against
+type dealExplanation struct {
+	projects         map[address.Address]string // nil without a project list
+	excludedProjects map[address.Address]string
+	restoreClients   map[address.Address]struct{} // nil without a restore client list
+	recovery         *recoveryRules
+	rules            eligibilityRules
+	providers        *providerFilter // nil without --only-provider or --exclude-provider
+}
+
+// Prints a line per rule in the order a rollup applies them, stopping at the first
+// one the deal fails. Returns whether the deal counts.
+func (ex *dealExplanation) evaluate(ctx context.Context, node api.FullNode, ts rollupTipSet, dealID string, deal *api.MarketDeal, w io.Writer) bool {
+	step := func(pass bool, rule, format string, a ...interface{}) bool {
+		verdict := "fail"
+		if pass {
+			verdict = "pass"
+		}
+		fmt.Fprintf(w, "  [%s] %s: %s\n", verdict, rule, fmt.Sprintf(format, a...)) //nolint:errcheck
+		return pass
+	}
+	skip := func(rule, format string, a ...interface{}) {
+		fmt.Fprintf(w, "  [skip] %s: %s\n", rule, fmt.Sprintf(format, a...)) //nolint:errcheck
+	}
+
+	if ex.providers != nil && !step(ex.providers.admits(deal.Proposal.Provider), "provider admitted", "%s", deal.Proposal.Provider) {
+		return false
+	}
+	if !step(deal.State.SectorStartEpoch > 0 && deal.State.SectorStartEpoch <= ts.Height(), "sector activated",
+		"sector start epoch %d, rollup epoch %d", deal.State.SectorStartEpoch, ts.Height()) {
+		if deal.State.SectorStartEpoch <= 0 && deal.State.SlashEpoch == -1 && deal.Proposal.StartEpoch > ts.Height() {
+			fmt.Fprintf(w, "         still due to start at epoch %d: listed as pending with --include-pending\n", deal.Proposal.StartEpoch) //nolint:errcheck
+		}
+		return false
+	}
+	if !step(deal.State.SlashEpoch == -1, "sector not terminated", "slash epoch %d", deal.State.SlashEpoch) {
+		return false
+	}
+
+	clientAddr, err := node.StateAccountKey(ctx, deal.Proposal.Client, ts.Key())
+	if !step(err == nil, "client resolves to a wallet", "%s -> %s", deal.Proposal.Client, explainResult(clientAddr, err)) {
+		return false
+	}
+
+	var projID string
+	projKnown := false
+	if ex.projects == nil {
+		skip("client registered", "no project list given")
+	} else {
+		if excludedID, excluded := ex.excludedProjects[clientAddr]; excluded {
+			return step(false, "client registered", "project %s registers a dataset of the exclusion list, disqualified", excludedID)
+		}
+		projID, projKnown = ex.projects[clientAddr]
+		if !step(projKnown, "client registered", "%s", explainProject(projID, projKnown)) {
+			return false
+		}
+	}
+
+	var kind int8
+	if ex.restoreClients == nil {
+		skip("recovery list", "no restore client list given")
+	} else {
+		kind = ex.recovery.recoveryKind(clientAddr, ex.restoreClients, deal)
+		fmt.Fprintf(w, "  [info] recovery list: %s\n", explainRecovery(kind, ex.recovery)) //nolint:errcheck
+	}
+
+	// the rules of the engine, bar the piece CID cap which needs the other deals
+	candidate := &dealCandidate{dealID: dealID, deal: deal, client: clientAddr, isRecovery: kind != 0}
+	for _, r := range ex.rules {
+		switch {
+		case r.disabled:
+			skip(r.name, "disabled by the rollup config")
+		case r.name == ruleMaxDealsPerPiece && !projKnown:
+			skip(r.name, "no project list given")
+		case r.name == ruleMaxDealsPerPiece:
+			fmt.Fprintf(w, "  [info] %s: %s, see the deal list of project %s\n", r.name, r.describe(candidate), projID) //nolint:errcheck
+		default:
+			if !step(r.check(candidate) == "", r.name, "%s", r.describe(candidate)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func explainResult(a address.Address, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return a.String()
+}
+
+func explainProject(projID string, known bool) string {
+	if !known {
+		return "not in the project list"
+	}
+	return "project " + projID
+}
+
+func explainRecovery(kind int8, rr *recoveryRules) string {
+	switch kind {
+	case recoveryRestore:
+		return "listed as a restore"
+	case recoveryRepair:
+		return "listed as a repair"
+	}
+	return fmt.Sprintf("not listed: not by a restore or repair client, or activated before %d or not longer than %d epochs", rr.StartEpoch, rr.MinDuration)
+}
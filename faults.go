@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+type providerFaultHistoryOutput struct {
+	Epoch         int64                   `json:"epoch"`
+	TipSetKey     []cid.Cid               `json:"tipset_key"`
+	Endpoint      string                  `json:"endpoint"`
+	Phase         int                     `json:"phase,omitempty"`
+	SchemaVersion string                  `json:"schema_version"`
+	Payload       []*providerFaultHistory `json:"payload"`
+}
+
+// How well a provider kept the sectors holding qualifying deals available over the
+// phase window. The fault state is sampled once a day, so short faults declared and
+// recovered between two samples go unnoticed.
+type providerFaultHistory struct {
+	Provider          string `json:"provider"`
+	QualifyingSectors int    `json:"qualifying_sectors"`
+	SampledDays       int    `json:"sampled_days"`
+	DaysFaulty        int    `json:"days_faulty"`        // days with at least one qualifying sector faulty
+	FaultySectorDays  int    `json:"faulty_sector_days"` // sum of faulty qualifying sectors over all sampled days
+	DaysRecovering    int    `json:"days_recovering"`    // days with at least one qualifying sector declared as recovering
+}
+
+// Collects the fault history of every provider holding qualifying deals, for the
+// window between windowStart and either windowEnd (when non-zero) or the rollup tipset
+func collectFaultHistory(ctx context.Context, api api.FullNode, ts rollupTipSet, windowStart, windowEnd abi.ChainEpoch, qualifyingDeals map[address.Address]map[abi.DealID]struct{}, progress *progressReporter) ([]*providerFaultHistory, error) {
+
+	// find which sectors hold the qualifying deals
+	qualifyingSectors := make(map[address.Address][]abi.SectorNumber, len(qualifyingDeals))
+	for provider, dealIDs := range qualifyingDeals {
+		sectors, err := api.StateMinerSectors(ctx, provider, nil, ts.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("listing sectors of %s: %w", provider, err)
+		}
+		for _, s := range sectors {
+			for _, d := range s.DealIDs {
+				if _, qualifying := dealIDs[d]; qualifying {
+					qualifyingSectors[provider] = append(qualifyingSectors[provider], s.SectorNumber)
+					break
+				}
+			}
+		}
+	}
+
+	ret := make([]*providerFaultHistory, 0, len(qualifyingSectors))
+	byProvider := make(map[address.Address]*providerFaultHistory, len(qualifyingSectors))
+	for provider, sectors := range qualifyingSectors {
+		pfh := &providerFaultHistory{
+			Provider:          provider.String(),
+			QualifyingSectors: len(sectors),
+		}
+		byProvider[provider] = pfh
+		ret = append(ret, pfh)
+	}
+
+	if windowStart < 0 {
+		windowStart = 0
+	}
+	if windowEnd <= 0 || windowEnd > ts.Height()+1 {
+		windowEnd = ts.Height() + 1
+	}
+	progress.start("sampling_provider_faults", int((windowEnd-windowStart+builtin.EpochsInDay-1)/builtin.EpochsInDay))
+	for h := windowStart; h < windowEnd; h += builtin.EpochsInDay {
+		if err := progress.step(int((h - windowStart) / builtin.EpochsInDay)); err != nil {
+			return nil, err
+		}
+		sampleTs, err := api.ChainGetTipSetByHeight(ctx, h, ts.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("getting tipset at height %d: %w", h, err)
+		}
+
+		for provider, sectors := range qualifyingSectors {
+			pfh := byProvider[provider]
+			pfh.SampledDays++
+
+			faults, err := api.StateMinerFaults(ctx, provider, sampleTs.Key())
+			if err != nil {
+				return nil, xerrors.Errorf("getting faults of %s at height %d: %w", provider, h, err)
+			}
+			recoveries, err := api.StateMinerRecoveries(ctx, provider, sampleTs.Key())
+			if err != nil {
+				return nil, xerrors.Errorf("getting recoveries of %s at height %d: %w", provider, h, err)
+			}
+
+			var faulty, recovering int
+			for _, sn := range sectors {
+				if isSet, err := faults.IsSet(uint64(sn)); err != nil {
+					return nil, err
+				} else if isSet {
+					faulty++
+				}
+				if isSet, err := recoveries.IsSet(uint64(sn)); err != nil {
+					return nil, err
+				} else if isSet {
+					recovering++
+				}
+			}
+
+			pfh.FaultySectorDays += faulty
+			if faulty > 0 {
+				pfh.DaysFaulty++
+			}
+			if recovering > 0 {
+				pfh.DaysRecovering++
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].FaultySectorDays != ret[j].FaultySectorDays {
+			return ret[i].FaultySectorDays > ret[j].FaultySectorDays
+		}
+		return ret[i].Provider < ret[j].Provider
+	})
+
+	return ret, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// Detached signature of an input list, expected next to it with this suffix
+const inputSignatureSuffix = ".sig"
+
+// Sidecar vouching for an input list: Signature covers the raw bytes of the file, in
+// the same encodings as the output signature
+type inputSignature struct {
+	Signer    string `json:"signer"`
+	KeyType   string `json:"key_type"`
+	Signature string `json:"signature"` // hex
+}
+
+var signInput = &cli.Command{
+	Usage:     "Sign input lists for use with rollup --final",
+	Name:      "sign-input",
+	ArgsUsage: "  <key file> <input file> [<input file>...]",
+	Description: `Writes a detached signature next to every given input file, named after it
+with a ` + inputSignatureSuffix + ` suffix. The key file is either a wallet key as written by
+'lotus wallet export', or a PEM encoded ed25519 private key, as for --sign-key.`,
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() < 2 {
+			return xerrors.New("expected a key file and at least one input file")
+		}
+		signer, err := loadOutputSigner(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		for _, path := range cctx.Args().Tail() {
+			raw, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			sig, err := signer.sign(raw)
+			if err != nil {
+				return xerrors.Errorf("signing %s: %w", path, err)
+			}
+			out, err := json.MarshalIndent(inputSignature{
+				Signer:    signer.signer,
+				KeyType:   signer.keyType,
+				Signature: hex.EncodeToString(sig),
+			}, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path+inputSignatureSuffix, append(out, '\n'), 0644); err != nil {
+				return err
+			}
+			log.Infof("signed %s as %s", path, signer.signer)
+		}
+		return nil
+	},
+}
+
+// The inputs of a run by the name their copy is saved under in the output directory
+func runInputs(cctx *cli.Context, projList, restoreList string) map[string]string {
+	inputs := map[string]string{
+		"client_list.json":         projList,
+		"restore_client_list.json": restoreList,
+	}
+	if cctx.String("config") != "" {
+		inputs["rollup_config.json"] = cctx.String("config")
+	}
+	if cctx.String("provider-probes") != "" {
+		inputs["provider_probes.json"] = cctx.String("provider-probes")
+	}
+	if cctx.String("exclusion-list") != "" {
+		inputs[exclusionListSavedName] = cctx.String("exclusion-list")
+	}
+	if cctx.String("phase-schedule") != "" {
+		inputs[phaseScheduleSavedName(cctx.String("phase-schedule"))] = cctx.String("phase-schedule")
+	}
+	return inputs
+}
+
+// The flag combinations --final insists on, checked before anything is fetched. All
+// inputs have to be local files, signed by one of the trusted signers.
+func checkFinalRun(cctx *cli.Context, inputs map[string]string) error {
+	for _, required := range []string{"tipset", "sign-key", "bundle", "input-signer"} {
+		if !cctx.IsSet(required) {
+			return xerrors.Errorf("--final requires --%s", required)
+		}
+	}
+	for _, conflicting := range []string{"soft-fail", "stdout"} {
+		if cctx.Bool(conflicting) {
+			return xerrors.Errorf("--final can not be combined with --%s", conflicting)
+		}
+	}
+	if cctx.String("lily") != "" {
+		return xerrors.New("--final reads the chain from a Lotus node, not from a Lily database")
+	}
+	if cctx.String("deals-snapshot") != "" {
+		return xerrors.New("--final reads the chain from a Lotus node, not from a deals snapshot")
+	}
+
+	// address mappings are for runs where the node can not answer, and may be stale
+	for _, spec := range cctx.StringSlice("resolver") {
+		for _, spec := range strings.Split(spec, ",") {
+			if spec != "rpc" {
+				return xerrors.Errorf("--final resolves clients against the chain only, not through resolver '%s'", spec)
+			}
+		}
+	}
+
+	for _, input := range inputs {
+		if strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") {
+			return xerrors.Errorf("--final requires local input files, fetch and sign '%s' first", input)
+		}
+	}
+	return nil
+}
+
+// Refuses tipsets that may still be reorganized, however they were selected
+func checkFinalityDepth(ctx context.Context, node api.FullNode, ts rollupTipSet, depth int64) error {
+	head, err := node.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+	if head.Height()-ts.Height() < abi.ChainEpoch(depth) {
+		return xerrors.Errorf("tipset at epoch %d is only %d epochs behind the head at %d, --final requires at least %d", ts.Height(), head.Height()-ts.Height(), head.Height(), depth)
+	}
+	return nil
+}
+
+// Checks the detached signature of an input file against the trusted signers, and
+// keeps a copy of it in the output directory as savedName plus the suffix
+func verifyInputSignature(path string, trusted []string, outDirName, savedName string) error {
+	rawSig, err := ioutil.ReadFile(path + inputSignatureSuffix)
+	if os.IsNotExist(err) {
+		return xerrors.Errorf("input '%s' is not signed: expected a signature in '%s'", path, path+inputSignatureSuffix)
+	} else if err != nil {
+		return err
+	}
+	var is inputSignature
+	if err := json.Unmarshal(rawSig, &is); err != nil {
+		return xerrors.Errorf("parsing %s: %w", path+inputSignatureSuffix, err)
+	}
+
+	isTrusted := false
+	for _, t := range trusted {
+		isTrusted = isTrusted || t == is.Signer
+	}
+	if !isTrusted {
+		return xerrors.Errorf("input '%s' is signed by %s, which is not among the trusted --input-signer", path, is.Signer)
+	}
+
+	msg, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig, err := hex.DecodeString(is.Signature)
+	if err != nil {
+		return xerrors.Errorf("signature in %s is not hex: %w", path+inputSignatureSuffix, err)
+	}
+
+	if strings.HasPrefix(is.Signer, "ed25519:") {
+		pub, err := hex.DecodeString(strings.TrimPrefix(is.Signer, "ed25519:"))
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return xerrors.Errorf("invalid ed25519 signer '%s'", is.Signer)
+		}
+		if !ed25519.Verify(pub, msg, sig) {
+			return xerrors.Errorf("signature of input '%s' by %s does not verify", path, is.Signer)
+		}
+	} else {
+		addr, err := address.NewFromString(is.Signer)
+		if err != nil {
+			return xerrors.Errorf("invalid signer '%s' in %s: %w", is.Signer, path+inputSignatureSuffix, err)
+		}
+		var s crypto.Signature
+		if err := s.UnmarshalBinary(sig); err != nil {
+			return xerrors.Errorf("malformed signature in %s: %w", path+inputSignatureSuffix, err)
+		}
+		if err := sigs.Verify(&s, addr, msg); err != nil {
+			return xerrors.Errorf("signature of input '%s' by %s does not verify: %w", path, is.Signer, err)
+		}
+	}
+
+	log.Infof("input '%s' is signed by %s", path, is.Signer)
+	return ioutil.WriteFile(filepath.Join(outDirName, savedName+inputSignatureSuffix), rawSig, 0644)
+}
+
+// The envelope fields every JSON output shares
+type outputEnvelope struct {
+	Epoch         int64     `json:"epoch"`
+	TipSetKey     []cid.Cid `json:"tipset_key"`
+	Endpoint      string    `json:"endpoint"`
+	SchemaVersion string    `json:"schema_version"`
+}
+
+// Reads back the outputs of a completed run before it is signed: every document has
+// to match its schema exactly and carry the envelope of this run, and the totals, the
+// project stats and the deal lists have to add up with each other.
+func validateRollup(outDirName string, ts rollupTipSet, dealListFmt string, ndjson bool) error {
+	required := map[string]bool{"basic_stats.json": true, "client_stats.json": true, "parameters.json": true, "recovery_deallist.json": !ndjson}
+
+	docs := make(map[string]interface{})
+	for name, doc := range schemaDocuments {
+		if strings.Contains(name, "{") {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(outDirName, name))
+		if os.IsNotExist(err) && !required[name] {
+			continue
+		} else if err != nil {
+			return err
+		}
+		v := reflect.New(doc.envelope).Interface()
+		if err := validateDocument(name, raw, doc.endpoint, ts, v); err != nil {
+			return err
+		}
+		docs[name] = v
+	}
+
+	basic := docs["basic_stats.json"].(*competitionTotalOutput).Payload
+	projects := docs["client_stats.json"].(*projectAggregateStatsOutput).Payload
+
+	var deals int
+	var size int64
+	for projID, ps := range projects {
+		deals += ps.NumDeals
+		size += ps.DataSize
+
+		var clientDeals int
+		var clientBytes int64
+		for _, cs := range ps.ClientStats {
+			clientDeals += cs.NumDeals
+			clientBytes += cs.DataSize
+		}
+		if clientDeals != ps.NumDeals || clientBytes != ps.DataSize {
+			return xerrors.Errorf("clients of project %s add up to %d deals of %d bytes, the project to %d deals of %d bytes", projID, clientDeals, clientBytes, ps.NumDeals, ps.DataSize)
+		}
+
+		listDeals, listBytes, err := validateDealList(outDirName, fmt.Sprintf(dealListFmt, projID), ts, ndjson)
+		if os.IsNotExist(err) && ps.NumDeals == 0 {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if listDeals != ps.NumDeals || listBytes != ps.DataSize {
+			return xerrors.Errorf("deal list of project %s holds %d deals of %d bytes, its stats count %d deals of %d bytes", projID, listDeals, listBytes, ps.NumDeals, ps.DataSize)
+		}
+	}
+	if deals != basic.TotalDeals || size != basic.TotalBytes {
+		return xerrors.Errorf("projects add up to %d deals of %d bytes, basic_stats.json to %d deals of %d bytes", deals, size, basic.TotalDeals, basic.TotalBytes)
+	}
+
+	log.Infof("validated the outputs of %d projects", len(projects))
+	return nil
+}
+
+// Decodes raw into v, refusing fields v does not have, and checks its envelope
+func validateDocument(name string, raw []byte, endpoint string, ts rollupTipSet, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return xerrors.Errorf("%s does not match its schema: %w", name, err)
+	}
+
+	var env outputEnvelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return xerrors.Errorf("decoding the envelope of %s: %w", name, err)
+	}
+	switch {
+	case env.Endpoint != endpoint:
+		return xerrors.Errorf("%s has endpoint %s, expected %s", name, env.Endpoint, endpoint)
+	case env.Epoch != int64(ts.Height()) || types.NewTipSetKey(env.TipSetKey...) != ts.Key():
+		return xerrors.Errorf("%s is at epoch %d, tipset %s instead of the rollup tipset", name, env.Epoch, tipSetKeyArg(env.TipSetKey))
+	case env.SchemaVersion != outputSchemaVersion:
+		return xerrors.Errorf("%s has schema version %s, expected %s", name, env.SchemaVersion, outputSchemaVersion)
+	}
+	return nil
+}
+
+// Returns the number and total size of the qualifying, non-pending deals of a list
+func validateDealList(outDirName, baseName string, ts rollupTipSet, ndjson bool) (int, int64, error) {
+	var dl []*individualDeal
+	if ndjson {
+		fh, err := os.Open(filepath.Join(outDirName, baseName+".ndjson"))
+		if err != nil {
+			return 0, 0, err
+		}
+		defer fh.Close() //nolint:errcheck
+		dec := json.NewDecoder(bufio.NewReader(fh))
+		dec.DisallowUnknownFields()
+		for {
+			d := new(individualDeal)
+			if err := dec.Decode(d); err == io.EOF {
+				break
+			} else if err != nil {
+				return 0, 0, xerrors.Errorf("%s does not match its schema: %w", baseName+".ndjson", err)
+			}
+			dl = append(dl, d)
+		}
+	} else {
+		raw, err := ioutil.ReadFile(filepath.Join(outDirName, baseName+".json"))
+		if err != nil {
+			return 0, 0, err
+		}
+		var out dealListOutput
+		if err := validateDocument(baseName+".json", raw, "DEAL_LIST", ts, &out); err != nil {
+			return 0, 0, err
+		}
+		dl = out.Payload
+	}
+
+	var n int
+	var size int64
+	for _, d := range dl {
+		if !d.Pending {
+			n++
+			size += d.PaddedSize
+		}
+	}
+	return n, size, nil
+}
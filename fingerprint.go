@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+const runFingerprintName = "run_fingerprint.json"
+
+// Everything that determines the contents of a rollup: identical fingerprints mean
+// identical outputs, so a finished run with the same digest does not need redoing
+type runFingerprint struct {
+	Digest    string                 `json:"digest"`
+	TipSetKey []cid.Cid              `json:"tipset_key"`
+	Inputs    map[string]string      `json:"inputs"` // saved input copy => sha256
+	Rules     map[string]interface{} `json:"rules"`
+}
+
+func newRunFingerprint(cctx *cli.Context, outDirName string, ts rollupTipSet) (*runFingerprint, error) {
+	fp := &runFingerprint{
+		TipSetKey: ts.Cids(),
+		Inputs:    make(map[string]string),
+		Rules: map[string]interface{}{
+			"phase_start_epoch":          int64(currentPhaseStart),
+			"phase_end_epoch":            int64(currentPhaseEnd),
+			"phase_boundaries":           cctx.Int64Slice("phase-boundaries"),
+			"recovery_start_epoch":       int64(recoveryStart),
+			"include_pending":            cctx.Bool("include-pending"),
+			"recovery_min_duration_days": cctx.Int64("recovery-min-duration-days"),
+			"min_deal_duration_days":     minQualifyingDealDurationDays,
+			"max_deals_per_piece":        maxQualifyingDealsPerPiece,
+			"only_providers":             cctx.StringSlice("only-provider"),
+			"excluded_providers":         cctx.StringSlice("exclude-provider"),
+			"piece_cap_per_provider":     pieceCapPerProvider,
+			"network":                    cctx.String("network"),
+			"repair_clients":             cctx.StringSlice("repair-client"),
+			"estuary_api":                cctx.String("estuary-api"),
+			"recovery_excluded":          cctx.Bool("exclude-recoveries-from-competition"),
+			"state_db":                   cctx.String("state-db"),
+			"sqlite":                     cctx.String("sqlite"),
+			"bigquery_dataset":           cctx.String("bigquery-dataset"),
+			"prometheus_textfile":        cctx.String("prometheus-textfile"),
+			"sign_key":                   cctx.String("sign-key"),
+			"fault_history":              cctx.Bool("fault-history"),
+			"geoip_db":                   cctx.String("geoip-db"),
+			"miner_power":                cctx.Bool("miner-power"),
+			"datacap":                    cctx.Bool("datacap"),
+			"terminated_deals":           cctx.Bool("terminated-deals"),
+			"exclusions":                 cctx.Bool("exclusions"),
+			"previous":                   cctx.String("previous"),
+			"resolver":                   cctx.StringSlice("resolver"),
+			"burst_window_days":          cctx.Int("burst-window-days"),
+			"burst_share":                cctx.Float64("burst-share"),
+			"burst_min_size":             cctx.String("burst-min-size"),
+			"expiry_horizon_days":        cctx.IntSlice("expiry-horizon-days"),
+			"deals_snapshot":             cctx.String("deals-snapshot") != "",
+			"lily":                       cctx.String("lily") != "",
+			"final":                      cctx.Bool("final"),
+			"deal_economics":             cctx.Bool("deal-economics"),
+			"registration_fields":        cctx.StringSlice("registration-field"),
+			"by_miner":                   cctx.Bool("by-miner"),
+			"cid_index":                  cctx.Bool("cid-index"),
+			"cid_v1":                     cctx.Bool("cid-v1"),
+			"cid_multibase":              cctx.String("cid-multibase"),
+			"cid_original":               cctx.Bool("cid-original"),
+			"deal_list_name":             cctx.String("deal-list-name"),
+		},
+	}
+
+	var formats []string
+	for _, f := range cctx.StringSlice("format") {
+		formats = append(formats, strings.Split(f, ",")...)
+	}
+	sort.Strings(formats)
+	fp.Rules["formats"] = formats
+
+	for _, inputName := range []string{"client_list.json", "restore_client_list.json", "rollup_config.json", "provider_probes.json", "phase_schedule.json", "phase_schedule.yaml", exclusionListSavedName} {
+		sum, err := sha256File(filepath.Join(outDirName, inputName))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		fp.Inputs[inputName] = sum
+	}
+
+	// map keys are marshaled sorted, making this stable
+	canon, err := json.Marshal(fp)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(canon)
+	fp.Digest = hex.EncodeToString(digest[:])
+
+	return fp, nil
+}
+
+// Looks through the siblings of outDirName for a completed run with the same digest
+func findIdenticalRun(outDirName string, fp *runFingerprint) (string, error) {
+	root := filepath.Dir(filepath.Clean(outDirName))
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		candidate := filepath.Join(root, e.Name())
+		if !e.IsDir() || candidate == filepath.Clean(outDirName) {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(candidate, runFingerprintName))
+		if err != nil {
+			continue
+		}
+		var other runFingerprint
+		if err := json.Unmarshal(raw, &other); err != nil {
+			log.Warnf("ignoring unparseable %s in %s: %s", runFingerprintName, candidate, err)
+			continue
+		}
+
+		if other.Digest == fp.Digest {
+			return candidate, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Written last, so that only complete runs are ever considered identical
+func writeRunFingerprint(outDirName string, fp *runFingerprint) error {
+	fh, err := os.Create(filepath.Join(outDirName, runFingerprintName))
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	if err := json.NewEncoder(fh).Encode(fp); err != nil {
+		return xerrors.Errorf("writing %s: %w", runFingerprintName, err)
+	}
+	return nil
+}
+
+func sha256File(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Obtains OAuth2 access tokens for Google Cloud APIs, either from a service account
+// key file (signing the JWT bearer assertion ourselves), or from the metadata server
+// when running on GCP without a key file
+type gcpTokenSource struct {
+	scope string
+	key   *gcpServiceAccountKey
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type gcpServiceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	rsaKey *rsa.PrivateKey
+}
+
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// An empty credentialsFile falls back to the metadata server
+func newGCPTokenSource(credentialsFile, scope string) (*gcpTokenSource, error) {
+	ts := &gcpTokenSource{scope: scope}
+	if credentialsFile == "" {
+		return ts, nil
+	}
+
+	raw, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	key := new(gcpServiceAccountKey)
+	if err := json.Unmarshal(raw, key); err != nil {
+		return nil, xerrors.Errorf("parsing service account key %s: %w", credentialsFile, err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, xerrors.Errorf("no PEM private key in service account key %s", credentialsFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, xerrors.Errorf("parsing private key of %s: %w", credentialsFile, err)
+	}
+	var isRSA bool
+	if key.rsaKey, isRSA = parsed.(*rsa.PrivateKey); !isRSA {
+		return nil, xerrors.Errorf("private key of %s is not an RSA key", credentialsFile)
+	}
+
+	ts.key = key
+	return ts, nil
+}
+
+// Returns a cached token while it has at least a minute left
+func (ts *gcpTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Until(ts.expiry) > time.Minute {
+		return ts.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if ts.key == nil {
+		req, err = http.NewRequestWithContext(ctx, "GET", gcpMetadataTokenURL+"?scopes="+url.QueryEscape(ts.scope), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		assertion, err := ts.key.signedAssertion(ts.scope)
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		req, err = http.NewRequestWithContext(ctx, "POST", ts.key.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", xerrors.Errorf("requesting access token: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", xerrors.Errorf("requesting access token: non-200 response %d: %s", resp.StatusCode, body)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return "", xerrors.Errorf("parsing access token response: %w", err)
+	}
+
+	ts.token = tok.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+func (k *gcpServiceAccountKey) signedAssertion(scope string) (string, error) {
+	now := time.Now()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": k.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   k.ClientEmail,
+		"scope": scope,
+		"aud":   k.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
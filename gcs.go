@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	gcsScope     = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsUploadURL = "https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=multipart"
+)
+
+// Uploads through the JSON API's multipart upload, authenticating like the BigQuery
+// sink does. Each object is created in a single request, which GCS applies atomically.
+type gcsUploader struct {
+	bucket string
+	auth   *gcpTokenSource
+}
+
+func newGCSUploader(bucket, credentialsFile string) (*gcsUploader, error) {
+	auth, err := newGCPTokenSource(credentialsFile, gcsScope)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsUploader{bucket: bucket, auth: auth}, nil
+}
+
+func (g *gcsUploader) put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType string) error {
+	token, err := g.auth.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	meta := map[string]string{
+		"name":        key,
+		"contentType": contentType,
+	}
+	// publicly readable objects are cached for an hour by default, which would keep
+	// serving a stale pointer
+	if path.Base(key) == latestPointerName {
+		meta["cacheControl"] = "no-cache, max-age=0"
+	}
+	rawMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	const boundary = "slingshot-stats-upload-boundary"
+	head := fmt.Sprintf(
+		"--%s\r\nContent-Type: application/json; charset=UTF-8\r\n\r\n%s\r\n--%s\r\nContent-Type: %s\r\n\r\n",
+		boundary, rawMeta, boundary, contentType,
+	)
+	tail := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf(gcsUploadURL, url.PathEscape(g.bucket)),
+		ioutil.NopCloser(io.MultiReader(strings.NewReader(head), body, strings.NewReader(tail))),
+	)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(head)) + size + int64(len(tail))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "multipart/related; boundary="+boundary)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return xerrors.Errorf("uploading gs://%s/%s: non-2xx response %d: %s", g.bucket, key, resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-cid"
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/xerrors"
+)
+
+type geoDistributionOutput struct {
+	Epoch         int64              `json:"epoch"`
+	TipSetKey     []cid.Cid          `json:"tipset_key"`
+	Endpoint      string             `json:"endpoint"`
+	Phase         int                `json:"phase,omitempty"`
+	SchemaVersion string             `json:"schema_version"`
+	Payload       []*geoCountryStats `json:"payload"`
+}
+
+// Qualifying deals by the country their provider announces itself from. Providers
+// that could not be located are gathered under an empty country.
+type geoCountryStats struct {
+	Country      string            `json:"country"` // ISO 3166-1 alpha-2
+	DataSize     int64             `json:"total_data_size"`
+	DataShare    float64           `json:"data_share"` // of all qualifying data, between 0 and 1
+	NumDeals     int               `json:"total_num_deals"`
+	NumProviders int               `json:"total_num_providers"`
+	Regions      []*geoRegionStats `json:"regions"` // most data first
+}
+
+type geoRegionStats struct {
+	Country      string  `json:"country"`
+	Region       string  `json:"region"` // "" when the database only resolves countries
+	DataSize     int64   `json:"total_data_size"`
+	DataShare    float64 `json:"data_share"`
+	NumDeals     int     `json:"total_num_deals"`
+	NumProviders int     `json:"total_num_providers"`
+}
+
+// An IP range to location database, loaded from the CSV files DB-IP publishes under
+// CC BY 4.0: either the country edition (ip_start,ip_end,country) or the city one
+// (ip_start,ip_end,continent,country,stateprov,city,...), optionally gzipped. IPv4
+// ranges are held in their IPv6-mapped form, so a single sorted list covers both.
+// The database is not bundled, as DB-IP republishes it monthly: see the README.
+type geoIPDatabase struct {
+	ranges []geoIPRange
+}
+
+type geoIPRange struct {
+	start, end [16]byte
+	country    string
+	region     string
+}
+
+func loadGeoIPDatabase(ctx context.Context, name string) (*geoIPDatabase, error) {
+	src, err := openSource(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close() //nolint:errcheck
+
+	var r io.Reader = src
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to decompress GeoIP database %s: %w", name, err)
+		}
+		defer gz.Close() //nolint:errcheck
+		r = gz
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	db := new(geoIPDatabase)
+	interned := make(map[string]string)
+	intern := func(s string) string {
+		if i, seen := interned[s]; seen {
+			return i
+		}
+		interned[s] = s
+		return s
+	}
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, xerrors.Errorf("failed to parse GeoIP database %s: %w", name, err)
+		}
+
+		var rng geoIPRange
+		switch {
+		case len(rec) == 3:
+			rng.country = intern(rec[2])
+		case len(rec) >= 6:
+			rng.country, rng.region = intern(rec[3]), intern(rec[4])
+		default:
+			return nil, xerrors.Errorf("line %d of GeoIP database %s has %d fields, neither a country nor a city edition", line, name, len(rec))
+		}
+		start, end := net.ParseIP(rec[0]), net.ParseIP(rec[1])
+		if start == nil || end == nil {
+			return nil, xerrors.Errorf("line %d of GeoIP database %s has an invalid range '%s'-'%s'", line, name, rec[0], rec[1])
+		}
+		copy(rng.start[:], start.To16())
+		copy(rng.end[:], end.To16())
+		db.ranges = append(db.ranges, rng)
+	}
+	if len(db.ranges) == 0 {
+		return nil, xerrors.Errorf("GeoIP database %s is empty", name)
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start[:], db.ranges[j].start[:]) < 0
+	})
+	return db, nil
+}
+
+// The country and region of ip, found false when no range covers it
+func (db *geoIPDatabase) lookup(ip net.IP) (country, region string, found bool) {
+	var key [16]byte
+	copy(key[:], ip.To16())
+
+	// the last range starting at or before ip
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start[:], key[:]) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(db.ranges[i].end[:], key[:]) < 0 {
+		return "", "", false
+	}
+	return db.ranges[i].country, db.ranges[i].region, true
+}
+
+// Sets the country and region of every provider from the first of its addresses the
+// database resolves. The addresses announced on chain in the miner info are tried
+// first, then those the node knows from the provider's peer record. Host names are
+// resolved through DNS at the time of the run.
+func locateProviders(ctx context.Context, api api.FullNode, ts rollupTipSet, db *geoIPDatabase, providers []*providerStats, progress *progressReporter) error {
+	progress.start("locating_providers", len(providers))
+	for i, ps := range providers {
+		if err := progress.step(i); err != nil {
+			return err
+		}
+
+		provider, err := address.NewFromString(ps.ProviderID)
+		if err != nil {
+			return err
+		}
+		mi, err := api.StateMinerInfo(ctx, provider, ts.Key())
+		if err != nil {
+			return xerrors.Errorf("getting miner info of %s: %w", provider, err)
+		}
+
+		addrs := make([]ma.Multiaddr, 0, len(mi.Multiaddrs))
+		for _, raw := range mi.Multiaddrs {
+			if m, err := ma.NewMultiaddrBytes(raw); err == nil {
+				addrs = append(addrs, m)
+			}
+		}
+		located := locateAddrs(ctx, db, addrs, ps)
+		if !located && mi.PeerId != nil {
+			if ai, err := api.NetFindPeer(ctx, *mi.PeerId); err != nil {
+				log.Debugf("finding peer %s of %s failed: %s", mi.PeerId, provider, err)
+			} else {
+				located = locateAddrs(ctx, db, ai.Addrs, ps)
+			}
+		}
+		if !located {
+			log.Debugf("could not locate provider %s", provider)
+		}
+	}
+	return nil
+}
+
+func locateAddrs(ctx context.Context, db *geoIPDatabase, addrs []ma.Multiaddr, ps *providerStats) bool {
+	for _, m := range addrs {
+		for _, ip := range multiaddrIPs(ctx, m) {
+			if country, region, found := db.lookup(ip); found {
+				ps.Country, ps.Region = country, region
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The IPs a multiaddr leads to, resolving its host name if it starts with one
+func multiaddrIPs(ctx context.Context, m ma.Multiaddr) []net.IP {
+	first, _ := ma.SplitFirst(m)
+	if first == nil {
+		return nil
+	}
+
+	switch first.Protocol().Code {
+	case ma.P_IP4, ma.P_IP6:
+		if ip := net.ParseIP(first.Value()); ip != nil {
+			return []net.IP{ip}
+		}
+	case ma.P_DNS, ma.P_DNS4, ma.P_DNS6:
+		resolved, err := net.DefaultResolver.LookupIPAddr(ctx, first.Value())
+		if err != nil {
+			log.Debugf("resolving %s failed: %s", first.Value(), err)
+			return nil
+		}
+		ret := make([]net.IP, 0, len(resolved))
+		for _, r := range resolved {
+			ret = append(ret, r.IP)
+		}
+		return ret
+	}
+	return nil
+}
+
+// Sums the providers up by country and region, most data first
+func newGeoDistribution(providers []*providerStats) []*geoCountryStats {
+	var total int64
+	byCountry := make(map[string]*geoCountryStats)
+	byRegion := make(map[[2]string]*geoRegionStats)
+	for _, ps := range providers {
+		total += ps.DataSize
+
+		cs, ok := byCountry[ps.Country]
+		if !ok {
+			cs = &geoCountryStats{Country: ps.Country}
+			byCountry[ps.Country] = cs
+		}
+		cs.DataSize += ps.DataSize
+		cs.NumDeals += ps.NumDeals
+		cs.NumProviders++
+
+		key := [2]string{ps.Country, ps.Region}
+		rs, ok := byRegion[key]
+		if !ok {
+			rs = &geoRegionStats{Country: ps.Country, Region: ps.Region}
+			byRegion[key] = rs
+			cs.Regions = append(cs.Regions, rs)
+		}
+		rs.DataSize += ps.DataSize
+		rs.NumDeals += ps.NumDeals
+		rs.NumProviders++
+	}
+
+	ret := make([]*geoCountryStats, 0, len(byCountry))
+	for _, cs := range byCountry {
+		for _, rs := range cs.Regions {
+			if total > 0 {
+				rs.DataShare = float64(rs.DataSize) / float64(total)
+			}
+		}
+		sort.Slice(cs.Regions, func(i, j int) bool {
+			if cs.Regions[i].DataSize != cs.Regions[j].DataSize {
+				return cs.Regions[i].DataSize > cs.Regions[j].DataSize
+			}
+			return cs.Regions[i].Region < cs.Regions[j].Region
+		})
+		if total > 0 {
+			cs.DataShare = float64(cs.DataSize) / float64(total)
+		}
+		ret = append(ret, cs)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].DataSize != ret[j].DataSize {
+			return ret[i].DataSize > ret[j].DataSize
+		}
+		return ret[i].Country < ret[j].Country
+	})
+	return ret
+}
+
+func writeGeoDistributionCSV(path string, epoch int64, gl []*geoCountryStats) error {
+	var rows [][]string
+	for _, c := range gl {
+		for _, r := range c.Regions {
+			rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(r))...))
+		}
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(geoRegionStats{}))...), rows)
+}
@@ -0,0 +1,1081 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Just enough of GraphQL to answer read-only queries over in-memory Go values:
+// operations with variables, aliases, arguments, named and inline fragments and the
+// @include/@skip directives. There are no mutations or subscriptions, and the only
+// introspection is __typename: the schema itself is published as SDL instead.
+//
+// Object types are Go structs. Their fields are those of the struct under their JSON
+// names, so that a query selects from the same names as the JSON documents, plus
+// resolved fields computed on demand and taking arguments. Resolvers are passed the
+// query root along with the object resolved on.
+//
+// Queries come from anyone able to reach the endpoint, so their cost is bounded: by
+// how deep they descend into objects, fragments included, and by how many fields
+// they resolve, where a field selected on a list counts once per element.
+
+const (
+	gqlMaxParseDepth   = 32 // nesting of selection sets and literals, bounding the parser's recursion
+	gqlDefaultMaxDepth = 12
+	gqlDefaultMaxCost  = 500000
+)
+
+type gqlSchema struct {
+	query *gqlType
+	types map[reflect.Type]*gqlType
+	order []*gqlType
+
+	maxDepth int // levels of objects below the query type
+	maxCost  int // fields resolved
+}
+
+type gqlType struct {
+	name   string
+	doc    string
+	fields map[string]*gqlField
+	order  []string
+}
+
+type gqlField struct {
+	name    string
+	typ     string // in SDL notation, e.g. [Deal!]!
+	doc     string
+	args    []gqlArg
+	index   []int // of the struct field holding the value
+	resolve func(root, parent interface{}, args map[string]interface{}) (interface{}, error)
+}
+
+type gqlArg struct {
+	name string
+	typ  string // String, Int or Boolean, with a trailing ! when required
+}
+
+func newGQLSchema() *gqlSchema {
+	return &gqlSchema{
+		types:    make(map[reflect.Type]*gqlType),
+		maxDepth: gqlDefaultMaxDepth,
+		maxCost:  gqlDefaultMaxCost,
+	}
+}
+
+// Registers the struct type of sample as an object type. Struct fields whose type is
+// registered already become nested objects, anything else not mapping onto a GraphQL
+// scalar is passed through as JSON. Resolved fields replace struct fields of the same
+// name.
+func (s *gqlSchema) addType(name, doc string, sample interface{}, resolved ...*gqlField) *gqlType {
+	st := reflect.TypeOf(sample)
+	for st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+
+	t := &gqlType{name: name, doc: doc, fields: make(map[string]*gqlField)}
+	add := func(f *gqlField) {
+		if _, dup := t.fields[f.name]; !dup {
+			t.order = append(t.order, f.name)
+		}
+		t.fields[f.name] = f
+	}
+
+	for i := 0; i < st.NumField(); i++ {
+		sf := st.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		fname := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if fname == "-" {
+			continue
+		}
+		if fname == "" {
+			fname = sf.Name
+		}
+		add(&gqlField{name: fname, typ: s.sdlType(sf.Type, true), index: sf.Index})
+	}
+	for _, f := range resolved {
+		add(f)
+	}
+
+	s.types[st] = t
+	s.order = append(s.order, t)
+	return t
+}
+
+func (s *gqlSchema) sdlType(t reflect.Type, nonNull bool) string {
+	bang := ""
+	if nonNull {
+		bang = "!"
+	}
+
+	if t.Kind() == reflect.Ptr {
+		return s.sdlType(t.Elem(), false)
+	}
+	if ot, isObject := s.types[t]; isObject {
+		return ot.name + bang
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "String" + bang
+	case reflect.Bool:
+		return "Boolean" + bang
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int, reflect.Uint8, reflect.Uint16:
+		return "Int" + bang
+	case reflect.Int64, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		return "Int64" + bang
+	case reflect.Float32, reflect.Float64:
+		return "Float" + bang
+	case reflect.Slice:
+		if elem := t.Elem(); elem.Kind() != reflect.Uint8 {
+			// nil slices encode as null, their elements are never nil
+			for elem.Kind() == reflect.Ptr {
+				elem = elem.Elem()
+			}
+			return "[" + s.sdlType(elem, true) + "]"
+		}
+	}
+	return "JSON"
+}
+
+// The object type values of t are completed as, if any
+func (s *gqlSchema) objectType(t reflect.Type) *gqlType {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return s.types[t]
+}
+
+// The schema in SDL, for client tooling
+func (s *gqlSchema) sdl() string {
+	var b strings.Builder
+	b.WriteString("\"64 bit integer, too wide for Int\"\nscalar Int64\n\n\"Arbitrary JSON value\"\nscalar JSON\n\nschema {\n  query: " + s.query.name + "\n}\n")
+	for _, t := range s.order {
+		b.WriteString("\n")
+		if t.doc != "" {
+			fmt.Fprintf(&b, "%q\n", t.doc)
+		}
+		fmt.Fprintf(&b, "type %s {\n", t.name)
+		for _, name := range t.order {
+			f := t.fields[name]
+			if f.doc != "" {
+				fmt.Fprintf(&b, "  %q\n", f.doc)
+			}
+			args := make([]string, len(f.args))
+			for i, a := range f.args {
+				args[i] = a.name + ": " + a.typ
+			}
+			if len(args) > 0 {
+				fmt.Fprintf(&b, "  %s(%s): %s\n", f.name, strings.Join(args, ", "), f.typ)
+			} else {
+				fmt.Fprintf(&b, "  %s: %s\n", f.name, f.typ)
+			}
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+type gqlResponse struct {
+	Data   *gqlResult `json:"data"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Object results keep the order fields were selected in, as the spec asks for
+type gqlResult struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+func (r *gqlResult) MarshalJSON() ([]byte, error) {
+	b := []byte{'{'}
+	for i, k := range r.keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, k)
+		b = append(b, ':')
+		v, err := json.Marshal(r.vals[k])
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, v...)
+	}
+	return append(b, '}'), nil
+}
+
+// Runs a query against root, an instance of the query type. Any error aborts the
+// whole query: all data is in memory, so resolvers only fail on invalid requests.
+func (s *gqlSchema) execute(root interface{}, query, operationName string, variables map[string]interface{}) *gqlResponse {
+	fail := func(err error) *gqlResponse {
+		ge := gqlError{Message: err.Error()}
+		var pe *gqlPathError
+		if xerrors.As(err, &pe) {
+			ge = gqlError{Message: pe.msg, Path: pe.path}
+		}
+		return &gqlResponse{Errors: []gqlError{ge}}
+	}
+
+	doc, err := parseGQLDocument(query)
+	if err != nil {
+		return fail(err)
+	}
+
+	var op *gqlOperation
+	for _, o := range doc.operations {
+		if operationName == "" || o.name == operationName {
+			if op != nil {
+				return fail(xerrors.New("document holds several operations: operationName is required"))
+			}
+			op = o
+		}
+	}
+	if op == nil {
+		return fail(xerrors.Errorf("operation '%s' not found", operationName))
+	}
+
+	ex := &gqlExec{schema: s, root: root, fragments: doc.fragments, vars: make(map[string]interface{})}
+	for _, vd := range op.vars {
+		v, given := variables[vd.name]
+		switch {
+		case given:
+			ex.vars[vd.name] = v
+		case vd.def != nil:
+			ex.vars[vd.name] = vd.def
+		case strings.HasSuffix(vd.typ, "!"):
+			return fail(xerrors.Errorf("variable $%s of required type %s was not provided", vd.name, vd.typ))
+		}
+	}
+	ex.declared = op.vars
+
+	data, err := ex.object(s.query, root, op.sel, nil)
+	if err != nil {
+		return fail(err)
+	}
+	return &gqlResponse{Data: data}
+}
+
+type gqlPathError struct {
+	msg  string
+	path []interface{}
+}
+
+func (e *gqlPathError) Error() string { return e.msg }
+
+type gqlExec struct {
+	schema    *gqlSchema
+	root      interface{}
+	fragments map[string]*gqlFragment
+	declared  []gqlVarDef
+	vars      map[string]interface{}
+	cost      int
+}
+
+func (ex *gqlExec) errorf(path []interface{}, format string, a ...interface{}) error {
+	return &gqlPathError{msg: fmt.Sprintf(format, a...), path: append([]interface{}(nil), path...)}
+}
+
+func (ex *gqlExec) object(t *gqlType, v interface{}, sel []*gqlSelection, path []interface{}) (*gqlResult, error) {
+	depth := 0
+	for _, p := range path {
+		if _, isKey := p.(string); isKey {
+			depth++
+		}
+	}
+	if depth > ex.schema.maxDepth {
+		return nil, ex.errorf(path, "query descends deeper than %d levels", ex.schema.maxDepth)
+	}
+
+	fields, err := ex.collect(t, sel, nil, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &gqlResult{vals: make(map[string]interface{}, len(fields))}
+	for _, f := range fields {
+		key := f.responseKey()
+		fpath := append(path, key) //nolint:gocritic
+
+		if f.name == "__typename" {
+			res.keys = append(res.keys, key)
+			res.vals[key] = t.name
+			continue
+		}
+
+		def, known := t.fields[f.name]
+		if !known {
+			return nil, ex.errorf(fpath, "cannot query field '%s' on type %s", f.name, t.name)
+		}
+		args, err := ex.arguments(def, f, fpath)
+		if err != nil {
+			return nil, err
+		}
+
+		var val interface{}
+		if def.resolve != nil {
+			if val, err = def.resolve(ex.root, v, args); err != nil {
+				return nil, ex.errorf(fpath, "%s", err)
+			}
+		} else {
+			val = reflect.Indirect(reflect.ValueOf(v)).FieldByIndex(def.index).Interface()
+		}
+
+		if res.vals[key], err = ex.complete(val, f.sub, fpath); err != nil {
+			return nil, err
+		}
+		res.keys = append(res.keys, key)
+	}
+	return res, nil
+}
+
+func (ex *gqlExec) complete(v interface{}, sub []*gqlSelection, path []interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return nil, nil
+	}
+
+	if ot := ex.schema.objectType(rv.Type()); ot != nil {
+		if len(sub) == 0 {
+			return nil, ex.errorf(path, "field of type %s must have a selection of subfields", ot.name)
+		}
+		return ex.object(ot, v, sub, path)
+	}
+
+	if rv.Kind() == reflect.Slice && ex.schema.objectType(rv.Type().Elem()) != nil {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			var err error
+			if list[i], err = ex.complete(rv.Index(i).Interface(), sub, append(path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+
+	if len(sub) > 0 {
+		return nil, ex.errorf(path, "field of scalar type has no subfields to select")
+	}
+	return v, nil
+}
+
+// Flattens fragments and directives into the fields to resolve, merging the
+// subselections of fields selected more than once under the same response key
+func (ex *gqlExec) collect(t *gqlType, sel []*gqlSelection, fields []*gqlSelection, visiting map[string]bool) ([]*gqlSelection, error) {
+	for _, s := range sel {
+		include, err := ex.included(s)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+
+		switch {
+		case s.spread != "":
+			frag, known := ex.fragments[s.spread]
+			if !known {
+				return nil, xerrors.Errorf("unknown fragment '%s'", s.spread)
+			}
+			if visiting[s.spread] {
+				return nil, xerrors.Errorf("fragment '%s' spreads itself", s.spread)
+			}
+			if frag.on != t.name {
+				continue
+			}
+			visiting[s.spread] = true
+			if fields, err = ex.collect(t, frag.sel, fields, visiting); err != nil {
+				return nil, err
+			}
+			delete(visiting, s.spread)
+
+		case s.inline:
+			if s.on != "" && s.on != t.name {
+				continue
+			}
+			if fields, err = ex.collect(t, s.sub, fields, visiting); err != nil {
+				return nil, err
+			}
+
+		default:
+			if ex.cost++; ex.cost > ex.schema.maxCost {
+				return nil, xerrors.Errorf("query resolves more than %d fields: select fewer, or page through lists with first and offset", ex.schema.maxCost)
+			}
+			merged := false
+			for i, f := range fields {
+				if f.responseKey() != s.responseKey() {
+					continue
+				}
+				if f.name != s.name {
+					return nil, xerrors.Errorf("fields '%s' and '%s' conflict under the response key '%s'", f.name, s.name, s.responseKey())
+				}
+				cp := *f
+				cp.sub = append(append([]*gqlSelection(nil), f.sub...), s.sub...)
+				fields[i] = &cp
+				merged = true
+				break
+			}
+			if !merged {
+				fields = append(fields, s)
+			}
+		}
+	}
+	return fields, nil
+}
+
+func (ex *gqlExec) included(s *gqlSelection) (bool, error) {
+	for _, d := range s.directives {
+		if d.name != "include" && d.name != "skip" {
+			continue
+		}
+		v, err := ex.value(d.args["if"])
+		if err != nil {
+			return false, err
+		}
+		cond, isBool := v.(bool)
+		if !isBool {
+			return false, xerrors.Errorf("@%s requires a Boolean if argument", d.name)
+		}
+		if cond == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (ex *gqlExec) arguments(def *gqlField, f *gqlSelection, path []interface{}) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(def.args))
+	for name := range f.args {
+		found := false
+		for _, a := range def.args {
+			found = found || a.name == name
+		}
+		if !found {
+			return nil, ex.errorf(path, "unknown argument '%s' of field '%s'", name, def.name)
+		}
+	}
+
+	for _, a := range def.args {
+		lit, given := f.args[a.name]
+		var v interface{}
+		if given {
+			var err error
+			if v, err = ex.value(lit); err != nil {
+				return nil, ex.errorf(path, "%s", err)
+			}
+		}
+		if v == nil {
+			if strings.HasSuffix(a.typ, "!") {
+				return nil, ex.errorf(path, "argument '%s' of type %s is required", a.name, a.typ)
+			}
+			continue
+		}
+
+		coerced, err := coerceGQLArg(strings.TrimSuffix(a.typ, "!"), v)
+		if err != nil {
+			return nil, ex.errorf(path, "argument '%s': %s", a.name, err)
+		}
+		args[a.name] = coerced
+	}
+	return args, nil
+}
+
+// Substitutes variables within a literal
+func (ex *gqlExec) value(lit interface{}) (interface{}, error) {
+	switch l := lit.(type) {
+	case gqlVariable:
+		declared := false
+		for _, vd := range ex.declared {
+			declared = declared || vd.name == string(l)
+		}
+		if !declared {
+			return nil, xerrors.Errorf("variable $%s is not defined by the operation", string(l))
+		}
+		return ex.vars[string(l)], nil
+	case []interface{}:
+		out := make([]interface{}, len(l))
+		for i, e := range l {
+			var err error
+			if out[i], err = ex.value(e); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(l))
+		for k, e := range l {
+			var err error
+			if out[k], err = ex.value(e); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return lit, nil
+}
+
+func coerceGQLArg(typ string, v interface{}) (interface{}, error) {
+	switch typ {
+	case "String":
+		if s, isString := v.(string); isString {
+			return s, nil
+		}
+	case "Boolean":
+		if b, isBool := v.(bool); isBool {
+			return b, nil
+		}
+	case "Int":
+		switch n := v.(type) {
+		case int64:
+			return n, nil
+		case float64: // from JSON variables
+			if n == float64(int64(n)) {
+				return int64(n), nil
+			}
+		}
+	}
+	return nil, xerrors.Errorf("expected a value of type %s, got %v", typ, v)
+}
+
+//
+// The query document
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	name string
+	vars []gqlVarDef
+	sel  []*gqlSelection
+}
+
+type gqlVarDef struct {
+	name string
+	typ  string
+	def  interface{}
+}
+
+type gqlFragment struct {
+	on  string
+	sel []*gqlSelection
+}
+
+// A field, a fragment spread (spread set) or an inline fragment (inline set)
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	directives []gqlDirective
+	sub        []*gqlSelection
+
+	spread string
+	inline bool
+	on     string
+}
+
+func (s *gqlSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+// Literals are parsed to string, int64, float64, bool, nil, []interface{} and
+// map[string]interface{}, enum values to strings
+type gqlVariable string
+
+type gqlToken struct {
+	kind byte // 'p'unctuator, 'n'ame, 'i'nt, 'f'loat, 's'tring, or 0 at the end
+	val  string
+	pos  int
+}
+
+func lexGQL(src string) ([]gqlToken, error) {
+	var toks []gqlToken
+	src = strings.TrimPrefix(src, "\ufeff")
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+
+		case strings.HasPrefix(src[i:], "..."):
+			toks = append(toks, gqlToken{'p', "...", i})
+			i += 3
+
+		case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+			toks = append(toks, gqlToken{'p', string(c), i})
+			i++
+
+		case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || (src[j]|0x20 >= 'a' && src[j]|0x20 <= 'z') || (src[j] >= '0' && src[j] <= '9')) {
+				j++
+			}
+			toks = append(toks, gqlToken{'n', src[i:j], i})
+			i = j
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			j, kind := i+1, byte('i')
+			for j < len(src) && strings.IndexByte("0123456789.eE+-", src[j]) >= 0 {
+				if strings.IndexByte(".eE", src[j]) >= 0 {
+					kind = 'f'
+				}
+				j++
+			}
+			toks = append(toks, gqlToken{kind, src[i:j], i})
+			i = j
+
+		case c == '"':
+			if strings.HasPrefix(src[i:], `"""`) {
+				return nil, xerrors.Errorf("block strings are not supported (at offset %d)", i)
+			}
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, xerrors.Errorf("unterminated string at offset %d", i)
+			}
+			var s string
+			if err := json.Unmarshal([]byte(src[i:j+1]), &s); err != nil {
+				return nil, xerrors.Errorf("invalid string at offset %d: %w", i, err)
+			}
+			toks = append(toks, gqlToken{'s', s, i})
+			i = j + 1
+
+		default:
+			return nil, xerrors.Errorf("unexpected character %q at offset %d", c, i)
+		}
+	}
+
+	return append(toks, gqlToken{pos: len(src)}), nil
+}
+
+type gqlParser struct {
+	toks  []gqlToken
+	pos   int
+	depth int
+}
+
+func parseGQLDocument(src string) (*gqlDocument, error) {
+	toks, err := lexGQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+
+	for p.peek().kind != 0 {
+		if p.peek().kind == 'p' && p.peek().val == "{" {
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{sel: sel})
+			continue
+		}
+
+		keyword, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		switch keyword {
+		case "query":
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+
+		case "fragment":
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if on, err := p.name(); err != nil || on != "on" {
+				return nil, p.errorf("expected 'on' after fragment name")
+			}
+			frag := &gqlFragment{}
+			if frag.on, err = p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			if frag.sel, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, xerrors.Errorf("fragment '%s' defined more than once", name)
+			}
+			doc.fragments[name] = frag
+
+		case "mutation", "subscription":
+			return nil, xerrors.Errorf("%s operations are not supported: the rollup is read-only", keyword)
+
+		default:
+			return nil, p.errorf("unexpected '%s'", keyword)
+		}
+	}
+
+	if len(doc.operations) == 0 {
+		return nil, xerrors.New("document holds no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken { return p.toks[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	t := p.toks[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) errorf(format string, a ...interface{}) error {
+	return xerrors.Errorf("syntax error at offset %d: %s", p.peek().pos, fmt.Sprintf(format, a...))
+}
+
+// Entered by every selection set and list or object literal, with leave deferred
+func (p *gqlParser) enter() error {
+	if p.depth++; p.depth > gqlMaxParseDepth {
+		return p.errorf("nested deeper than %d levels", gqlMaxParseDepth)
+	}
+	return nil
+}
+
+func (p *gqlParser) leave() { p.depth-- }
+
+// Consumes the punctuator if it is next
+func (p *gqlParser) punct(s string) bool {
+	if t := p.peek(); t.kind == 'p' && t.val == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(s string) error {
+	if !p.punct(s) {
+		return p.errorf("expected '%s'", s)
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.peek().kind != 'n' {
+		return "", p.errorf("expected a name")
+	}
+	return p.next().val, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{}
+	if p.peek().kind == 'n' {
+		op.name = p.next().val
+	}
+
+	if p.punct("(") {
+		for !p.punct(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			var vd gqlVarDef
+			var err error
+			if vd.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if vd.typ, err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			if p.punct("=") {
+				if vd.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			op.vars = append(op.vars, vd)
+		}
+	}
+
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.sel, err = p.selectionSet()
+	return op, err
+}
+
+func (p *gqlParser) typeRef() (string, error) {
+	var typ string
+	if p.punct("[") {
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		var err error
+		if typ, err = p.name(); err != nil {
+			return "", err
+		}
+	}
+	if p.punct("!") {
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	var sel []*gqlSelection
+	for !p.punct("}") {
+		if p.peek().kind == 0 {
+			return nil, p.errorf("unterminated selection set")
+		}
+
+		s := &gqlSelection{}
+		var err error
+
+		if p.punct("...") {
+			if t := p.peek(); t.kind == 'n' && t.val != "on" {
+				s.spread = p.next().val
+				if s.directives, err = p.directives(); err != nil {
+					return nil, err
+				}
+				sel = append(sel, s)
+				continue
+			}
+
+			s.inline = true
+			if p.peek().kind == 'n' {
+				p.next()
+				if s.on, err = p.name(); err != nil {
+					return nil, err
+				}
+			}
+			if s.directives, err = p.directives(); err != nil {
+				return nil, err
+			}
+			if s.sub, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+			sel = append(sel, s)
+			continue
+		}
+
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if p.punct(":") {
+			s.alias = s.name
+			if s.name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if s.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t.kind == 'p' && t.val == "{" {
+			if s.sub, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		sel = append(sel, s)
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	if !p.punct("(") {
+		return args, nil
+	}
+	for !p.punct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if _, dup := args[name]; dup {
+			return nil, p.errorf("argument '%s' given more than once", name)
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var ds []gqlDirective
+	for p.punct("@") {
+		var d gqlDirective
+		var err error
+		if d.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if d.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// Variables are not allowed within constant values such as variable defaults
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case 'i':
+		n, err := strconv.ParseInt(t.val, 10, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid integer '%s' at offset %d", t.val, t.pos)
+		}
+		return n, nil
+	case 'f':
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid number '%s' at offset %d", t.val, t.pos)
+		}
+		return f, nil
+	case 's':
+		return t.val, nil
+	case 'n':
+		switch t.val {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return t.val, nil
+	case 'p':
+		switch t.val {
+		case "$":
+			if constant {
+				break
+			}
+			name, err := p.name()
+			return gqlVariable(name), err
+		case "[":
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			list := []interface{}{}
+			for !p.punct("]") {
+				if p.peek().kind == 0 {
+					return nil, p.errorf("unterminated list")
+				}
+				v, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, nil
+		case "{":
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			obj := map[string]interface{}{}
+			for !p.punct("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			return obj, nil
+		}
+	}
+	if t.kind != 0 {
+		p.pos--
+	}
+	return nil, p.errorf("expected a value")
+}
+
+// Applies first and offset arguments to a list of length n
+func gqlPage(n int, args map[string]interface{}) (lo, hi int, err error) {
+	lo, hi = 0, n
+	if off, given := args["offset"]; given {
+		if off.(int64) < 0 {
+			return 0, 0, xerrors.New("offset must not be negative")
+		}
+		if off.(int64) < int64(n) {
+			lo = int(off.(int64))
+		} else {
+			lo = n
+		}
+	}
+	if first, given := args["first"]; given {
+		if first.(int64) < 0 {
+			return 0, 0, xerrors.New("first must not be negative")
+		}
+		if first.(int64) < int64(hi-lo) {
+			hi = lo + int(first.(int64))
+		}
+	}
+	return lo, hi, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type gqlTestRoot struct {
+	Name  string          `json:"name"`
+	Items []*gqlTestItem  `json:"items"`
+	Child *gqlTestRoot    `json:"child"`
+	Tags  []string        `json:"tags"`
+	Extra json.RawMessage `json:"extra"`
+}
+
+type gqlTestItem struct {
+	ID   int64  `json:"id"`
+	Kind string `json:"kind"`
+}
+
+func newGQLTestSchema() *gqlSchema {
+	s := newGQLSchema()
+	s.addType("Item", "", &gqlTestItem{})
+	s.query = s.addType("Root", "", gqlTestRoot{}, &gqlField{
+		name: "item",
+		typ:  "Item",
+		args: []gqlArg{{"id", "Int!"}},
+		resolve: func(root, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			for _, it := range parent.(*gqlTestRoot).Items {
+				if it.ID == args["id"].(int64) {
+					return it, nil
+				}
+			}
+			return nil, nil
+		},
+	}, &gqlField{
+		name: "page",
+		typ:  "[Item!]!",
+		args: []gqlArg{{"first", "Int"}, {"offset", "Int"}},
+		resolve: func(root, parent interface{}, args map[string]interface{}) (interface{}, error) {
+			items := parent.(*gqlTestRoot).Items
+			lo, hi, err := gqlPage(len(items), args)
+			if err != nil {
+				return nil, err
+			}
+			return items[lo:hi], nil
+		},
+	})
+	return s
+}
+
+func gqlTestData() *gqlTestRoot {
+	return &gqlTestRoot{
+		Name:  "root",
+		Items: []*gqlTestItem{{1, "a"}, {2, "b"}, {3, "a"}},
+		Child: &gqlTestRoot{Name: "child"},
+		Tags:  []string{"x", "y"},
+		Extra: json.RawMessage(`{"k":1}`),
+	}
+}
+
+func TestParseGQLDocument(t *testing.T) {
+	for _, tc := range []struct {
+		name, src, err string
+	}{
+		{name: "shorthand", src: `{ name }`},
+		{name: "named with variables", src: `query Q($id: Int! = 2, $on: [Boolean!]) @dir { item(id: $id) { id } }`},
+		{name: "fragments", src: `query { ...F ... on Root { name } ... @include(if: true) { tags } } fragment F on Root { child { name } }`},
+		{name: "literals", src: `{ a(s: "q\"\u00e9", i: -3, f: 1.5e3, b: false, n: null, e: ENUM, l: [1 [2]], o: {k: {v: 1}}) }`},
+		{name: "comments and commas", src: "# leading\n{ name, tags # trailing\n}"},
+		{name: "byte order mark", src: "\ufeff{ name }"},
+		{name: "empty", src: ``, err: "holds no operation"},
+		{name: "mutation", src: `mutation { name }`, err: "read-only"},
+		{name: "unterminated selection", src: `{ name`, err: "unterminated selection set"},
+		{name: "unterminated string", src: `{ a(s: "x) }`, err: "unterminated string"},
+		{name: "block string", src: `{ a(s: """x""") }`, err: "block strings"},
+		{name: "bad character", src: `{ name % }`, err: "unexpected character"},
+		{name: "duplicate argument", src: `{ a(x: 1, x: 2) }`, err: "given more than once"},
+		{name: "duplicate fragment", src: `{ ...F } fragment F on Root { name } fragment F on Root { name }`, err: "defined more than once"},
+		{name: "variable in default", src: `query ($a: Int = $b) { name }`, err: "expected a value"},
+		{name: "missing fragment type", src: `fragment F { name } { name }`, err: "expected 'on'"},
+		{name: "deep selections", src: strings.Repeat("{ a ", gqlMaxParseDepth+1) + strings.Repeat("}", gqlMaxParseDepth+1), err: "nested deeper"},
+		{name: "deep literal", src: `{ a(l: ` + strings.Repeat("[", gqlMaxParseDepth) + strings.Repeat("]", gqlMaxParseDepth) + `) }`, err: "nested deeper"},
+	} {
+		_, err := parseGQLDocument(tc.src)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+		case tc.err != "" && err == nil:
+			t.Errorf("%s: expected an error containing '%s'", tc.name, tc.err)
+		case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+			t.Errorf("%s: expected an error containing '%s', got: %s", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestParseGQLSelections(t *testing.T) {
+	doc, err := parseGQLDocument(`query Q { first: item(id: 1) @skip(if: $s) { id } ...F }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := doc.operations[0]
+	if op.name != "Q" || len(op.sel) != 2 {
+		t.Fatalf("unexpected operation %+v", op)
+	}
+	f := op.sel[0]
+	if f.alias != "first" || f.name != "item" || f.responseKey() != "first" || f.args["id"] != int64(1) {
+		t.Errorf("unexpected field %+v", f)
+	}
+	if len(f.directives) != 1 || f.directives[0].name != "skip" || f.directives[0].args["if"] != gqlVariable("s") {
+		t.Errorf("unexpected directives %+v", f.directives)
+	}
+	if len(f.sub) != 1 || f.sub[0].name != "id" {
+		t.Errorf("unexpected subselection %+v", f.sub)
+	}
+	if op.sel[1].spread != "F" {
+		t.Errorf("unexpected spread %+v", op.sel[1])
+	}
+}
+
+func TestExecuteGQL(t *testing.T) {
+	s := newGQLTestSchema()
+	for _, tc := range []struct {
+		name, query, op string
+		vars            map[string]interface{}
+		want, err       string
+	}{
+		{
+			name:  "fields in selection order",
+			query: `{ tags name extra __typename }`,
+			want:  `{"tags":["x","y"],"name":"root","extra":{"k":1},"__typename":"Root"}`,
+		},
+		{
+			name:  "nested objects and lists",
+			query: `{ child { name child { name } } items { id } }`,
+			want:  `{"child":{"name":"child","child":null},"items":[{"id":1},{"id":2},{"id":3}]}`,
+		},
+		{
+			name:  "aliases and arguments",
+			query: `{ a: item(id: 2) { kind } b: item(id: 9) { kind } }`,
+			want:  `{"a":{"kind":"b"},"b":null}`,
+		},
+		{
+			name:  "variables with JSON numbers and defaults",
+			query: `query ($id: Int!, $n: Int = 1) { item(id: $id) { id } page(first: $n) { id } }`,
+			vars:  map[string]interface{}{"id": float64(3)},
+			want:  `{"item":{"id":3},"page":[{"id":1}]}`,
+		},
+		{
+			name:  "paging",
+			query: `{ page(first: 1, offset: 1) { id } }`,
+			want:  `{"page":[{"id":2}]}`,
+		},
+		{
+			name:  "fragments merge",
+			query: `{ items { id } ...F ... on Root { name } ... on Item { nope } } fragment F on Root { items { kind } }`,
+			want:  `{"items":[{"id":1,"kind":"a"},{"id":2,"kind":"b"},{"id":3,"kind":"a"}],"name":"root"}`,
+		},
+		{
+			name:  "directives",
+			query: `query ($yes: Boolean!) { name @include(if: $yes) tags @skip(if: $yes) }`,
+			vars:  map[string]interface{}{"yes": true},
+			want:  `{"name":"root"}`,
+		},
+		{
+			name:  "operation by name",
+			query: `query A { name } query B { tags }`,
+			op:    "B",
+			want:  `{"tags":["x","y"]}`,
+		},
+		{name: "ambiguous operation", query: `query A { name } query B { tags }`, err: "operationName is required"},
+		{name: "unknown operation", query: `query A { name }`, op: "B", err: "operation 'B' not found"},
+		{name: "unknown field", query: `{ child { nope } }`, err: "cannot query field 'nope' on type Root"},
+		{name: "missing subselection", query: `{ child }`, err: "must have a selection of subfields"},
+		{name: "subselection on scalar", query: `{ name { x } }`, err: "no subfields"},
+		{name: "unknown argument", query: `{ item(id: 1, x: 2) { id } }`, err: "unknown argument 'x'"},
+		{name: "missing argument", query: `{ item { id } }`, err: "argument 'id' of type Int! is required"},
+		{name: "wrong argument type", query: `{ item(id: "1") { id } }`, err: "expected a value of type Int"},
+		{name: "missing variable", query: `query ($id: Int!) { item(id: $id) { id } }`, err: "was not provided"},
+		{name: "undeclared variable", query: `{ item(id: $id) { id } }`, err: "not defined by the operation"},
+		{name: "conflicting keys", query: `{ x: name x: tags }`, err: "conflict under the response key 'x'"},
+		{name: "self spreading fragment", query: `{ ...F } fragment F on Root { ...F }`, err: "spreads itself"},
+		{name: "unknown fragment", query: `{ ...F }`, err: "unknown fragment"},
+		{name: "negative paging", query: `{ page(first: -1) { id } }`, err: "must not be negative"},
+	} {
+		resp := s.execute(gqlTestData(), tc.query, tc.op, tc.vars)
+		if tc.err != "" {
+			if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, tc.err) {
+				t.Errorf("%s: expected an error containing '%s', got %+v", tc.name, tc.err, resp.Errors)
+			}
+			continue
+		}
+		if len(resp.Errors) > 0 {
+			t.Errorf("%s: unexpected errors %+v", tc.name, resp.Errors)
+			continue
+		}
+		got, err := json.Marshal(resp.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestExecuteGQLErrorPath(t *testing.T) {
+	resp := newGQLTestSchema().execute(gqlTestData(), `{ child { items { id } x: item(id: "1") { id } } }`, "", nil)
+	if len(resp.Errors) != 1 || resp.Data != nil {
+		t.Fatalf("expected a single error and no data, got %+v", resp)
+	}
+	path, _ := json.Marshal(resp.Errors[0].Path)
+	if string(path) != `["child","x"]` {
+		t.Errorf("unexpected error path %s", path)
+	}
+}
+
+func TestExecuteGQLLimits(t *testing.T) {
+	s := newGQLTestSchema()
+	s.maxDepth = 2
+
+	deep := &gqlTestRoot{Child: &gqlTestRoot{Child: &gqlTestRoot{Child: &gqlTestRoot{}}}}
+	if resp := s.execute(deep, `{ child { child { name } } }`, "", nil); len(resp.Errors) > 0 {
+		t.Errorf("query within the depth limit failed: %+v", resp.Errors)
+	}
+	resp := s.execute(deep, `{ child { child { child { name } } } }`, "", nil)
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "deeper than 2 levels") {
+		t.Errorf("expected the depth limit to be hit, got %+v", resp.Errors)
+	}
+	// fragments do not get around it
+	resp = s.execute(deep, `{ child { ...F } } fragment F on Root { child { child { name } } }`, "", nil)
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "deeper than 2 levels") {
+		t.Errorf("expected the depth limit to be hit through a fragment, got %+v", resp.Errors)
+	}
+
+	// 1 for items, 2 per item
+	s.maxCost = 7
+	if resp := s.execute(gqlTestData(), `{ items { id kind } }`, "", nil); len(resp.Errors) > 0 {
+		t.Errorf("query within the cost limit failed: %+v", resp.Errors)
+	}
+	s.maxCost = 6
+	resp = s.execute(gqlTestData(), `{ items { id kind } }`, "", nil)
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "more than 6 fields") {
+		t.Errorf("expected the cost limit to be hit, got %+v", resp.Errors)
+	}
+
+	// fragments spread twice per level multiply the fields to resolve
+	s.maxCost, s.maxDepth = 1000, gqlDefaultMaxDepth
+	blowup := `{ ...A } fragment A on Root { a1: child { ...B } a2: child { ...B } }
+		fragment B on Root { b1: child { ...C } b2: child { ...C } }
+		fragment C on Root { c1: child { ...D } c2: child { ...D } }
+		fragment D on Root { d1: items { id kind } d2: items { id kind } }`
+	loop := &gqlTestRoot{Items: make([]*gqlTestItem, 100)}
+	for i := range loop.Items {
+		loop.Items[i] = &gqlTestItem{ID: int64(i)}
+	}
+	loop.Child = loop
+	resp = s.execute(loop, blowup, "", nil)
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "more than 1000 fields") {
+		t.Errorf("expected the cost limit to be hit, got %+v", resp.Errors)
+	}
+}
+
+func TestGQLSchemaSDL(t *testing.T) {
+	sdl := newGQLTestSchema().sdl()
+	for _, want := range []string{
+		"schema {\n  query: Root\n}",
+		"type Item {\n  id: Int64!\n  kind: String!\n}",
+		"  items: [Item!]\n",
+		"  extra: JSON\n",
+		"  item(id: Int!): Item\n",
+		"  page(first: Int, offset: Int): [Item!]!\n",
+	} {
+		if !strings.Contains(sdl, want) {
+			t.Errorf("SDL lacks %q:\n%s", want, sdl)
+		}
+	}
+}
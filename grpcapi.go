@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// The gRPC API of serve, for services that would otherwise parse the JSON documents.
+// Without a protoc step in the build, the protobuf descriptors are assembled here and
+// messages are handled dynamically; `schema --proto` prints the equivalent .proto for
+// generating clients.
+//
+// Messages mirroring an output struct take their fields from it, numbered in the
+// order listed. The numbers are the wire format: fields are only ever appended to
+// these lists, and a struct field missing from its list stops the program at start.
+
+const (
+	rollupProtoPackage = "slingshot.rollup.v1"
+	rollupProtoService = "Rollup"
+
+	grpcDefaultPageSize = 1000
+	grpcMaxPageSize     = 10000
+)
+
+type protoMessageDef struct {
+	name   string
+	doc    string
+	sample interface{} // output struct the leading fields are taken from, if any
+	fields []string    // of sample, by JSON name
+	extra  []*descriptorpb.FieldDescriptorProto
+}
+
+var rollupProtoMessages = []*protoMessageDef{
+	{name: "RollupInfo", doc: "The rollup a response was taken from", extra: []*descriptorpb.FieldDescriptorProto{
+		protoField("epoch", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+		protoRepeated(protoField("tipset_key", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")),
+		protoField("schema_version", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+	}},
+	{name: "Totals", doc: "The payload of basic_stats.json", sample: competitionTotal{}, fields: []string{
+		"total_unique_cids", "total_unique_providers", "total_unique_projects", "total_unique_clients",
+		"total_num_deals", "total_stored_data_size", "filplus_total_num_deals", "filplus_total_stored_data_size",
+		"qa_total_stored_data_size",
+	}},
+	{name: "Deal", doc: "An entry of a project deal list", sample: individualDeal{}, fields: []string{
+		"project_id", "client", "deal_id", "deal_start_epoch", "miner_id", "payload_cid",
+		"payload_cid_original", "label_kind",
+		"extra_root_cids", "data_size", "pending", "verified",
+		"storage_price_per_epoch", "total_storage_fee", "provider_collateral",
+	}},
+	{name: "RecoveredDeal", doc: "An entry of recovery_deallist.json", sample: recoveredDeal{}, fields: []string{
+		"deal_id", "client_address", "miner_id", "piece_cid", "label", "payload_cid",
+		"padded_piece_size", "data_size", "deal_start_epoch", "deal_end_epoch", "recovery",
+	}},
+	{name: "GetCompetitionTotalsRequest", doc: "site is the served prefix, and may be left out when serving a single one", extra: []*descriptorpb.FieldDescriptorProto{
+		protoField("site", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+	}},
+	{name: "CompetitionTotals", extra: []*descriptorpb.FieldDescriptorProto{
+		protoField("rollup", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, "RollupInfo"),
+		protoField("totals", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, "Totals"),
+	}},
+	{name: "ListProjectDealsRequest", doc: "page_token is the next_page_token of the previous page, empty for the first one", extra: []*descriptorpb.FieldDescriptorProto{
+		protoField("site", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+		protoField("project_id", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+		protoField("page_size", 3, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+		protoField("page_token", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+	}},
+	{name: "ListProjectDealsResponse", doc: "next_page_token is empty on the last page", extra: []*descriptorpb.FieldDescriptorProto{
+		protoField("rollup", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, "RollupInfo"),
+		protoRepeated(protoField("deals", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, "Deal")),
+		protoField("next_page_token", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+	}},
+	{name: "ListRecoveredDealsRequest", extra: []*descriptorpb.FieldDescriptorProto{
+		protoField("site", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+		protoField("page_size", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+		protoField("page_token", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+	}},
+	{name: "ListRecoveredDealsResponse", extra: []*descriptorpb.FieldDescriptorProto{
+		protoField("rollup", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, "RollupInfo"),
+		protoRepeated(protoField("deals", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, "RecoveredDeal")),
+		protoField("next_page_token", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+	}},
+}
+
+// The Stream variants send every page of the listing in turn, starting at page_token
+var rollupProtoMethods = []*descriptorpb.MethodDescriptorProto{
+	protoMethod("GetCompetitionTotals", "GetCompetitionTotalsRequest", "CompetitionTotals", false),
+	protoMethod("ListProjectDeals", "ListProjectDealsRequest", "ListProjectDealsResponse", false),
+	protoMethod("StreamProjectDeals", "ListProjectDealsRequest", "ListProjectDealsResponse", true),
+	protoMethod("ListRecoveredDeals", "ListRecoveredDealsRequest", "ListRecoveredDealsResponse", false),
+	protoMethod("StreamRecoveredDeals", "ListRecoveredDealsRequest", "ListRecoveredDealsResponse", true),
+}
+
+func protoField(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, message string) *descriptorpb.FieldDescriptorProto {
+	f := &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(name),
+		Number:   proto.Int32(number),
+		Type:     typ.Enum(),
+		Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+	if message != "" {
+		f.TypeName = proto.String("." + rollupProtoPackage + "." + message)
+	}
+	return f
+}
+
+func protoRepeated(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+	f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	return f
+}
+
+func protoMethod(name, in, out string, streaming bool) *descriptorpb.MethodDescriptorProto {
+	return &descriptorpb.MethodDescriptorProto{
+		Name:            proto.String(name),
+		InputType:       proto.String("." + rollupProtoPackage + "." + in),
+		OutputType:      proto.String("." + rollupProtoPackage + "." + out),
+		ServerStreaming: proto.Bool(streaming),
+	}
+}
+
+// The scalar fields of an output struct by JSON name
+func protoStructFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, scalar := csvFieldName(f)
+		if !scalar && f.PkgPath == "" && f.Type == reflect.TypeOf([]string(nil)) {
+			name, scalar = strings.Split(f.Tag.Get("json"), ",")[0], true
+		}
+		if scalar {
+			fields[name] = f
+		}
+	}
+	return fields
+}
+
+func protoScalarType(t reflect.Type) (descriptorpb.FieldDescriptorProto_Type, bool) {
+	switch t.Kind() {
+	case reflect.String:
+		return descriptorpb.FieldDescriptorProto_TYPE_STRING, false
+	case reflect.Bool:
+		return descriptorpb.FieldDescriptorProto_TYPE_BOOL, false
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return descriptorpb.FieldDescriptorProto_TYPE_INT64, false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return descriptorpb.FieldDescriptorProto_TYPE_UINT64, false
+	case reflect.Float32, reflect.Float64:
+		return descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, false
+	case reflect.Slice:
+		return descriptorpb.FieldDescriptorProto_TYPE_STRING, true
+	}
+	panic(fmt.Sprintf("no protobuf mapping for %s", t))
+}
+
+var rollupProtoFile, rollupProto = buildRollupProto()
+
+func buildRollupProto() (*descriptorpb.FileDescriptorProto, protoreflect.FileDescriptor) {
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("slingshot/rollup/v1/rollup.proto"),
+		Package: proto.String(rollupProtoPackage),
+		Syntax:  proto.String("proto3"),
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name:   proto.String(rollupProtoService),
+			Method: rollupProtoMethods,
+		}},
+	}
+
+	for _, md := range rollupProtoMessages {
+		mdp := &descriptorpb.DescriptorProto{Name: proto.String(md.name)}
+
+		if md.sample != nil {
+			st := reflect.TypeOf(md.sample)
+			available := protoStructFields(st)
+			for i, name := range md.fields {
+				sf, known := available[name]
+				if !known {
+					panic(fmt.Sprintf("protobuf message %s lists '%s', which %s does not have", md.name, name, st.Name()))
+				}
+				delete(available, name)
+				typ, repeated := protoScalarType(sf.Type)
+				f := protoField(name, int32(i+1), typ, "")
+				if repeated {
+					protoRepeated(f)
+				}
+				mdp.Field = append(mdp.Field, f)
+			}
+			for name := range available {
+				panic(fmt.Sprintf("%s field '%s' has no protobuf field number: append it to the %s message", st.Name(), name, md.name))
+			}
+		}
+		mdp.Field = append(mdp.Field, md.extra...)
+
+		fdp.MessageType = append(fdp.MessageType, mdp)
+	}
+
+	fd, err := protodesc.NewFile(fdp, new(protoregistry.Files))
+	if err != nil {
+		panic(fmt.Sprintf("invalid rollup protobuf descriptor: %s", err))
+	}
+	return fdp, fd
+}
+
+func newRollupMessage(name string) *dynamicpb.Message {
+	return dynamicpb.NewMessage(rollupProto.Messages().ByName(protoreflect.Name(name)))
+}
+
+// Fills the fields of msg mirroring the output struct v
+func setProtoFromStruct(msg *dynamicpb.Message, v interface{}) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	fields := protoStructFields(rv.Type())
+
+	fds := msg.Descriptor().Fields()
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		sf, mirrored := fields[string(fd.Name())]
+		if !mirrored {
+			continue
+		}
+		fv := rv.FieldByIndex(sf.Index)
+
+		switch fd.Kind() {
+		case protoreflect.StringKind:
+			if fd.IsList() {
+				list := msg.Mutable(fd).List()
+				for j := 0; j < fv.Len(); j++ {
+					list.Append(protoreflect.ValueOfString(fv.Index(j).String()))
+				}
+			} else {
+				msg.Set(fd, protoreflect.ValueOfString(fv.String()))
+			}
+		case protoreflect.BoolKind:
+			msg.Set(fd, protoreflect.ValueOfBool(fv.Bool()))
+		case protoreflect.Int64Kind:
+			msg.Set(fd, protoreflect.ValueOfInt64(fv.Int()))
+		case protoreflect.Uint64Kind:
+			msg.Set(fd, protoreflect.ValueOfUint64(fv.Uint()))
+		case protoreflect.DoubleKind:
+			msg.Set(fd, protoreflect.ValueOfFloat64(fv.Float()))
+		}
+	}
+}
+
+func protoGet(msg *dynamicpb.Message, field string) protoreflect.Value {
+	return msg.Get(msg.Descriptor().Fields().ByName(protoreflect.Name(field)))
+}
+
+func protoSet(msg *dynamicpb.Message, field string, v protoreflect.Value) {
+	msg.Set(msg.Descriptor().Fields().ByName(protoreflect.Name(field)), v)
+}
+
+// The service answering from the current rollups of the served sites
+type rollupService struct {
+	sites map[string]*site
+}
+
+func (rs *rollupService) graph(siteName string) (*rollupGraph, error) {
+	if siteName == "" && len(rs.sites) == 1 {
+		for _, s := range rs.sites {
+			siteName = s.prefix
+		}
+	}
+	s, known := rs.sites["/"+strings.Trim(siteName, "/")]
+	if !known {
+		return nil, status.Errorf(codes.NotFound, "no site '%s' served", siteName)
+	}
+
+	s.mu.RLock()
+	cur := s.current
+	s.mu.RUnlock()
+
+	g, err := cur.graph.load(cur.docs)
+	if err != nil {
+		log.Errorf("%s: loading rollup '%s' for gRPC failed: %s", s.prefix, cur.dir, err)
+		return nil, status.Error(codes.Unavailable, "rollup not available")
+	}
+	return g, nil
+}
+
+func (rs *rollupService) rollupInfo(g *rollupGraph) *dynamicpb.Message {
+	info := newRollupMessage("RollupInfo")
+	protoSet(info, "epoch", protoreflect.ValueOfInt64(g.epoch))
+	list := info.Mutable(info.Descriptor().Fields().ByName("tipset_key")).List()
+	for _, c := range g.tipSetKey {
+		list.Append(protoreflect.ValueOfString(c))
+	}
+	protoSet(info, "schema_version", protoreflect.ValueOfString(g.schemaVersion))
+	return info
+}
+
+func (rs *rollupService) totals(req *dynamicpb.Message) (*dynamicpb.Message, error) {
+	g, err := rs.graph(protoGet(req, "site").String())
+	if err != nil {
+		return nil, err
+	}
+
+	totals := newRollupMessage("Totals")
+	setProtoFromStruct(totals, &g.totals)
+
+	resp := newRollupMessage("CompetitionTotals")
+	protoSet(resp, "rollup", protoreflect.ValueOfMessage(rs.rollupInfo(g)))
+	protoSet(resp, "totals", protoreflect.ValueOfMessage(totals))
+	return resp, nil
+}
+
+// Pages through a list of records held by the rollup at the given epoch. Page tokens
+// carry the epoch, so that paging across a rollup refresh fails instead of silently
+// mixing two rollups.
+func (rs *rollupService) page(req *dynamicpb.Message, g *rollupGraph, n int) (lo, hi int, next string, err error) {
+	size := int(protoGet(req, "page_size").Int())
+	switch {
+	case size < 0:
+		return 0, 0, "", status.Error(codes.InvalidArgument, "page_size must not be negative")
+	case size == 0:
+		size = grpcDefaultPageSize
+	case size > grpcMaxPageSize:
+		size = grpcMaxPageSize
+	}
+
+	if token := protoGet(req, "page_token").String(); token != "" {
+		parts := strings.SplitN(token, ":", 2)
+		epoch, err1 := strconv.ParseInt(parts[0], 10, 64)
+		var err2 error
+		if len(parts) == 2 {
+			lo, err2 = strconv.Atoi(parts[1])
+		}
+		if len(parts) != 2 || err1 != nil || err2 != nil || lo < 0 || lo > n {
+			return 0, 0, "", status.Errorf(codes.InvalidArgument, "invalid page_token '%s'", token)
+		}
+		if epoch != g.epoch {
+			return 0, 0, "", status.Errorf(codes.FailedPrecondition, "page_token is from the rollup at epoch %d, now serving epoch %d: start over", epoch, g.epoch)
+		}
+	}
+
+	hi = lo + size
+	if hi >= n {
+		return lo, n, "", nil
+	}
+	return lo, hi, fmt.Sprintf("%d:%d", g.epoch, hi), nil
+}
+
+func (rs *rollupService) projectDeals(req *dynamicpb.Message, send func(*dynamicpb.Message) error, all bool) error {
+	g, err := rs.graph(protoGet(req, "site").String())
+	if err != nil {
+		return err
+	}
+	projID := protoGet(req, "project_id").String()
+	deals, known := g.deals[projID]
+	if !known {
+		return status.Errorf(codes.NotFound, "no deal list for project '%s'", projID)
+	}
+
+	return rs.pages(req, g, len(deals), "ListProjectDealsResponse", all, send, func(list protoreflect.List, i int) {
+		d := newRollupMessage("Deal")
+		setProtoFromStruct(d, deals[i])
+		list.Append(protoreflect.ValueOfMessage(d))
+	})
+}
+
+func (rs *rollupService) recoveredDeals(req *dynamicpb.Message, send func(*dynamicpb.Message) error, all bool) error {
+	g, err := rs.graph(protoGet(req, "site").String())
+	if err != nil {
+		return err
+	}
+
+	return rs.pages(req, g, len(g.recovered), "ListRecoveredDealsResponse", all, send, func(list protoreflect.List, i int) {
+		d := newRollupMessage("RecoveredDeal")
+		setProtoFromStruct(d, g.recovered[i])
+		list.Append(protoreflect.ValueOfMessage(d))
+	})
+}
+
+// Sends the page asked for, or with all set every page from there on
+func (rs *rollupService) pages(req *dynamicpb.Message, g *rollupGraph, n int, respType string, all bool, send func(*dynamicpb.Message) error, appendRecord func(protoreflect.List, int)) error {
+	for {
+		lo, hi, next, err := rs.page(req, g, n)
+		if err != nil {
+			return err
+		}
+
+		resp := newRollupMessage(respType)
+		protoSet(resp, "rollup", protoreflect.ValueOfMessage(rs.rollupInfo(g)))
+		list := resp.Mutable(resp.Descriptor().Fields().ByName("deals")).List()
+		for i := lo; i < hi; i++ {
+			appendRecord(list, i)
+		}
+		protoSet(resp, "next_page_token", protoreflect.ValueOfString(next))
+
+		if err := send(resp); err != nil {
+			return err
+		}
+		if !all || next == "" {
+			return nil
+		}
+		protoSet(req, "page_token", protoreflect.ValueOfString(next))
+	}
+}
+
+func grpcUnaryHandler(method, reqType string, call func(*rollupService, *dynamicpb.Message) (*dynamicpb.Message, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newRollupMessage(reqType)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(_ context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(*rollupService), req.(*dynamicpb.Message))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + rollupProtoPackage + "." + rollupProtoService + "/" + method}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
+
+func grpcStreamHandler(reqType string, call func(*rollupService, *dynamicpb.Message, func(*dynamicpb.Message) error) error) grpc.StreamHandler {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		req := newRollupMessage(reqType)
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		return call(srv.(*rollupService), req, func(m *dynamicpb.Message) error { return stream.SendMsg(m) })
+	}
+}
+
+var rollupServiceDesc = grpc.ServiceDesc{
+	ServiceName: rollupProtoPackage + "." + rollupProtoService,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		grpcUnaryHandler("GetCompetitionTotals", "GetCompetitionTotalsRequest", (*rollupService).totals),
+		grpcUnaryHandler("ListProjectDeals", "ListProjectDealsRequest", func(rs *rollupService, req *dynamicpb.Message) (resp *dynamicpb.Message, err error) {
+			err = rs.projectDeals(req, func(m *dynamicpb.Message) error { resp = m; return nil }, false)
+			return resp, err
+		}),
+		grpcUnaryHandler("ListRecoveredDeals", "ListRecoveredDealsRequest", func(rs *rollupService, req *dynamicpb.Message) (resp *dynamicpb.Message, err error) {
+			err = rs.recoveredDeals(req, func(m *dynamicpb.Message) error { resp = m; return nil }, false)
+			return resp, err
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamProjectDeals",
+			ServerStreams: true,
+			Handler: grpcStreamHandler("ListProjectDealsRequest", func(rs *rollupService, req *dynamicpb.Message, send func(*dynamicpb.Message) error) error {
+				return rs.projectDeals(req, send, true)
+			}),
+		},
+		{
+			StreamName:    "StreamRecoveredDeals",
+			ServerStreams: true,
+			Handler: grpcStreamHandler("ListRecoveredDealsRequest", func(rs *rollupService, req *dynamicpb.Message, send func(*dynamicpb.Message) error) error {
+				return rs.recoveredDeals(req, send, true)
+			}),
+		},
+	},
+	Metadata: rollupProtoFile.GetName(),
+}
+
+// The descriptors as .proto source
+func rollupProtoSource() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Generated by `schema --proto`, schema version %s\n\nsyntax = \"proto3\";\n\npackage %s;\n", outputSchemaVersion, rollupProtoPackage)
+
+	typeName := func(f *descriptorpb.FieldDescriptorProto) string {
+		if f.GetType() == descriptorpb.FieldDescriptorProto_TYPE_MESSAGE {
+			return strings.TrimPrefix(f.GetTypeName(), "."+rollupProtoPackage+".")
+		}
+		return strings.ToLower(strings.TrimPrefix(f.GetType().String(), "TYPE_"))
+	}
+
+	docs := make(map[string]string, len(rollupProtoMessages))
+	for _, md := range rollupProtoMessages {
+		docs[md.name] = md.doc
+	}
+
+	b.WriteString("\nservice " + rollupProtoService + " {\n")
+	for _, m := range rollupProtoFile.Service[0].Method {
+		stream := ""
+		if m.GetServerStreaming() {
+			stream = "stream "
+		}
+		fmt.Fprintf(&b, "  rpc %s(%s) returns (%s%s);\n", m.GetName(),
+			strings.TrimPrefix(m.GetInputType(), "."+rollupProtoPackage+"."), stream,
+			strings.TrimPrefix(m.GetOutputType(), "."+rollupProtoPackage+"."))
+	}
+	b.WriteString("}\n")
+
+	for _, m := range rollupProtoFile.MessageType {
+		b.WriteString("\n")
+		if doc := docs[m.GetName()]; doc != "" {
+			fmt.Fprintf(&b, "// %s\n", doc)
+		}
+		fmt.Fprintf(&b, "message %s {\n", m.GetName())
+		fields := append([]*descriptorpb.FieldDescriptorProto(nil), m.Field...)
+		sort.Slice(fields, func(i, j int) bool { return fields[i].GetNumber() < fields[j].GetNumber() })
+		for _, f := range fields {
+			label := ""
+			if f.GetLabel() == descriptorpb.FieldDescriptorProto_LABEL_REPEATED {
+				label = "repeated "
+			}
+			fmt.Fprintf(&b, "  %s%s %s = %d;\n", label, typeName(f), f.GetName(), f.GetNumber())
+		}
+		b.WriteString("}\n")
+	}
+
+	return b.String()
+}
+
+// Registers the service for the given sites
+func newRollupGRPCServer(sites map[string]*site, guard *serveGuard) (*grpc.Server, error) {
+	if len(sites) == 0 {
+		return nil, xerrors.New("no sites to serve over gRPC")
+	}
+	srv := grpc.NewServer(guard.grpcOptions()...)
+	srv.RegisterService(&rollupServiceDesc, &rollupService{sites: sites})
+	return srv, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const defaultHistoryLength = 100
+
+// contents of /history
+type totalsHistoryOutput struct {
+	Endpoint      string                `json:"endpoint"`
+	SchemaVersion string                `json:"schema_version"`
+	Metric        string                `json:"metric"`
+	Payload       []*totalsHistoryPoint `json:"payload"` // by epoch
+}
+type totalsHistoryPoint struct {
+	Epoch int64 `json:"epoch"`
+	Value int64 `json:"value"`
+}
+
+// The competition totals of a rollup found under a site root
+type historyEntry struct {
+	epoch  int64
+	totals competitionTotal
+}
+
+// Orders the entries by epoch, keeping the newest length of them, and one per epoch
+func trimHistory(entries []*historyEntry, length int) []*historyEntry {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].epoch < entries[j].epoch })
+	ret := entries[:0]
+	for _, e := range entries {
+		if len(ret) > 0 && ret[len(ret)-1].epoch == e.epoch {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	if length > 0 && len(ret) > length {
+		ret = ret[len(ret)-length:]
+	}
+	return ret
+}
+
+// The metrics of /history: the numeric fields of the totals, by JSON name
+func historyMetrics() map[string][]int {
+	ret := make(map[string][]int)
+	t := reflect.TypeOf(competitionTotal{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int64:
+			ret[strings.Split(f.Tag.Get("json"), ",")[0]] = f.Index
+		}
+	}
+	return ret
+}
+
+func historyMetricNames() []string {
+	metrics := historyMetrics()
+	names := make([]string, 0, len(metrics))
+	for n := range metrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Serves /history?metric=<field of basic_stats>
+func (s *site) serveHistory(w http.ResponseWriter, r *http.Request, cur *servedRollup) {
+	metric := r.URL.Query().Get("metric")
+	idx, known := historyMetrics()[metric]
+	if !known {
+		http.Error(w, "metric must be one of "+strings.Join(historyMetricNames(), ", "), http.StatusBadRequest)
+		return
+	}
+
+	out := &totalsHistoryOutput{
+		Endpoint:      "COMPETITION_TOTALS_HISTORY",
+		SchemaVersion: outputSchemaVersion,
+		Metric:        metric,
+		Payload:       make([]*totalsHistoryPoint, 0, len(cur.history)),
+	}
+	for _, e := range cur.history {
+		out.Payload = append(out.Payload, &totalsHistoryPoint{
+			Epoch: e.epoch,
+			Value: reflect.ValueOf(e.totals).FieldByIndex(idx).Int(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Warnf("sending %s%s failed: %s", s.prefix, r.URL.Path, err)
+	}
+}
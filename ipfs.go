@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// Adds a completed rollup directory as a UnixFS DAG through the /api/v0/add endpoint
+// of a Kubo (go-ipfs) RPC API, pinning it there, and returns the root CID. The DAG
+// layout is left to the node, using CIDv1 with raw leaves so that the same files
+// always yield the same root.
+func addRollupToIPFS(ctx context.Context, apiBase, outDirName string, epoch int64) (cid.Cid, error) {
+	names, err := rollupFileNames(outDirName)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	dirName := strconv.FormatInt(epoch, 10)
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeDirectoryMultipart(mw, outDirName, dirName, names, true)) //nolint:errcheck
+	}()
+
+	params := url.Values{
+		"cid-version":     {"1"},
+		"raw-leaves":      {"true"},
+		"pin":             {"true"},
+		"quieter":         {"true"},
+		"stream-channels": {"true"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(apiBase, "/")+"/api/v0/add?"+params.Encode(), pr)
+	if err != nil {
+		pr.Close() //nolint:errcheck
+		return cid.Undef, err
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return cid.Undef, xerrors.Errorf("non-200 response %d from %s: %s", resp.StatusCode, apiBase, respBody)
+	}
+
+	// one line per added object, the wrapping directory comes last
+	var root string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		var added struct {
+			Name    string
+			Hash    string
+			Message string
+		}
+		if err := json.Unmarshal(sc.Bytes(), &added); err != nil {
+			return cid.Undef, xerrors.Errorf("unexpected response from %s: %w", apiBase, err)
+		}
+		if added.Message != "" {
+			return cid.Undef, xerrors.Errorf("adding to %s failed: %s", apiBase, added.Message)
+		}
+		if added.Name == dirName {
+			root = added.Hash
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return cid.Undef, err
+	}
+	if root == "" {
+		return cid.Undef, xerrors.Errorf("no root directory reported back by %s", apiBase)
+	}
+
+	return cid.Parse(root)
+}
+
+func rollupFileNames(outDirName string) ([]string, error) {
+	entries, err := ioutil.ReadDir(outDirName)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Mode().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Streams the named files as multipart/form-data `file` parts, each named dirName/file.
+// Kubo expects an explicit directory entry first, and URL-escaped file names.
+func writeDirectoryMultipart(mw *multipart.Writer, outDirName, dirName string, names []string, forKubo bool) error {
+	escape := func(s string) string { return s }
+	if forKubo {
+		escape = url.QueryEscape
+
+		dirHdr := make(textproto.MIMEHeader)
+		dirHdr.Set("Content-Disposition", `form-data; name="file"; filename="`+escape(dirName)+`"`)
+		dirHdr.Set("Content-Type", "application/x-directory")
+		if _, err := mw.CreatePart(dirHdr); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		fileHdr := make(textproto.MIMEHeader)
+		fileHdr.Set("Content-Disposition", `form-data; name="file"; filename="`+escape(dirName+"/"+name)+`"`)
+		fileHdr.Set("Content-Type", "application/octet-stream")
+		part, err := mw.CreatePart(fileHdr)
+		if err != nil {
+			return err
+		}
+
+		fh, err := os.Open(filepath.Join(outDirName, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, fh)
+		fh.Close() //nolint:errcheck
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	markettypes "github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/adt"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/xerrors"
+)
+
+// What a deal label holds, as listed with every deal list entry
+const (
+	labelKindCid      = "cid"       // a CID as text
+	labelKindCidList  = "cid_list"  // a JSON array of CAR root CIDs
+	labelKindCidBytes = "cid_bytes" // a CID in its binary form
+	labelKindText     = "text"      // any other UTF-8 text
+	labelKindBytes    = "bytes"     // any other binary data
+	labelKindEmpty    = "empty"
+)
+
+// Interprets a deal label as the payload CID(s) of the deal. Besides a bare CID, some
+// tooling sets the label to a JSON array of CAR root CIDs: the first root is then
+// taken as the payload CID, and the remaining ones are returned as extra roots.
+// Labels made of bytes rather than text are cast as a binary CID. The payload is
+// cid.Undef unless the kind is one of the CID ones.
+func parseDealLabel(label market.DealLabel) (payload cid.Cid, extraRoots []cid.Cid, kind string) {
+	if label.Length() == 0 {
+		return cid.Undef, nil, labelKindEmpty
+	}
+	if label.IsBytes() {
+		raw, _ := label.ToBytes()
+		if c, err := cid.Cast(raw); err == nil {
+			return c, nil, labelKindCidBytes
+		}
+		return cid.Undef, nil, labelKindBytes
+	}
+
+	text, _ := label.ToString()
+	if c, err := cid.Parse(text); err == nil {
+		return c, nil, labelKindCid
+	}
+
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "[") {
+		return cid.Undef, nil, labelKindText
+	}
+
+	var roots []string
+	if err := json.Unmarshal([]byte(trimmed), &roots); err != nil || len(roots) == 0 {
+		return cid.Undef, nil, labelKindText
+	}
+	parsed := make([]cid.Cid, 0, len(roots))
+	for _, r := range roots {
+		c, err := cid.Parse(r)
+		if err != nil {
+			return cid.Undef, nil, labelKindText
+		}
+		parsed = append(parsed, c)
+	}
+
+	return parsed[0], parsed[1:], labelKindCidList
+}
+
+// The payload CID as written in the label, in whichever version and base the tooling
+// making the deal chose, "" when the label is not a CID. A binary CID has neither, and
+// is given in its default string form.
+func labelPayloadText(label market.DealLabel) string {
+	c, _, kind := parseDealLabel(label)
+	switch kind {
+	case labelKindCid:
+		return labelText(label)
+	case labelKindCidBytes:
+		return c.String()
+	case labelKindCidList:
+	default:
+		return ""
+	}
+	var roots []string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(labelText(label))), &roots); err != nil {
+		return ""
+	}
+	return roots[0]
+}
+
+// The label as a string: text labels as they are, and byte labels as the CID they
+// hold or else base64 encoded
+func labelText(label market.DealLabel) string {
+	if label.IsString() {
+		text, _ := label.ToString()
+		return text
+	}
+	raw, _ := label.ToBytes()
+	if c, err := cid.Cast(raw); err == nil {
+		return c.String()
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// Byte labels do not survive the JSON of the node API, which renders them as empty
+// strings. The labels of the deals that get listed are read back from the market
+// actor state, where they are kept as they are, when the rollup runs against a node.
+type chainLabels struct {
+	ctx  context.Context
+	node api.FullNode
+	tsk  types.TipSetKey
+
+	proposals market.DealProposals // loaded on first use
+}
+
+// The label of the deal, from chain state when the one given is empty. A nil
+// chainLabels, for rollups from Lily or a deals snapshot, returns the label given.
+func (cl *chainLabels) label(dealID string, d *api.MarketDeal) (market.DealLabel, error) {
+	if cl == nil || d.Proposal.Label.Length() > 0 {
+		return d.Proposal.Label, nil
+	}
+
+	if cl.proposals == nil {
+		store := adt.WrapStore(cl.ctx, cbor.NewCborStore(blockstore.NewAPIBlockstore(cl.node)))
+		act, err := cl.node.StateGetActor(cl.ctx, market.Address, cl.tsk)
+		if err != nil {
+			return markettypes.EmptyDealLabel, xerrors.Errorf("loading the market actor: %w", err)
+		}
+		st, err := market.Load(store, act)
+		if err != nil {
+			return markettypes.EmptyDealLabel, xerrors.Errorf("loading the market state: %w", err)
+		}
+		if cl.proposals, err = st.Proposals(); err != nil {
+			return markettypes.EmptyDealLabel, xerrors.Errorf("loading the deal proposals: %w", err)
+		}
+	}
+
+	id, err := strconv.ParseUint(dealID, 10, 64)
+	if err != nil {
+		return markettypes.EmptyDealLabel, xerrors.Errorf("unexpected non-numeric deal id %s: %w", dealID, err)
+	}
+	p, found, err := cl.proposals.Get(abi.DealID(id))
+	if err != nil {
+		return markettypes.EmptyDealLabel, xerrors.Errorf("loading the proposal of deal %s: %w", dealID, err)
+	}
+	if !found {
+		return d.Proposal.Label, nil
+	}
+	return p.Label, nil
+}
+
+// A market deal as written to disk by the rollup. Its JSON is that of api.MarketDeal,
+// which reads back as such, with byte labels kept alongside.
+type storedMarketDeal struct {
+	api.MarketDeal
+	LabelBytes []byte `json:",omitempty"`
+}
+
+func newStoredMarketDeal(d *api.MarketDeal) storedMarketDeal {
+	sd := storedMarketDeal{MarketDeal: *d}
+	if d.Proposal.Label.IsBytes() {
+		sd.LabelBytes, _ = d.Proposal.Label.ToBytes()
+	}
+	return sd
+}
+
+func (sd *storedMarketDeal) marketDeal() (api.MarketDeal, error) {
+	d := sd.MarketDeal
+	if len(sd.LabelBytes) > 0 {
+		var err error
+		if d.Proposal.Label, err = markettypes.NewLabelFromBytes(sd.LabelBytes); err != nil {
+			return d, err
+		}
+	}
+	return d, nil
+}
+
+func cidStrings(cids []cid.Cid) []string {
+	if len(cids) == 0 {
+		return nil
+	}
+	ret := make([]string, len(cids))
+	for i, c := range cids {
+		ret[i] = c.String()
+	}
+	return ret
+}
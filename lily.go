@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	markettypes "github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	_ "github.com/lib/pq" // registers the postgres driver
+	"golang.org/x/xerrors"
+)
+
+// Reads the chain state a rollup needs from the Postgres database of a Lily (formerly
+// sentinel-visor) instance instead of from a Lotus node: the tipset from block_headers,
+// the market deals from market_deal_proposals and market_deal_states, and client
+// addresses from id_addresses.
+//
+// Lily records deal states as they change, but not their removal from the market
+// actor, so deals the actor has dropped by the rollup height are left out by the
+// same rules it drops them by: expired, slashed, or never activated by their start.
+// Neither does Lily record block tickets, so tipsets it resolves list their blocks
+// in CID order, which need not be the order of their key on chain.
+type lilySource struct {
+	db *sql.DB
+	ts *keyedTipSet // only known once resolved
+}
+
+func openLilySource(ctx context.Context, dbURL string) (*lilySource, error) {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, xerrors.Errorf("opening Lily database: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close() //nolint:errcheck
+		return nil, xerrors.Errorf("connecting to Lily database: %w", err)
+	}
+	return &lilySource{db: db}, nil
+}
+
+func (ls *lilySource) Close() error {
+	return ls.db.Close()
+}
+
+// Resolves --tipset like resolveRollupTipSet does against a node, the head being the
+// highest tipset Lily has processed
+func (ls *lilySource) resolveTipSet(ctx context.Context, ref string) (rollupTipSet, abi.ChainEpoch, error) {
+	ref = strings.TrimSpace(ref)
+
+	var head sql.NullInt64
+	if err := ls.db.QueryRowContext(ctx, `SELECT MAX(height) FROM block_headers`).Scan(&head); err != nil {
+		return nil, 0, xerrors.Errorf("finding the Lily head: %w", err)
+	}
+	if !head.Valid {
+		return nil, 0, xerrors.New("the Lily database holds no blocks")
+	}
+
+	var lookback abi.ChainEpoch
+	var err error
+	switch {
+	case ref == "":
+		var h int64
+		if err := ls.db.QueryRowContext(ctx,
+			`SELECT MAX(height) FROM block_headers WHERE height <= $1`, head.Int64-int64(defaultEpochLookback),
+		).Scan(&h); err != nil {
+			return nil, 0, xerrors.Errorf("no tipset in the Lily database %d epochs behind its head at %d", defaultEpochLookback, head.Int64)
+		}
+		if ls.ts, err = ls.tipSetAt(ctx, abi.ChainEpoch(h)); err != nil {
+			return nil, 0, err
+		}
+		lookback = defaultEpochLookback
+		log.Infof("rolling up at epoch %d, pass --tipset '%s' to reproduce this run exactly", h, tipSetKeyArg(ls.ts.cids))
+
+	case ref == "@head":
+		return nil, 0, xerrors.Errorf("refusing to roll up at @head (epoch %d): it is not final, specify a height at least %d epochs back or the full tipset key", head.Int64, policy.ChainFinality)
+
+	case strings.HasPrefix(ref, "@"):
+		h, err := strconv.ParseInt(ref[1:], 10, 64)
+		if err != nil || h < 0 {
+			return nil, 0, xerrors.Errorf("invalid tipset height '%s'", ref)
+		}
+		if head.Int64-h < int64(policy.ChainFinality) {
+			return nil, 0, xerrors.Errorf("refusing to roll up at @%d: it is within %d epochs of the Lily head at %d and may still be reorganized", h, policy.ChainFinality, head.Int64)
+		}
+		if ls.ts, err = ls.tipSetAt(ctx, abi.ChainEpoch(h)); err != nil {
+			return nil, 0, err
+		}
+
+	default:
+		cids, err := parseTipSetKeyArg(ref)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ls.ts, err = ls.tipSetOf(ctx, cids); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return ls.ts, lookback, nil
+}
+
+func (ls *lilySource) tipSetAt(ctx context.Context, h abi.ChainEpoch) (*keyedTipSet, error) {
+	rows, err := ls.db.QueryContext(ctx, `SELECT cid, timestamp FROM block_headers WHERE height = $1 ORDER BY cid`, int64(h))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	ts := &keyedTipSet{height: h}
+	for rows.Next() {
+		var c string
+		var timestamp uint64
+		if err := rows.Scan(&c, &timestamp); err != nil {
+			return nil, err
+		}
+		parsed, err := cid.Parse(c)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid block CID '%s' in Lily database: %w", c, err)
+		}
+		ts.cids = append(ts.cids, parsed)
+		if ts.minTimestamp == 0 || timestamp < ts.minTimestamp {
+			ts.minTimestamp = timestamp
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ts.cids) == 0 {
+		return nil, xerrors.Errorf("epoch %d is a null round or was not processed by Lily, pass the full tipset key of the tipset to roll up at", h)
+	}
+	return ts, nil
+}
+
+// The tipset with exactly the given blocks, which keep their order
+func (ls *lilySource) tipSetOf(ctx context.Context, cids []cid.Cid) (*keyedTipSet, error) {
+	var h int64
+	if err := ls.db.QueryRowContext(ctx, `SELECT height FROM block_headers WHERE cid = $1`, cids[0].String()).Scan(&h); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, xerrors.Errorf("block %s not found in Lily database", cids[0])
+		}
+		return nil, err
+	}
+
+	ts, err := ls.tipSetAt(ctx, abi.ChainEpoch(h))
+	if err != nil {
+		return nil, err
+	}
+	if !sameCidSet(ts.cids, cids) {
+		return nil, xerrors.Errorf("tipset %s does not match the blocks at epoch %d in Lily database: %s", tipSetKeyArg(cids), h, tipSetKeyArg(ts.cids))
+	}
+	ts.cids = cids
+	return ts, nil
+}
+
+func sameCidSet(a, b []cid.Cid) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[cid.Cid]bool, len(a))
+	for _, c := range a {
+		seen[c] = true
+	}
+	for _, c := range b {
+		if !seen[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// The node API answered from the database, for the methods a rollup reads deals and
+// clients through. All others fail, as do calls against any but the resolved tipset.
+func (ls *lilySource) node() api.FullNode {
+	fns := unavailableFullNode("a Lily database")
+
+	fns.Internal.StateMarketDeals = func(ctx context.Context, tsk types.TipSetKey) (map[string]*api.MarketDeal, error) {
+		if err := ls.checkTipSet(tsk); err != nil {
+			return nil, err
+		}
+		return ls.marketDeals(ctx, "")
+	}
+	fns.Internal.StateMarketStorageDeal = func(ctx context.Context, dealID abi.DealID, tsk types.TipSetKey) (*api.MarketDeal, error) {
+		if err := ls.checkTipSet(tsk); err != nil {
+			return nil, err
+		}
+		deals, err := ls.marketDeals(ctx, "AND deal_id = "+strconv.FormatUint(uint64(dealID), 10))
+		if err != nil {
+			return nil, err
+		}
+		md, found := deals[strconv.FormatUint(uint64(dealID), 10)]
+		if !found {
+			return nil, xerrors.Errorf("deal %d not found", dealID)
+		}
+		return md, nil
+	}
+	fns.Internal.StateLookupID = func(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+		if err := ls.checkTipSet(tsk); err != nil {
+			return address.Undef, err
+		}
+		if addr.Protocol() == address.ID {
+			return addr, nil
+		}
+		return ls.lookupAddress(ctx, `SELECT id FROM id_addresses WHERE address = $1 AND height <= $2 ORDER BY height DESC LIMIT 1`, addr)
+	}
+	fns.Internal.StateAccountKey = func(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+		if err := ls.checkTipSet(tsk); err != nil {
+			return address.Undef, err
+		}
+		if addr.Protocol() == address.BLS || addr.Protocol() == address.SECP256K1 || addr.Protocol() == address.Delegated {
+			return addr, nil
+		}
+		return ls.lookupAddress(ctx, `SELECT address FROM id_addresses WHERE id = $1 AND height <= $2 ORDER BY height DESC LIMIT 1`, addr)
+	}
+	return fns
+}
+
+func (ls *lilySource) checkTipSet(tsk types.TipSetKey) error {
+	if ls.ts == nil || tsk != ls.ts.Key() {
+		return xerrors.Errorf("a Lily database is only queried at the tipset of the rollup, not at %s", tsk)
+	}
+	return nil
+}
+
+func (ls *lilySource) lookupAddress(ctx context.Context, query string, addr address.Address) (address.Address, error) {
+	var found string
+	if err := ls.db.QueryRowContext(ctx, query, addr.String(), int64(ls.ts.height)).Scan(&found); err != nil {
+		if err == sql.ErrNoRows {
+			return address.Undef, xerrors.Errorf("address %s not found in Lily database as of epoch %d", addr, ls.ts.height)
+		}
+		return address.Undef, err
+	}
+	return address.NewFromString(found)
+}
+
+// The latest proposal and state of every deal the market actor still holds at the
+// rollup height, narrowed down by filter
+const lilyDealsQuery = `
+SELECT p.deal_id, p.piece_cid, p.padded_piece_size, p.is_verified, p.client_id, p.provider_id, p.label,
+	p.start_epoch, p.end_epoch, p.storage_price_per_epoch, p.provider_collateral, p.client_collateral,
+	COALESCE(s.sector_start_epoch, -1), COALESCE(s.last_update_epoch, -1), COALESCE(s.slash_epoch, -1)
+FROM (
+	SELECT DISTINCT ON (deal_id) * FROM market_deal_proposals WHERE height <= $1 %[1]s ORDER BY deal_id, height DESC
+) p LEFT JOIN (
+	SELECT DISTINCT ON (deal_id) * FROM market_deal_states WHERE height <= $1 %[1]s ORDER BY deal_id, height DESC
+) s USING (deal_id)
+WHERE p.end_epoch >= $1
+	AND (COALESCE(s.slash_epoch, -1) = -1 OR s.slash_epoch >= $1)
+	AND (COALESCE(s.sector_start_epoch, -1) <> -1 OR p.start_epoch >= $1)`
+
+func (ls *lilySource) marketDeals(ctx context.Context, filter string) (map[string]*api.MarketDeal, error) {
+	rows, err := ls.db.QueryContext(ctx, fmt.Sprintf(lilyDealsQuery, filter), int64(ls.ts.height))
+	if err != nil {
+		return nil, xerrors.Errorf("querying Lily deals: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	deals := make(map[string]*api.MarketDeal)
+	for rows.Next() {
+		var (
+			dealID                               uint64
+			pieceCid, clientID, providerID       string
+			label                                sql.NullString
+			price, providerColl, clientColl      string
+			p                                    market.DealProposal
+			s                                    market.DealState
+			pieceSize, start, end                int64
+			sectorStart, lastUpdated, slashEpoch int64
+		)
+		if err := rows.Scan(
+			&dealID, &pieceCid, &pieceSize, &p.VerifiedDeal, &clientID, &providerID, &label,
+			&start, &end, &price, &providerColl, &clientColl,
+			&sectorStart, &lastUpdated, &slashEpoch,
+		); err != nil {
+			return nil, err
+		}
+
+		if p.PieceCID, err = cid.Parse(pieceCid); err != nil {
+			return nil, xerrors.Errorf("deal %d: invalid piece CID '%s': %w", dealID, pieceCid, err)
+		}
+		if p.Client, err = address.NewFromString(clientID); err != nil {
+			return nil, xerrors.Errorf("deal %d: invalid client '%s': %w", dealID, clientID, err)
+		}
+		if p.Provider, err = address.NewFromString(providerID); err != nil {
+			return nil, xerrors.Errorf("deal %d: invalid provider '%s': %w", dealID, providerID, err)
+		}
+		for _, amount := range []struct {
+			dst *abi.TokenAmount
+			src string
+		}{{&p.StoragePricePerEpoch, price}, {&p.ProviderCollateral, providerColl}, {&p.ClientCollateral, clientColl}} {
+			if *amount.dst, err = big.FromString(amount.src); err != nil {
+				return nil, xerrors.Errorf("deal %d: invalid amount '%s': %w", dealID, amount.src, err)
+			}
+		}
+		p.PieceSize = abi.PaddedPieceSize(pieceSize)
+		if p.Label, err = markettypes.NewLabelFromString(label.String); err != nil {
+			return nil, xerrors.Errorf("deal %d: invalid label: %w", dealID, err)
+		}
+		p.StartEpoch, p.EndEpoch = abi.ChainEpoch(start), abi.ChainEpoch(end)
+		s.SectorStartEpoch, s.LastUpdatedEpoch, s.SlashEpoch = abi.ChainEpoch(sectorStart), abi.ChainEpoch(lastUpdated), abi.ChainEpoch(slashEpoch)
+
+		deals[strconv.FormatUint(dealID, 10)] = &api.MarketDeal{Proposal: p, State: s}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("reading Lily deals: %w", err)
+	}
+	return deals, nil
+}
@@ -1,22 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Jeffail/gabs"
+	"github.com/dustin/go-humanize"
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/filecoin-project/lotus/chain/types"
-	lcli "github.com/filecoin-project/lotus/cli"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
 	"github.com/filecoin-project/specs-actors/actors/builtin"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
@@ -28,28 +34,37 @@ import (
 // How many epochs back to look at for dealstats
 var defaultEpochLookback = abi.ChainEpoch(10)
 
-// perl -E 'say scalar gmtime ( XXX * 30 + 1598306400 )'
-//
-// 166560:  Wed Oct 21 18:00:00 2020
-// 307680:  Wed Dec  9 18:00:00 2020
-// 448800:  Wed Jan 27 18:00:00 2021
-// 569760:  Wed Mar 10 18:00:00 2021
-// 756960:  Fri May 14 18:00:00 2021
-// 912480:  Wed Jul  7 18:00:00 2021
-// 1099680: Fri Sep 10 18:00:00 2021
-// 1275360: Wed Nov 10 18:00:00 2021
-// 1623840: Fri Mar 11 18:00:00 2021
-var currentPhaseStart = abi.ChainEpoch(1623840)
+// The start of the last phase of the schedule, unless selected otherwise
+var currentPhaseStart = abi.ChainEpoch(builtinPhases[len(builtinPhases)-1].StartEpoch)
+
+// Only set when selecting a past phase via --phase: 0 means open-ended
+var currentPhaseEnd = abi.ChainEpoch(0)
+
+// Stamped into the output envelopes when the window matches a known phase
+var currentPhaseID int
 
 // 1381920: Fri Dec 17 18:00:00 2021
 var recoveryStart = abi.ChainEpoch(1381920)
 
+// Deals shorter than this never qualify
+var minQualifyingDealDurationDays = int64(360)
+
+// Deals beyond this many for the same piece CID within a project do not count, 0
+// when the rollup config disables the cap
+var maxQualifyingDealsPerPiece = 10
+
+// Whether the cap above applies to the deals of a piece with each provider separately
+var pieceCapPerProvider = false
+
 //
 // contents of basic_stats.json
 type competitionTotalOutput struct {
-	Epoch    int64            `json:"epoch"`
-	Endpoint string           `json:"endpoint"`
-	Payload  competitionTotal `json:"payload"`
+	Epoch         int64            `json:"epoch"`
+	TipSetKey     []cid.Cid        `json:"tipset_key"`
+	Endpoint      string           `json:"endpoint"`
+	Phase         int              `json:"phase,omitempty"`
+	SchemaVersion string           `json:"schema_version"`
+	Payload       competitionTotal `json:"payload"`
 }
 type competitionTotal struct {
 	UniqueCids        int   `json:"total_unique_cids"`
@@ -60,6 +75,7 @@ type competitionTotal struct {
 	TotalBytes        int64 `json:"total_stored_data_size"`
 	FilplusTotalDeals int   `json:"filplus_total_num_deals"`
 	FilplusTotalBytes int64 `json:"filplus_total_stored_data_size"`
+	QATotalBytes      int64 `json:"qa_total_stored_data_size"` // FIL+ data counted 10x
 
 	seenProject  map[string]bool
 	seenClient   map[address.Address]bool
@@ -70,23 +86,43 @@ type competitionTotal struct {
 //
 // contents of client_stats.json
 type projectAggregateStatsOutput struct {
-	Epoch    int64                             `json:"epoch"`
-	Endpoint string                            `json:"endpoint"`
-	Payload  map[string]*projectAggregateStats `json:"payload"`
+	Epoch         int64                             `json:"epoch"`
+	TipSetKey     []cid.Cid                         `json:"tipset_key"`
+	Endpoint      string                            `json:"endpoint"`
+	Phase         int                               `json:"phase,omitempty"`
+	SchemaVersion string                            `json:"schema_version"`
+	Payload       map[string]*projectAggregateStats `json:"payload"`
 }
 type projectAggregateStats struct {
 	ProjectID           string                           `json:"project_id"`
+	ProjectName         string                           `json:"project_name,omitempty"` // as given in the project list
 	DataSizeMaxProvider int64                            `json:"max_data_size_stored_with_single_provider"`
 	HighestCidDealCount int                              `json:"max_same_cid_deals"`
 	DataSize            int64                            `json:"total_data_size"`
+	QADataSize          int64                            `json:"qa_total_data_size"` // FIL+ data counted 10x
 	NumCids             int                              `json:"total_num_cids"`
 	NumDeals            int                              `json:"total_num_deals"`
 	NumProviders        int                              `json:"total_num_providers"`
+	FilplusNumDeals     int                              `json:"filplus_total_num_deals"`
+	FilplusDataSize     int64                            `json:"filplus_total_data_size"`
+	FilplusDataShare    float64                          `json:"filplus_data_share"`          // fraction of total_data_size in verified deals
+	TotalStorageFee     string                           `json:"total_storage_fee"`           // attoFIL, over the full term of the deals
+	AvgStoragePrice     string                           `json:"avg_storage_price_per_epoch"` // attoFIL, mean over the deals
+	ProviderCollateral  string                           `json:"total_provider_collateral"`   // attoFIL
+	NumZeroPriceDeals   int                              `json:"num_zero_price_deals"`
+	LargestClientShare  float64                          `json:"largest_client_data_share"`    // fraction of total_data_size from the single largest client
+	NumClients90Pct     int                              `json:"num_clients_90pct_data"`       // fewest clients together accounting for 90% of total_data_size
+	LifetimeDataSize    int64                            `json:"lifetime_data_size,omitempty"` // only with --state-db
+	Registration        map[string]interface{}           `json:"registration,omitempty"`       // project list fields selected with --registration-field
 	ClientStats         map[string]*clientAggregateStats `json:"clients"`
+	Tags                map[string]*tagStats             `json:"tags,omitempty"`
+	Warnings            []*projectWarning                `json:"warnings"`
 
 	dataPerProvider          map[address.Address]int64
+	dataPerClient            map[address.Address]int64
 	timesSeenPieceCid        map[cid.Cid]int
-	timesSeenPieceCidAllTime map[cid.Cid]int
+	timesSeenPieceCidAllTime map[pieceCapKey]int
+	pricing                  dealPricing
 }
 type clientAggregateStats struct {
 	Client       string `json:"client"`
@@ -95,6 +131,9 @@ type clientAggregateStats struct {
 	NumDeals     int    `json:"total_num_deals"`
 	NumProviders int    `json:"total_num_providers"`
 
+	FilplusNumDeals int   `json:"filplus_total_num_deals"`
+	FilplusDataSize int64 `json:"filplus_total_data_size"`
+
 	providers map[address.Address]bool
 	cids      map[cid.Cid]bool
 }
@@ -102,26 +141,42 @@ type clientAggregateStats struct {
 //
 // contents of deals_list_{{projid}}.json
 type dealListOutput struct {
-	Epoch    int64             `json:"epoch"`
-	Endpoint string            `json:"endpoint"`
-	Payload  []*individualDeal `json:"payload"`
+	Epoch         int64             `json:"epoch"`
+	TipSetKey     []cid.Cid         `json:"tipset_key"`
+	Endpoint      string            `json:"endpoint"`
+	Phase         int               `json:"phase,omitempty"`
+	SchemaVersion string            `json:"schema_version"`
+	Payload       []*individualDeal `json:"payload"`
 }
 type individualDeal struct {
-	ProjectID      string `json:"project_id"`
-	Client         string `json:"client"`
-	DealID         string `json:"deal_id"`
-	DealStartEpoch int64  `json:"deal_start_epoch"`
-	MinerID        string `json:"miner_id"`
-	PayloadCID     string `json:"payload_cid"`
-	PaddedSize     int64  `json:"data_size"`
+	ProjectID      string   `json:"project_id"`
+	Client         string   `json:"client"`
+	DealID         string   `json:"deal_id"`
+	DealStartEpoch int64    `json:"deal_start_epoch"`
+	MinerID        string   `json:"miner_id"`
+	PayloadCID     string   `json:"payload_cid"`
+	PayloadCIDOrig string   `json:"payload_cid_original,omitempty"` // only with --cid-original: as written in the deal label
+	ExtraRootCIDs  []string `json:"extra_root_cids,omitempty"`      // further CAR roots, when the label lists several
+	LabelKind      string   `json:"label_kind"`                     // cid, cid_list, cid_bytes, text, bytes or empty
+	PaddedSize     int64    `json:"data_size"`
+	Verified       bool     `json:"verified"`                // a FIL+ deal
+	StoragePrice   string   `json:"storage_price_per_epoch"` // attoFIL
+	StorageFee     string   `json:"total_storage_fee"`       // attoFIL, over the full deal term
+	Collateral     string   `json:"provider_collateral"`     // attoFIL
+	Pending        bool     `json:"pending,omitempty"`       // published but not yet activated: not counted in any totals
+
+	Economics *dealEconomics `json:"economics,omitempty"` // only with --deal-economics
 }
 
 //
 // contents of recovery_deallist.json
 type recoveryListOutput struct {
-	Epoch    int64           `json:"epoch"`
-	Endpoint string          `json:"endpoint"`
-	Payload  []recoveredDeal `json:"payload"`
+	Epoch         int64           `json:"epoch"`
+	TipSetKey     []cid.Cid       `json:"tipset_key"`
+	Endpoint      string          `json:"endpoint"`
+	Phase         int             `json:"phase,omitempty"`
+	SchemaVersion string          `json:"schema_version"`
+	Payload       []recoveredDeal `json:"payload"`
 }
 type recoveredDeal struct {
 	DealID          string `json:"deal_id"`
@@ -135,10 +190,33 @@ type recoveredDeal struct {
 	DealStartEpoch  int64  `json:"deal_start_epoch"`
 	DealEndEpoch    int64  `json:"deal_end_epoch"`
 	RecoveryType    int8   `json:"recovery"` // 1: restore, 2: repair
+
+	Estuary *estuaryDealRecord `json:"estuary,omitempty"` // only for repairs, with --estuary-api
+}
+
+// Output formats selectable via --format, JSON is always written
+var knownOutputFormats = map[string]string{
+	"json":    "the canonical JSON outputs",
+	"csv":     "flattened CSV variants of every JSON output",
+	"parquet": "Parquet variants of the per-project deal lists and the recovery list",
+	"ndjson":  "deal lists and recovery list written as one record per line, streamed while iterating, instead of the JSON arrays",
+	"html":    "summary.html, a standalone page with the same contents as the always written summary.md",
+	"car":     "rollup.car, the complete results as a DAG-CBOR DAG in a CARv1 file",
+}
+
+// The --format usage, listing every known format but the always written JSON
+func outputFormatsUsage() string {
+	formats := make([]string, 0, len(knownOutputFormats))
+	for f := range knownOutputFormats {
+		if f != "json" {
+			formats = append(formats, f)
+		}
+	}
+	sort.Strings(formats)
+	return "Additional output formats to emit alongside the JSON outputs: " + strings.Join(formats, ", ")
 }
 
 var log = logging.Logger("slingshot-stats")
-var resolvedWallets = map[address.Address]address.Address{}
 
 func main() {
 	logging.SetLogLevel("*", "INFO") //nolint:errcheck
@@ -152,8 +230,17 @@ func main() {
 				EnvVars: []string{"LOTUS_PATH"},
 				Value:   "~/.lotus", // TODO: Consider XDG_DATA_HOME
 			},
+			&cli.StringFlag{
+				Name:  "api",
+				Usage: "Multiaddr or URL of the Lotus node API, instead of FULLNODE_API_INFO or the API of the node at --repo",
+			},
+			&cli.StringFlag{
+				Name:    "api-token",
+				EnvVars: []string{apiTokenEnv},
+				Usage:   "JWT for the API at --api",
+			},
 		},
-		Commands: []*cli.Command{rollup},
+		Commands: []*cli.Command{rollup, daemon, serve, schema, openAPI, checkCompat, trend, signInput, exportDeals, backfill, explain},
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -166,328 +253,1953 @@ func main() {
 var rollup = &cli.Command{
 	Usage:     "Translating current lotus state into format and rollups as understood by https://slingshot.filecoin.io/",
 	Name:      "rollup",
-	ArgsUsage: "  <non-existent output directory name>  <eligible project list>",
+	ArgsUsage: "  <output directory name>  <eligible project list>",
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:        "tipset",
-			Usage:       "Current tipset either as comma separated array of cids, or @height",
+			Usage:       "Tipset to roll up at, as comma separated array of cids or @height. Heights must be final and not fall on a null round",
 			DefaultText: fmt.Sprintf("%d epochs behind current", defaultEpochLookback),
 		},
+		&cli.StringFlag{
+			Name:  "phase",
+			Usage: "Select the phase window by id or name from the phase schedule, instead of passing --phasestart-epoch",
+		},
+		&cli.StringFlag{
+			Name:  "network",
+			Usage: "Network the node follows, mainnet or calibnet, which sets the default phase schedule, recovery start and deal durations",
+			Value: "mainnet",
+		},
+		&cli.StringFlag{
+			Name:  "phase-schedule",
+			Usage: "Local file or URL of a JSON or YAML phase schedule, replacing the built-in phases and recovery start of the --network: the last phase is rolled up by default",
+		},
+		&cli.Int64Flag{
+			Name:        "phasestart-epoch",
+			DefaultText: fmt.Sprintf("%d on mainnet", currentPhaseStart),
+		},
+		&cli.Int64SliceFlag{
+			Name:  "phase-boundaries",
+			Usage: "Start epoch of a phase window to break the qualifying deals down by into phase_stats.json alongside the main rollup, may be repeated in increasing order: each window ends where the next starts, the last one at the rollup epoch",
+		},
+		&cli.Int64Flag{
+			Name:        "recovery-start-epoch",
+			DefaultText: fmt.Sprintf("%d on mainnet", recoveryStart),
+		},
+		&cli.Int64Flag{
+			Name:        "recovery-min-duration-days",
+			Usage:       "Deals by restore clients must last strictly longer than this to make the recovery list",
+			DefaultText: fmt.Sprintf("%d on mainnet", defaultRecoveryMinDurationDays),
+		},
+		&cli.Int64Flag{
+			Name:        "min-deal-duration-days",
+			Usage:       "Deals shorter than this many days do not count",
+			DefaultText: fmt.Sprintf("%d on mainnet", minQualifyingDealDurationDays),
+		},
+		&cli.IntFlag{
+			Name:        "max-deals-per-piece",
+			Usage:       "Deals of the same piece CID within a project beyond this many do not count",
+			DefaultText: fmt.Sprint(maxQualifyingDealsPerPiece),
+		},
+		&cli.BoolFlag{
+			Name:  "piece-cap-per-provider",
+			Usage: "Apply --max-deals-per-piece to the deals of a piece with each provider separately",
+		},
+		&cli.StringSliceFlag{
+			Name:  "repair-client",
+			Usage: "Wallet address making repair deals: its deals make the recovery list as repairs under the same rules as those of restore clients, may be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "estuary-api",
+			Usage: "Estuary endpoint (e.g. https://api.estuary.tech) of the account making the repair deals, authenticating with the token in $" + estuaryTokenEnv + ", to attach its content ids and replication status to the repairs in the recovery list",
+		},
+		&cli.BoolFlag{
+			Name:  "exclude-recoveries-from-competition",
+			Usage: "Deals making the recovery list do not also count towards the competition totals and project stats",
+		},
+		&cli.BoolFlag{
+			Name:  "deal-economics",
+			Usage: "Extend every deal list entry with the remaining terms of its proposal: end epoch, client collateral and weights (JSON and ndjson deal lists only)",
+		},
+		&cli.BoolFlag{
+			Name:  "include-pending",
+			Usage: "List published but not yet activated deals in the per-project deal lists, flagged as pending and excluded from all totals",
+		},
+		&cli.StringFlag{
+			Name:        "memory-budget",
+			Usage:       "Approximate memory to stay within (e.g. 16GiB): per-project deal lists are spilled to disk when the estimated deal count would not fit",
+			DefaultText: "unlimited",
+		},
+		&cli.IntFlag{
+			Name:  "client-spill-threshold",
+			Usage: "Once a project has this many clients, spill the stats of any further clients to disk (0 to never spill)",
+			Value: 20000,
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "Optional rollup config file or URL (custom deal tags, phases, eligibility rules)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "format",
+			Usage: outputFormatsUsage(),
+			Value: cli.NewStringSlice("json"),
+		},
+		&cli.BoolFlag{
+			Name:  "fault-history",
+			Usage: "Sample provider faults daily over the phase window, and write provider_faults.json (one node query per provider per day)",
+		},
+		&cli.BoolFlag{
+			Name:  "miner-power",
+			Usage: "Add the raw and quality-adjusted power and the sector counts of every provider to provider_stats.json (two node queries per provider)",
+		},
+		&cli.BoolFlag{
+			Name:  "datacap",
+			Usage: "Look up the datacap left to every registered client in the verified registry, and write datacap_stats.json along with what the qualifying deals of each project used (one node query per client)",
+		},
+		&cli.BoolFlag{
+			Name:  "terminated-deals",
+			Usage: "Write terminated_deals.json listing the deals of registered projects whose sectors got terminated, along with the termination rate of their providers",
+		},
+		&cli.BoolFlag{
+			Name:  "exclusions",
+			Usage: "Write exclusions.ndjson recording every deal of a registered project that does not count towards the totals, along with the reason",
+		},
+		&cli.IntFlag{
+			Name:  "burst-window-days",
+			Usage: "Length of the window before the measurement deadline (phase end, or the rollup epoch while the phase runs) examined for onboarding bursts",
+			Value: 3,
+		},
+		&cli.Float64Flag{
+			Name:  "burst-share",
+			Usage: "Share of a project's qualifying data activated within the burst window at which burst_report.json flags it",
+			Value: 0.5,
+		},
+		&cli.StringFlag{
+			Name:  "burst-min-size",
+			Usage: "Projects with less qualifying data than this are never flagged for onboarding bursts",
+			Value: "1TiB",
+		},
+		&cli.IntSliceFlag{
+			Name:  "expiry-horizon-days",
+			Usage: "List the qualifying deals ending within this many days of the rollup in expiring_deals.json, may be repeated to tally several horizons",
+			Value: cli.NewIntSlice(30, 60, 90),
+		},
+		&cli.StringSliceFlag{
+			Name:  "only-provider",
+			Usage: "Only count deals made with this provider, may be repeated",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude-provider",
+			Usage: "Do not count deals made with this provider, may be repeated",
+		},
+		&cli.StringFlag{
+			Name:        "exclusion-list",
+			Usage:       "Local file or URL of the clients, datasets and deal ids kept out of the competition",
+			DefaultText: "the built-in list",
+		},
+		&cli.StringFlag{
+			Name:  "provider-probes",
+			Usage: "Local file or URL of per-provider probe results (latency, availability, ...) to join into miner_stats.json",
+		},
+		&cli.StringFlag{
+			Name:  "geoip-db",
+			Usage: "Local file or URL of a DB-IP country or city lite CSV (optionally .gz, not bundled, see the README): locate providers by the addresses they announce, adding their country and region to provider_stats.json and writing geo_distribution.json (one node query per provider)",
+		},
+		&cli.StringFlag{
+			Name:  "prometheus-textfile",
+			Usage: "Also write the competition totals in Prometheus exposition format to this path, e.g. /var/lib/node_exporter/textfile_collector/slingshot_stats.prom",
+		},
+		&cli.StringFlag{
+			Name:  "sign-key",
+			Usage: "Sign the hashes of all outputs into signature.json, with a secp256k1 wallet key as written by `lotus wallet export`, or a PEM ed25519 key",
+		},
+		&cli.StringFlag{
+			Name:  "upload",
+			Usage: "Publish the completed rollup to s3://bucket/prefix/<epoch>/ or gs://bucket/prefix/<epoch>/, then point latest.json under the prefix at it",
+		},
+		&cli.StringFlag{
+			Name:  "ipfs-api",
+			Usage: "Kubo RPC API (e.g. http://127.0.0.1:5001) to add and pin the completed rollup directory at, printing its root CID",
+		},
+		&cli.BoolFlag{
+			Name:  "web3storage",
+			Usage: "Store the completed rollup directory on web3.storage, authenticating with the token in $" + web3StorageTokenEnv + ", and print its root CID",
+		},
+		&cli.StringFlag{
+			Name:  "web3storage-api",
+			Usage: "Endpoint of web3.storage, or of another pinning service exposing the same /upload API",
+			Value: "https://api.web3.storage",
+		},
+		&cli.StringFlag{
+			Name:    "gcs-credentials",
+			Usage:   "Service account key file for gs:// uploads, the GCE metadata server is used when not set",
+			EnvVars: []string{"GOOGLE_APPLICATION_CREDENTIALS"},
+		},
+		&cli.StringFlag{
+			Name:  "deal-list-name",
+			Usage: "Name of the per-project deal lists without extension, may use {{projid}} (required), {{epoch}} and {{date}}. The output directory name may use {{epoch}} and {{date}} too",
+			Value: defaultDealListName,
+		},
+		&cli.BoolFlag{
+			Name:  "allow-existing-dir",
+			Usage: "Write into an already existing output directory, replacing files of the same name",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Remove an already existing output directory before writing the rollup",
+		},
+		&cli.BoolFlag{
+			Name:  "by-miner",
+			Usage: "Also write the qualifying deals of every storage provider into deals_by_miner_<provider id>.json",
+		},
+		&cli.BoolFlag{
+			Name:  "cid-index",
+			Usage: "Write cid_index.json mapping every payload CID of the qualifying deals to the piece CIDs, projects, datasets and deal ids it is stored in (JSON only, held in memory)",
+		},
+		&cli.BoolFlag{
+			Name:  "cid-v1",
+			Usage: "Render the CIDs in the deal lists and cid_index.json as CIDv1, upgrading CIDv0 payload CIDs",
+		},
+		&cli.StringFlag{
+			Name:        "cid-multibase",
+			Usage:       "Multibase (e.g. base32, base36, base58btc) to render the CIDv1 in the deal lists and cid_index.json in: any but base58btc implies --cid-v1",
+			DefaultText: "base32 for CIDv1, CIDv0 as is",
+		},
+		&cli.BoolFlag{
+			Name:  "cid-original",
+			Usage: "Also list the payload CID of every deal list entry as written in its deal label, whatever --cid-v1 and --cid-multibase render it as",
+		},
+		&cli.StringSliceFlag{
+			Name:  "registration-field",
+			Usage: "Project list entry field to pass through into the client_stats.json project entries, e.g. projectName, may be repeated",
+		},
+		&cli.Int64Flag{
+			Name:  "rpc-budget",
+			Usage: "Number of node API calls the run is expected to stay within, for metered gateways. 0 for no budget",
+		},
+		&cli.StringSliceFlag{
+			Name:  "rpc-method-budget",
+			Usage: "Budget of a single node API method as Method=calls, may be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "rpc-budget-action",
+			Usage: "What to do once a budget is exceeded: warn, or abort the run",
+			Value: "warn",
+		},
+		&cli.IntFlag{
+			Name:  "rpc-retries",
+			Usage: "Number of times a node API call is retried when the connection to the node fails or the call times out. Errors returned by the node are not retried",
+			Value: 3,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-retry-backoff",
+			Usage: "Wait before the first retry of a node API call, doubled on every further one",
+			Value: time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-retry-max-backoff",
+			Usage: "Longest wait between retries of a node API call",
+			Value: 30 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-timeout",
+			Usage: "Time a single node API call may take before it is abandoned and retried. 0 for no limit",
+			Value: 15 * time.Minute,
+		},
+		&cli.StringSliceFlag{
+			Name:  "rpc-method-timeout",
+			Usage: "Timeout of a single node API method as Method=duration, e.g. StateMarketDeals=1h, may be repeated",
+		},
+		&cli.BoolFlag{
+			Name:  "soft-fail",
+			Usage: fmt.Sprintf("Carry on when an individual output can not be written, listing it in %s and exiting with code %d", manifestName, exitCodePartialOutputs),
+		},
+		&cli.BoolFlag{
+			Name:  "final",
+			Usage: "Produce the canonical end-of-phase rollup: requires a final --tipset, local input lists signed by an --input-signer (see sign-input), --sign-key and --bundle, resolves clients against the chain only and validates all outputs before signing them",
+		},
 		&cli.Int64Flag{
-			Name:  "phasestart-epoch",
-			Value: int64(currentPhaseStart),
+			Name:  "final-depth",
+			Usage: "Number of epochs the tipset of a --final rollup must be behind the head",
+			Value: int64(policy.ChainFinality),
+		},
+		&cli.StringSliceFlag{
+			Name:  "input-signer",
+			Usage: "Address, or ed25519:<hex public key>, trusted to sign the input lists of a --final rollup, may be repeated",
+		},
+		&cli.StringFlag{
+			Name:   "metrics-out",
+			Usage:  "File to write the run telemetry to, for the daemon",
+			Hidden: true,
+		},
+		&cli.StringFlag{
+			Name:  "notify-webhook",
+			Usage: "Slack or Discord webhook URL to post a summary of the run to, including the error of a failed one",
+		},
+		&cli.StringFlag{
+			Name:  "notify",
+			Usage: "When to post to --notify-webhook: always, or only on failure",
+			Value: "always",
+		},
+		&cli.BoolFlag{
+			Name:  "stdout",
+			Usage: "Write all JSON outputs to standard output as a single NDJSON stream, discriminated by `endpoint`, instead of into an output directory (which is then not passed)",
+		},
+		&cli.BoolFlag{
+			Name:  "progress",
+			Usage: "Report progress on stderr as one JSON object per line: stage, done, total, percent",
+		},
+		&cli.StringFlag{
+			Name:  "bundle",
+			Usage: "Additionally package the finished output directory into a single .tar.gz at this path, with a manifest",
+		},
+		&cli.StringFlag{
+			Name:    "lily",
+			EnvVars: []string{"SLINGSHOT_LILY_DB"},
+			Usage:   "Postgres URL of a Lily database to read market deals and client addresses from instead of a Lotus node",
+		},
+		&cli.StringFlag{
+			Name:  "deals-snapshot",
+			Usage: "Run offline from a deals snapshot written by export-deals, as .json or .json.zst, instead of reading a Lotus node",
+		},
+		&cli.StringSliceFlag{
+			Name:  "resolver",
+			Usage: "How to resolve client ID addresses, tried in order: 'rpc' (StateAccountKey) and/or 'file:<path>' (JSON object of ID => key address). Resolutions are persisted in --resolver-cache or --state-db when given",
+			Value: cli.NewStringSlice("rpc"),
+		},
+		&cli.IntFlag{
+			Name:  "resolver-workers",
+			Usage: "How many client addresses to resolve concurrently",
+			Value: 16,
+		},
+		&cli.StringFlag{
+			Name:        "resolver-cache",
+			Usage:       "Path to a store persisting client address resolutions across runs, without the all-time counters of --state-db",
+			DefaultText: "--state-db",
+		},
+		&cli.StringFlag{
+			Name:  "checkpoint",
+			Usage: "Directory to keep the tipset, market deals and resolved clients of the run in as it goes. Run again with the same --checkpoint after an interruption to resume at the same tipset without fetching them again. Removed once the run completes",
+		},
+		&cli.StringFlag{
+			Name:  "previous",
+			Usage: "Directory of a previous rollup: write removed_deals.json listing its deals no longer listed now, along with the reason, and report changes since it in summary.md",
+		},
+		&cli.StringFlag{
+			Name:  "sqlite",
+			Usage: "Path to a SQLite database to append the results of this rollup to, keyed by epoch",
+		},
+		&cli.StringFlag{
+			Name:  "bigquery-dataset",
+			Usage: "Stream the results of this rollup into BigQuery tables of this dataset, given as project.dataset",
+		},
+		&cli.StringFlag{
+			Name:  "bigquery-table-prefix",
+			Usage: "Prefix of the BigQuery table names: competition_totals, project_stats, client_stats, deals, recovered_deals",
+		},
+		&cli.StringFlag{
+			Name:    "bigquery-credentials",
+			Usage:   "Service account key file for BigQuery, the GCE metadata server is used when not set",
+			EnvVars: []string{"GOOGLE_APPLICATION_CREDENTIALS"},
+		},
+		&cli.StringFlag{
+			Name:  "state-db",
+			Usage: "Path to a persistent store carrying all-time counters across runs: deals that vanished from chain state keep counting towards piece CID caps and lifetime project bytes",
+		},
+		&cli.BoolFlag{
+			Name:  "stream-deals",
+			Usage: "Decode the StateMarketDeals response of the node one deal at a time as it arrives, over plain HTTP, instead of all at once",
+			Value: true,
+		},
+		&cli.BoolFlag{
+			Name:  "incremental",
+			Usage: "Keep the market deals in --state-db, and only fetch what changed since the tipset of the previous run instead of pulling all of them through StateMarketDeals",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-identical",
+			Usage: "Do not recompute when a sibling of the output directory already holds a finished run over the same tipset, inputs and rules. Off with --allow-existing-dir, as the output directory is removed when skipping",
+			Value: true,
 		},
 	},
-	Action: func(cctx *cli.Context) error {
+	Action: func(cctx *cli.Context) (err error) {
+
+		args := cctx.Args().Slice()
+		if cctx.Bool("stdout") {
+			if len(args) != 2 || args[0] == "" || args[1] == "" {
+				return errors.New("must supply 2 arguments when streaming to stdout: a source of currently active projects and a source of recovery list clients")
+			}
+			// everything is assembled in a scratch directory as usual, then streamed out
+			args = append([]string{""}, args...)
+		} else if len(args) != 3 || args[0] == "" || args[1] == "" || args[2] == "" {
+			return errors.New("must supply 3 arguments: a target directory to write results to, a source of currently active projects and a source of recovery list clients")
+		}
+		ctx := rollupContext(cctx)
+		progress := newProgressReporter(ctx, cctx.Bool("progress"))
+
+		network, err := lookupNetwork(cctx.String("network"))
+		if err != nil {
+			return err
+		}
+		network.apply()
 
-		if cctx.Args().Len() != 3 || cctx.Args().Get(0) == "" || cctx.Args().Get(1) == "" || cctx.Args().Get(2) == "" {
-			return errors.New("must supply 3 arguments: a nonexistent target directory to write results to, a source of currently active projects and a source of recovery list clients")
+		var phaseSchedule *phaseScheduleFile
+		if cctx.String("phase-schedule") != "" {
+			if phaseSchedule, err = loadPhaseSchedule(ctx, cctx.String("phase-schedule")); err != nil {
+				return xerrors.Errorf("loading phase schedule failed: %w", err)
+			}
+			phaseSchedule.apply()
 		}
-		ctx := lcli.ReqContext(cctx)
 
+		if cctx.IsSet("phase") && cctx.IsSet("phasestart-epoch") {
+			return xerrors.New("--phase and --phasestart-epoch are mutually exclusive")
+		}
+		skipIdentical := cctx.Bool("skip-identical") && !cctx.Bool("stdout")
+		if cctx.Bool("allow-existing-dir") {
+			if cctx.IsSet("skip-identical") && skipIdentical {
+				return xerrors.New("--skip-identical removes the output directory when skipping, and can not be combined with --allow-existing-dir")
+			}
+			skipIdentical = false
+		}
 		if cctx.Int64("phasestart-epoch") > 0 {
 			currentPhaseStart = abi.ChainEpoch(cctx.Int64("phasestart-epoch"))
 		}
-
-		outDirName := cctx.Args().Get(0)
-		if _, err := os.Stat(outDirName); err == nil {
-			return xerrors.Errorf("unable to proceed: supplied stat target '%s' already exists", outDirName)
+		if cctx.Int64("recovery-start-epoch") > 0 {
+			recoveryStart = abi.ChainEpoch(cctx.Int64("recovery-start-epoch"))
+		}
+		recoveryMinDays := network.recoveryMinDurationDays
+		if cctx.IsSet("recovery-min-duration-days") {
+			recoveryMinDays = cctx.Int64("recovery-min-duration-days")
+		}
+		if err := checkMinDurationDays("recovery minimum duration", recoveryMinDays, true); err != nil {
+			return err
+		}
+		recovery := &recoveryRules{
+			StartEpoch:             recoveryStart,
+			MinDuration:            recoveryMinDurationEpochs(recoveryMinDays),
+			ExcludeFromCompetition: cctx.Bool("exclude-recoveries-from-competition"),
+			RepairClients:          make(map[address.Address]struct{}),
+		}
+		for _, a := range cctx.StringSlice("repair-client") {
+			addr, err := address.NewFromString(a)
+			if err != nil {
+				return xerrors.Errorf("invalid repair client address '%s': %w", a, err)
+			}
+			recovery.RepairClients[addr] = struct{}{}
+		}
+		if cctx.String("estuary-api") != "" && len(recovery.RepairClients) == 0 {
+			return xerrors.New("--estuary-api requires the --repair-client addresses whose deals to look up")
+		}
+		providers, err := newProviderFilter(cctx.StringSlice("only-provider"), cctx.StringSlice("exclude-provider"))
+		if err != nil {
+			return err
+		}
+		cidRender, err := newCidRendering(cctx.Bool("cid-v1"), cctx.String("cid-multibase"))
+		if err != nil {
+			return err
 		}
 
-		if err := os.MkdirAll(outDirName, 0755); err != nil {
-			return xerrors.Errorf("creation of destination '%s' failed: %s", outDirName, err)
+		failures := &outputFailures{soft: cctx.Bool("soft-fail")}
+
+		rpcCalls, err := newRPCBudget(cctx.Int64("rpc-budget"), cctx.StringSlice("rpc-method-budget"), cctx.String("rpc-budget-action"))
+		if err != nil {
+			return err
+		}
+		rpcRetry, err := newRPCRetryPolicy(cctx.Int("rpc-retries"), cctx.Duration("rpc-retry-backoff"), cctx.Duration("rpc-retry-max-backoff"), cctx.Duration("rpc-timeout"), cctx.StringSlice("rpc-method-timeout"))
+		if err != nil {
+			return err
 		}
 
-		knownAddrMap, err := getAndParseProjectList(ctx, outDirName, cctx.Args().Get(1))
+		notifier, err := newRunNotifier(cctx.String("notify-webhook"), cctx.String("notify"))
 		if err != nil {
-			return xerrors.Errorf("determining registered project failed: %s", err)
+			return err
+		}
+		defer func() { notifier.notify(err) }()
+
+		metrics := newRunMetrics()
+		metrics.rpc = rpcCalls
+		if path := cctx.String("metrics-out"); path != "" {
+			defer func() {
+				if err := metrics.write(path); err != nil {
+					log.Warnf("writing run metrics failed: %s", err)
+				}
+			}()
+		}
+
+		formats := make(map[string]bool)
+		for _, f := range cctx.StringSlice("format") {
+			for _, f := range strings.Split(f, ",") {
+				if _, known := knownOutputFormats[f]; !known {
+					return xerrors.Errorf("unknown output format '%s'", f)
+				}
+				formats[f] = true
+			}
+		}
+		if cctx.Bool("stdout") {
+			for f := range formats {
+				if f != "json" {
+					return xerrors.Errorf("output format '%s' can not be combined with --stdout", f)
+				}
+			}
+		}
+
+		inputs := runInputs(cctx, args[1], args[2])
+		if cctx.Bool("final") {
+			if err := checkFinalRun(cctx, inputs); err != nil {
+				return err
+			}
+		}
+
+		var memBudget uint64
+		var uploader rollupUploader
+		var uploadPrefix string
+		if cctx.String("upload") != "" {
+			var err error
+			if uploader, uploadPrefix, err = newRollupUploader(cctx.String("upload"), cctx.String("gcs-credentials")); err != nil {
+				return err
+			}
+		}
+
+		var signer *outputSigner
+		if cctx.String("sign-key") != "" {
+			var err error
+			if signer, err = loadOutputSigner(cctx.String("sign-key")); err != nil {
+				return xerrors.Errorf("loading signing key failed: %w", err)
+			}
+			log.Infof("outputs will be signed by %s", signer.signer)
+		}
+
+		if cctx.Bool("web3storage") && os.Getenv(web3StorageTokenEnv) == "" {
+			return xerrors.Errorf("--web3storage requires an API token in %s", web3StorageTokenEnv)
+		}
+		if cctx.Int("resolver-workers") < 1 {
+			return xerrors.New("--resolver-workers must be at least 1")
+		}
+		if cctx.Bool("incremental") {
+			if cctx.String("state-db") == "" {
+				return xerrors.New("--incremental requires --state-db to keep the market deals in")
+			}
+			if cctx.String("lily") != "" || cctx.String("deals-snapshot") != "" {
+				return xerrors.New("--incremental diffs market state on a Lotus node, and can not be combined with --lily or --deals-snapshot")
+			}
 		}
 
-		knownRestoreClients, err := getAndParseRestore(ctx, outDirName, cctx.Args().Get(2))
+		burstMinSize, err := humanize.ParseBytes(cctx.String("burst-min-size"))
 		if err != nil {
-			return xerrors.Errorf("determining restore clients failed: %s", err)
+			return xerrors.Errorf("unable to parse burst minimum size '%s': %w", cctx.String("burst-min-size"), err)
+		}
+		if cctx.Float64("burst-share") <= 0 || cctx.Float64("burst-share") > 1 {
+			return xerrors.New("--burst-share must be within (0, 1]")
+		}
+
+		if cctx.String("memory-budget") != "" {
+			var err error
+			if memBudget, err = humanize.ParseBytes(cctx.String("memory-budget")); err != nil {
+				return xerrors.Errorf("unable to parse memory budget '%s': %w", cctx.String("memory-budget"), err)
+			}
+		}
+
+		var checkpoint *runCheckpoint
+		if dir := cctx.String("checkpoint"); dir != "" {
+			if checkpoint, err = openRunCheckpoint(dir); err != nil {
+				return err
+			}
+			if checkpoint.resuming() && !cctx.IsSet("tipset") {
+				if err := cctx.Set("tipset", checkpoint.tipSetRef()); err != nil {
+					return err
+				}
+			}
+			defer func() {
+				if err == nil {
+					if err := checkpoint.remove(); err != nil {
+						log.Warnf("removing checkpoint '%s' failed: %s", dir, err)
+					}
+				}
+			}()
 		}
 
-		api, apiCloser, err := lcli.GetFullNodeAPI(cctx)
+		api, ts, lookback, apiCloser, err := openRollupChain(ctx, cctx, rpcCalls, rpcRetry)
 		if err != nil {
 			return err
 		}
 		defer apiCloser()
+		if checkpoint != nil {
+			if lookback, err = checkpoint.pin(ts, lookback); err != nil {
+				return err
+			}
+		}
+		defer rpcCalls.report()
+		if err := network.checkNode(ctx, api, cctx.String("network")); err != nil {
+			return err
+		}
+		notifier.atEpoch(int64(ts.Height()))
+		metrics.Epoch = int64(ts.Height())
+		if cctx.Bool("final") {
+			if err := checkFinalityDepth(ctx, api, ts, cctx.Int64("final-depth")); err != nil {
+				return err
+			}
+		}
 
-		outClientStatsFd, err := os.Create(outDirName + "/client_stats.json")
+		var store *stateStore
+		if cctx.String("state-db") != "" {
+			if store, err = openStateStore(cctx.String("state-db")); err != nil {
+				return err
+			}
+			defer store.Close() //nolint:errcheck
+		}
+
+		backends, err := newRollupBackends(cctx, api, ts, rpcCalls, rpcRetry, store)
 		if err != nil {
 			return err
 		}
-		defer outClientStatsFd.Close() //nolint:errcheck
+		if checkpoint != nil {
+			backends.deals = checkpoint.deals(backends.deals)
+		}
+		var labels *chainLabels
+		if cctx.String("lily") == "" && cctx.String("deals-snapshot") == "" {
+			labels = &chainLabels{ctx: ctx, node: api, tsk: ts.Key()}
+		}
 
-		outBasicStatsFd, err := os.Create(outDirName + "/basic_stats.json")
+		naming, err := newOutputNaming(ts, cctx.String("deal-list-name"))
 		if err != nil {
 			return err
 		}
-		defer outBasicStatsFd.Close() //nolint:errcheck
 
-		outRecoveryListFd, err := os.Create(outDirName + "/recovery_deallist.json")
+		outDirName, err := naming.outputDir(args[0])
 		if err != nil {
 			return err
 		}
-		defer outRecoveryListFd.Close() //nolint:errcheck
-
-		var ts *types.TipSet
-		if cctx.String("tipset") == "" {
-			ts, err = api.ChainHead(ctx)
+		if cctx.Bool("stdout") {
+			scratchDir, err := ioutil.TempDir("", "slingshot-stats-")
 			if err != nil {
 				return err
 			}
-			ts, err = api.ChainGetTipSetByHeight(ctx, ts.Height()-defaultEpochLookback, ts.Key())
-			if err != nil {
-				return err
+			defer os.RemoveAll(scratchDir) //nolint:errcheck
+			outDirName = filepath.Join(scratchDir, "rollup")
+		}
+		if err := prepareExistingOutputDir(outDirName, cctx.Bool("allow-existing-dir"), cctx.Bool("overwrite")); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(outDirName, 0755); err != nil {
+			return xerrors.Errorf("creation of destination '%s' failed: %s", outDirName, err)
+		}
+
+		if cctx.Bool("final") {
+			for savedName, input := range inputs {
+				if err := verifyInputSignature(input, cctx.StringSlice("input-signer"), outDirName, savedName); err != nil {
+					return err
+				}
 			}
-		} else {
-			ts, err = lcli.ParseTipSetRef(ctx, api, cctx.String("tipset"))
-			if err != nil {
+		}
+
+		if phaseSchedule != nil {
+			if err := ioutil.WriteFile(filepath.Join(outDirName, phaseScheduleSavedName(cctx.String("phase-schedule"))), phaseSchedule.raw, 0644); err != nil {
 				return err
 			}
 		}
 
-		deals, err := api.StateMarketDeals(ctx, ts.Key())
+		rollupCfg, err := getAndParseConfig(ctx, outDirName, cctx.String("config"))
 		if err != nil {
+			return xerrors.Errorf("loading rollup config failed: %s", err)
+		}
+		if err := applyRuleFlags(cctx, rollupCfg); err != nil {
 			return err
 		}
+		rules, err := newEligibilityRules(rollupCfg.Rules, recovery)
+		if err != nil {
+			return xerrors.Errorf("loading rollup config failed: %s", err)
+		}
+		excludeList, err := getAndParseExclusionList(ctx, outDirName, cctx.String("exclusion-list"), recovery.StartEpoch)
+		if err != nil {
+			return xerrors.Errorf("loading exclusion list failed: %w", err)
+		}
+		rules.useExclusionList(excludeList)
 
-		recoveredDeals := make([]recoveredDeal, 0, 8192)
+		var providerProbes map[address.Address]map[string]interface{}
+		if cctx.String("provider-probes") != "" {
+			if providerProbes, err = getAndParseProviderProbes(ctx, outDirName, cctx.String("provider-probes")); err != nil {
+				return xerrors.Errorf("loading provider probes failed: %w", err)
+			}
+		}
+
+		var geoDB *geoIPDatabase
+		if cctx.String("geoip-db") != "" {
+			if geoDB, err = loadGeoIPDatabase(ctx, cctx.String("geoip-db")); err != nil {
+				return xerrors.Errorf("loading GeoIP database failed: %w", err)
+			}
+		}
+
+		phases, err := newPhaseSchedule(rollupCfg.Phases)
+		if err != nil {
+			return xerrors.Errorf("loading phase schedule failed: %s", err)
+		}
+		if cctx.String("phase") != "" {
+			phase, end, err := phases.resolve(cctx.String("phase"))
+			if err != nil {
+				return err
+			}
+			currentPhaseStart = abi.ChainEpoch(phase.StartEpoch)
+			currentPhaseEnd = end
+		}
+		currentPhaseID = phases.idStartingAt(currentPhaseStart)
+		var breakdown *phaseBreakdown
+		if cctx.IsSet("phase-boundaries") {
+			if breakdown, err = newPhaseBreakdown(cctx.Int64Slice("phase-boundaries"), phases); err != nil {
+				return err
+			}
+		}
+		if cctx.Bool("final") && currentPhaseEnd > 0 && ts.Height() < currentPhaseEnd {
+			return xerrors.Errorf("--final rollup at epoch %d is taken before the end of the phase at %d", ts.Height(), currentPhaseEnd)
+		}
+
+		projects, err := getAndParseProjectList(ctx, outDirName, args[1], cctx.StringSlice("registration-field"), excludeList)
+		if err != nil {
+			return xerrors.Errorf("determining registered project failed: %s", err)
+		}
+		knownAddrMap, registrations, datasets := projects.byAddr, projects.registrations, projects.datasets
+
+		knownRestoreClients, err := getAndParseRestore(ctx, outDirName, args[2])
+		if err != nil {
+			return xerrors.Errorf("determining restore clients failed: %s", err)
+		}
+
+		outClientStatsFd, err := os.Create(outDirName + "/client_stats.json")
+		if err != nil {
+			return err
+		}
+		defer outClientStatsFd.Close() //nolint:errcheck
+
+		outBasicStatsFd, err := os.Create(outDirName + "/basic_stats.json")
+		if err != nil {
+			return err
+		}
+		defer outBasicStatsFd.Close() //nolint:errcheck
+
+		recoveryListName := outDirName + "/recovery_deallist.json"
+		if formats["ndjson"] {
+			recoveryListName = outDirName + "/recovery_deallist.ndjson"
+		}
+		outRecoveryListFd, err := os.Create(recoveryListName)
+		if err != nil {
+			return err
+		}
+		defer outRecoveryListFd.Close() //nolint:errcheck
+		outRecoveryListBuf := bufio.NewWriter(outRecoveryListFd)
+		outRecoveryListEnc := json.NewEncoder(outRecoveryListBuf)
+
+		fingerprint, err := newRunFingerprint(cctx, outDirName, ts)
+		if err != nil {
+			return xerrors.Errorf("fingerprinting run inputs failed: %w", err)
+		}
+
+		// hands a completed rollup, either this one or an identical earlier one, to
+		// everything that wants it once finished
+		publish := func(rollupDir string) error {
+			if cctx.String("bundle") != "" {
+				if err := writeBundle(rollupDir, cctx.String("bundle"), int64(ts.Height()), fingerprint); err != nil {
+					return xerrors.Errorf("writing bundle failed: %w", err)
+				}
+			}
+			if uploader != nil {
+				if err := uploadRollup(ctx, uploader, uploadPrefix, rollupDir, int64(ts.Height()), fingerprint); err != nil {
+					return xerrors.Errorf("upload failed: %w", err)
+				}
+			}
+			if cctx.String("ipfs-api") != "" {
+				root, err := addRollupToIPFS(ctx, cctx.String("ipfs-api"), rollupDir, int64(ts.Height()))
+				if err != nil {
+					return xerrors.Errorf("adding rollup to IPFS failed: %w", err)
+				}
+				log.Infof("rollup at epoch %d added to IPFS as %s", ts.Height(), root)
+				if !cctx.Bool("stdout") {
+					fmt.Println("ipfs", root)
+				}
+			}
+			if cctx.Bool("web3storage") {
+				root, err := uploadRollupToWeb3Storage(ctx, cctx.String("web3storage-api"), rollupDir, int64(ts.Height()))
+				if err != nil {
+					return xerrors.Errorf("storing rollup on web3.storage failed: %w", err)
+				}
+				log.Infof("rollup at epoch %d stored on web3.storage as %s", ts.Height(), root)
+				if !cctx.Bool("stdout") {
+					fmt.Println("web3.storage", root)
+				}
+			}
+			notifier.rollupPublished(rollupDir)
+			return nil
+		}
+
+		if skipIdentical {
+			existing, err := findIdenticalRun(outDirName, fingerprint)
+			if err != nil {
+				return xerrors.Errorf("searching for identical runs failed: %w", err)
+			}
+			if existing != "" {
+				log.Infof("an identical run over tipset %s already exists in '%s': not recomputing", ts.Key(), existing)
+				if err := os.RemoveAll(outDirName); err != nil {
+					return err
+				}
+				return publish(existing)
+			}
+		}
+
+		dealCountEstimate, err := estimateDealCount(ctx, api, ts)
+		if err != nil {
+			log.Warnf("unable to estimate deal count, structures will not be pre-sized: %s", err)
+		}
+
+		dealsFit := dealListsFitBudget(memBudget, dealCountEstimate)
+
+		var projDealLists dealListStore
+		if formats["ndjson"] {
+			projDealLists = newNDJSONDealLists(outDirName, naming.dealListFmt(".ndjson"))
+		} else if dealsFit {
+			projDealLists = make(memDealLists)
+		} else {
+			log.Infof("~%d deals do not fit in memory budget of %s: spilling per-project deal lists to disk", dealCountEstimate, humanize.IBytes(memBudget))
+			if projDealLists, err = newDiskDealLists(outDirName); err != nil {
+				return err
+			}
+		}
+		defer projDealLists.Close() //nolint:errcheck
+
+		var resultsCar *carBuilder
+		if formats["car"] {
+			if resultsCar, err = newCarBuilder(outDirName); err != nil {
+				return err
+			}
+			defer resultsCar.Close() //nolint:errcheck
+		}
+
+		// same storage strategy as the per-project lists, keyed by provider instead
+		var minerDealLists dealListStore
+		if cctx.Bool("by-miner") {
+			if formats["ndjson"] {
+				minerDealLists = newNDJSONDealLists(outDirName, minerDealListFmt+".ndjson")
+			} else if _, inMemory := projDealLists.(memDealLists); inMemory {
+				minerDealLists = make(memDealLists)
+			} else if minerDealLists, err = newDiskDealLists(outDirName); err != nil {
+				return err
+			}
+			defer minerDealLists.Close() //nolint:errcheck
+		}
+
+		var cids cidIndex
+		if cctx.Bool("cid-index") {
+			cids = make(cidIndex)
+		}
+
+		clientSpills := newClientSpill(outDirName, cctx.Int("client-spill-threshold"))
+		defer clientSpills.Close() //nolint:errcheck
+
+		var prevRollup *previousRollup
+		var prevTotals *previousTotals
+		if cctx.String("previous") != "" {
+			if prevRollup, err = loadPreviousRollup(cctx.String("previous"), naming.dealListGlob("")); err != nil {
+				return xerrors.Errorf("loading previous rollup failed: %w", err)
+			}
+			if pt, err := loadPreviousTotals(cctx.String("previous")); err != nil {
+				log.Warnf("summary will not include changes, totals of previous rollup unavailable: %s", err)
+			} else {
+				prevTotals = pt
+			}
+		}
+
+		// Deals are looked at one at a time as they arrive, and only the eligible ones
+		// are kept, in processing order: spilled to disk in sorted chunks along with
+		// the deal lists when they do not fit the memory budget
+		sortChunkSize := 0
+		if !dealsFit {
+			sortChunkSize = dealSortChunkSize
+		}
+		activeDeals := newSortedDeals(outDirName, sortChunkSize, activationOrder)
+		defer activeDeals.Close() //nolint:errcheck
+		pendingDeals := newSortedDeals(outDirName, sortChunkSize, dealIDOrder)
+		defer pendingDeals.Close() //nolint:errcheck
+
+		// besides, only what is needed of the ones not kept is remembered
+		var presentDeals map[string]struct{}
+		if store != nil {
+			presentDeals = make(map[string]struct{}, dealCountEstimate)
+		}
+		var prevDealsInState map[string]lapi.MarketDeal
+		if prevRollup != nil {
+			prevDealsInState = make(map[string]lapi.MarketDeal, len(prevRollup.deals))
+		}
+		clientIDs := make(map[address.Address]struct{})
+		projByClientID := projectsByClientID(ctx, api, ts, knownAddrMap)
+		var exclusions *exclusionLog
+		if cctx.Bool("exclusions") {
+			if exclusions, err = openExclusionLog(outDirName+"/exclusions.ndjson", projByClientID, projectsByClientID(ctx, api, ts, projects.excluded)); err != nil {
+				return err
+			}
+			defer exclusions.Close() //nolint:errcheck
+		}
+		var terminations *terminationCollector
+		if cctx.Bool("terminated-deals") {
+			terminations = new(terminationCollector)
+		}
+
+		progress.start("fetching_deals", dealCountEstimate)
+		scanned := 0
+		if err := backends.deals.ForEachDeal(ctx, ts, func(dealID string, d *lapi.MarketDeal) error {
+			if err := progress.step(scanned); err != nil {
+				return err
+			}
+			scanned++
+
+			if presentDeals != nil {
+				presentDeals[dealID] = struct{}{}
+			}
+			if prevRollup != nil {
+				if _, listed := prevRollup.deals[dealID]; listed {
+					prevDealsInState[dealID] = *d
+				}
+			}
+			if !providers.admits(d.Proposal.Provider) {
+				return exclusions.recordByClientID(dealID, d, exclusionProviderFiltered)
+			}
+			if terminations != nil {
+				terminations.observe(dealID, d)
+			}
+
+			eligibility := backends.eligibility.Eligibility(d, ts)
+			if err := exclusions.screen(dealID, d, eligibility); err != nil {
+				return err
+			}
+
+			switch eligibility {
+			case dealActive:
+				clientIDs[d.Proposal.Client] = struct{}{}
+				return activeDeals.Add(dealID, d)
+			case dealPending:
+				clientIDs[d.Proposal.Client] = struct{}{}
+				return pendingDeals.Add(dealID, d)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		metrics.DealsScanned = scanned
+
+		var vanishedPieceCounts map[string]map[pieceCapKey]int
+		var observedDeals []observedDeal
+		if store != nil {
+			if vanishedPieceCounts, err = store.vanishedPieceCounts(presentDeals, ts.Height()); err != nil {
+				return err
+			}
+			presentDeals = nil
+		}
+
+		recoveredDeals := make([]recoveredDeal, 0, 8192)
+		var estuaryDeals map[string]*estuaryDealRecord
+		if estuaryAPI := cctx.String("estuary-api"); estuaryAPI != "" {
+			if estuaryDeals, err = fetchEstuaryDeals(ctx, estuaryAPI, progress); err != nil {
+				return xerrors.Errorf("fetching repair deals from Estuary failed: %w", err)
+			}
+		}
+
+		resolverStore := store
+		if path := cctx.String("resolver-cache"); path != "" && path != cctx.String("state-db") {
+			if resolverStore, err = openStateStore(path); err != nil {
+				return err
+			}
+			defer resolverStore.Close() //nolint:errcheck
+		}
+		if resolverStore == nil && checkpoint != nil {
+			if resolverStore, err = checkpoint.resolutions(); err != nil {
+				return err
+			}
+			defer resolverStore.Close() //nolint:errcheck
+		}
+		listed := make([]address.Address, 0, len(knownAddrMap)+len(knownRestoreClients))
+		for addr := range knownAddrMap {
+			listed = append(listed, addr)
+		}
+		for addr := range knownRestoreClients {
+			listed = append(listed, addr)
+		}
+		backend := backends.resolver
+		if delegated := newDelegatedResolver(ctx, api, ts, listed); len(delegated) > 0 {
+			backend = chainedResolver{delegated, backend}
+		}
+		resolver := newCachingResolver(backend, resolverStore)
+		metrics.resolver = resolver
+		// resolutions stay valid whether the run completes or not
+		defer func() {
+			if err := resolver.Flush(); err != nil {
+				log.Warnf("persisting resolved addresses failed: %s", err)
+			}
+		}()
+
+		warnings := make(projectWarnings)
+		faultHistoryDeals := make(map[address.Address]map[abi.DealID]struct{})
+		datacapUsed := make(datacapUsage)
 
 		projStats := make(map[string]*projectAggregateStats)
-		projDealLists := make(map[string][]*individualDeal)
+		minerStatsEntries := make(minerStatsCollector)
+		providerStatsEntries := make(providerStatsCollector)
+		datasetStatsEntries := make(datasetStatsCollector)
+		timeseries := newTimeseriesCollector(ts, currentPhaseStart)
+		expiring, err := newExpiryCollector(ts.Height(), cctx.IntSlice("expiry-horizon-days"))
+		if err != nil {
+			return err
+		}
+		bursts := newBurstDetector(
+			ts.Height(),
+			currentPhaseEnd,
+			abi.ChainEpoch(cctx.Int("burst-window-days"))*builtin.EpochsInDay,
+			cctx.Float64("burst-share"),
+			int64(burstMinSize),
+		)
 		grandTotals := competitionTotal{
 			seenProject:  make(map[string]bool),
 			seenClient:   make(map[address.Address]bool),
 			seenProvider: make(map[address.Address]bool),
-			seenPieceCid: make(map[cid.Cid]bool),
+			seenPieceCid: make(map[cid.Cid]bool, dealCountEstimate),
 		}
 
-		orderedDealList := make([]string, 0, len(deals))
-		for dealID, dealInfo := range deals {
-			// Only count deals whose sectors have properly started, not past/future ones
-			// https://github.com/filecoin-project/specs-actors/blob/v0.9.9/actors/builtin/market/deal.go#L81-L85
-			// Bail on 0 as well in case SectorStartEpoch is uninitialized due to some bug
-			//
-			// Additionally if the SlashEpoch is set this means the underlying sector is
-			// terminated for whatever reason ( not just slashed ), and the deal record
-			// will soon be removed from the state entirely
-			if dealInfo.State.SectorStartEpoch <= 0 ||
-				dealInfo.State.SectorStartEpoch > ts.Height() ||
-				dealInfo.State.SlashEpoch > -1 {
+		clientList := make([]address.Address, 0, len(clientIDs))
+		for id := range clientIDs {
+			clientList = append(clientList, id)
+		}
+		if err := resolver.prefetch(ctx, clientList, cctx.Int("resolver-workers"), progress); err != nil {
+			return err
+		}
+
+		progress.start("aggregating_deals", activeDeals.Len())
+		activeIter := activeDeals.Iterate()
+		defer activeIter.Close()
+		for i := 0; activeIter.Next(); i++ {
+			if err := progress.step(i); err != nil {
+				return err
+			}
+
+			dealID, dealInfo := activeIter.Deal()
+
+			clientAddr, err := resolver.AccountKey(ctx, dealInfo.Proposal.Client)
+			if err != nil && cctx.Bool("final") {
+				return xerrors.Errorf("failed to resolve id '%s' to wallet address: %w", dealInfo.Proposal.Client, err)
+			} else if err != nil {
+				log.Warnf("failed to resolve id '%s' to wallet address: %s", dealInfo.Proposal.Client, err)
+				if projID, known := projByClientID[dealInfo.Proposal.Client]; known {
+					warnings.add(projID, warnUnresolvedClient)
+					if err := exclusions.record(dealID, projID, &dealInfo, exclusionUnresolvedClient); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			recoveryKind := recovery.recoveryKind(clientAddr, knownRestoreClients, &dealInfo)
+			isRecovery := recoveryKind != 0
+			projID, projKnown := knownAddrMap[clientAddr]
+			if !isRecovery && !projKnown {
+				continue
+			}
+
+			if dealInfo.Proposal.Label, err = labels.label(dealID, &dealInfo); err != nil {
+				return xerrors.Errorf("reading the label of deal %s: %w", dealID, err)
+			}
+			payloadCid := "unknown"
+			payloadCidB32 := "unknown"
+			c, extraRoots, labelKind := parseDealLabel(dealInfo.Proposal.Label)
+			labelIsCid := c.Defined()
+			if labelIsCid {
+				payloadCid = cidRender.render(c)
+				payloadCidB32 = cid.NewCidV1(c.Type(), c.Hash()).String()
+			}
+
+			if isRecovery {
+				rd := recoveredDeal{
+					DealID:          dealID,
+					ClientAddress:   clientAddr.String(),
+					MinerID:         dealInfo.Proposal.Provider.String(),
+					PieceCID:        dealInfo.Proposal.PieceCID.String(),
+					Label:           labelText(dealInfo.Proposal.Label),
+					PayloadCIDb32:   payloadCidB32,
+					PaddedPieceSize: uint64(dealInfo.Proposal.PieceSize),
+					DataSize:        uint64(dealInfo.Proposal.PieceSize),
+					DealStartEpoch:  int64(dealInfo.Proposal.StartEpoch),
+					DealEndEpoch:    int64(dealInfo.Proposal.EndEpoch),
+					RecoveryType:    recoveryKind,
+				}
+				if recoveryKind == recoveryRepair && estuaryDeals != nil {
+					rd.Estuary = estuaryDeals[dealID]
+				}
+				recoveredDeals = append(recoveredDeals, rd)
+
+				if formats["ndjson"] {
+					if err := outRecoveryListEnc.Encode(rd); err != nil {
+						return err
+					}
+				}
+			}
+
+			if !projKnown {
+				continue
+			}
+
+			candidate := &dealCandidate{dealID: dealID, deal: &dealInfo, client: clientAddr, isRecovery: isRecovery}
+			if rule, reason := rules.evaluate(ruleStageCompetition, candidate); rule != nil {
+				if rule.warning != "" {
+					warnings.add(projID, rule.warning)
+				}
+				if err := exclusions.record(dealID, projID, &dealInfo, reason); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !labelIsCid {
+				warnings.add(projID, warnUnparsableLabel)
+			}
+
+			projStatEntry, ok := projStats[projID]
+			if !ok {
+				projStatEntry = &projectAggregateStats{
+					ProjectID:                projID,
+					ClientStats:              make(map[string]*clientAggregateStats),
+					timesSeenPieceCid:        make(map[cid.Cid]int),
+					timesSeenPieceCidAllTime: make(map[pieceCapKey]int),
+					dataPerProvider:          make(map[address.Address]int64),
+					dataPerClient:            make(map[address.Address]int64),
+				}
+				projStats[projID] = projStatEntry
+
+				for key, cnt := range vanishedPieceCounts[projID] {
+					projStatEntry.timesSeenPieceCidAllTime[key] = cnt
+				}
+			}
+
+			pieceKey := newPieceCapKey(dealInfo.Proposal.PieceCID, dealInfo.Proposal.Provider)
+			projStatEntry.timesSeenPieceCidAllTime[pieceKey]++
+
+			if store != nil {
+				observedDeals = append(observedDeals, observedDeal{
+					DealID:      dealID,
+					ProjectID:   projID,
+					PieceCID:    dealInfo.Proposal.PieceCID,
+					Size:        int64(dealInfo.Proposal.PieceSize),
+					Provider:    dealInfo.Proposal.Provider,
+					SectorStart: dealInfo.State.SectorStartEpoch,
+				})
+			}
+
+			if breakdown != nil {
+				breakdown.observe(projID, clientAddr, &dealInfo, projStatEntry.timesSeenPieceCidAllTime[pieceKey])
+			}
+
+			candidate.timesSeenPiece = projStatEntry.timesSeenPieceCidAllTime[pieceKey]
+			if rule, reason := rules.evaluate(ruleStageQualifying, candidate); rule != nil {
+				if rule.seesProject {
+					grandTotals.seenProject[projID] = true
+				}
+				if rule.warning != "" {
+					warnings.add(projID, rule.warning)
+				}
+				if err := exclusions.record(dealID, projID, &dealInfo, reason); err != nil {
+					return err
+				}
+				continue
+			}
+
+			grandTotals.seenProject[projID] = true
+
+			grandTotals.seenClient[clientAddr] = true
+			clientStatEntry, ok := projStatEntry.ClientStats[clientAddr.String()]
+			if !ok && clientSpills.shouldSpill(projStatEntry) {
+				if err := clientSpills.Append(projID, clientAddr, dealInfo.Proposal.Provider, dealInfo.Proposal.PieceCID, int64(dealInfo.Proposal.PieceSize), dealInfo.Proposal.VerifiedDeal); err != nil {
+					return xerrors.Errorf("spilling client stats failed: %w", err)
+				}
+			} else if !ok {
+				clientStatEntry = &clientAggregateStats{
+					Client:    clientAddr.String(),
+					cids:      make(map[cid.Cid]bool),
+					providers: make(map[address.Address]bool),
+				}
+				projStatEntry.ClientStats[clientAddr.String()] = clientStatEntry
+			}
+
+			grandTotals.TotalBytes += int64(dealInfo.Proposal.PieceSize)
+			grandTotals.QATotalBytes += qualityAdjustedSize(&dealInfo.Proposal)
+			projStatEntry.DataSize += int64(dealInfo.Proposal.PieceSize)
+			projStatEntry.QADataSize += qualityAdjustedSize(&dealInfo.Proposal)
+
+			grandTotals.seenProvider[dealInfo.Proposal.Provider] = true
+			projStatEntry.dataPerProvider[dealInfo.Proposal.Provider] += int64(dealInfo.Proposal.PieceSize)
+			projStatEntry.dataPerClient[clientAddr] += int64(dealInfo.Proposal.PieceSize)
+
+			grandTotals.seenPieceCid[dealInfo.Proposal.PieceCID] = true
+			projStatEntry.timesSeenPieceCid[dealInfo.Proposal.PieceCID]++
+
+			grandTotals.TotalDeals++
+			projStatEntry.NumDeals++
+			projStatEntry.pricing.observe(&dealInfo.Proposal)
+
+			bursts.observe(projID, dealInfo.State.SectorStartEpoch, int64(dealInfo.Proposal.PieceSize))
+			minerStatsEntries.observe(dealInfo.Proposal.Provider, projID, clientAddr, int64(dealInfo.Proposal.PieceSize), dealInfo.Proposal.VerifiedDeal)
+			providerStatsEntries.observe(dealInfo.Proposal.Provider, projID, clientAddr, &dealInfo.Proposal)
+			datasetStatsEntries.observe(datasets[clientAddr], projID, dealInfo.Proposal.Provider, dealInfo.Proposal.PieceCID, int64(dealInfo.Proposal.PieceSize), dealInfo.Proposal.VerifiedDeal)
+			timeseries.observe(clientAddr, dealInfo.Proposal.Provider, dealInfo.State.SectorStartEpoch, int64(dealInfo.Proposal.PieceSize))
+			expiring.observe(projID, dealID, &dealInfo)
+
+			// nil when the client is spilled: aggregated only at write-out time
+			if clientStatEntry != nil {
+				clientStatEntry.DataSize += int64(dealInfo.Proposal.PieceSize)
+				clientStatEntry.providers[dealInfo.Proposal.Provider] = true
+				clientStatEntry.cids[dealInfo.Proposal.PieceCID] = true
+				clientStatEntry.NumDeals++
+			}
+
+			if dealInfo.Proposal.VerifiedDeal {
+				grandTotals.FilplusTotalDeals++
+				grandTotals.FilplusTotalBytes += int64(dealInfo.Proposal.PieceSize)
+				projStatEntry.FilplusNumDeals++
+				projStatEntry.FilplusDataSize += int64(dealInfo.Proposal.PieceSize)
+				if clientStatEntry != nil {
+					clientStatEntry.FilplusNumDeals++
+					clientStatEntry.FilplusDataSize += int64(dealInfo.Proposal.PieceSize)
+				}
+				datacapUsed.observe(projID, clientAddr, int64(dealInfo.Proposal.PieceSize))
+			}
+
+			for _, td := range rollupCfg.Tags {
+				matched, err := td.matches(&tagEnv{deal: &dealInfo, client: clientAddr})
+				if err != nil {
+					return xerrors.Errorf("deal %s: %w", dealID, err)
+				}
+				if !matched {
+					continue
+				}
+				if projStatEntry.Tags == nil {
+					projStatEntry.Tags = make(map[string]*tagStats, len(rollupCfg.Tags))
+				}
+				tagEntry, ok := projStatEntry.Tags[td.Name]
+				if !ok {
+					tagEntry = new(tagStats)
+					projStatEntry.Tags[td.Name] = tagEntry
+				}
+				tagEntry.NumDeals++
+				tagEntry.DataSize += int64(dealInfo.Proposal.PieceSize)
+			}
+
+			qualifyingDeal := &individualDeal{
+				DealID:         dealID,
+				ProjectID:      projID,
+				Client:         clientAddr.String(),
+				MinerID:        dealInfo.Proposal.Provider.String(),
+				PayloadCID:     payloadCid,
+				ExtraRootCIDs:  cidRender.renderAll(extraRoots),
+				LabelKind:      labelKind,
+				PaddedSize:     int64(dealInfo.Proposal.PieceSize),
+				Verified:       dealInfo.Proposal.VerifiedDeal,
+				StoragePrice:   dealInfo.Proposal.StoragePricePerEpoch.String(),
+				StorageFee:     totalStorageFee(&dealInfo.Proposal).String(),
+				Collateral:     dealInfo.Proposal.ProviderCollateral.String(),
+				DealStartEpoch: int64(dealInfo.State.SectorStartEpoch),
+			}
+			if cctx.Bool("deal-economics") {
+				qualifyingDeal.Economics = newDealEconomics(&dealInfo.Proposal)
+			}
+			if cctx.Bool("cid-original") {
+				qualifyingDeal.PayloadCIDOrig = labelPayloadText(dealInfo.Proposal.Label)
+			}
+			if err := projDealLists.Append(projID, qualifyingDeal); err != nil {
+				return err
+			}
+			if minerDealLists != nil {
+				if err := minerDealLists.Append(qualifyingDeal.MinerID, qualifyingDeal); err != nil {
+					return err
+				}
+			}
+			if cids != nil {
+				var roots []string
+				if labelIsCid {
+					roots = append([]string{payloadCid}, qualifyingDeal.ExtraRootCIDs...)
+				}
+				cids.observe(roots, cidRender.render(dealInfo.Proposal.PieceCID), projID, datasets[clientAddr], dealID)
+			}
+			if prevRollup != nil {
+				delete(prevRollup.deals, dealID)
+			}
+
+			if cctx.Bool("fault-history") {
+				numericID, err := strconv.ParseUint(dealID, 10, 64)
+				if err != nil {
+					return xerrors.Errorf("unexpected non-numeric deal id %s: %w", dealID, err)
+				}
+				if _, ok := faultHistoryDeals[dealInfo.Proposal.Provider]; !ok {
+					faultHistoryDeals[dealInfo.Proposal.Provider] = make(map[abi.DealID]struct{})
+				}
+				faultHistoryDeals[dealInfo.Proposal.Provider][abi.DealID(numericID)] = struct{}{}
+			}
+		}
+
+		if err := activeIter.Err(); err != nil {
+			return err
+		}
+
+		progress.start("listing_pending_deals", pendingDeals.Len())
+		pendingIter := pendingDeals.Iterate()
+		defer pendingIter.Close()
+		for i := 0; pendingIter.Next(); i++ {
+			if err := progress.step(i); err != nil {
+				return err
+			}
+
+			dealID, dealInfo := pendingIter.Deal()
+
+			clientAddr, err := resolver.AccountKey(ctx, dealInfo.Proposal.Client)
+			if err != nil && cctx.Bool("final") {
+				return xerrors.Errorf("failed to resolve id '%s' to wallet address: %w", dealInfo.Proposal.Client, err)
+			} else if err != nil {
+				log.Warnf("failed to resolve id '%s' to wallet address: %s", dealInfo.Proposal.Client, err)
+				if projID, known := projByClientID[dealInfo.Proposal.Client]; known {
+					warnings.add(projID, warnUnresolvedClient)
+				}
+				continue
+			}
+
+			projID, projKnown := knownAddrMap[clientAddr]
+			if !projKnown {
+				continue
+			}
+
+			// no point listing what the rules will never let qualify. They look at the
+			// sector start, which the deal only gets once activated: it is taken to be
+			// the start epoch, the latest the deal can activate at
+			projected := dealInfo
+			projected.State.SectorStartEpoch = dealInfo.Proposal.StartEpoch
+			candidate := &dealCandidate{dealID: dealID, deal: &projected, client: clientAddr}
+			candidate.isRecovery = recovery.recoveryKind(clientAddr, knownRestoreClients, &projected) != 0
+			if rule, _ := rules.firstFailed(ruleStageCompetition, candidate); rule != nil {
 				continue
 			}
-
-			orderedDealList = append(orderedDealList, dealID)
+			pieceKey := newPieceCapKey(dealInfo.Proposal.PieceCID, dealInfo.Proposal.Provider)
+			if ps, ok := projStats[projID]; ok {
+				candidate.timesSeenPiece = ps.timesSeenPieceCidAllTime[pieceKey] + 1
+			} else {
+				candidate.timesSeenPiece = vanishedPieceCounts[projID][pieceKey] + 1
+			}
+			if rule, _ := rules.firstFailed(ruleStageQualifying, candidate); rule != nil {
+				continue
+			}
+
+			if dealInfo.Proposal.Label, err = labels.label(dealID, &dealInfo); err != nil {
+				return xerrors.Errorf("reading the label of deal %s: %w", dealID, err)
+			}
+			payloadCid := "unknown"
+			c, extraRoots, labelKind := parseDealLabel(dealInfo.Proposal.Label)
+			if c.Defined() {
+				payloadCid = cidRender.render(c)
+			} else {
+				warnings.add(projID, warnUnparsableLabel)
+			}
+
+			pendingDeal := &individualDeal{
+				DealID:         dealID,
+				ProjectID:      projID,
+				Client:         clientAddr.String(),
+				MinerID:        dealInfo.Proposal.Provider.String(),
+				PayloadCID:     payloadCid,
+				ExtraRootCIDs:  cidRender.renderAll(extraRoots),
+				LabelKind:      labelKind,
+				PaddedSize:     int64(dealInfo.Proposal.PieceSize),
+				Verified:       dealInfo.Proposal.VerifiedDeal,
+				StoragePrice:   dealInfo.Proposal.StoragePricePerEpoch.String(),
+				StorageFee:     totalStorageFee(&dealInfo.Proposal).String(),
+				Collateral:     dealInfo.Proposal.ProviderCollateral.String(),
+				DealStartEpoch: int64(dealInfo.Proposal.StartEpoch),
+				Pending:        true,
+			}
+			if cctx.Bool("deal-economics") {
+				pendingDeal.Economics = newDealEconomics(&dealInfo.Proposal)
+			}
+			if cctx.Bool("cid-original") {
+				pendingDeal.PayloadCIDOrig = labelPayloadText(dealInfo.Proposal.Label)
+			}
+			if err := projDealLists.Append(projID, pendingDeal); err != nil {
+				return err
+			}
+			if prevRollup != nil {
+				delete(prevRollup.deals, dealID)
+			}
+		}
+
+		if err := pendingIter.Err(); err != nil {
+			return err
+		}
+
+		metrics.DealsQualified = grandTotals.TotalDeals
+
+		var sinks []rollupSink
+		if cctx.String("sqlite") != "" {
+			sqlDb, err := openSQLiteSink(cctx.String("sqlite"), ts)
+			if err != nil {
+				return err
+			}
+			defer sqlDb.Close() //nolint:errcheck
+			sinks = append(sinks, sqlDb)
+		}
+		if cctx.String("bigquery-dataset") != "" {
+			bq, err := openBigQuerySink(ctx, cctx.String("bigquery-dataset"), cctx.String("bigquery-table-prefix"), cctx.String("bigquery-credentials"), ts)
+			if err != nil {
+				return err
+			}
+			defer bq.Close() //nolint:errcheck
+			sinks = append(sinks, bq)
+		}
+
+		//
+		// Write out per-project deal lists
+		projIDs := projDealLists.Projects()
+		progress.start("writing_deal_lists", len(projIDs))
+		for i, proj := range projIDs {
+			if err := progress.step(i); err != nil {
+				return err
+			}
+			err := func() error {
+				// ndjson deal lists are complete already, only load them if other outputs need them
+				if formats["ndjson"] && !formats["csv"] && !formats["parquet"] && !formats["car"] && len(sinks) == 0 {
+					return nil
+				}
+
+				dl, err := projDealLists.Load(proj)
+				if err != nil {
+					return err
+				}
+
+				sort.Slice(dl, func(i, j int) bool {
+					return dl[j].PaddedSize < dl[i].PaddedSize
+				})
+
+				if !formats["ndjson"] {
+					listName := filepath.Join(outDirName, fmt.Sprintf(naming.dealListFmt(".json"), proj))
+					if err := failures.check(listName, writeDealListJSON(
+						listName,
+						dealListOutput{
+							Epoch:         int64(ts.Height()),
+							TipSetKey:     ts.Cids(),
+							Endpoint:      "DEAL_LIST",
+							Phase:         currentPhaseID,
+							SchemaVersion: outputSchemaVersion,
+						},
+						dl,
+					)); err != nil {
+						return err
+					}
+				}
+
+				if formats["csv"] {
+					listName := filepath.Join(outDirName, fmt.Sprintf(naming.dealListFmt(".csv"), proj))
+					if err := failures.check(listName, writeDealListCSV(listName, dl)); err != nil {
+						return err
+					}
+				}
+				if formats["parquet"] {
+					listName := filepath.Join(outDirName, fmt.Sprintf(naming.dealListFmt(".parquet"), proj))
+					if err := failures.check(listName, writeParquet(listName, dl)); err != nil {
+						return err
+					}
+				}
+				for _, sink := range sinks {
+					if err := sink.addDeals(dl); err != nil {
+						return err
+					}
+				}
+				if resultsCar != nil {
+					if err := resultsCar.addDeals(proj, dl); err != nil {
+						return xerrors.Errorf("adding deal list of %s to %s: %w", proj, carOutputName, err)
+					}
+				}
+
+				return nil
+			}()
+
+			if err != nil {
+				return err
+			}
+		}
+		if err := projDealLists.Close(); err != nil {
+			return err
+		}
+
+		//
+		// Write out per-provider deal lists
+		if minerDealLists != nil {
+			if err := writeMinerDealLists(outDirName, ts, minerDealLists, formats, failures); err != nil {
+				return xerrors.Errorf("writing per-provider deal lists failed: %w", err)
+			}
+		}
+
+		//
+		// write out basic_stats.json
+		grandTotals.UniqueCids = len(grandTotals.seenPieceCid)
+		grandTotals.UniqueClients = len(grandTotals.seenClient)
+		grandTotals.UniqueProviders = len(grandTotals.seenProvider)
+		grandTotals.UniqueProjects = len(grandTotals.seenProject)
+
+		if err := failures.check(outBasicStatsFd.Name(), json.NewEncoder(outBasicStatsFd).Encode(
+			competitionTotalOutput{
+				Epoch:         int64(ts.Height()),
+				TipSetKey:     ts.Cids(),
+				Endpoint:      "COMPETITION_TOTALS",
+				Phase:         currentPhaseID,
+				SchemaVersion: outputSchemaVersion,
+				Payload:       grandTotals,
+			},
+		)); err != nil {
+			return err
+		}
+		for _, sink := range sinks {
+			if err := sink.addTotals(&grandTotals); err != nil {
+				return err
+			}
+		}
+		if resultsCar != nil {
+			if err := resultsCar.setTotals(&grandTotals); err != nil {
+				return err
+			}
+		}
+		if cctx.String("prometheus-textfile") != "" {
+			if err := writePrometheusTextfile(cctx.String("prometheus-textfile"), int64(ts.Height()), &grandTotals); err != nil {
+				return xerrors.Errorf("writing prometheus textfile failed: %w", err)
+			}
+		}
+		if formats["csv"] {
+			if err := failures.check(outDirName+"/basic_stats.csv", writeBasicStatsCSV(outDirName+"/basic_stats.csv", int64(ts.Height()), &grandTotals)); err != nil {
+				return err
+			}
+		}
+
+		//
+		// write out recovery_deallist.json
+		if err := failures.check(recoveryListName, func() error {
+			if !formats["ndjson"] {
+				if err := outRecoveryListEnc.Encode(
+					recoveryListOutput{
+						Epoch:         int64(ts.Height()),
+						TipSetKey:     ts.Cids(),
+						Endpoint:      "RECOVERED_DEALS_LIST",
+						Phase:         currentPhaseID,
+						SchemaVersion: outputSchemaVersion,
+						Payload:       recoveredDeals,
+					},
+				); err != nil {
+					return err
+				}
+			}
+			return outRecoveryListBuf.Flush()
+		}()); err != nil {
+			return err
+		}
+		if formats["csv"] {
+			if err := failures.check(outDirName+"/recovery_deallist.csv", writeRecoveryListCSV(outDirName+"/recovery_deallist.csv", recoveredDeals)); err != nil {
+				return err
+			}
+		}
+		if formats["parquet"] {
+			if err := failures.check(outDirName+"/recovery_deallist.parquet", writeParquet(outDirName+"/recovery_deallist.parquet", recoveredDeals)); err != nil {
+				return err
+			}
+		}
+		for _, sink := range sinks {
+			if err := sink.addRecoveredDeals(recoveredDeals); err != nil {
+				return err
+			}
+		}
+		if resultsCar != nil {
+			if err := resultsCar.setRecoveredDeals(recoveredDeals); err != nil {
+				return err
+			}
+		}
+
+		//
+		// write out removed_deals.json
+		if prevRollup != nil {
+			removedDeals := annotateRemovedDeals(ctx, api, ts, prevDealsInState, prevRollup)
+
+			if err := failures.check(outDirName+"/removed_deals.json", writeJSONFile(
+				outDirName+"/removed_deals.json",
+				removedDealsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "REMOVED_DEALS",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       removedDeals,
+				},
+			)); err != nil {
+				return err
+			}
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/removed_deals.csv", writeRemovedDealsCSV(outDirName+"/removed_deals.csv", removedDeals)); err != nil {
+					return err
+				}
+			}
+		}
+
+		//
+		// write out provider_faults.json
+		if cctx.Bool("fault-history") {
+			faultHistory, err := collectFaultHistory(ctx, api, ts, currentPhaseStart, currentPhaseEnd, faultHistoryDeals, progress)
+			if err != nil {
+				return xerrors.Errorf("collecting provider fault history failed: %w", err)
+			}
+
+			if err := failures.check(outDirName+"/provider_faults.json", writeJSONFile(
+				outDirName+"/provider_faults.json",
+				providerFaultHistoryOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "PROVIDER_FAULT_HISTORY",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       faultHistory,
+				},
+			)); err != nil {
+				return err
+			}
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/provider_faults.csv", writeProviderFaultsCSV(outDirName+"/provider_faults.csv", int64(ts.Height()), faultHistory)); err != nil {
+					return err
+				}
+			}
+		}
+
+		//
+		// write out datacap_stats.json
+		if cctx.Bool("datacap") {
+			datacap, err := collectDatacap(ctx, api, ts, knownAddrMap, datacapUsed, progress)
+			if err != nil {
+				return xerrors.Errorf("collecting datacap stats failed: %w", err)
+			}
+
+			if err := failures.check(outDirName+"/datacap_stats.json", writeJSONFile(
+				outDirName+"/datacap_stats.json",
+				datacapStatsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "DATACAP_STATS",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       datacap,
+				},
+			)); err != nil {
+				return err
+			}
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/datacap_stats.csv", writeDatacapStatsCSV(outDirName+"/datacap_stats.csv", int64(ts.Height()), datacap)); err != nil {
+					return err
+				}
+			}
+		}
+
+		//
+		// write out burst_report.json
+		{
+			burstList := bursts.bursts(projStats)
+
+			if err := failures.check(outDirName+"/burst_report.json", writeJSONFile(
+				outDirName+"/burst_report.json",
+				onboardingBurstOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "ONBOARDING_BURSTS",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       burstList,
+				},
+			)); err != nil {
+				return err
+			}
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/burst_report.csv", writeBurstReportCSV(outDirName+"/burst_report.csv", int64(ts.Height()), burstList)); err != nil {
+					return err
+				}
+			}
 		}
 
-		sort.Slice(orderedDealList, func(i, j int) bool {
-			di, dj := deals[orderedDealList[i]], deals[orderedDealList[j]]
-			switch {
-
-			case di.State.SectorStartEpoch != dj.State.SectorStartEpoch:
-				return di.State.SectorStartEpoch < dj.State.SectorStartEpoch
-
-			case di.Proposal.StartEpoch != dj.Proposal.StartEpoch:
-				return di.Proposal.StartEpoch < dj.Proposal.StartEpoch
-
-			default:
-				didi, _ := strconv.ParseInt(orderedDealList[i], 10, 64)
-				didj, _ := strconv.ParseInt(orderedDealList[j], 10, 64)
-				return didi < didj
+		//
+		// write out miner_stats.json
+		{
+			minerList := minerStatsEntries.list(providerProbes)
+
+			if err := failures.check(outDirName+"/miner_stats.json", writeJSONFile(
+				outDirName+"/miner_stats.json",
+				minerStatsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "MINER_STATS",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       minerList,
+				},
+			)); err != nil {
+				return err
 			}
-		})
-
-		for _, dealID := range orderedDealList {
-
-			dealInfo := deals[dealID]
-
-			payloadCid := "unknown"
-			payloadCidB32 := "unknown"
-			if c, err := cid.Parse(dealInfo.Proposal.Label); err == nil {
-				payloadCid = c.String()
-				payloadCidB32 = cid.NewCidV1(c.Type(), c.Hash()).String()
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/miner_stats.csv", writeMinerStatsCSV(outDirName+"/miner_stats.csv", int64(ts.Height()), minerList)); err != nil {
+					return err
+				}
 			}
+		}
 
-			clientAddr, found := resolvedWallets[dealInfo.Proposal.Client]
-			if !found {
-				var err error
-				clientAddr, err = api.StateAccountKey(ctx, dealInfo.Proposal.Client, ts.Key())
+		//
+		// write out provider_stats.json
+		{
+			providerList := providerStatsEntries.list()
+			if store != nil {
+				firstSeen, err := store.providerFirstSeen(observedDeals)
 				if err != nil {
-					log.Warnf("failed to resolve id '%s' to wallet address: %s", dealInfo.Proposal.Client, err)
-					continue
+					return err
+				}
+				for _, ps := range providerList {
+					provider, err := address.NewFromString(ps.ProviderID)
+					if err != nil {
+						return err
+					}
+					ps.FirstSeenEpoch = int64(firstSeen[provider])
 				}
-
-				resolvedWallets[dealInfo.Proposal.Client] = clientAddr
 			}
-
-			if _, isRecover := knownRestoreClients[clientAddr]; isRecover &&
-				dealInfo.State.SectorStartEpoch >= recoveryStart &&
-				dealInfo.Proposal.EndEpoch-dealInfo.Proposal.StartEpoch > builtin.EpochsInDay*499 {
-				recoveredDeals = append(recoveredDeals, recoveredDeal{
-					DealID:          dealID,
-					ClientAddress:   clientAddr.String(),
-					MinerID:         dealInfo.Proposal.Provider.String(),
-					PieceCID:        dealInfo.Proposal.PieceCID.String(),
-					Label:           dealInfo.Proposal.Label,
-					PayloadCIDb32:   payloadCidB32,
-					PaddedPieceSize: uint64(dealInfo.Proposal.PieceSize),
-					DataSize:        uint64(dealInfo.Proposal.PieceSize),
-					DealStartEpoch:  int64(dealInfo.Proposal.StartEpoch),
-					DealEndEpoch:    int64(dealInfo.Proposal.EndEpoch),
-					RecoveryType:    1,
-				})
+			if cctx.Bool("miner-power") {
+				if err := joinMinerPower(ctx, api, ts, providerList, progress); err != nil {
+					return xerrors.Errorf("querying miner power failed: %w", err)
+				}
 			}
-
-			// TEMP WORKAROUND
-			if clientAddr.String() == "f17ia7m5mvizrdug3sqtevqw3tifiqvxqr3kdaeuq" && dealInfo.State.SectorStartEpoch >= recoveryStart {
-				continue
+			if geoDB != nil {
+				if err := locateProviders(ctx, api, ts, geoDB, providerList, progress); err != nil {
+					return xerrors.Errorf("locating providers failed: %w", err)
+				}
 			}
 
-			projID, projKnown := knownAddrMap[clientAddr]
-			if !projKnown {
-				continue
+			if err := failures.check(outDirName+"/provider_stats.json", writeJSONFile(
+				outDirName+"/provider_stats.json",
+				providerStatsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "PROVIDER_STATS",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       providerList,
+				},
+			)); err != nil {
+				return err
 			}
-
-			projStatEntry, ok := projStats[projID]
-			if !ok {
-				projStatEntry = &projectAggregateStats{
-					ProjectID:                projID,
-					ClientStats:              make(map[string]*clientAggregateStats),
-					timesSeenPieceCid:        make(map[cid.Cid]int),
-					timesSeenPieceCidAllTime: make(map[cid.Cid]int),
-					dataPerProvider:          make(map[address.Address]int64),
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/provider_stats.csv", writeProviderStatsCSV(outDirName+"/provider_stats.csv", int64(ts.Height()), providerList)); err != nil {
+					return err
 				}
-				projStats[projID] = projStatEntry
 			}
 
-			projStatEntry.timesSeenPieceCidAllTime[dealInfo.Proposal.PieceCID]++
-
-			if dealInfo.State.SectorStartEpoch < currentPhaseStart {
-				continue
+			//
+			// write out geo_distribution.json
+			if geoDB != nil {
+				geoList := newGeoDistribution(providerList)
+
+				if err := failures.check(outDirName+"/geo_distribution.json", writeJSONFile(
+					outDirName+"/geo_distribution.json",
+					geoDistributionOutput{
+						Epoch:         int64(ts.Height()),
+						TipSetKey:     ts.Cids(),
+						Endpoint:      "GEO_DISTRIBUTION",
+						Phase:         currentPhaseID,
+						SchemaVersion: outputSchemaVersion,
+						Payload:       geoList,
+					},
+				)); err != nil {
+					return err
+				}
+				if formats["csv"] {
+					if err := failures.check(outDirName+"/geo_distribution.csv", writeGeoDistributionCSV(outDirName+"/geo_distribution.csv", int64(ts.Height()), geoList)); err != nil {
+						return err
+					}
+				}
 			}
+		}
 
-			// anything under 360 days: not qualified
-			if dealInfo.Proposal.EndEpoch-dealInfo.Proposal.StartEpoch < builtin.EpochsInDay*360 {
-				continue
+		//
+		// write out exclusions.ndjson
+		if exclusions != nil {
+			if err := failures.check(outDirName+"/exclusions.ndjson", exclusions.Close()); err != nil {
+				return err
 			}
+		}
 
-			grandTotals.seenProject[projID] = true
-
-			if projStatEntry.timesSeenPieceCidAllTime[dealInfo.Proposal.PieceCID] >= 10 {
-				continue
+		//
+		// write out terminated_deals.json
+		if terminations != nil {
+			terminated := terminations.report(projByClientID, providerStatsEntries)
+
+			if err := failures.check(outDirName+"/terminated_deals.json", writeJSONFile(
+				outDirName+"/terminated_deals.json",
+				terminatedDealsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "TERMINATED_DEALS",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       terminated,
+				},
+			)); err != nil {
+				return err
 			}
-
-			grandTotals.seenClient[clientAddr] = true
-			clientStatEntry, ok := projStatEntry.ClientStats[clientAddr.String()]
-			if !ok {
-				clientStatEntry = &clientAggregateStats{
-					Client:    clientAddr.String(),
-					cids:      make(map[cid.Cid]bool),
-					providers: make(map[address.Address]bool),
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/terminated_deals.csv", writeTerminatedDealsCSV(outDirName+"/terminated_deals.csv", int64(ts.Height()), terminated)); err != nil {
+					return err
 				}
-				projStatEntry.ClientStats[clientAddr.String()] = clientStatEntry
 			}
+		}
 
-			grandTotals.TotalBytes += int64(dealInfo.Proposal.PieceSize)
-			projStatEntry.DataSize += int64(dealInfo.Proposal.PieceSize)
-			clientStatEntry.DataSize += int64(dealInfo.Proposal.PieceSize)
-
-			grandTotals.seenProvider[dealInfo.Proposal.Provider] = true
-			projStatEntry.dataPerProvider[dealInfo.Proposal.Provider] += int64(dealInfo.Proposal.PieceSize)
-			clientStatEntry.providers[dealInfo.Proposal.Provider] = true
-
-			grandTotals.seenPieceCid[dealInfo.Proposal.PieceCID] = true
-			projStatEntry.timesSeenPieceCid[dealInfo.Proposal.PieceCID]++
-			clientStatEntry.cids[dealInfo.Proposal.PieceCID] = true
-
-			grandTotals.TotalDeals++
-			projStatEntry.NumDeals++
-			clientStatEntry.NumDeals++
-
-			if dealInfo.Proposal.VerifiedDeal {
-				grandTotals.FilplusTotalDeals++
-				grandTotals.FilplusTotalBytes += int64(dealInfo.Proposal.PieceSize)
+		//
+		// write out dataset_stats.json
+		{
+			datasetList := datasetStatsEntries.list()
+
+			if err := failures.check(outDirName+"/dataset_stats.json", writeJSONFile(
+				outDirName+"/dataset_stats.json",
+				datasetStatsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "DATASET_STATS",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       datasetList,
+				},
+			)); err != nil {
+				return err
+			}
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/dataset_stats.csv", writeDatasetStatsCSV(outDirName+"/dataset_stats.csv", int64(ts.Height()), datasetList)); err != nil {
+					return err
+				}
 			}
+		}
 
-			projDealLists[projID] = append(projDealLists[projID], &individualDeal{
-				DealID:         dealID,
-				ProjectID:      projID,
-				Client:         clientAddr.String(),
-				MinerID:        dealInfo.Proposal.Provider.String(),
-				PayloadCID:     payloadCid,
-				PaddedSize:     int64(dealInfo.Proposal.PieceSize),
-				DealStartEpoch: int64(dealInfo.State.SectorStartEpoch),
-			})
+		//
+		// write out cid_index.json
+		if cids != nil {
+			if err := failures.check(outDirName+"/cid_index.json", writeJSONFile(
+				outDirName+"/cid_index.json",
+				cidIndexOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "CID_INDEX",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       cids.list(),
+				},
+			)); err != nil {
+				return err
+			}
 		}
 
 		//
-		// Write out per-project deal lists
-		for proj, dl := range projDealLists {
-			err := func() error {
-				outListFd, err := os.Create(fmt.Sprintf(outDirName+"/deals_list_%s.json", proj))
-				if err != nil {
+		// write out timeseries_stats.json
+		{
+			dayList := timeseries.list()
+
+			if err := failures.check(outDirName+"/timeseries_stats.json", writeJSONFile(
+				outDirName+"/timeseries_stats.json",
+				timeseriesStatsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "DAILY_TIMESERIES",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					Payload:       dayList,
+				},
+			)); err != nil {
+				return err
+			}
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/timeseries_stats.csv", writeTimeseriesStatsCSV(outDirName+"/timeseries_stats.csv", int64(ts.Height()), dayList)); err != nil {
 					return err
 				}
+			}
+		}
 
-				defer outListFd.Close() //nolint:errcheck
-
-				sort.Slice(dl, func(i, j int) bool {
-					return dl[j].PaddedSize < dl[i].PaddedSize
-				})
-
-				if err := json.NewEncoder(outListFd).Encode(
-					dealListOutput{
-						Epoch:    int64(ts.Height()),
-						Endpoint: "DEAL_LIST",
-						Payload:  dl,
-					},
-				); err != nil {
+		//
+		// write out expiring_deals.json
+		{
+			expiringList := expiring.list()
+
+			if err := failures.check(outDirName+"/expiring_deals.json", writeJSONFile(
+				outDirName+"/expiring_deals.json",
+				expiringDealsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "EXPIRING_DEALS",
+					Phase:         currentPhaseID,
+					SchemaVersion: outputSchemaVersion,
+					HorizonDays:   expiring.horizons,
+					Payload:       expiringList,
+				},
+			)); err != nil {
+				return err
+			}
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/expiring_deals.csv", writeExpiringDealsCSV(outDirName+"/expiring_deals.csv", int64(ts.Height()), expiringList)); err != nil {
 					return err
 				}
+			}
+		}
 
-				return nil
-			}()
-
-			if err != nil {
+		//
+		// write out phase_stats.json
+		if breakdown != nil {
+			phaseList := breakdown.list()
+
+			if err := failures.check(outDirName+"/phase_stats.json", writeJSONFile(
+				outDirName+"/phase_stats.json",
+				phaseStatsOutput{
+					Epoch:         int64(ts.Height()),
+					TipSetKey:     ts.Cids(),
+					Endpoint:      "PHASE_STATS",
+					SchemaVersion: outputSchemaVersion,
+					Payload:       phaseList,
+				},
+			)); err != nil {
 				return err
 			}
+			if formats["csv"] {
+				if err := failures.check(outDirName+"/phase_stats.csv", writePhaseStatsCSV(outDirName+"/phase_stats.csv", int64(ts.Height()), phaseList)); err != nil {
+					return err
+				}
+			}
 		}
 
 		//
-		// write out basic_stats.json
-		grandTotals.UniqueCids = len(grandTotals.seenPieceCid)
-		grandTotals.UniqueClients = len(grandTotals.seenClient)
-		grandTotals.UniqueProviders = len(grandTotals.seenProvider)
-		grandTotals.UniqueProjects = len(grandTotals.seenProject)
+		// write out client_stats.json
 
-		if err := json.NewEncoder(outBasicStatsFd).Encode(
-			competitionTotalOutput{
-				Epoch:    int64(ts.Height()),
-				Endpoint: "COMPETITION_TOTALS",
-				Payload:  grandTotals,
-			},
-		); err != nil {
-			return err
+		// projects that only have caveats still show up, rather than silently missing
+		for projID := range warnings {
+			if _, ok := projStats[projID]; !ok {
+				projStats[projID] = &projectAggregateStats{
+					ProjectID:   projID,
+					ClientStats: make(map[string]*clientAggregateStats),
+				}
+			}
 		}
 
-		//
-		// write out recovery_deallist.json
-		if err := json.NewEncoder(outRecoveryListFd).Encode(
-			recoveryListOutput{
-				Epoch:    int64(ts.Height()),
-				Endpoint: "RECOVERED_DEALS_LIST",
-				Payload:  recoveredDeals,
-			},
-		); err != nil {
-			return err
+		if err := resolver.Flush(); err != nil {
+			return xerrors.Errorf("persisting resolved addresses failed: %w", err)
+		}
+		if store != nil {
+			if err := store.record(observedDeals); err != nil {
+				return xerrors.Errorf("updating state store failed: %w", err)
+			}
+			lifetimeBytes, err := store.projectLifetimeBytes()
+			if err != nil {
+				return err
+			}
+			for projID, ps := range projStats {
+				ps.LifetimeDataSize = lifetimeBytes[projID]
+			}
 		}
 
-		//
-		// write out client_stats.json
-		for _, ps := range projStats {
+		for projID, ps := range projStats {
+			ps.Warnings = warnings.list(projID)
 			ps.NumCids = len(ps.timesSeenPieceCid)
 			ps.NumProviders = len(ps.dataPerProvider)
 			for _, dealsForCid := range ps.timesSeenPieceCid {
@@ -500,6 +2212,13 @@ var rollup = &cli.Command{
 					ps.DataSizeMaxProvider = dataForProvider
 				}
 			}
+			ps.LargestClientShare, ps.NumClients90Pct = clientConcentration(ps.DataSize, ps.dataPerClient)
+			if ps.DataSize > 0 {
+				ps.FilplusDataShare = float64(ps.FilplusDataSize) / float64(ps.DataSize)
+			}
+			ps.TotalStorageFee, ps.AvgStoragePrice, ps.ProviderCollateral, ps.NumZeroPriceDeals = ps.pricing.totals()
+			ps.Registration = registrations[ps.ProjectID]
+			ps.ProjectName = projects.names[ps.ProjectID]
 
 			for _, cs := range ps.ClientStats {
 				cs.NumCids = len(cs.cids)
@@ -507,20 +2226,99 @@ var rollup = &cli.Command{
 			}
 		}
 
-		if err := json.NewEncoder(outClientStatsFd).Encode(
-			projectAggregateStatsOutput{
-				Epoch:    int64(ts.Height()),
-				Endpoint: "PROJECT_DEAL_STATS",
-				Payload:  projStats,
-			},
+		if err := failures.check(outClientStatsFd.Name(), writeClientStatsJSON(outClientStatsFd, int64(ts.Height()), ts.Cids(), currentPhaseID, projStats, clientSpills)); err != nil {
+			return err
+		}
+		if formats["csv"] {
+			if err := failures.check(outDirName+"/client_stats.csv", writeClientStatsCSV(outDirName+"/client_stats.csv", int64(ts.Height()), projStats, clientSpills)); err != nil {
+				return err
+			}
+		}
+		for _, sink := range sinks {
+			if err := sink.addProjectStats(projStats, clientSpills); err != nil {
+				return err
+			}
+			if err := sink.Commit(); err != nil {
+				return xerrors.Errorf("committing rollup to %T failed: %w", sink, err)
+			}
+		}
+		if resultsCar != nil {
+			if err := failures.check(filepath.Join(outDirName, carOutputName), func() error {
+				if err := resultsCar.setProjects(projStats, clientSpills); err != nil {
+					return err
+				}
+				if err := resultsCar.finish(ts); err != nil {
+					return err
+				}
+				return resultsCar.Close()
+			}()); err != nil {
+				return err
+			}
+		}
+
+		if err := writeSummary(
+			outDirName,
+			newRollupSummary(int64(ts.Height()), &grandTotals, projStats, prevTotals),
+			formats["html"],
 		); err != nil {
+			return xerrors.Errorf("writing summary failed: %w", err)
+		}
+
+		rules.logHits()
+		if err := writeRollupParameters(outDirName, ts, lookback, recovery, rules, excludeList, providers); err != nil {
+			return err
+		}
+		if err := writeSchemaFile(outDirName); err != nil {
+			return err
+		}
+		if cctx.Bool("final") {
+			if err := validateRollup(outDirName, ts, naming.dealListFmt(""), formats["ndjson"]); err != nil {
+				return xerrors.Errorf("validating the final rollup failed: %w", err)
+			}
+		}
+
+		if signer != nil {
+			if err := writeOutputSignature(outDirName, int64(ts.Height()), fingerprint, signer); err != nil {
+				return err
+			}
+		}
+		if err := writeManifest(outDirName, int64(ts.Height()), fingerprint, failures.failed); err != nil {
+			return xerrors.Errorf("writing %s failed: %w", manifestName, err)
+		}
+
+		// an incomplete rollup gets no fingerprint: it is neither served, published
+		// nor mistaken for a finished identical run
+		if len(failures.failed) > 0 {
+			return cli.Exit(fmt.Sprintf("%d outputs could not be written, see %s for the list", len(failures.failed), filepath.Join(outDirName, manifestName)), exitCodePartialOutputs)
+		}
+
+		if err := writeRunFingerprint(outDirName, fingerprint); err != nil {
+			return err
+		}
+		progress.start("done", 0)
+
+		if err := publish(outDirName); err != nil {
 			return err
 		}
 
+		if cctx.Bool("stdout") {
+			return streamOutputs(outDirName, naming.dealListGlob(".json"), os.Stdout)
+		}
+
 		return nil
 	},
 }
 
+// The active projects, by the client addresses they registered
+type projectList struct {
+	byAddr        map[address.Address]string
+	registrations map[string]map[string]interface{} // by project, of the --registration-field fields
+	datasets      map[address.Address][]string      // the curated datasets each address registers
+	excluded      map[address.Address]string        // registered, but disqualified by a dataset of the exclusion list
+
+	names map[string]string // by project, the names given in the list
+}
+
 // Downloads and parses JSON input in the form:
 // {
 // 	"payload": [
@@ -532,10 +2330,25 @@ var rollup = &cli.Command{
 // 			"project": "5fb608c4ad3275e236287ced",
 // 			"address": "f3rs2khurnubol6ent27lpggidxxujqo2lg5aap5d5bmtam6yjb5wfla5cxxdgj45tqoaawgpzt5lofc3vpzfq"
 // 		},
+// 		{
+// 			"project": "5fb60a2fad3275e236287cf1",
+// 			"name": "Example project",
+// 			"addresses": [
+// 				"f1abjxfbp274xpdqcpuaykwkfb43omjotacm2p3za",
+// 				"f1ys5qqiciehcml3sp764ymbbytfn3qoar5fo3iwy"
+// 			]
+// 		},
 //  	...
 //  ]
 // }
-func getAndParseProjectList(ctx context.Context, saveToDir, projListName string) (map[address.Address]string, error) {
+//
+// Entries of the same project are merged, as are the addresses of an entry listing
+// several: all the wallets of a project count towards the same stats. The
+// registrationFields of each entry are collected per project, to be passed
+// through into the outputs as-is. Projects registering a dataset of the exclusion
+// list are disqualified. An address registered by several projects belongs to the
+// last one listing it, whether that project qualifies or not.
+func getAndParseProjectList(ctx context.Context, saveToDir, projListName string, registrationFields []string, excludeList *exclusionList) (*projectList, error) {
 
 	var projListSrc io.Reader
 
@@ -581,7 +2394,15 @@ func getAndParseProjectList(ctx context.Context, saveToDir, projListName string)
 		return nil, err
 	}
 
-	projList, err := gabs.ParseJSONBuffer(projListCopy)
+	raw, err := ioutil.ReadAll(projListCopy)
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = relaxedJSON(raw); err != nil {
+		return nil, xerrors.Errorf("failed to parse %s: %w", projListName, err)
+	}
+
+	projList, err := gabs.ParseJSON(raw)
 	if err != nil {
 		return nil, err
 	}
@@ -591,12 +2412,20 @@ func getAndParseProjectList(ctx context.Context, saveToDir, projListName string)
 	}
 
 	ret := make(map[address.Address]string, 64)
+	registrations := make(map[string]map[string]interface{})
+	datasets := make(map[address.Address][]string)
+	excluded := make(map[address.Address]string)
+
+	names := make(map[string]string)
 
-knownProject:
 	for _, p := range proj {
-		a, err := address.NewFromString(p.S("address").Data().(string))
+		projID, isStr := p.S("project").Data().(string)
+		if !isStr || projID == "" {
+			return nil, xerrors.Errorf("entry without a project id in %s", projListName)
+		}
+		addrStrs, err := projectListAddresses(p)
 		if err != nil {
-			return nil, err
+			return nil, xerrors.Errorf("invalid entry of project %s in %s: %w", projID, projListName, err)
 		}
 
 		dsets, err := p.Search("curatedDataset").Children()
@@ -604,21 +2433,121 @@ knownProject:
 			return nil, err
 		}
 
-		// TEMP WORKAROUND
-		// disqualify any project that has `landsat-8` registered
+		var dsetIDs []string
+	registeredDataset:
 		for _, dset := range dsets {
-			if dset.Data().(string) == "landsat-8" {
-				continue knownProject
+			dsetID, isStr := dset.Data().(string)
+			if !isStr || dsetID == "" {
+				continue
+			}
+			for _, seen := range dsetIDs {
+				if seen == dsetID {
+					continue registeredDataset
+				}
+			}
+			dsetIDs = append(dsetIDs, dsetID)
+		}
+		disqualifiedBy := excludeList.disqualifyingDataset(dsetIDs)
+
+		for _, addrStr := range addrStrs {
+			a, err := address.NewFromString(addrStr)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid address '%s' of project %s in %s: %w", addrStr, projID, projListName, err)
+			}
+			other, seen := ret[a]
+			if !seen {
+				other, seen = excluded[a]
+			}
+			if seen && other != projID {
+				log.Warnf("address %s is registered by both project %s and %s, attributing it to the latter", a, other, projID)
+			}
+			delete(ret, a)
+			delete(excluded, a)
+			delete(datasets, a)
+
+			if disqualifiedBy != "" {
+				excluded[a] = projID
+				continue
+			}
+			ret[a] = projID
+			if len(dsetIDs) > 0 {
+				datasets[a] = dsetIDs
+			}
+		}
+		if disqualifiedBy != "" {
+			log.Infof("project %s registers dataset '%s' of the exclusion list: disqualified", projID, disqualifiedBy)
+			continue
+		}
+
+		if name, isStr := p.S("name").Data().(string); isStr && name != "" {
+			if prev, seen := names[projID]; !seen {
+				names[projID] = name
+			} else if prev != name {
+				log.Warnf("project %s registers conflicting names, keeping the first one: %s", projID, prev)
 			}
 		}
 
-		ret[a] = p.S("project").Data().(string)
+		// a project registering several entries is expected to repeat the same
+		// details with each of them
+		for _, field := range registrationFields {
+			if !p.Exists(field) {
+				continue
+			}
+			reg, ok := registrations[projID]
+			if !ok {
+				reg = make(map[string]interface{}, len(registrationFields))
+				registrations[projID] = reg
+			}
+			val := p.S(field).Data()
+			if prev, seen := reg[field]; !seen {
+				reg[field] = val
+			} else if !reflect.DeepEqual(prev, val) {
+				log.Warnf("project %s registers conflicting values for '%s', keeping the first one: %v", projID, field, prev)
+			}
+		}
 	}
 
 	if len(ret) == 0 {
 		return nil, xerrors.Errorf("no active projects/clients found in '%s': unable to continue", projListName)
 	}
 
+	return &projectList{
+		byAddr:        ret,
+		registrations: registrations,
+		datasets:      datasets,
+		excluded:      excluded,
+
+		names: names,
+	}, nil
+}
+
+// A project list entry registers either a single "address", or, as of the second
+// version of the list, an "addresses" array holding all the wallets of the project
+func projectListAddresses(p *gabs.Container) ([]string, error) {
+	var ret []string
+	if p.Exists("address") {
+		a, isStr := p.S("address").Data().(string)
+		if !isStr {
+			return nil, xerrors.New("address is not a string")
+		}
+		ret = append(ret, a)
+	}
+	if p.Exists("addresses") {
+		addrs, err := p.S("addresses").Children()
+		if err != nil {
+			return nil, xerrors.New("addresses is not an array")
+		}
+		for _, c := range addrs {
+			a, isStr := c.Data().(string)
+			if !isStr {
+				return nil, xerrors.New("addresses holds a non-string")
+			}
+			ret = append(ret, a)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, xerrors.New("no address or addresses")
+	}
 	return ret, nil
 }
 
@@ -669,15 +2598,27 @@ func getAndParseRestore(ctx context.Context, saveToDir, restoreClientsListName s
 		return nil, err
 	}
 
+	raw, err := ioutil.ReadAll(clientListCopy)
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = relaxedJSON(raw); err != nil {
+		return nil, xerrors.Errorf("failed to parse %s: %w", restoreClientsListName, err)
+	}
+
 	fl := struct {
-		Payload []address.Address `json:"payload"`
+		Payload []string `json:"payload"`
 	}{}
-	if err = json.NewDecoder(clientListCopy).Decode(&fl); err != nil {
+	if err = json.Unmarshal(raw, &fl); err != nil {
 		return nil, err
 	}
 
 	ret := make(map[address.Address]struct{})
-	for _, a := range fl.Payload {
+	for _, s := range fl.Payload {
+		a, err := address.NewFromString(s)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid address '%s' in %s: %w", s, restoreClientsListName, err)
+		}
 		ret[a] = struct{}{}
 	}
 
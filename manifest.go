@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+const manifestName = "manifest.json"
+
+// Lists every file of a rollup along with what produced it, so that mirrored or
+// downloaded copies can be verified to be complete. Written into the output directory
+// right before the fingerprint, and as the first entry of every bundle.
+type rollupManifest struct {
+	Epoch         int64                  `json:"epoch"`
+	Phase         int                    `json:"phase,omitempty"`
+	TipSetKey     []cid.Cid              `json:"tipset_key"`
+	SchemaVersion string                 `json:"schema_version"`
+	Digest        string                 `json:"run_digest"`
+	Parameters    map[string]interface{} `json:"parameters"`
+	Inputs        map[string]string      `json:"inputs"` // saved input copy => sha256
+	Files         []manifestFile         `json:"files"`
+	Failures      []outputFailure        `json:"failures,omitempty"` // outputs missing from a --soft-fail run
+}
+type manifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Describes everything within outDirName apart from the manifest itself and any of
+// the skipped names
+func newRollupManifest(outDirName string, epoch int64, fp *runFingerprint, skip ...string) (*rollupManifest, error) {
+	m := &rollupManifest{
+		Epoch:         epoch,
+		Phase:         currentPhaseID,
+		TipSetKey:     fp.TipSetKey,
+		SchemaVersion: outputSchemaVersion,
+		Digest:        fp.Digest,
+		Parameters:    fp.Rules,
+		Inputs:        fp.Inputs,
+		Files:         make([]manifestFile, 0),
+	}
+
+	skipped := map[string]bool{manifestName: true}
+	for _, s := range skip {
+		skipped[s] = true
+	}
+
+	if err := filepath.Walk(outDirName, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// scratch space of a run still in progress
+		if path != outDirName && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(outDirName, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if skipped[rel] {
+			return nil
+		}
+		sum, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, manifestFile{
+			Name:   rel,
+			Size:   info.Size(),
+			SHA256: sum,
+		})
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("listing contents of '%s': %w", outDirName, err)
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+
+	return m, nil
+}
+
+// The fingerprint is not yet written at this point: its digest stands in for it
+func writeManifest(outDirName string, epoch int64, fp *runFingerprint, failures []outputFailure) error {
+	m, err := newRollupManifest(outDirName, epoch, fp, runFingerprintName)
+	if err != nil {
+		return err
+	}
+	m.Failures = failures
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outDirName, manifestName), append(raw, '\n'), 0644)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"golang.org/x/xerrors"
+)
+
+// Rough per-deal memory costs, derived from heap profiles of mainnet runs
+const (
+	// decoded api.MarketDeal as returned by StateMarketDeals, including map overhead
+	memPerMarketDeal = 1024
+	// ordering list entry + share of the piece CID / provider / client maps
+	memPerDealAggregate = 192
+	// a single *individualDeal held in a per-project deal list
+	memPerDealRecord = 320
+)
+
+// Uses the market actor NextID as an upper bound of how many deals StateMarketDeals
+// is about to return, without pulling the deals themselves
+func estimateDealCount(ctx context.Context, api api.FullNode, ts rollupTipSet) (int, error) {
+	st, err := api.StateReadState(ctx, builtin.StorageMarketActorAddr, ts.Key())
+	if err != nil {
+		return 0, err
+	}
+
+	fields, isMap := st.State.(map[string]interface{})
+	if !isMap {
+		return 0, xerrors.Errorf("unexpected market actor state type %T", st.State)
+	}
+	nextID, isNum := fields["NextID"].(float64)
+	if !isNum {
+		return 0, xerrors.New("market actor state does not contain a numeric NextID")
+	}
+
+	return int(nextID), nil
+}
+
+// Decides whether the per-project deal lists fit in memory alongside everything else,
+// given a budget in bytes. A budget of 0 means unlimited.
+func dealListsFitBudget(budget uint64, dealCount int) bool {
+	if budget == 0 {
+		return true
+	}
+
+	fixed := uint64(dealCount) * (memPerMarketDeal + memPerDealAggregate)
+	if fixed > budget {
+		log.Warnf("memory budget of %d bytes is below the ~%d bytes needed just to hold %d market deals: expect to exceed it", budget, fixed, dealCount)
+	}
+
+	return fixed+uint64(dealCount)*memPerDealRecord <= budget
+}
+
+// Holds the per-project deal lists until they are written out
+type dealListStore interface {
+	Append(projID string, d *individualDeal) error
+	Projects() []string
+	Load(projID string) ([]*individualDeal, error)
+	Close() error
+}
+
+type memDealLists map[string][]*individualDeal
+
+func (m memDealLists) Append(projID string, d *individualDeal) error {
+	m[projID] = append(m[projID], d)
+	return nil
+}
+func (m memDealLists) Projects() []string {
+	ret := make([]string, 0, len(m))
+	for p := range m {
+		ret = append(ret, p)
+	}
+	sort.Strings(ret)
+	return ret
+}
+func (m memDealLists) Load(projID string) ([]*individualDeal, error) { return m[projID], nil }
+func (m memDealLists) Close() error                                  { return nil }
+
+// Spills every deal record to a per-project newline-delimited file as soon as it is
+// seen, so that only one project's list needs to be in memory at write-out time.
+//
+// With --by-miner there is a list per provider, too many to keep a file and buffer
+// open for each: the least recently appended lists are closed beyond
+// maxOpenDealLists, and reopened for appending when they come up again.
+type diskDealLists struct {
+	dir     string
+	nameFmt string
+	keep    bool // whether the files are final outputs, or temporary spill files
+	open    map[string]*openDealList
+	recent  *list.List     // of the open lists, most recently appended first
+	count   map[string]int // to size the list when loading it back
+}
+
+const (
+	maxOpenDealLists   = 64
+	dealListBufferSize = 64 << 10
+)
+
+type openDealList struct {
+	fh     *os.File
+	writer *bufio.Writer
+	enc    *json.Encoder
+	elem   *list.Element
+}
+
+func newDiskDealLists(parentDir string) (*diskDealLists, error) {
+	dir, err := ioutil.TempDir(parentDir, ".deal_lists_")
+	if err != nil {
+		return nil, err
+	}
+	return &diskDealLists{
+		dir:     dir,
+		nameFmt: "%s.ndjson",
+		open:    make(map[string]*openDealList),
+		recent:  list.New(),
+		count:   make(map[string]int),
+	}, nil
+}
+
+// Same as the spill store, except that the files are the final ndjson deal list
+// outputs: records are flushed in iteration order and never need to be held in memory
+func newNDJSONDealLists(outDir, nameFmt string) *diskDealLists {
+	return &diskDealLists{
+		dir:     outDir,
+		nameFmt: nameFmt,
+		keep:    true,
+		open:    make(map[string]*openDealList),
+		recent:  list.New(),
+		count:   make(map[string]int),
+	}
+}
+
+func (d *diskDealLists) path(projID string) string {
+	return filepath.Join(d.dir, fmt.Sprintf(d.nameFmt, projID))
+}
+
+func (d *diskDealLists) Append(projID string, deal *individualDeal) error {
+	ol, ok := d.open[projID]
+	if ok {
+		d.recent.MoveToFront(ol.elem)
+	} else {
+		if len(d.open) >= maxOpenDealLists {
+			if err := d.closeList(d.recent.Back().Value.(string)); err != nil {
+				return err
+			}
+		}
+
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if _, seen := d.count[projID]; seen {
+			flags = os.O_WRONLY | os.O_APPEND
+		}
+		fh, err := os.OpenFile(d.path(projID), flags, 0666)
+		if err != nil {
+			return err
+		}
+		ol = &openDealList{fh: fh, writer: bufio.NewWriterSize(fh, dealListBufferSize)}
+		ol.enc = json.NewEncoder(ol.writer)
+		ol.elem = d.recent.PushFront(projID)
+		d.open[projID] = ol
+	}
+
+	d.count[projID]++
+	return ol.enc.Encode(deal)
+}
+
+func (d *diskDealLists) closeList(projID string) error {
+	ol := d.open[projID]
+	delete(d.open, projID)
+	d.recent.Remove(ol.elem)
+
+	if err := ol.writer.Flush(); err != nil {
+		ol.fh.Close() //nolint:errcheck
+		return err
+	}
+	return ol.fh.Close()
+}
+
+func (d *diskDealLists) Projects() []string {
+	ret := make([]string, 0, len(d.count))
+	for p := range d.count {
+		ret = append(ret, p)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (d *diskDealLists) Load(projID string) ([]*individualDeal, error) {
+	if _, seen := d.count[projID]; !seen {
+		return nil, nil
+	}
+	if _, ok := d.open[projID]; ok {
+		if err := d.closeList(projID); err != nil {
+			return nil, err
+		}
+	}
+
+	fh, err := os.Open(d.path(projID))
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	ret := make([]*individualDeal, 0, d.count[projID])
+	dec := json.NewDecoder(bufio.NewReaderSize(fh, dealListBufferSize))
+	for dec.More() {
+		deal := new(individualDeal)
+		if err := dec.Decode(deal); err != nil {
+			return nil, xerrors.Errorf("reading back spilled deal list for project %s: %w", projID, err)
+		}
+		ret = append(ret, deal)
+	}
+
+	return ret, nil
+}
+
+func (d *diskDealLists) Close() error {
+	for projID := range d.open {
+		if err := d.closeList(projID); err != nil {
+			return err
+		}
+	}
+
+	if d.keep {
+		return nil
+	}
+	return os.RemoveAll(d.dir)
+}
+
+// How many deals a sorted chunk spilled by sortedDeals holds
+const dealSortChunkSize = 1 << 16
+
+// A deal as held by sortedDeals, its numeric id parsed once for ordering
+type sortedDeal struct {
+	ID    string           `json:"i"`
+	NumID uint64           `json:"n"`
+	Deal  storedMarketDeal `json:"d"`
+}
+
+// Orders deals by sector start, then deal start, then deal id
+func activationOrder(a, b *sortedDeal) bool {
+	switch {
+	case a.Deal.State.SectorStartEpoch != b.Deal.State.SectorStartEpoch:
+		return a.Deal.State.SectorStartEpoch < b.Deal.State.SectorStartEpoch
+	case a.Deal.Proposal.StartEpoch != b.Deal.Proposal.StartEpoch:
+		return a.Deal.Proposal.StartEpoch < b.Deal.Proposal.StartEpoch
+	default:
+		return a.NumID < b.NumID
+	}
+}
+
+func dealIDOrder(a, b *sortedDeal) bool { return a.NumID < b.NumID }
+
+// Collects deals in any order and hands them back sorted by less. Once chunkSize of
+// them are buffered they are sorted and spilled to a file under parentDir, and the
+// files are merged back when iterating. A chunkSize of 0 keeps everything in memory.
+type sortedDeals struct {
+	less      func(a, b *sortedDeal) bool
+	parentDir string
+	chunkSize int
+	dir       string // created on the first spill
+	buf       []*sortedDeal
+	chunks    []string
+	count     int
+}
+
+func newSortedDeals(parentDir string, chunkSize int, less func(a, b *sortedDeal) bool) *sortedDeals {
+	return &sortedDeals{
+		less:      less,
+		parentDir: parentDir,
+		chunkSize: chunkSize,
+	}
+}
+
+func (s *sortedDeals) Len() int { return s.count }
+
+func (s *sortedDeals) Add(dealID string, d *api.MarketDeal) error {
+	numID, err := strconv.ParseUint(dealID, 10, 64)
+	if err != nil {
+		return xerrors.Errorf("unexpected non-numeric deal id %s: %w", dealID, err)
+	}
+	s.buf = append(s.buf, &sortedDeal{ID: dealID, NumID: numID, Deal: newStoredMarketDeal(d)})
+	s.count++
+
+	if s.chunkSize > 0 && len(s.buf) >= s.chunkSize {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *sortedDeals) sortBuf() {
+	sort.Slice(s.buf, func(i, j int) bool { return s.less(s.buf[i], s.buf[j]) })
+}
+
+func (s *sortedDeals) spill() error {
+	if s.dir == "" {
+		dir, err := ioutil.TempDir(s.parentDir, ".deal_chunks_")
+		if err != nil {
+			return err
+		}
+		s.dir = dir
+	}
+
+	s.sortBuf()
+	fh, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("%d.ndjson", len(s.chunks))))
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	w := bufio.NewWriterSize(fh, 1<<20)
+	enc := json.NewEncoder(w)
+	for _, d := range s.buf {
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	s.chunks = append(s.chunks, fh.Name())
+	s.buf = nil
+	return nil
+}
+
+// Iterates the deals in order. Nothing may be added once iterating.
+func (s *sortedDeals) Iterate() *sortedDealIter {
+	it := &sortedDealIter{merge: &chunkMerge{less: s.less}}
+	if len(s.chunks) == 0 {
+		s.sortBuf()
+		it.buf = s.buf
+		return it
+	}
+
+	if len(s.buf) > 0 {
+		if it.err = s.spill(); it.err != nil {
+			return it
+		}
+	}
+	for _, name := range s.chunks {
+		fh, err := os.Open(name)
+		if err != nil {
+			it.err = err
+			return it
+		}
+		c := &dealChunk{fh: fh, dec: json.NewDecoder(bufio.NewReaderSize(fh, 1<<16))}
+		it.merge.open = append(it.merge.open, c)
+		if it.err = c.next(); it.err != nil {
+			return it
+		}
+		if c.head != nil {
+			it.merge.heads = append(it.merge.heads, c)
+		}
+	}
+	heap.Init(it.merge)
+	return it
+}
+
+func (s *sortedDeals) Close() error {
+	s.buf = nil
+	if s.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.dir)
+}
+
+type sortedDealIter struct {
+	buf   []*sortedDeal // when nothing was spilled
+	merge *chunkMerge   // otherwise
+	cur   *sortedDeal
+	err   error
+}
+
+func (it *sortedDealIter) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.buf != nil {
+		if len(it.buf) == 0 {
+			return false
+		}
+		it.cur, it.buf = it.buf[0], it.buf[1:]
+		return true
+	}
+
+	if it.cur != nil && it.merge.Len() > 0 {
+		// advance the chunk the previous deal came from
+		c := it.merge.heads[0]
+		if it.err = c.next(); it.err != nil {
+			return false
+		}
+		if c.head == nil {
+			heap.Pop(it.merge)
+		} else {
+			heap.Fix(it.merge, 0)
+		}
+	}
+	if it.merge.Len() == 0 {
+		return false
+	}
+	it.cur = it.merge.heads[0].head
+	return true
+}
+
+func (it *sortedDealIter) Deal() (string, api.MarketDeal) { return it.cur.ID, it.cur.Deal.MarketDeal }
+func (it *sortedDealIter) Err() error                     { return it.err }
+
+func (it *sortedDealIter) Close() {
+	for _, c := range it.merge.open {
+		c.fh.Close() //nolint:errcheck
+	}
+	it.merge.open = nil
+}
+
+// A spilled chunk being read back, head being its next deal or nil once exhausted
+type dealChunk struct {
+	fh   *os.File
+	dec  *json.Decoder
+	head *sortedDeal
+}
+
+func (c *dealChunk) next() error {
+	if !c.dec.More() {
+		c.head = nil
+		return nil
+	}
+	c.head = new(sortedDeal)
+	if err := c.dec.Decode(c.head); err != nil {
+		return xerrors.Errorf("reading back spilled deals from %s: %w", c.fh.Name(), err)
+	}
+	var err error
+	if c.head.Deal.MarketDeal, err = c.head.Deal.marketDeal(); err != nil {
+		return xerrors.Errorf("reading back deal %s from %s: %w", c.head.ID, c.fh.Name(), err)
+	}
+	return nil
+}
+
+// A heap of the chunks not yet exhausted, by their head deal
+type chunkMerge struct {
+	less  func(a, b *sortedDeal) bool
+	heads []*dealChunk
+	open  []*dealChunk
+}
+
+func (m *chunkMerge) Len() int           { return len(m.heads) }
+func (m *chunkMerge) Less(i, j int) bool { return m.less(m.heads[i].head, m.heads[j].head) }
+func (m *chunkMerge) Swap(i, j int)      { m.heads[i], m.heads[j] = m.heads[j], m.heads[i] }
+func (m *chunkMerge) Push(x interface{}) { m.heads = append(m.heads, x.(*dealChunk)) }
+func (m *chunkMerge) Pop() interface{} {
+	c := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return c
+}
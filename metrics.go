@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telemetry of a single rollup run. The daemon runs every rollup in a child process,
+// which hands these over through the file given with the hidden --metrics-out.
+type runMetrics struct {
+	Epoch           int64            `json:"epoch"` // 0 when the run failed before resolving its tipset
+	DurationSeconds float64          `json:"duration_seconds"`
+	DealsScanned    int              `json:"deals_scanned"`
+	DealsQualified  int              `json:"deals_qualified"`
+	APICalls        map[string]int64 `json:"api_calls"`
+	APIErrors       map[string]int64 `json:"api_errors"`
+	ResolverHits    int64            `json:"resolver_cache_hits"`
+	ResolverMisses  int64            `json:"resolver_cache_misses"`
+
+	start    time.Time
+	rpc      *rpcBudget
+	resolver *cachingResolver
+}
+
+func newRunMetrics() *runMetrics {
+	return &runMetrics{start: time.Now()}
+}
+
+// Takes the final counts and writes them out, replacing any earlier file
+func (rm *runMetrics) write(path string) error {
+	rm.DurationSeconds = time.Since(rm.start).Seconds()
+	if rm.rpc != nil {
+		rm.APICalls, rm.APIErrors = rm.rpc.counts()
+	}
+	if rm.resolver != nil {
+		rm.ResolverHits, rm.ResolverMisses = rm.resolver.hits, rm.resolver.misses
+	}
+
+	raw, err := json.Marshal(rm)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readRunMetrics(path string) (*runMetrics, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rm := new(runMetrics)
+	if err := json.Unmarshal(raw, rm); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+// A sample of a metric in the Prometheus exposition format, labels already rendered
+type promSample struct {
+	labels string
+	value  float64
+}
+
+func writePrometheusMetric(w io.Writer, name, typ, help string, samples ...promSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, s.labels, strconv.FormatFloat(s.value, 'f', -1, 64))
+	}
+}
+
+// One sample per key of counts, labelled with it, in key order
+func promLabelled(label string, counts map[string]int64) []promSample {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	samples := make([]promSample, len(keys))
+	for i, k := range keys {
+		samples[i] = promSample{labels: fmt.Sprintf(`{%s=%q}`, label, k), value: float64(counts[k])}
+	}
+	return samples
+}
+
+// What the daemon exposes at /metrics: the outcome of the scheduled runs, the
+// telemetry of the latest one, and the totals of the latest published rollup
+type daemonMetrics struct {
+	mu               sync.Mutex
+	runs             map[string]int64 // by result
+	lastRun          *runMetrics
+	lastSuccess      time.Time
+	lastSuccessEpoch int64
+	totals           *competitionTotal
+}
+
+func newDaemonMetrics() *daemonMetrics {
+	return &daemonMetrics{runs: map[string]int64{"success": 0, "failure": 0}}
+}
+
+// Records a scheduled run, which published the rollup in dir unless it failed
+func (dm *daemonMetrics) observe(rm *runMetrics, dir string, runErr error) {
+	var totals *competitionTotalOutput
+	if runErr == nil {
+		var err error
+		if totals, err = loadBasicStats(dir); err != nil {
+			log.Warnf("metrics will lack the totals of '%s': %s", dir, err)
+		}
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if rm != nil {
+		dm.lastRun = rm
+	}
+	if runErr != nil {
+		dm.runs["failure"]++
+		return
+	}
+	dm.runs["success"]++
+	dm.lastSuccess = time.Now()
+	if totals != nil {
+		dm.lastSuccessEpoch = totals.Epoch
+		dm.totals = &totals.Payload
+	}
+}
+
+// Takes the rollup already published at start as the latest success, as of the time
+// it was completed
+func (dm *daemonMetrics) restore(dir string) {
+	fi, err := os.Stat(filepath.Join(dir, runFingerprintName))
+	if err != nil {
+		return
+	}
+	totals, err := loadBasicStats(dir)
+	if err != nil {
+		log.Warnf("metrics will lack the totals of '%s': %s", dir, err)
+		return
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.lastSuccess = fi.ModTime()
+	dm.lastSuccessEpoch = totals.Epoch
+	dm.totals = &totals.Payload
+}
+
+func (dm *daemonMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	var b strings.Builder
+	writePrometheusMetric(&b, "slingshot_daemon_runs_total", "counter", "Scheduled rollup runs by result", promLabelled("result", dm.runs)...)
+	if !dm.lastSuccess.IsZero() {
+		writePrometheusMetric(&b, "slingshot_daemon_last_success_timestamp_seconds", "gauge", "Unix time the latest successful rollup was published at", promSample{value: float64(dm.lastSuccess.Unix())})
+		writePrometheusMetric(&b, "slingshot_daemon_last_success_epoch", "gauge", "Epoch of the latest successfully published rollup", promSample{value: float64(dm.lastSuccessEpoch)})
+	}
+
+	if rm := dm.lastRun; rm != nil {
+		writePrometheusMetric(&b, "slingshot_rollup_duration_seconds", "gauge", "Wall time of the latest rollup run", promSample{value: rm.DurationSeconds})
+		writePrometheusMetric(&b, "slingshot_rollup_deals_scanned", "gauge", "Market deals examined by the latest rollup run", promSample{value: float64(rm.DealsScanned)})
+		writePrometheusMetric(&b, "slingshot_rollup_deals_qualified", "gauge", "Deals qualifying in the latest rollup run", promSample{value: float64(rm.DealsQualified)})
+		writePrometheusMetric(&b, "slingshot_rollup_api_calls", "gauge", "Node API calls made by the latest rollup run", promLabelled("method", rm.APICalls)...)
+		writePrometheusMetric(&b, "slingshot_rollup_api_errors", "gauge", "Node API calls of the latest rollup run that returned an error", promLabelled("method", rm.APIErrors)...)
+		writePrometheusMetric(&b, "slingshot_rollup_resolver_cache_hits", "gauge", "Client address resolutions of the latest rollup run answered without asking the node", promSample{value: float64(rm.ResolverHits)})
+		writePrometheusMetric(&b, "slingshot_rollup_resolver_cache_misses", "gauge", "Client address resolutions of the latest rollup run that had to ask the node", promSample{value: float64(rm.ResolverMisses)})
+	}
+
+	if dm.totals != nil {
+		for _, m := range prometheusTotals {
+			writePrometheusMetric(&b, m.name, "gauge", m.help, promSample{value: float64(m.value(dm.totals))})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String()) //nolint:errcheck
+}
+
+// The metrics of serve, labelled by site prefix
+type servedMetrics map[string]*site
+
+func (sm servedMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefixes := make([]string, 0, len(sm))
+	for p := range sm {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	var epochs, refreshed, failures []promSample
+	totals := make([][]promSample, len(prometheusTotals))
+	for _, p := range prefixes {
+		s := sm[p]
+		labels := fmt.Sprintf(`{site=%q}`, p)
+
+		s.mu.RLock()
+		cur, lastRefresh, numFailures := s.current, s.lastRefresh, s.refreshFailures
+		s.mu.RUnlock()
+
+		epochs = append(epochs, promSample{labels, float64(cur.epoch)})
+		refreshed = append(refreshed, promSample{labels, float64(lastRefresh.Unix())})
+		failures = append(failures, promSample{labels, float64(numFailures)})
+
+		var basic competitionTotalOutput
+		doc, loaded := cur.docs["basic_stats"]
+		if !loaded || json.Unmarshal(doc.body, &basic) != nil {
+			continue
+		}
+		for i, m := range prometheusTotals {
+			totals[i] = append(totals[i], promSample{labels, float64(m.value(&basic.Payload))})
+		}
+	}
+
+	var b strings.Builder
+	writePrometheusMetric(&b, "slingshot_served_rollup_epoch", "gauge", "Epoch of the served rollup", epochs...)
+	writePrometheusMetric(&b, "slingshot_serve_last_refresh_timestamp_seconds", "gauge", "Unix time of the latest successful rescan of the rollup root", refreshed...)
+	writePrometheusMetric(&b, "slingshot_serve_refresh_failures_total", "counter", "Failed rescans of the rollup root", failures...)
+	for i, m := range prometheusTotals {
+		writePrometheusMetric(&b, m.name, "gauge", m.help, totals[i]...)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String()) //nolint:errcheck
+}
+
+// Where a daemon run leaves its metrics, next to the rollups
+func runMetricsPath(root string) string {
+	return filepath.Join(root, ".run_metrics.json")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"golang.org/x/xerrors"
+	"math/big"
+)
+
+// Joins the power and sector counts of every provider at the rollup tipset, telling
+// large providers apart from small ones. Two node queries per provider.
+func joinMinerPower(ctx context.Context, api api.FullNode, ts rollupTipSet, providers []*providerStats, progress *progressReporter) error {
+	progress.start("querying_miner_power", len(providers))
+	for i, ps := range providers {
+		if err := progress.step(i); err != nil {
+			return err
+		}
+
+		provider, err := address.NewFromString(ps.ProviderID)
+		if err != nil {
+			return err
+		}
+		mp, err := api.StateMinerPower(ctx, provider, ts.Key())
+		if err != nil {
+			return xerrors.Errorf("getting power of %s: %w", provider, err)
+		}
+		sectors, err := api.StateMinerSectorCount(ctx, provider, ts.Key())
+		if err != nil {
+			return xerrors.Errorf("getting sector counts of %s: %w", provider, err)
+		}
+
+		ps.RawBytePower = mp.MinerPower.RawBytePower.String()
+		ps.QualityAdjPower = mp.MinerPower.QualityAdjPower.String()
+		if !mp.TotalPower.QualityAdjPower.NilOrZero() {
+			share, _ := new(big.Float).Quo(
+				new(big.Float).SetInt(mp.MinerPower.QualityAdjPower.Int),
+				new(big.Float).SetInt(mp.TotalPower.QualityAdjPower.Int),
+			).Float64()
+			ps.NetworkPowerShare = share
+		}
+		ps.HasMinPower = mp.HasMinPower
+		ps.LiveSectors = sectors.Live
+		ps.ActiveSectors = sectors.Active
+		ps.FaultySectors = sectors.Faulty
+	}
+	return nil
+}
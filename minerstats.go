@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+type minerStatsOutput struct {
+	Epoch         int64         `json:"epoch"`
+	TipSetKey     []cid.Cid     `json:"tipset_key"`
+	Endpoint      string        `json:"endpoint"`
+	Phase         int           `json:"phase,omitempty"`
+	SchemaVersion string        `json:"schema_version"`
+	Payload       []*minerStats `json:"payload"`
+}
+
+// Qualifying deals per storage provider, optionally joined with the results of an
+// external probe service
+type minerStats struct {
+	MinerID     string                 `json:"miner_id"`
+	DataSize    int64                  `json:"total_data_size"`
+	NumDeals    int                    `json:"total_num_deals"`
+	NumProjects int                    `json:"total_num_projects"`
+	NumClients  int                    `json:"total_num_clients"`
+	FilplusSize int64                  `json:"filplus_total_data_size"`
+	FilplusNum  int                    `json:"filplus_total_num_deals"`
+	FilplusPart float64                `json:"filplus_share"`   // of the data size, between 0 and 1
+	Probe       map[string]interface{} `json:"probe,omitempty"` // the provider's entry of the --provider-probes feed, as-is
+
+	projects map[string]struct{}
+	clients  map[address.Address]struct{}
+}
+
+type minerStatsCollector map[address.Address]*minerStats
+
+func (mc minerStatsCollector) observe(provider address.Address, projID string, client address.Address, size int64, verified bool) {
+	ms, ok := mc[provider]
+	if !ok {
+		ms = &minerStats{
+			MinerID:  provider.String(),
+			projects: make(map[string]struct{}),
+			clients:  make(map[address.Address]struct{}),
+		}
+		mc[provider] = ms
+	}
+	ms.DataSize += size
+	ms.NumDeals++
+	if verified {
+		ms.FilplusSize += size
+		ms.FilplusNum++
+	}
+	ms.projects[projID] = struct{}{}
+	ms.clients[client] = struct{}{}
+}
+
+// Lists all providers, most data first, with the probe results joined in
+func (mc minerStatsCollector) list(probes map[address.Address]map[string]interface{}) []*minerStats {
+	ret := make([]*minerStats, 0, len(mc))
+	for provider, ms := range mc {
+		ms.NumProjects = len(ms.projects)
+		ms.NumClients = len(ms.clients)
+		if ms.DataSize > 0 {
+			ms.FilplusPart = float64(ms.FilplusSize) / float64(ms.DataSize)
+		}
+		ms.Probe = probes[provider]
+		ret = append(ret, ms)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].DataSize != ret[j].DataSize {
+			return ret[i].DataSize > ret[j].DataSize
+		}
+		return ret[i].MinerID < ret[j].MinerID
+	})
+	return ret
+}
+
+// Loads a feed of per-provider probe results (latency, availability or whatever else
+// the probe service measures), saving a verbatim copy as provider_probes.json. Either
+// an object keyed by provider address, or a list of objects each naming its provider
+// in `provider` or `miner_id`, optionally wrapped in a `payload`:
+//
+//	{ "payload": [ { "provider": "f01234", "retrieval_latency_ms": 812, "available": true } ] }
+func getAndParseProviderProbes(ctx context.Context, saveToDir, probesName string) (map[address.Address]map[string]interface{}, error) {
+	src, err := openSource(ctx, probesName)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close() //nolint:errcheck
+
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read provider probes from %s: %w", probesName, err)
+	}
+	if err := ioutil.WriteFile(saveToDir+"/provider_probes.json", raw, 0644); err != nil {
+		return nil, err
+	}
+	if raw, err = relaxedJSON(raw); err != nil {
+		return nil, xerrors.Errorf("failed to parse provider probes %s: %w", probesName, err)
+	}
+
+	var feed interface{}
+	if err := json.Unmarshal(raw, &feed); err != nil {
+		return nil, xerrors.Errorf("failed to parse provider probes %s: %w", probesName, err)
+	}
+	if wrapped, isObj := feed.(map[string]interface{}); isObj {
+		if payload, hasPayload := wrapped["payload"]; hasPayload {
+			feed = payload
+		}
+	}
+
+	ret := make(map[address.Address]map[string]interface{})
+	add := func(providerStr string, entry interface{}) error {
+		fields, isObj := entry.(map[string]interface{})
+		if !isObj {
+			return xerrors.Errorf("probe entry of provider '%s' in %s is not an object", providerStr, probesName)
+		}
+		provider, err := address.NewFromString(providerStr)
+		if err != nil {
+			return xerrors.Errorf("invalid provider '%s' in %s: %w", providerStr, probesName, err)
+		}
+		ret[provider] = fields
+		return nil
+	}
+
+	switch f := feed.(type) {
+	case map[string]interface{}:
+		for providerStr, entry := range f {
+			if err := add(providerStr, entry); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for _, entry := range f {
+			fields, _ := entry.(map[string]interface{})
+			providerStr, _ := fields["provider"].(string)
+			if providerStr == "" {
+				providerStr, _ = fields["miner_id"].(string)
+			}
+			if providerStr == "" {
+				return nil, xerrors.Errorf("probe entry without a provider or miner_id in %s", probesName)
+			}
+			if err := add(providerStr, entry); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, xerrors.Errorf("provider probes %s are neither an object nor a list", probesName)
+	}
+
+	return ret, nil
+}
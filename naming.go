@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Default --deal-list-name, the only name the outputs carried before templating
+const defaultDealListName = "deals_list_{{projid}}"
+
+var namingPlaceholder = regexp.MustCompile(`{{\s*([a-z]+)\s*}}`)
+
+// Expands the placeholders of the output directory and deal list name templates:
+//
+//	{{epoch}}   height of the rollup tipset
+//	{{date}}    UTC date of the rollup tipset, as YYYY-MM-DD
+//	{{projid}}  project id, deal list names only
+//
+// The values derive from the tipset rather than the wall clock, so that re-running a
+// rollup at a pinned tipset produces the same names.
+type outputNaming struct {
+	vars     map[string]string
+	dealList string
+}
+
+func newOutputNaming(ts rollupTipSet, dealListTemplate string) (*outputNaming, error) {
+	n := &outputNaming{
+		vars: map[string]string{
+			"epoch": strconv.FormatInt(int64(ts.Height()), 10),
+			"date":  time.Unix(int64(ts.MinTimestamp()), 0).UTC().Format("2006-01-02"),
+		},
+		dealList: dealListTemplate,
+	}
+
+	if err := validateDealListName(dealListTemplate); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func validateDealListName(template string) error {
+	if strings.ContainsAny(template, `/\`) {
+		return xerrors.Errorf("deal list name '%s' must not contain path separators", template)
+	}
+	hasProjID := false
+	for _, m := range namingPlaceholder.FindAllStringSubmatch(template, -1) {
+		switch m[1] {
+		case "projid":
+			hasProjID = true
+		case "epoch", "date":
+		default:
+			return xerrors.Errorf("unknown placeholder %s in deal list name '%s'", m[0], template)
+		}
+	}
+	if !hasProjID {
+		return xerrors.Errorf("deal list name '%s' must contain {{projid}}", template)
+	}
+	return nil
+}
+
+// Recognizes the deal lists written with the given template, capturing the project id
+// as the first submatch
+func dealListPattern(template, ext string) (*regexp.Regexp, error) {
+	if err := validateDealListName(template); err != nil {
+		return nil, err
+	}
+
+	var re strings.Builder
+	re.WriteByte('^')
+	last := 0
+	for _, loc := range namingPlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		re.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		if template[loc[2]:loc[3]] == "projid" {
+			re.WriteString("(.+)")
+		} else {
+			re.WriteString("(?:.+)")
+		}
+		last = loc[1]
+	}
+	re.WriteString(regexp.QuoteMeta(template[last:] + ext))
+	re.WriteByte('$')
+
+	return regexp.Compile(re.String())
+}
+
+// The output directory name with its placeholders expanded. {{projid}} makes no sense
+// here and is refused along with unknown placeholders.
+func (n *outputNaming) outputDir(template string) (string, error) {
+	var err error
+	expanded := namingPlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		v, known := n.vars[namingPlaceholder.FindStringSubmatch(p)[1]]
+		if !known && err == nil {
+			err = xerrors.Errorf("unknown placeholder %s in output directory name '%s'", p, template)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// A fmt format of the deal list file name, taking the project id as its only argument
+func (n *outputNaming) dealListFmt(ext string) string {
+	return namingPlaceholder.ReplaceAllStringFunc(strings.ReplaceAll(n.dealList, "%", "%%"), func(p string) string {
+		name := namingPlaceholder.FindStringSubmatch(p)[1]
+		if name == "projid" {
+			return "%s"
+		}
+		return n.vars[name]
+	}) + ext
+}
+
+// Matches the deal lists of any rollup written with the same template
+func (n *outputNaming) dealListGlob(ext string) string {
+	return namingPlaceholder.ReplaceAllString(n.dealList, "*") + ext
+}
+
+// By default an existing output directory is an error. With allowExisting the rollup
+// is written into it, replacing files of the same name, and with overwrite the
+// directory is removed beforehand. Either way any fingerprint already present goes
+// first, so the directory is not mistaken for a completed rollup while being written.
+func prepareExistingOutputDir(outDirName string, allowExisting, overwrite bool) error {
+	fi, err := os.Stat(outDirName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !allowExisting && !overwrite {
+		return xerrors.Errorf("unable to proceed: supplied stat target '%s' already exists, pass --allow-existing-dir or --overwrite to write into it", outDirName)
+	}
+	if !fi.IsDir() {
+		return xerrors.Errorf("unable to proceed: supplied stat target '%s' exists and is not a directory", outDirName)
+	}
+
+	if overwrite {
+		log.Warnf("removing existing output directory '%s'", outDirName)
+		return os.RemoveAll(outDirName)
+	}
+
+	if err := os.Remove(filepath.Join(outDirName, runFingerprintName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Infof("writing into existing output directory '%s'", outDirName)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"golang.org/x/xerrors"
+)
+
+// The competition rules that differ between the networks a rollup can run against.
+// Epochs are 30 seconds long on all of them and dates are taken from the tipset
+// timestamps, so nothing else, the genesis time included, depends on the network.
+type networkParams struct {
+	nodeName                string // as reported by StateNetworkName
+	phases                  []phaseDefinition
+	phaseStart              abi.ChainEpoch
+	recoveryStart           abi.ChainEpoch
+	minDealDurationDays     int64
+	recoveryMinDurationDays int64
+}
+
+var networks = map[string]*networkParams{
+	"mainnet": {
+		nodeName:                "mainnet",
+		phases:                  builtinPhases,
+		phaseStart:              currentPhaseStart,
+		recoveryStart:           recoveryStart,
+		minDealDurationDays:     minQualifyingDealDurationDays,
+		recoveryMinDurationDays: defaultRecoveryMinDurationDays,
+	},
+	// For trying out phases end to end ahead of mainnet: there is no phase schedule,
+	// so the window is given with --phasestart-epoch, --phase-schedule or the "phases"
+	// of the rollup config, and deals only need to last as long as the market actor
+	// allows at least
+	"calibnet": {
+		nodeName:                "calibrationnet",
+		minDealDurationDays:     180,
+		recoveryMinDurationDays: 180,
+	},
+}
+
+func lookupNetwork(name string) (*networkParams, error) {
+	if n, known := networks[name]; known {
+		return n, nil
+	}
+	names := make([]string, 0, len(networks))
+	for n := range networks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, xerrors.Errorf("unknown network '%s': expected one of %s", name, strings.Join(names, ", "))
+}
+
+// Makes the network's rules the defaults the rollup flags and config then override
+func (n *networkParams) apply() {
+	builtinPhases = n.phases
+	currentPhaseStart = n.phaseStart
+	recoveryStart = n.recoveryStart
+	minQualifyingDealDurationDays = n.minDealDurationDays
+}
+
+// Fails when the node follows another network. Stand-ins for a node not knowing
+// their network are taken at their word.
+func (n *networkParams) checkNode(ctx context.Context, node api.FullNode, name string) error {
+	nodeName, err := node.StateNetworkName(ctx)
+	if err != nil {
+		log.Infof("unable to confirm the chain is %s: %s", name, err)
+		return nil
+	}
+	if string(nodeName) != n.nodeName {
+		return xerrors.Errorf("the node follows network '%s', not %s: pass the matching --network", nodeName, name)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	lapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	cliutil "github.com/filecoin-project/lotus/cli/util"
+	"github.com/filecoin-project/lotus/node/repo"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// Passing the token through the environment keeps it out of process listings
+const apiTokenEnv = "SLINGSHOT_API_TOKEN"
+
+// Connects to the Lotus node given by --api, else by FULLNODE_API_INFO, else by the
+// endpoint and token found in the repo at --repo. Only the last needs a local repo.
+func getFullNodeAPI(cctx *cli.Context) (lapi.FullNode, jsonrpc.ClientCloser, error) {
+	if !cctx.IsSet("api") {
+		if cctx.String("api-token") != "" {
+			return nil, nil, xerrors.New("--api-token requires --api")
+		}
+		return cliutil.GetFullNodeAPIV1(cctx)
+	}
+
+	info := apiInfoFlags(cctx)
+	addr, err := info.DialArgs("v1")
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid --api '%s': %w", info.Addr, err)
+	}
+	return client.NewFullNodeRPCV1(cctx.Context, addr, info.AuthHeader())
+}
+
+func apiInfoFlags(cctx *cli.Context) cliutil.APIInfo {
+	// the token may also come in front of the address, as in FULLNODE_API_INFO
+	info := cliutil.ParseApiInfo(strings.TrimSpace(cctx.String("api")))
+	if tok := cctx.String("api-token"); tok != "" {
+		info.Token = []byte(tok)
+	}
+	// a URL may name the RPC path, which DialArgs appends on its own
+	info.Addr = strings.TrimSuffix(info.Addr, "/")
+	for _, path := range []string{"/rpc/v0", "/rpc/v1"} {
+		info.Addr = strings.TrimSuffix(info.Addr, path)
+	}
+	return info
+}
+
+// The plain HTTP JSON-RPC endpoint of the node getFullNodeAPI connects to
+func nodeHTTPEndpoint(cctx *cli.Context) (string, http.Header, error) {
+	var info cliutil.APIInfo
+	if cctx.IsSet("api") {
+		info = apiInfoFlags(cctx)
+	} else {
+		var err error
+		if info, err = cliutil.GetAPIInfo(cctx, repo.FullNode); err != nil {
+			return "", nil, err
+		}
+	}
+
+	addr, err := info.DialArgs("v1")
+	if err != nil {
+		return "", nil, err
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	return u.String(), info.AuthHeader(), nil
+}
+
+// The arguments and environment connecting a child process to the same node.
+// FULLNODE_API_INFO is inherited along with the rest of the environment.
+func nodeConnectionArgs(cctx *cli.Context) (args []string, env []string) {
+	if !cctx.IsSet("api") {
+		return []string{"--repo", cctx.String("repo")}, nil
+	}
+	info := apiInfoFlags(cctx)
+	if len(info.Token) > 0 {
+		env = []string{apiTokenEnv + "=" + string(info.Token)}
+	}
+	return []string{"--api", info.Addr}, env
+}
+
+// Opens the chain a rollup reads from, a Lotus node, with --lily a Lily database or
+// with --deals-snapshot a snapshot file, and resolves the tipset to roll up at. Calls
+// through the returned API are metered against budget, and those to a node retried
+// as per retry.
+func openRollupChain(ctx context.Context, cctx *cli.Context, budget *rpcBudget, retry *rpcRetryPolicy) (lapi.FullNode, rollupTipSet, abi.ChainEpoch, func(), error) {
+	if path := cctx.String("deals-snapshot"); path != "" {
+		if cctx.String("lily") != "" {
+			return nil, nil, 0, nil, xerrors.New("--deals-snapshot and --lily are mutually exclusive")
+		}
+		ss, err := openDealsSnapshot(path)
+		if err != nil {
+			return nil, nil, 0, nil, err
+		}
+		ts, lookback, err := ss.resolveTipSet(cctx.String("tipset"))
+		if err != nil {
+			return nil, nil, 0, nil, err
+		}
+		log.Infof("rolling up offline from deals snapshot '%s' taken at epoch %d", path, ts.Height())
+		return meterFullNode(ss.node(), budget), ts, lookback, func() {}, nil
+	}
+
+	if dbURL := cctx.String("lily"); dbURL != "" {
+		ls, err := openLilySource(ctx, dbURL)
+		if err != nil {
+			return nil, nil, 0, nil, err
+		}
+		ts, lookback, err := ls.resolveTipSet(ctx, cctx.String("tipset"))
+		if err != nil {
+			ls.Close() //nolint:errcheck
+			return nil, nil, 0, nil, err
+		}
+		closer := func() {
+			ls.Close() //nolint:errcheck
+		}
+		return meterFullNode(ls.node(), budget), ts, lookback, closer, nil
+	}
+
+	node, closer, err := getFullNodeAPI(cctx)
+	if err != nil {
+		return nil, nil, 0, nil, err
+	}
+	node = retryFullNode(meterFullNode(node, budget), retry)
+	ts, lookback, err := resolveRollupTipSet(ctx, node, cctx.String("tipset"))
+	if err != nil {
+		closer()
+		return nil, nil, 0, nil, err
+	}
+	return node, ts, lookback, closer, nil
+}
+
+// A node API whose every method fails as not available from source, for stand-ins
+// of a node to fill in the few methods they do answer
+func unavailableFullNode(source string) *lapi.FullNodeStruct {
+	fns := new(lapi.FullNodeStruct)
+	for _, ptr := range lapi.GetInternalStructs(fns) {
+		internal := reflect.ValueOf(ptr).Elem()
+		for i := 0; i < internal.NumField(); i++ {
+			f := internal.Field(i)
+			if f.Kind() != reflect.Func {
+				continue
+			}
+			err := xerrors.Errorf("%s is not available from %s", internal.Type().Field(i).Name, source)
+			ft := f.Type()
+			f.Set(reflect.MakeFunc(ft, func([]reflect.Value) []reflect.Value {
+				out := make([]reflect.Value, ft.NumOut())
+				for j := range out {
+					out[j] = reflect.Zero(ft.Out(j))
+				}
+				if ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType {
+					out[len(out)-1] = reflect.ValueOf(&err).Elem()
+				}
+				return out
+			}))
+		}
+	}
+	return fns
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/xerrors"
+)
+
+const (
+	notifyTimeout = 15 * time.Second
+	// Discord refuses messages beyond 2000 characters, Slack truncates long ones
+	notifyMaxErrorLength = 1500
+)
+
+// Posts a one-line summary of how a run went to a Slack or Discord webhook, so that
+// operators learn of a broken run before the dashboards go stale. Which of the two
+// is told apart by the webhook URL. All methods are no-ops on a nil notifier.
+type runNotifier struct {
+	webhook   string
+	discord   bool
+	onSuccess bool
+
+	epoch     int64 // 0 until the tipset is resolved
+	published string
+	totals    *competitionTotal
+}
+
+// when is either "always" or "failure"
+func newRunNotifier(webhook, when string) (*runNotifier, error) {
+	if webhook == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, xerrors.Errorf("invalid notification webhook URL '%s'", webhook)
+	}
+
+	n := &runNotifier{
+		webhook: webhook,
+		discord: u.Hostname() == "discord.com" || u.Hostname() == "discordapp.com",
+	}
+	switch when {
+	case "always":
+		n.onSuccess = true
+	case "failure":
+	default:
+		return nil, xerrors.Errorf("unknown notification condition '%s': expected always or failure", when)
+	}
+	return n, nil
+}
+
+func (n *runNotifier) atEpoch(epoch int64) {
+	if n != nil {
+		n.epoch = epoch
+	}
+}
+
+// Records the completed rollup in dir for the summary. It has to be read right away,
+// as a streamed rollup is removed again before the run ends.
+func (n *runNotifier) rollupPublished(dir string) {
+	if n == nil {
+		return
+	}
+	n.published = dir
+	basic, err := loadBasicStats(dir)
+	if err != nil {
+		log.Warnf("run notification will lack totals: %s", err)
+		return
+	}
+	n.totals = &basic.Payload
+}
+
+// Posts the outcome of the run, which runErr is the result of. Failing to do so is
+// logged, and never changes the outcome of the run itself.
+func (n *runNotifier) notify(runErr error) {
+	if n == nil || (runErr == nil && !n.onSuccess) {
+		return
+	}
+
+	// the run context may be what was cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	if err := n.post(ctx, n.message(runErr)); err != nil {
+		log.Warnf("posting run notification failed: %s", err)
+	}
+}
+
+func (n *runNotifier) message(runErr error) string {
+	var msg strings.Builder
+	if runErr != nil {
+		msg.WriteString(":x: slingshot-stats rollup")
+	} else {
+		msg.WriteString(":white_check_mark: slingshot-stats rollup")
+	}
+	if n.epoch > 0 {
+		fmt.Fprintf(&msg, " at epoch %d", n.epoch)
+	}
+	if host, err := os.Hostname(); err == nil {
+		fmt.Fprintf(&msg, " on %s", host)
+	}
+
+	if runErr != nil {
+		errMsg := runErr.Error()
+		if len(errMsg) > notifyMaxErrorLength {
+			errMsg = errMsg[:notifyMaxErrorLength] + "..."
+		}
+		fmt.Fprintf(&msg, " failed: %s", errMsg)
+		return msg.String()
+	}
+
+	msg.WriteString(" published")
+	if n.published != "" {
+		fmt.Fprintf(&msg, " as %s", filepath.Base(n.published))
+	}
+	if t := n.totals; t != nil {
+		fmt.Fprintf(&msg, ": %s deals (%s) from %d projects, %d clients, %d providers",
+			humanize.Comma(int64(t.TotalDeals)), humanize.IBytes(uint64(t.TotalBytes)),
+			t.UniqueProjects, t.UniqueClients, t.UniqueProviders,
+		)
+	}
+	return msg.String()
+}
+
+func (n *runNotifier) post(ctx context.Context, text string) error {
+	payload := map[string]string{"text": text}
+	if n.discord {
+		payload = map[string]string{"content": text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return xerrors.Errorf("webhook responded with %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	return nil
+}
+
+func loadBasicStats(dir string) (*competitionTotalOutput, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "basic_stats.json"))
+	if err != nil {
+		return nil, err
+	}
+	var basic competitionTotalOutput
+	if err := json.Unmarshal(raw, &basic); err != nil {
+		return nil, xerrors.Errorf("decoding basic_stats.json of '%s': %w", dir, err)
+	}
+	return &basic, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+var openAPI = &cli.Command{
+	Usage: "Emit an OpenAPI 3.1 document describing the HTTP API of serve",
+	Name:  "openapi",
+	Description: `Paths are relative to the prefix of a site, which --server sets the URL of.
+The payload schemas are derived from the same types the rollup outputs are
+written from, like those of the schema command, so that typed clients generated
+from the document match what is actually served.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "server",
+			Usage: "URL of the site the document describes, prefix included",
+			Value: "/",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(openAPIDocument(cctx.String("server")))
+	},
+}
+
+type openAPIQueryParam struct {
+	name, typ string
+	required  bool
+}
+
+// The JSON answers of a site, by API path, with the component describing them
+var openAPIDocuments = []struct {
+	path, summary, endpoint string
+	envelope                reflect.Type
+	query                   []openAPIQueryParam
+}{
+	{"/basic_stats", "Competition totals", "COMPETITION_TOTALS", reflect.TypeOf(competitionTotalOutput{}), nil},
+	{"/client_stats", "Deal stats per project and client", "PROJECT_DEAL_STATS", reflect.TypeOf(projectAggregateStatsOutput{}), nil},
+	{"/miner_stats", "Deal stats per storage provider", "MINER_STATS", reflect.TypeOf(minerStatsOutput{}), nil},
+	{"/recovery", "Recovered deals", "RECOVERED_DEALS_LIST", reflect.TypeOf(recoveryListOutput{}), nil},
+	{"/deals/{project_id}", "Deal list of a project", "DEAL_LIST", reflect.TypeOf(dealListOutput{}), nil},
+	{"/projects/{project_id}/deals", "A page of the deal list of a project", "DEAL_LIST_PAGE", reflect.TypeOf(dealListPage{}),
+		[]openAPIQueryParam{{"limit", "integer", false}, {"offset", "integer", false}, {"sort", "string", false}}},
+	{"/miners/{miner_id}", "Deal stats of a storage provider", "MINER_STATS_ENTRY", reflect.TypeOf(minerStatsEntry{}), nil},
+	{"/history", "A competition total across the rollups kept", "COMPETITION_TOTALS_HISTORY", reflect.TypeOf(totalsHistoryOutput{}),
+		[]openAPIQueryParam{{"metric", "string", true}}},
+}
+
+func openAPIDocument(server string) map[string]interface{} {
+	schemas := map[string]interface{}{
+		"SiteIndex": jsonSchemaOf(reflect.TypeOf(siteIndex{})),
+		"GraphQLRequest": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"query":         map[string]interface{}{"type": "string"},
+				"operationName": map[string]interface{}{"type": "string"},
+				"variables":     map[string]interface{}{"type": "object"},
+			},
+			"required": []string{"query"},
+		},
+	}
+	paths := map[string]interface{}{
+		"/": map[string]interface{}{
+			"get": openAPIOperation("getIndex", "Epoch, files and documents of the served rollup", "SiteIndex", nil, false),
+		},
+	}
+
+	for _, d := range openAPIDocuments {
+		component := openAPIComponentName(d.endpoint)
+		s := jsonSchemaOf(d.envelope)
+		s["properties"].(map[string]interface{})["endpoint"] = map[string]interface{}{"type": "string", "const": d.endpoint}
+		schemas[component] = s
+
+		var params []interface{}
+		for _, seg := range strings.Split(d.path, "/") {
+			if strings.HasPrefix(seg, "{") {
+				params = append(params, openAPIParameter(strings.Trim(seg, "{}"), "path", "string", true))
+			}
+		}
+		for _, q := range d.query {
+			params = append(params, openAPIParameter(q.name, "query", q.typ, q.required))
+		}
+		paths[d.path] = map[string]interface{}{
+			"get": openAPIOperation("get"+component, d.summary, component, params, strings.HasPrefix(d.path, "/projects/")),
+		}
+	}
+
+	graphQLResponse := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "The GraphQL response, or the schema in SDL for a GET without a query",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "object"}},
+				"text/plain":       map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			},
+		},
+		"401": map[string]interface{}{"description": "Bearer token required"},
+		"429": map[string]interface{}{"description": "Rate limited"},
+	}
+	paths["/graphql"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"operationId": "getGraphQL",
+			"summary":     "GraphQL query over GET",
+			"parameters": []interface{}{
+				openAPIParameter("query", "query", "string", false),
+				openAPIParameter("operationName", "query", "string", false),
+				openAPIParameter("variables", "query", "string", false),
+			},
+			"responses": graphQLResponse,
+			"security":  []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+		},
+		"post": map[string]interface{}{
+			"operationId": "postGraphQL",
+			"summary":     "GraphQL query",
+			"requestBody": map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/GraphQLRequest"}},
+				},
+			},
+			"responses": graphQLResponse,
+			"security":  []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "slingshot-stats",
+			"version": outputSchemaVersion,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": server}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// The endpoint of an envelope as a type name: DEAL_LIST_PAGE => DealListPage
+func openAPIComponentName(endpoint string) string {
+	var b strings.Builder
+	for _, w := range strings.Split(strings.ToLower(endpoint), "_") {
+		if w != "" {
+			b.WriteString(strings.ToUpper(w[:1]) + w[1:])
+		}
+	}
+	return b.String()
+}
+
+func openAPIParameter(name, in, typ string, required bool) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     name,
+		"in":       in,
+		"required": required,
+		"schema":   map[string]interface{}{"type": typ},
+	}
+}
+
+// A GET answered with the given component, behind a bearer token if protected
+func openAPIOperation(id, summary, component string, params []interface{}, protected bool) map[string]interface{} {
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": summary,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"$ref": "#/components/schemas/" + component},
+				},
+			},
+		},
+		"429": map[string]interface{}{"description": "Rate limited"},
+	}
+	op := map[string]interface{}{
+		"operationId": id,
+		"summary":     summary,
+		"responses":   responses,
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	for _, p := range params {
+		switch p.(map[string]interface{})["in"] {
+		case "path":
+			responses["404"] = map[string]interface{}{"description": "Not found"}
+		case "query":
+			responses["400"] = map[string]interface{}{"description": "Invalid parameters"}
+		}
+	}
+	if protected {
+		responses["401"] = map[string]interface{}{"description": "Bearer token required"}
+		op["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+	}
+	return op
+}
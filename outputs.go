@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/xerrors"
+)
+
+// Exit code of a --soft-fail run that completed with some of its outputs missing
+const exitCodePartialOutputs = 3
+
+// An output that could not be written, as recorded in the manifest
+type outputFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// Collects the outputs that failed to be written. Without soft failing every error is
+// passed straight through, aborting the run as before.
+type outputFailures struct {
+	soft   bool
+	failed []outputFailure
+}
+
+// Passes err through, unless soft failing: then the partially written file at path is
+// removed, the failure is recorded and generation carries on with the next output
+func (of *outputFailures) check(path string, err error) error {
+	if err == nil || !of.soft {
+		return err
+	}
+
+	name := filepath.Base(path)
+	log.Errorf("writing %s failed, continuing without it: %s", name, err)
+	of.failed = append(of.failed, outputFailure{Name: name, Error: err.Error()})
+
+	if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) {
+		log.Warnf("removing partially written %s failed: %s", name, rmErr)
+	}
+	return nil
+}
+
+// Writes a single JSON document, surfacing errors only reported on close, which is
+// where a full disk tends to show up
+func writeJSONFile(path string, v interface{}) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	if err := json.NewEncoder(fh).Encode(v); err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// Writes a deal list document with the deals streamed into its payload one at a time
+// through a single reused encoder, instead of marshaling the whole document in one
+// go: on big projects that buffer alone ran into hundreds of MiB. envelope must be
+// the document with its payload left nil, and is otherwise written out unchanged.
+func writeDealListJSON(path string, envelope interface{}, deals []*individualDeal) error {
+	head, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(head, []byte(`"payload":null}`)) {
+		return xerrors.Errorf("%T does not end in an empty payload", envelope)
+	}
+	head = head[:len(head)-len("null}")]
+
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+	w := bufio.NewWriterSize(fh, 1<<20)
+
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	if deals == nil {
+		_, err = w.WriteString("null")
+	} else {
+		err = writeDealArray(w, deals)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteString("}\n"); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+func writeDealArray(w *bufio.Writer, deals []*individualDeal) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	if err := w.WriteByte('['); err != nil {
+		return err
+	}
+	for i, d := range deals {
+		if i > 0 {
+			if err := w.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		buf.Reset()
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+		// minus the newline Encode terminates every value with
+		if _, err := w.Write(buf.Bytes()[:buf.Len()-1]); err != nil {
+			return err
+		}
+	}
+	return w.WriteByte(']')
+}
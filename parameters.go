@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/ipfs/go-cid"
+)
+
+// contents of parameters.json
+type rollupParametersOutput struct {
+	Epoch         int64            `json:"epoch"`
+	TipSetKey     []cid.Cid        `json:"tipset_key"`
+	Endpoint      string           `json:"endpoint"`
+	Phase         int              `json:"phase,omitempty"`
+	SchemaVersion string           `json:"schema_version"`
+	Payload       rollupParameters `json:"payload"`
+}
+
+// The exact rules a rollup was computed with, so that every published rollup is
+// self-describing
+type rollupParameters struct {
+	TipSetKey                       []cid.Cid   `json:"tipset_key"`
+	EpochLookback                   int64       `json:"epoch_lookback"` // 0 when the tipset was given explicitly
+	PhaseStartEpoch                 int64       `json:"phase_start_epoch"`
+	PhaseEndEpoch                   int64       `json:"phase_end_epoch,omitempty"`
+	MinDealDurationEpochs           int64       `json:"min_deal_duration_epochs"`
+	MaxDealsPerPiece                int         `json:"max_deals_per_piece"`
+	PieceCapPerProvider             bool        `json:"piece_cap_per_provider"` // whether max_deals_per_piece counts the deals with each provider separately
+	RecoveryStartEpoch              int64       `json:"recovery_start_epoch"`
+	RecoveryMinDurationEpochs       int64       `json:"recovery_min_duration_epochs"`
+	RecoveryExcludedFromCompetition bool        `json:"recovery_excluded_from_competition"`
+	ExcludedWallets                 int         `json:"excluded_wallets"`
+	ExcludedWalletsSHA256           string      `json:"excluded_wallets_sha256"` // over the sorted addresses, one per line
+	ExcludedDatasets                []string    `json:"excluded_datasets"`
+	ExcludedDeals                   int         `json:"excluded_deals"`
+	OnlyProviders                   []string    `json:"only_providers,omitempty"`
+	ExcludedProviders               []string    `json:"excluded_providers,omitempty"`
+	Rules                           []*ruleHits `json:"rules"` // in the order they apply
+}
+
+func writeRollupParameters(outDirName string, ts rollupTipSet, lookback abi.ChainEpoch, recovery *recoveryRules, rules eligibilityRules, excludeList *exclusionList, providers *providerFilter) error {
+	excluded := excludeList.clientAddresses()
+	excludedDatasets := append([]string{}, excludeList.Datasets...)
+	sort.Strings(excludedDatasets)
+	onlyProviders, excludedProviders := providers.lists()
+	excludedSum := sha256.Sum256([]byte(strings.Join(excluded, "\n")))
+
+	fh, err := os.Create(filepath.Join(outDirName, "parameters.json"))
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	if err := json.NewEncoder(fh).Encode(rollupParametersOutput{
+		Epoch:         int64(ts.Height()),
+		TipSetKey:     ts.Cids(),
+		Endpoint:      "ROLLUP_PARAMETERS",
+		Phase:         currentPhaseID,
+		SchemaVersion: outputSchemaVersion,
+		Payload: rollupParameters{
+			TipSetKey:                       ts.Cids(),
+			EpochLookback:                   int64(lookback),
+			PhaseStartEpoch:                 int64(currentPhaseStart),
+			PhaseEndEpoch:                   int64(currentPhaseEnd),
+			MinDealDurationEpochs:           int64(builtin.EpochsInDay) * minQualifyingDealDurationDays,
+			MaxDealsPerPiece:                maxQualifyingDealsPerPiece,
+			PieceCapPerProvider:             pieceCapPerProvider,
+			RecoveryStartEpoch:              int64(recovery.StartEpoch),
+			RecoveryMinDurationEpochs:       int64(recovery.MinDuration),
+			RecoveryExcludedFromCompetition: recovery.ExcludeFromCompetition,
+			ExcludedWallets:                 len(excluded),
+			ExcludedWalletsSHA256:           hex.EncodeToString(excludedSum[:]),
+			ExcludedDatasets:                excludedDatasets,
+			ExcludedDeals:                   len(excludeList.deals),
+			OnlyProviders:                   onlyProviders,
+			ExcludedProviders:               excludedProviders,
+			Rules:                           rules.hitCounts(),
+		},
+	}); err != nil {
+		return err
+	}
+	return fh.Close()
+}
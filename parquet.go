@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+
+	"github.com/xitongsys/parquet-go/writer"
+	"golang.org/x/xerrors"
+)
+
+// Just like the CSV outputs, the parquet schema is derived from the json tags of the
+// output structs. Only scalar fields are supported, which covers the deal lists.
+
+func parquetSchema(t reflect.Type) (string, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	type schemaNode struct {
+		Tag    string        `json:"Tag"`
+		Fields []*schemaNode `json:"Fields,omitempty"`
+	}
+	root := &schemaNode{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := csvFieldName(f)
+		if !ok {
+			continue
+		}
+
+		var pqType string
+		switch f.Type.Kind() {
+		case reflect.String:
+			pqType = "type=UTF8"
+		case reflect.Bool:
+			pqType = "type=BOOLEAN"
+		case reflect.Int8, reflect.Int16, reflect.Int32:
+			pqType = "type=INT32"
+		case reflect.Int, reflect.Int64, reflect.Uint64:
+			pqType = "type=INT64"
+		default:
+			return "", xerrors.Errorf("field %s.%s of kind %s has no parquet mapping", t.Name(), f.Name, f.Type.Kind())
+		}
+
+		root.Fields = append(root.Fields, &schemaNode{
+			Tag: "name=" + name + ", " + pqType + ", repetitiontype=REQUIRED",
+		})
+	}
+
+	s, err := json.Marshal(root)
+	return string(s), err
+}
+
+// Writes a slice of structs (or pointers to structs) as a single parquet file
+func writeParquet(path string, rows interface{}) error {
+	rv := reflect.ValueOf(rows)
+	if rv.Kind() != reflect.Slice {
+		return xerrors.Errorf("writeParquet expects a slice, got %T", rows)
+	}
+
+	schema, err := parquetSchema(rv.Type().Elem())
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	pw, err := writer.NewJSONWriterFromWriter(schema, fh, 4)
+	if err != nil {
+		return xerrors.Errorf("initializing parquet writer for %s: %w", path, err)
+	}
+
+	// the JSON writer wants every column present: build the rows without omitempty
+	for i := 0; i < rv.Len(); i++ {
+		elem := rv.Index(i)
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+
+		row := make(map[string]interface{}, elem.NumField())
+		for j := 0; j < elem.NumField(); j++ {
+			if name, ok := csvFieldName(elem.Type().Field(j)); ok {
+				row[name] = elem.Field(j).Interface()
+			}
+		}
+
+		js, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if err := pw.Write(string(js)); err != nil {
+			return xerrors.Errorf("writing parquet row to %s: %w", path, err)
+		}
+	}
+
+	if err := pw.WriteStop(); err != nil {
+		return xerrors.Errorf("finalizing %s: %w", path, err)
+	}
+
+	return fh.Close()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"golang.org/x/xerrors"
+)
+
+// A competition phase: deals activated from its start epoch up to the start of the
+// following phase count towards it
+type phaseDefinition struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name,omitempty"`
+	StartEpoch int64  `json:"start_epoch"`
+}
+
+// The mainnet schedule, or that of the --network or --phase-schedule. Entries in the
+// "phases" section of the rollup config replace the built-in ones with the same id.
+//
+// perl -E 'say scalar gmtime ( XXX * 30 + 1598306400 )'
+var builtinPhases = []phaseDefinition{
+	{ID: 1, StartEpoch: 166560},  // Wed Oct 21 18:00:00 2020
+	{ID: 2, StartEpoch: 307680},  // Wed Dec  9 18:00:00 2020
+	{ID: 3, StartEpoch: 448800},  // Wed Jan 27 18:00:00 2021
+	{ID: 4, StartEpoch: 569760},  // Wed Mar 10 18:00:00 2021
+	{ID: 5, StartEpoch: 756960},  // Fri May 14 18:00:00 2021
+	{ID: 6, StartEpoch: 912480},  // Wed Jul  7 18:00:00 2021
+	{ID: 7, StartEpoch: 1099680}, // Fri Sep 10 18:00:00 2021
+	{ID: 8, StartEpoch: 1275360}, // Wed Nov 10 18:00:00 2021
+	{ID: 9, StartEpoch: 1623840}, // Fri Mar 11 18:00:00 2022
+}
+
+type phaseSchedule []phaseDefinition
+
+func newPhaseSchedule(overrides []phaseDefinition) (phaseSchedule, error) {
+	byID := make(map[int]phaseDefinition, len(builtinPhases)+len(overrides))
+	for _, p := range builtinPhases {
+		byID[p.ID] = p
+	}
+	for _, p := range overrides {
+		if p.ID <= 0 {
+			return nil, xerrors.Errorf("phase ids must be positive, got %d", p.ID)
+		}
+		byID[p.ID] = p
+	}
+
+	sched := make(phaseSchedule, 0, len(byID))
+	for _, p := range byID {
+		sched = append(sched, p)
+	}
+	sort.Slice(sched, func(i, j int) bool { return sched[i].ID < sched[j].ID })
+
+	// ids and start epochs must both be increasing, otherwise phase windows overlap
+	for i := 1; i < len(sched); i++ {
+		if sched[i].StartEpoch <= sched[i-1].StartEpoch {
+			return nil, xerrors.Errorf("phase %d starts at epoch %d, not after the start of phase %d at %d", sched[i].ID, sched[i].StartEpoch, sched[i-1].ID, sched[i-1].StartEpoch)
+		}
+	}
+
+	return sched, nil
+}
+
+// Finds a phase by id or name, returning it along with the epoch the following
+// phase starts at, or 0 when it is the last one
+func (ps phaseSchedule) resolve(sel string) (*phaseDefinition, abi.ChainEpoch, error) {
+	id, numErr := strconv.Atoi(sel)
+	for i := range ps {
+		if (numErr == nil && ps[i].ID == id) || (ps[i].Name != "" && ps[i].Name == sel) {
+			var end abi.ChainEpoch
+			if i+1 < len(ps) {
+				end = abi.ChainEpoch(ps[i+1].StartEpoch)
+			}
+			return &ps[i], end, nil
+		}
+	}
+	return nil, 0, xerrors.Errorf("no phase '%s' in the phase schedule", sel)
+}
+
+// The id of the phase starting exactly at the given epoch, 0 if there is none
+func (ps phaseSchedule) idStartingAt(start abi.ChainEpoch) int {
+	for _, p := range ps {
+		if abi.ChainEpoch(p.StartEpoch) == start {
+			return p.ID
+		}
+	}
+	return 0
+}
+
+// The phase the given epoch falls in, nil when it is before the first one
+func (ps phaseSchedule) containing(epoch abi.ChainEpoch) *phaseDefinition {
+	var in *phaseDefinition
+	for i := range ps {
+		if abi.ChainEpoch(ps[i].StartEpoch) <= epoch {
+			in = &ps[i]
+		}
+	}
+	return in
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"golang.org/x/xerrors"
+	"gopkg.in/yaml.v2"
+)
+
+// A phase schedule, supplied via --phase-schedule as a local file or URL, replacing
+// the built-in one of the --network. The last phase is the one rolled up by default.
+// Files named .yaml or .yml are read as YAML, anything else as JSON:
+//
+//	{
+//		"recovery_start_epoch": 1381920,
+//		"phases": [
+//			{ "id": 9, "start_epoch": 1623840 },
+//			{ "id": 10, "name": "autumn", "start_epoch": 1900000 }
+//		]
+//	}
+type phaseScheduleFile struct {
+	RecoveryStartEpoch int64             `json:"recovery_start_epoch,omitempty"` // the --network default when unset
+	Phases             []phaseDefinition `json:"phases"`
+
+	raw []byte
+}
+
+func phaseScheduleIsYAML(name string) bool {
+	if i := strings.IndexAny(name, "?#"); i >= 0 && (strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")) {
+		name = name[:i]
+	}
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// The name the verbatim copy of the schedule is saved under in the output directory
+func phaseScheduleSavedName(name string) string {
+	if phaseScheduleIsYAML(name) {
+		return "phase_schedule.yaml"
+	}
+	return "phase_schedule.json"
+}
+
+// Loads and validates a phase schedule. Phases must be listed in order, both of their
+// ids and start epochs, as each one runs up to the start of the next.
+func loadPhaseSchedule(ctx context.Context, name string) (*phaseScheduleFile, error) {
+	src, err := openSource(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close() //nolint:errcheck
+
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read phase schedule from %s: %w", name, err)
+	}
+
+	var asJSON []byte
+	if phaseScheduleIsYAML(name) {
+		var doc interface{}
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return nil, xerrors.Errorf("failed to parse phase schedule %s: %w", name, err)
+		}
+		if asJSON, err = json.Marshal(yamlToJSONValue(doc)); err != nil {
+			return nil, err
+		}
+	} else if asJSON, err = relaxedJSON(raw); err != nil {
+		return nil, xerrors.Errorf("failed to parse phase schedule %s: %w", name, err)
+	}
+
+	sched := &phaseScheduleFile{raw: raw}
+	dec := json.NewDecoder(bytes.NewReader(asJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(sched); err != nil {
+		return nil, xerrors.Errorf("failed to parse phase schedule %s: %w", name, err)
+	}
+
+	if len(sched.Phases) == 0 {
+		return nil, xerrors.Errorf("phase schedule %s lists no phases", name)
+	}
+	if sched.RecoveryStartEpoch < 0 {
+		return nil, xerrors.Errorf("phase schedule %s: invalid recovery_start_epoch %d", name, sched.RecoveryStartEpoch)
+	}
+	names := make(map[string]int)
+	for i, p := range sched.Phases {
+		if p.ID <= 0 {
+			return nil, xerrors.Errorf("phase schedule %s: phase ids must be positive, got %d", name, p.ID)
+		}
+		if p.StartEpoch < 0 {
+			return nil, xerrors.Errorf("phase schedule %s: phase %d starts at invalid epoch %d", name, p.ID, p.StartEpoch)
+		}
+		if i > 0 && p.ID <= sched.Phases[i-1].ID {
+			return nil, xerrors.Errorf("phase schedule %s: phase %d is listed after phase %d", name, p.ID, sched.Phases[i-1].ID)
+		}
+		if i > 0 && p.StartEpoch <= sched.Phases[i-1].StartEpoch {
+			return nil, xerrors.Errorf("phase schedule %s: phase %d starts at epoch %d, not after the start of phase %d at %d", name, p.ID, p.StartEpoch, sched.Phases[i-1].ID, sched.Phases[i-1].StartEpoch)
+		}
+		if p.Name != "" {
+			if other, dup := names[p.Name]; dup {
+				return nil, xerrors.Errorf("phase schedule %s: phases %d and %d are both named '%s'", name, other, p.ID, p.Name)
+			}
+			names[p.Name] = p.ID
+		}
+	}
+
+	return sched, nil
+}
+
+// Makes the schedule the defaults the rollup flags and config then override, in
+// place of those of the --network
+func (s *phaseScheduleFile) apply() {
+	builtinPhases = s.Phases
+	currentPhaseStart = abi.ChainEpoch(s.Phases[len(s.Phases)-1].StartEpoch)
+	if s.RecoveryStartEpoch > 0 {
+		recoveryStart = abi.ChainEpoch(s.RecoveryStartEpoch)
+	}
+}
+
+// YAML maps decode with arbitrary keys, JSON objects only have string ones
+func yamlToJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			ret[fmt.Sprint(k)] = yamlToJSONValue(val)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, val := range v {
+			ret[i] = yamlToJSONValue(val)
+		}
+		return ret
+	default:
+		return v
+	}
+}
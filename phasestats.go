@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+type phaseStatsOutput struct {
+	Epoch         int64         `json:"epoch"`
+	TipSetKey     []cid.Cid     `json:"tipset_key"`
+	Endpoint      string        `json:"endpoint"`
+	SchemaVersion string        `json:"schema_version"`
+	Payload       []*phaseStats `json:"payload"`
+}
+
+// The competition totals and project stats of one of the --phase-boundaries windows,
+// as a rollup with that window would have them
+type phaseStats struct {
+	PhaseID    int                  `json:"phase,omitempty"` // of the phase schedule entry starting at start_epoch, if any
+	StartEpoch int64                `json:"start_epoch"`
+	EndEpoch   int64                `json:"end_epoch,omitempty"` // unset for the last window, running up to the rollup
+	Totals     *competitionTotal    `json:"totals"`
+	Projects   []*phaseProjectStats `json:"projects"` // by project id
+}
+
+type phaseProjectStats struct {
+	PhaseID         int    `json:"phase,omitempty"`
+	StartEpoch      int64  `json:"start_epoch"`
+	ProjectID       string `json:"project_id"`
+	DataSize        int64  `json:"total_data_size"`
+	NumCids         int    `json:"total_num_cids"`
+	NumDeals        int    `json:"total_num_deals"`
+	NumProviders    int    `json:"total_num_providers"`
+	NumClients      int    `json:"total_num_clients"`
+	FilplusDataSize int64  `json:"filplus_total_data_size"`
+	QADataSize      int64  `json:"qa_total_data_size"` // FIL+ data counted 10x
+
+	cids      map[cid.Cid]struct{}
+	providers map[address.Address]struct{}
+	clients   map[address.Address]struct{}
+}
+
+// Tallies the qualifying deals of several phase windows within the one pass over the
+// deals, under the same rules as the phase the rollup is run for
+type phaseBreakdown struct {
+	phases   []*phaseStats
+	projects []map[string]*phaseProjectStats
+}
+
+// Boundaries are the start epochs of consecutive windows, each ending where the next
+// one starts
+func newPhaseBreakdown(boundaries []int64, sched phaseSchedule) (*phaseBreakdown, error) {
+	pb := &phaseBreakdown{}
+	for i, start := range boundaries {
+		if i > 0 && start <= boundaries[i-1] {
+			return nil, xerrors.Errorf("phase boundary %d is not after the previous one at %d", start, boundaries[i-1])
+		}
+		ps := &phaseStats{
+			PhaseID:    sched.idStartingAt(abi.ChainEpoch(start)),
+			StartEpoch: start,
+			Totals: &competitionTotal{
+				seenProject:  make(map[string]bool),
+				seenClient:   make(map[address.Address]bool),
+				seenProvider: make(map[address.Address]bool),
+				seenPieceCid: make(map[cid.Cid]bool),
+			},
+		}
+		if i+1 < len(boundaries) {
+			ps.EndEpoch = boundaries[i+1]
+		}
+		pb.phases = append(pb.phases, ps)
+		pb.projects = append(pb.projects, make(map[string]*phaseProjectStats))
+	}
+	return pb, nil
+}
+
+// Takes a deal of a registered project, along with the number of deals of its piece
+// the project made so far, before any phase window applies
+func (pb *phaseBreakdown) observe(projID string, client address.Address, deal *api.MarketDeal, timesSeenPiece int) {
+	i := sort.Search(len(pb.phases), func(i int) bool {
+		return abi.ChainEpoch(pb.phases[i].StartEpoch) > deal.State.SectorStartEpoch
+	}) - 1
+	if i < 0 || (pb.phases[i].EndEpoch > 0 && deal.State.SectorStartEpoch >= abi.ChainEpoch(pb.phases[i].EndEpoch)) {
+		return
+	}
+
+	if deal.Proposal.EndEpoch-deal.Proposal.StartEpoch < builtin.EpochsInDay*abi.ChainEpoch(minQualifyingDealDurationDays) {
+		return
+	}
+	totals := pb.phases[i].Totals
+	totals.seenProject[projID] = true
+	if maxQualifyingDealsPerPiece > 0 && timesSeenPiece >= maxQualifyingDealsPerPiece {
+		return
+	}
+
+	size := int64(deal.Proposal.PieceSize)
+	totals.seenClient[client] = true
+	totals.seenProvider[deal.Proposal.Provider] = true
+	totals.seenPieceCid[deal.Proposal.PieceCID] = true
+	totals.TotalDeals++
+	totals.TotalBytes += size
+	totals.QATotalBytes += qualityAdjustedSize(&deal.Proposal)
+	if deal.Proposal.VerifiedDeal {
+		totals.FilplusTotalDeals++
+		totals.FilplusTotalBytes += size
+	}
+
+	pps, ok := pb.projects[i][projID]
+	if !ok {
+		pps = &phaseProjectStats{
+			PhaseID:    pb.phases[i].PhaseID,
+			StartEpoch: pb.phases[i].StartEpoch,
+			ProjectID:  projID,
+			cids:       make(map[cid.Cid]struct{}),
+			providers:  make(map[address.Address]struct{}),
+			clients:    make(map[address.Address]struct{}),
+		}
+		pb.projects[i][projID] = pps
+	}
+	pps.DataSize += size
+	pps.QADataSize += qualityAdjustedSize(&deal.Proposal)
+	pps.NumDeals++
+	if deal.Proposal.VerifiedDeal {
+		pps.FilplusDataSize += size
+	}
+	pps.cids[deal.Proposal.PieceCID] = struct{}{}
+	pps.providers[deal.Proposal.Provider] = struct{}{}
+	pps.clients[client] = struct{}{}
+}
+
+func (pb *phaseBreakdown) list() []*phaseStats {
+	for i, ps := range pb.phases {
+		ps.Totals.UniqueCids = len(ps.Totals.seenPieceCid)
+		ps.Totals.UniqueProviders = len(ps.Totals.seenProvider)
+		ps.Totals.UniqueProjects = len(ps.Totals.seenProject)
+		ps.Totals.UniqueClients = len(ps.Totals.seenClient)
+
+		ps.Projects = make([]*phaseProjectStats, 0, len(pb.projects[i]))
+		for _, pps := range pb.projects[i] {
+			pps.NumCids = len(pps.cids)
+			pps.NumProviders = len(pps.providers)
+			pps.NumClients = len(pps.clients)
+			ps.Projects = append(ps.Projects, pps)
+		}
+		sort.Slice(ps.Projects, func(a, b int) bool { return ps.Projects[a].ProjectID < ps.Projects[b].ProjectID })
+	}
+	return pb.phases
+}
+
+// One row per phase and project, the phase totals are left to the reader
+func writePhaseStatsCSV(path string, epoch int64, pl []*phaseStats) error {
+	var rows [][]string
+	for _, p := range pl {
+		for _, pps := range p.Projects {
+			rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(pps))...))
+		}
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(phaseProjectStats{}))...), rows)
+}
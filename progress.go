@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/urfave/cli/v2"
+)
+
+// When embedding, a rollup is driven through the cli.App via RunContext: canceling
+// that context stops the run, and a progress callback can be attached to it with
+// withRollupProgress. The --progress flag reports the same events on stderr.
+type rollupProgress struct {
+	Stage   string  `json:"stage"`
+	Done    int     `json:"done"`
+	Total   int     `json:"total"`
+	Percent float64 `json:"percent"`
+}
+
+type rollupProgressFunc func(rollupProgress)
+
+type rollupProgressKey struct{}
+
+func withRollupProgress(ctx context.Context, cb rollupProgressFunc) context.Context {
+	return context.WithValue(ctx, rollupProgressKey{}, cb)
+}
+
+// Like lcli.ReqContext, except derived from the context the app was run with, so
+// that cancellation by an embedding caller is honored
+func rollupContext(cctx *cli.Context) context.Context {
+	ctx, done := context.WithCancel(cctx.Context)
+	sigChan := make(chan os.Signal, 2)
+	go func() {
+		select {
+		case <-sigChan:
+			done()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigChan)
+	}()
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	return ctx
+}
+
+// How many loop iterations pass between cancellation checks
+const progressCheckInterval = 1024
+
+type progressReporter struct {
+	ctx         context.Context
+	cb          rollupProgressFunc
+	stage       string
+	total       int
+	lastPercent int
+}
+
+func newProgressReporter(ctx context.Context, toStderr bool) *progressReporter {
+	cb, _ := ctx.Value(rollupProgressKey{}).(rollupProgressFunc)
+	if cb == nil && toStderr {
+		enc := json.NewEncoder(os.Stderr)
+		cb = func(p rollupProgress) { enc.Encode(p) } //nolint:errcheck
+	}
+	return &progressReporter{ctx: ctx, cb: cb}
+}
+
+// Begins a new stage, total being the amount of steps it takes or 0 when unknown
+func (p *progressReporter) start(stage string, total int) {
+	p.stage = stage
+	p.total = total
+	p.lastPercent = -1
+	p.report(0)
+}
+
+// Records done steps of the current stage, reporting whenever another whole percent
+// is reached. Returns the context error once the run has been canceled.
+func (p *progressReporter) step(done int) error {
+	if done%progressCheckInterval == 0 {
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if p.total > 0 && done*100/p.total > p.lastPercent {
+		p.report(done)
+	}
+	return nil
+}
+
+func (p *progressReporter) report(done int) {
+	if p.cb == nil {
+		return
+	}
+	pr := rollupProgress{Stage: p.stage, Done: done, Total: p.total}
+	if p.total > 0 {
+		pr.Percent = float64(done) * 100 / float64(p.total)
+		p.lastPercent = done * 100 / p.total
+	}
+	p.cb(pr)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The competition totals exported for node-exporter's textfile collector
+var prometheusTotals = []struct {
+	name  string
+	help  string
+	value func(*competitionTotal) int64
+}{
+	{"slingshot_deals", "Qualifying deals", func(t *competitionTotal) int64 { return int64(t.TotalDeals) }},
+	{"slingshot_stored_bytes", "Padded size of all qualifying deals", func(t *competitionTotal) int64 { return t.TotalBytes }},
+	{"slingshot_filplus_deals", "Qualifying FIL+ deals", func(t *competitionTotal) int64 { return int64(t.FilplusTotalDeals) }},
+	{"slingshot_filplus_stored_bytes", "Padded size of all qualifying FIL+ deals", func(t *competitionTotal) int64 { return t.FilplusTotalBytes }},
+	{"slingshot_qa_stored_bytes", "Quality-adjusted size of all qualifying deals, FIL+ deals counted 10x", func(t *competitionTotal) int64 { return t.QATotalBytes }},
+	{"slingshot_unique_piece_cids", "Distinct piece CIDs among qualifying deals", func(t *competitionTotal) int64 { return int64(t.UniqueCids) }},
+	{"slingshot_unique_providers", "Distinct providers storing qualifying deals", func(t *competitionTotal) int64 { return int64(t.UniqueProviders) }},
+	{"slingshot_unique_clients", "Distinct clients making qualifying deals", func(t *competitionTotal) int64 { return int64(t.UniqueClients) }},
+	{"slingshot_unique_projects", "Projects with qualifying deals", func(t *competitionTotal) int64 { return int64(t.UniqueProjects) }},
+}
+
+// Writes the totals in the Prometheus exposition format. The file is replaced
+// atomically, so that the collector never scrapes a partially written one.
+func writePrometheusTextfile(path string, epoch int64, totals *competitionTotal) error {
+	var labels string
+	if currentPhaseID != 0 {
+		labels = fmt.Sprintf(`{phase="%d"}`, currentPhaseID)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP slingshot_rollup_epoch Epoch of the tipset the rollup was computed over\n")
+	fmt.Fprintf(&b, "# TYPE slingshot_rollup_epoch gauge\n")
+	fmt.Fprintf(&b, "slingshot_rollup_epoch%s %d\n", labels, epoch)
+	for _, m := range prometheusTotals {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", m.name)
+		fmt.Fprintf(&b, "%s%s %d\n", m.name, labels, m.value(totals))
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
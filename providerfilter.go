@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"golang.org/x/xerrors"
+)
+
+// Restricts a rollup to some providers with --only-provider, or keeps some out of it
+// with --exclude-provider. The deals of the others are dropped as they are read, before
+// anything counts them, so that the totals, project stats and deal lists all add up.
+// A nil filter admits every provider.
+type providerFilter struct {
+	allow map[address.Address]struct{} // nil when all providers not denied are admitted
+	deny  map[address.Address]struct{}
+}
+
+func newProviderFilter(allow, deny []string) (*providerFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	parse := func(flag string, addrs []string) (map[address.Address]struct{}, error) {
+		if len(addrs) == 0 {
+			return nil, nil
+		}
+		ret := make(map[address.Address]struct{}, len(addrs))
+		for _, a := range addrs {
+			addr, err := address.NewFromString(a)
+			if err != nil {
+				return nil, xerrors.Errorf("invalid --%s '%s': %w", flag, a, err)
+			}
+			if addr.Protocol() != address.ID {
+				return nil, xerrors.Errorf("invalid --%s '%s': providers are given by their f0 miner id", flag, a)
+			}
+			ret[addr] = struct{}{}
+		}
+		return ret, nil
+	}
+
+	pf := new(providerFilter)
+	var err error
+	if pf.allow, err = parse("only-provider", allow); err != nil {
+		return nil, err
+	}
+	if pf.deny, err = parse("exclude-provider", deny); err != nil {
+		return nil, err
+	}
+	for a := range pf.deny {
+		if _, both := pf.allow[a]; both {
+			return nil, xerrors.Errorf("provider %s passed to both --only-provider and --exclude-provider", a)
+		}
+	}
+	return pf, nil
+}
+
+func (pf *providerFilter) admits(provider address.Address) bool {
+	if pf == nil {
+		return true
+	}
+	if _, denied := pf.deny[provider]; denied {
+		return false
+	}
+	if pf.allow == nil {
+		return true
+	}
+	_, allowed := pf.allow[provider]
+	return allowed
+}
+
+// The providers passed to either flag, sorted, for parameters.json
+func (pf *providerFilter) lists() (allow, deny []string) {
+	if pf == nil {
+		return nil, nil
+	}
+	sorted := func(set map[address.Address]struct{}) []string {
+		if set == nil {
+			return nil
+		}
+		ret := make([]string, 0, len(set))
+		for a := range set {
+			ret = append(ret, a.String())
+		}
+		sort.Strings(ret)
+		return ret
+	}
+	return sorted(pf.allow), sorted(pf.deny)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+)
+
+type providerStatsOutput struct {
+	Epoch         int64            `json:"epoch"`
+	TipSetKey     []cid.Cid        `json:"tipset_key"`
+	Endpoint      string           `json:"endpoint"`
+	Phase         int              `json:"phase,omitempty"`
+	SchemaVersion string           `json:"schema_version"`
+	Payload       []*providerStats `json:"payload"`
+}
+
+// How concentrated the qualifying deals held by a storage provider are, across the
+// projects and clients it serves
+type providerStats struct {
+	ProviderID         string  `json:"provider_id"`
+	DataSize           int64   `json:"total_data_size"`
+	NumDeals           int     `json:"total_num_deals"`
+	NumProjects        int     `json:"total_num_projects"`
+	NumPieceCids       int     `json:"total_num_unique_piece_cids"`
+	FilplusPart        float64 `json:"filplus_share"` // of the data size, between 0 and 1
+	LargestClient      string  `json:"largest_client"`
+	LargestClientSize  int64   `json:"largest_client_data_size"`
+	LargestClientShare float64 `json:"largest_client_share"`        // of the data size, between 0 and 1
+	TotalStorageFee    string  `json:"total_storage_fee"`           // attoFIL, over the full term of the deals
+	AvgStoragePrice    string  `json:"avg_storage_price_per_epoch"` // attoFIL, mean over the deals
+	ProviderCollateral string  `json:"total_provider_collateral"`   // attoFIL
+	NumZeroPriceDeals  int     `json:"num_zero_price_deals"`
+	FirstSeenEpoch     int64   `json:"first_seen_epoch,omitempty"` // only with --state-db: earliest sector start of a project deal with the provider, over all runs
+	Country            string  `json:"country,omitempty"`          // only with --geoip-db, when the provider could be located
+	Region             string  `json:"region,omitempty"`
+	RawBytePower       string  `json:"raw_byte_power,omitempty"` // this and the below only with --miner-power
+	QualityAdjPower    string  `json:"quality_adj_power,omitempty"`
+	NetworkPowerShare  float64 `json:"network_power_share,omitempty"` // of the network quality-adjusted power, between 0 and 1
+	HasMinPower        bool    `json:"has_min_power,omitempty"`       // meets the consensus minimum, eligible to mine blocks
+	LiveSectors        uint64  `json:"live_sectors,omitempty"`
+	ActiveSectors      uint64  `json:"active_sectors,omitempty"` // contributing to power
+	FaultySectors      uint64  `json:"faulty_sectors,omitempty"`
+
+	filplusSize int64
+	projects    map[string]struct{}
+	pieces      map[cid.Cid]struct{}
+	clientSize  map[address.Address]int64
+	pricing     dealPricing
+}
+
+type providerStatsCollector map[address.Address]*providerStats
+
+func (pc providerStatsCollector) observe(provider address.Address, projID string, client address.Address, p *market.DealProposal) {
+	ps, ok := pc[provider]
+	if !ok {
+		ps = &providerStats{
+			ProviderID: provider.String(),
+			projects:   make(map[string]struct{}),
+			pieces:     make(map[cid.Cid]struct{}),
+			clientSize: make(map[address.Address]int64),
+		}
+		pc[provider] = ps
+	}
+	size := int64(p.PieceSize)
+	ps.DataSize += size
+	ps.NumDeals++
+	if p.VerifiedDeal {
+		ps.filplusSize += size
+	}
+	ps.projects[projID] = struct{}{}
+	ps.pieces[p.PieceCID] = struct{}{}
+	ps.clientSize[client] += size
+	ps.pricing.observe(p)
+}
+
+// Lists all providers, most data first. Of clients holding the same amount of data
+// with a provider, the lowest address is taken as its largest.
+func (pc providerStatsCollector) list() []*providerStats {
+	ret := make([]*providerStats, 0, len(pc))
+	for _, ps := range pc {
+		ps.NumProjects = len(ps.projects)
+		ps.NumPieceCids = len(ps.pieces)
+
+		var largest address.Address
+		for client, size := range ps.clientSize {
+			if size > ps.LargestClientSize || (size == ps.LargestClientSize && client.String() < largest.String()) {
+				largest = client
+				ps.LargestClientSize = size
+			}
+		}
+		ps.LargestClient = largest.String()
+		ps.TotalStorageFee, ps.AvgStoragePrice, ps.ProviderCollateral, ps.NumZeroPriceDeals = ps.pricing.totals()
+
+		if ps.DataSize > 0 {
+			ps.FilplusPart = float64(ps.filplusSize) / float64(ps.DataSize)
+			ps.LargestClientShare = float64(ps.LargestClientSize) / float64(ps.DataSize)
+		}
+		ret = append(ret, ps)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].DataSize != ret[j].DataSize {
+			return ret[i].DataSize > ret[j].DataSize
+		}
+		return ret[i].ProviderID < ret[j].ProviderID
+	})
+	return ret
+}
+
+func writeProviderStatsCSV(path string, epoch int64, pl []*providerStats) error {
+	rows := make([][]string, 0, len(pl))
+	for _, p := range pl {
+		rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(p))...))
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(providerStats{}))...), rows)
+}
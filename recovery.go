@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+// Deals made by restore or repair clients after recoveryStart with a long enough
+// duration make up the recovery list. Independently of that, such deals may or may not
+// also count towards the regular competition totals.
+type recoveryRules struct {
+	StartEpoch  abi.ChainEpoch
+	MinDuration abi.ChainEpoch
+
+	// wallets making the repair deals, as opposed to those in the restore client list
+	RepairClients map[address.Address]struct{}
+
+	// When set, deals that made it into the recovery list do not count towards the
+	// competition. Otherwise they count like any other deal of their project.
+	ExcludeFromCompetition bool
+}
+
+var defaultRecoveryMinDurationDays = int64(499)
+
+// The kinds of recovery, as in the recovery field of the recovery list
+const (
+	recoveryRestore int8 = 1
+	recoveryRepair  int8 = 2
+)
+
+// The kind of recovery a deal is, 0 when it is none
+func (rr *recoveryRules) recoveryKind(clientAddr address.Address, restoreClients map[address.Address]struct{}, deal *api.MarketDeal) int8 {
+	var kind int8
+	if _, isRestoreClient := restoreClients[clientAddr]; isRestoreClient {
+		kind = recoveryRestore
+	} else if _, isRepairClient := rr.RepairClients[clientAddr]; isRepairClient {
+		kind = recoveryRepair
+	} else {
+		return 0
+	}
+
+	if deal.State.SectorStartEpoch >= rr.StartEpoch &&
+		deal.Proposal.EndEpoch-deal.Proposal.StartEpoch > rr.MinDuration {
+		return kind
+	}
+	return 0
+}
+
+// Whether a deal is kept out of the competition on recovery grounds
+func (rr *recoveryRules) excludedFromCompetition(isRecovery bool) bool {
+	return isRecovery && rr.ExcludeFromCompetition
+}
+
+func recoveryMinDurationEpochs(days int64) abi.ChainEpoch {
+	return abi.ChainEpoch(days) * builtin.EpochsInDay
+}
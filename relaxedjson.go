@@ -0,0 +1,81 @@
+package main
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// Hand maintained inputs (project and restore lists, the rollup config, address
+// mappings) may carry // and /* */ comments as well as trailing commas in objects and
+// arrays. These are blanked out before handing the input to the regular JSON parsers,
+// keeping every offset and line number intact for their error messages.
+func relaxedJSON(raw []byte) ([]byte, error) {
+	out := make([]byte, len(raw))
+	copy(out, raw)
+
+	// blank comments
+	inString := false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			start := i
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; ; i++ {
+				if i+1 >= len(out) {
+					return nil, xerrors.Errorf("unterminated /* comment starting at offset %d", start)
+				}
+				if out[i] == '*' && out[i+1] == '/' {
+					out[i], out[i+1] = ' ', ' '
+					i++
+					break
+				}
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+		}
+	}
+
+	// blank commas followed by nothing but whitespace up to the closing bracket
+	inString = false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		if c == '"' {
+			inString = true
+		} else if c == ',' {
+			j := i + 1
+			for j < len(out) && (out[j] == ' ' || out[j] == '\t' || out[j] == '\n' || out[j] == '\r') {
+				j++
+			}
+			if j < len(out) && (out[j] == '}' || out[j] == ']') {
+				out[i] = ' '
+			}
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// contents of removed_deals.json
+type removedDealsOutput struct {
+	Epoch         int64          `json:"epoch"`
+	TipSetKey     []cid.Cid      `json:"tipset_key"`
+	Endpoint      string         `json:"endpoint"`
+	Phase         int            `json:"phase,omitempty"`
+	SchemaVersion string         `json:"schema_version"`
+	Payload       []*removedDeal `json:"payload"`
+}
+type removedDeal struct {
+	DealID     string `json:"deal_id"`
+	ProjectID  string `json:"project_id"`
+	Client     string `json:"client"`
+	MinerID    string `json:"miner_id"`
+	PayloadCID string `json:"payload_cid"`
+	PaddedSize int64  `json:"padded_size"`
+	Reason     string `json:"reason"`
+	SlashEpoch int64  `json:"slash_epoch,omitempty"`
+	EndEpoch   int64  `json:"end_epoch,omitempty"`
+}
+
+const (
+	// still in market state, but with its sector terminated: about to be removed
+	removedReasonSlashed = "slashed"
+	// gone from market state after reaching its end epoch
+	removedReasonExpired = "expired"
+	// gone from market state before its end epoch
+	removedReasonTerminated = "sector_terminated"
+	// still active on chain, no longer listed due to changed project lists or rules
+	removedReasonNotListed = "no_longer_listed"
+	// the deal could not be looked up at the previous tipset either
+	removedReasonUnknown = "unknown"
+)
+
+// The deals listed by a previous rollup, keyed by deal id, along with the tipset it
+// was computed over when known
+type previousRollup struct {
+	dir   string
+	tsk   *types.TipSetKey
+	deals map[string]*individualDeal
+}
+
+// Deal lists are recognized by dealListGlob: the previous rollup has to have been
+// written with the same --deal-list-name
+func loadPreviousRollup(dir, dealListGlob string) (*previousRollup, error) {
+	prev := &previousRollup{
+		dir:   dir,
+		deals: make(map[string]*individualDeal),
+	}
+
+	if raw, err := ioutil.ReadFile(filepath.Join(dir, runFingerprintName)); err == nil {
+		var fp runFingerprint
+		if err := json.Unmarshal(raw, &fp); err != nil {
+			return nil, xerrors.Errorf("parsing %s of previous rollup: %w", runFingerprintName, err)
+		}
+		tsk := types.NewTipSetKey(fp.TipSetKey...)
+		prev.tsk = &tsk
+	} else if os.IsNotExist(err) {
+		log.Warnf("previous rollup '%s' has no %s: it may be incomplete, and removal reasons can only be derived from current state", dir, runFingerprintName)
+	} else {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if matched, _ := filepath.Match(dealListGlob+filepath.Ext(e.Name()), e.Name()); !matched {
+			continue
+		}
+
+		var dl []*individualDeal
+		switch filepath.Ext(e.Name()) {
+		case ".json":
+			var out dealListOutput
+			raw, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(raw, &out); err != nil {
+				return nil, xerrors.Errorf("parsing previous deal list %s: %w", e.Name(), err)
+			}
+			// lists predating schema versioning carry none, and are laid out the same as 1.0
+			if out.SchemaVersion != "" && !schemaVersionCompatible(out.SchemaVersion, "1.0") {
+				return nil, xerrors.Errorf("previous deal list %s has incompatible schema version %s", e.Name(), out.SchemaVersion)
+			}
+			dl = out.Payload
+		case ".ndjson":
+			fh, err := os.Open(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			dec := json.NewDecoder(bufio.NewReader(fh))
+			for dec.More() {
+				d := new(individualDeal)
+				if err := dec.Decode(d); err != nil {
+					fh.Close() //nolint:errcheck
+					return nil, xerrors.Errorf("parsing previous deal list %s: %w", e.Name(), err)
+				}
+				dl = append(dl, d)
+			}
+			fh.Close() //nolint:errcheck
+		default:
+			continue
+		}
+
+		for _, d := range dl {
+			prev.deals[d.DealID] = d
+		}
+	}
+
+	return prev, nil
+}
+
+// Determines why each deal still left in prev.deals (the ones not listed by this run)
+// went missing. deals holds those of them still in market state.
+func annotateRemovedDeals(ctx context.Context, api api.FullNode, ts rollupTipSet, deals map[string]api.MarketDeal, prev *previousRollup) []*removedDeal {
+	ret := make([]*removedDeal, 0, len(prev.deals))
+
+	for dealID, d := range prev.deals {
+		rd := &removedDeal{
+			DealID:     dealID,
+			ProjectID:  d.ProjectID,
+			Client:     d.Client,
+			MinerID:    d.MinerID,
+			PayloadCID: d.PayloadCID,
+			PaddedSize: d.PaddedSize,
+		}
+		ret = append(ret, rd)
+
+		if cur, inState := deals[dealID]; inState {
+			rd.EndEpoch = int64(cur.Proposal.EndEpoch)
+			if cur.State.SlashEpoch > -1 {
+				rd.Reason = removedReasonSlashed
+				rd.SlashEpoch = int64(cur.State.SlashEpoch)
+			} else {
+				rd.Reason = removedReasonNotListed
+			}
+			continue
+		}
+
+		rd.Reason = removedReasonUnknown
+		if prev.tsk == nil {
+			continue
+		}
+		numericID, err := strconv.ParseUint(dealID, 10, 64)
+		if err != nil {
+			continue
+		}
+		was, err := api.StateMarketStorageDeal(ctx, abi.DealID(numericID), *prev.tsk)
+		if err != nil {
+			log.Warnf("failed to look up removed deal %s at the previous rollup tipset: %s", dealID, err)
+			continue
+		}
+		rd.EndEpoch = int64(was.Proposal.EndEpoch)
+		if was.Proposal.EndEpoch <= ts.Height() {
+			rd.Reason = removedReasonExpired
+		} else {
+			rd.Reason = removedReasonTerminated
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		didi, _ := strconv.ParseInt(ret[i].DealID, 10, 64)
+		didj, _ := strconv.ParseInt(ret[j].DealID, 10, 64)
+		return didi < didj
+	})
+
+	return ret
+}
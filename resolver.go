@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/xerrors"
+)
+
+// Resolves the ID address of a deal client to its key address
+type addressResolver interface {
+	AccountKey(ctx context.Context, id address.Address) (address.Address, error)
+}
+
+// Resolves through StateAccountKey against the rollup tipset
+type rpcResolver struct {
+	api api.FullNode
+	tsk types.TipSetKey
+}
+
+func (r *rpcResolver) AccountKey(ctx context.Context, id address.Address) (address.Address, error) {
+	return r.api.StateAccountKey(ctx, id, r.tsk)
+}
+
+// A precomputed mapping, for runs against snapshots where no node is available to ask.
+// The file holds a single JSON object of ID address => key address:
+//
+//	{ "f01234": "f1abjxfbp274xpdqcpuaykwkfb43omjotacm2p3za" }
+type mappingFileResolver map[address.Address]address.Address
+
+func loadMappingFileResolver(path string) (mappingFileResolver, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = relaxedJSON(raw); err != nil {
+		return nil, xerrors.Errorf("parsing address mapping %s: %w", path, err)
+	}
+	var m map[string]string
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, xerrors.Errorf("parsing address mapping %s: %w", path, err)
+	}
+
+	ret := make(mappingFileResolver, len(m))
+	for idStr, keyStr := range m {
+		id, err := address.NewFromString(idStr)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid address '%s' in %s: %w", idStr, path, err)
+		}
+		key, err := address.NewFromString(keyStr)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid address '%s' in %s: %w", keyStr, path, err)
+		}
+		ret[id] = key
+	}
+	return ret, nil
+}
+
+func (m mappingFileResolver) AccountKey(_ context.Context, id address.Address) (address.Address, error) {
+	if key, found := m[id]; found {
+		return key, nil
+	}
+	return address.Undef, xerrors.Errorf("%s not present in address mapping", id)
+}
+
+// Maps the ID addresses behind the delegated (f4) addresses of the project and restore
+// lists back to them, as looked up through the node: deals name FEVM-era clients by ID
+// only, and neither a mapping file nor a node before the FEVM upgrade maps them back
+type delegatedResolver map[address.Address]address.Address
+
+func newDelegatedResolver(ctx context.Context, node api.FullNode, ts rollupTipSet, listed []address.Address) delegatedResolver {
+	ret := make(delegatedResolver)
+	for _, addr := range listed {
+		if addr.Protocol() != address.Delegated {
+			continue
+		}
+		idAddr, err := node.StateLookupID(ctx, addr, ts.Key())
+		if err != nil {
+			// not on chain (yet): can not be the client of any deal either
+			continue
+		}
+		ret[idAddr] = addr
+	}
+	return ret
+}
+
+func (d delegatedResolver) AccountKey(_ context.Context, id address.Address) (address.Address, error) {
+	if addr, found := d[id]; found {
+		return addr, nil
+	}
+	return address.Undef, xerrors.Errorf("%s is not behind a listed delegated address", id)
+}
+
+// Tries each resolver in turn, returning the first success
+type chainedResolver []addressResolver
+
+func (c chainedResolver) AccountKey(ctx context.Context, id address.Address) (address.Address, error) {
+	var errs []string
+	for _, r := range c {
+		key, err := r.AccountKey(ctx, id)
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return address.Undef, xerrors.Errorf("all resolvers failed: %s", strings.Join(errs, "; "))
+}
+
+// Remembers every successful resolution, and when a state store is in use also
+// persists them across runs: the key behind an ID address never changes
+type cachingResolver struct {
+	backend addressResolver
+	store   *stateStore
+	cache   map[address.Address]address.Address
+	fresh   map[address.Address]address.Address
+	failed  map[address.Address]error // by prefetch, not asked again
+
+	hits, misses int64 // lookups answered from the cache or store, and by the backend
+}
+
+func newCachingResolver(backend addressResolver, store *stateStore) *cachingResolver {
+	return &cachingResolver{
+		backend: backend,
+		store:   store,
+		cache:   make(map[address.Address]address.Address),
+		fresh:   make(map[address.Address]address.Address),
+		failed:  make(map[address.Address]error),
+	}
+}
+
+func (c *cachingResolver) AccountKey(ctx context.Context, id address.Address) (address.Address, error) {
+	if key, found := c.cache[id]; found {
+		c.hits++
+		return key, nil
+	}
+	if err, failed := c.failed[id]; failed {
+		return address.Undef, err
+	}
+
+	if c.store != nil {
+		key, err := c.store.accountKey(id)
+		if err != nil {
+			return address.Undef, err
+		}
+		if key != address.Undef {
+			c.cache[id] = key
+			c.hits++
+			return key, nil
+		}
+	}
+
+	c.misses++
+	key, err := c.backend.AccountKey(ctx, id)
+	if err != nil {
+		return address.Undef, err
+	}
+	c.cache[id] = key
+	c.fresh[id] = key
+	return key, nil
+}
+
+// Number of resolutions prefetch makes between persisting them
+const resolverFlushEvery = 1000
+
+// Resolves ids ahead of the deals that need them, with up to workers backend lookups
+// in flight at once. Every ID is looked up once: failures are remembered as well, and
+// returned by AccountKey without asking the backend again.
+func (c *cachingResolver) prefetch(ctx context.Context, ids []address.Address, workers int, progress *progressReporter) error {
+	var pending []address.Address
+	seen := make(map[address.Address]struct{})
+	for _, id := range ids {
+		if _, dup := seen[id]; dup {
+			continue
+		}
+		seen[id] = struct{}{}
+		if _, cached := c.cache[id]; cached {
+			continue
+		}
+		if c.store != nil {
+			key, err := c.store.accountKey(id)
+			if err != nil {
+				return err
+			}
+			if key != address.Undef {
+				c.cache[id] = key
+				continue
+			}
+		}
+		pending = append(pending, id)
+	}
+
+	type resolution struct {
+		id, key address.Address
+		err     error
+	}
+	work := make(chan address.Address)
+	results := make(chan resolution)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				key, err := c.backend.AccountKey(ctx, id)
+				results <- resolution{id: id, key: key, err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(work)
+		for _, id := range pending {
+			select {
+			case work <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	progress.start("resolving_clients", len(pending))
+	done := 0
+	var flushErr error
+	for r := range results {
+		c.misses++
+		if r.err != nil {
+			c.failed[r.id] = r.err
+		} else {
+			c.cache[r.id] = r.key
+			c.fresh[r.id] = r.key
+		}
+		done++
+		// cancellation already stops the feed, the workers just drain
+		progress.step(done) //nolint:errcheck
+
+		// persisted as it goes, so that an interrupted run loses little of it
+		if done%resolverFlushEvery == 0 && flushErr == nil {
+			flushErr = c.Flush()
+		}
+	}
+
+	if flushErr != nil {
+		return flushErr
+	}
+	return ctx.Err()
+}
+
+// Persists the resolutions made since the last flush, if there is a store to persist to
+func (c *cachingResolver) Flush() error {
+	if c.store == nil || len(c.fresh) == 0 {
+		return nil
+	}
+	if err := c.store.putAccountKeys(c.fresh); err != nil {
+		return err
+	}
+	c.fresh = make(map[address.Address]address.Address)
+	return nil
+}
+
+// Builds the resolver chain from --resolver values: "rpc" or "file:<path>"
+func newAddressResolver(specs []string, node api.FullNode, ts rollupTipSet) (addressResolver, error) {
+	var chain chainedResolver
+	for _, spec := range specs {
+		for _, spec := range strings.Split(spec, ",") {
+			switch {
+			case spec == "rpc":
+				chain = append(chain, &rpcResolver{api: node, tsk: ts.Key()})
+			case strings.HasPrefix(spec, "file:"):
+				m, err := loadMappingFileResolver(strings.TrimPrefix(spec, "file:"))
+				if err != nil {
+					return nil, err
+				}
+				chain = append(chain, m)
+			default:
+				return nil, xerrors.Errorf("unknown address resolver '%s'", spec)
+			}
+		}
+	}
+	if len(chain) == 0 {
+		return nil, xerrors.New("at least one address resolver is required")
+	}
+
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
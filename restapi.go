@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+const (
+	restDefaultPageSize = 100
+	restMaxPageSize     = 5000
+)
+
+// contents of a page of /projects/<project id>/deals
+type dealListPage struct {
+	Epoch         int64             `json:"epoch"`
+	TipSetKey     []cid.Cid         `json:"tipset_key"`
+	Endpoint      string            `json:"endpoint"`
+	SchemaVersion string            `json:"schema_version"`
+	ProjectID     string            `json:"project_id"`
+	Total         int               `json:"total"` // deals in the whole list
+	Offset        int               `json:"offset"`
+	Limit         int               `json:"limit"`
+	Sort          string            `json:"sort,omitempty"`
+	Payload       []*individualDeal `json:"payload"`
+}
+
+// The orders a deal list can be paged through in, by the JSON name of the field. A
+// leading - sorts descending, and ties are broken by deal id either way.
+var dealSortKeys = map[string]func(a, b *individualDeal) int{
+	"data_size":        func(a, b *individualDeal) int { return compareInt64(a.PaddedSize, b.PaddedSize) },
+	"deal_start_epoch": func(a, b *individualDeal) int { return compareInt64(a.DealStartEpoch, b.DealStartEpoch) },
+	"deal_id":          func(a, b *individualDeal) int { return compareDealIDs(a.DealID, b.DealID) },
+	"miner_id":         func(a, b *individualDeal) int { return strings.Compare(a.MinerID, b.MinerID) },
+	"client":           func(a, b *individualDeal) int { return strings.Compare(a.Client, b.Client) },
+	"payload_cid":      func(a, b *individualDeal) int { return strings.Compare(a.PayloadCID, b.PayloadCID) },
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Deal ids are decimal strings: the shorter one is the smaller number
+func compareDealIDs(a, b string) int {
+	if len(a) != len(b) {
+		return compareInt64(int64(len(a)), int64(len(b)))
+	}
+	return strings.Compare(a, b)
+}
+
+// Returns the deal list of a project in the given order, sorting it once per rollup.
+// The empty order is the one of the deal list document.
+func (g *rollupGraph) sortedDeals(projID, order string) ([]*individualDeal, error) {
+	dl := g.deals[projID]
+	if order == "" {
+		return dl, nil
+	}
+
+	field, desc := strings.TrimPrefix(order, "-"), strings.HasPrefix(order, "-")
+	cmp, known := dealSortKeys[field]
+	if !known {
+		keys := make([]string, 0, len(dealSortKeys))
+		for k := range dealSortKeys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return nil, xerrors.Errorf("unknown sort order '%s', expected one of %s, optionally prefixed with -", order, strings.Join(keys, ", "))
+	}
+
+	g.sortedMu.Lock()
+	defer g.sortedMu.Unlock()
+	cacheKey := projID + "\x00" + order
+	if sorted, done := g.sorted[cacheKey]; done {
+		return sorted, nil
+	}
+
+	sorted := make([]*individualDeal, len(dl))
+	copy(sorted, dl)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		c := cmp(sorted[i], sorted[j])
+		if desc {
+			c = -c
+		}
+		if c == 0 {
+			return compareDealIDs(sorted[i].DealID, sorted[j].DealID) < 0
+		}
+		return c < 0
+	})
+	g.sorted[cacheKey] = sorted
+	return sorted, nil
+}
+
+// Serves /projects/<project id>/deals?limit=&offset=&sort=
+func (s *site) serveProjectDeals(w http.ResponseWriter, r *http.Request, cur *servedRollup, projID string) {
+	g, err := cur.graph.load(cur.docs)
+	if err != nil {
+		log.Errorf("%s: loading rollup '%s' for the REST API failed: %s", s.prefix, cur.dir, err)
+		http.Error(w, "rollup not available", http.StatusInternalServerError)
+		return
+	}
+
+	_, listed := g.deals[projID]
+	known := listed
+	for _, ps := range g.projects {
+		known = known || ps.ProjectID == projID
+	}
+	if !known {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	limit, offset := restDefaultPageSize, 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > restMaxPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", restMaxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			http.Error(w, "offset must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+	order := q.Get("sort")
+	dl, err := g.sortedDeals(projID, order)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := &dealListPage{
+		Epoch:         g.epoch,
+		TipSetKey:     decodeTipSetKey(g.tipSetKey),
+		Endpoint:      "DEAL_LIST_PAGE",
+		SchemaVersion: g.schemaVersion,
+		ProjectID:     projID,
+		Total:         len(dl),
+		Offset:        offset,
+		Limit:         limit,
+		Sort:          order,
+		Payload:       []*individualDeal{},
+	}
+	if offset < len(dl) {
+		end := offset + limit
+		if end > len(dl) {
+			end = len(dl)
+		}
+		page.Payload = dl[offset:end]
+	}
+
+	if next := offset + limit; next < len(dl) {
+		nq := url.Values{"limit": {strconv.Itoa(limit)}, "offset": {strconv.Itoa(next)}}
+		if order != "" {
+			nq.Set("sort", order)
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s?%s>; rel="next"`, s.prefix, r.URL.Path, nq.Encode()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		log.Warnf("sending %s%s failed: %s", s.prefix, r.URL.Path, err)
+	}
+}
+
+// contents of /miners/<miner id>
+type minerStatsEntry struct {
+	Epoch         int64       `json:"epoch"`
+	TipSetKey     []cid.Cid   `json:"tipset_key"`
+	Endpoint      string      `json:"endpoint"`
+	SchemaVersion string      `json:"schema_version"`
+	Payload       *minerStats `json:"payload"`
+}
+
+// Serves /miners/<miner id> from miner_stats.json: rollups without one have no miners
+func (s *site) serveMiner(w http.ResponseWriter, r *http.Request, cur *servedRollup, minerID string) {
+	g, err := cur.graph.load(cur.docs)
+	if err != nil {
+		log.Errorf("%s: loading rollup '%s' for the REST API failed: %s", s.prefix, cur.dir, err)
+		http.Error(w, "rollup not available", http.StatusInternalServerError)
+		return
+	}
+
+	ms, found := g.miners[minerID]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(&minerStatsEntry{
+		Epoch:         g.epoch,
+		TipSetKey:     decodeTipSetKey(g.tipSetKey),
+		Endpoint:      "MINER_STATS_ENTRY",
+		SchemaVersion: g.schemaVersion,
+		Payload:       ms,
+	}); err != nil {
+		log.Warnf("sending %s%s failed: %s", s.prefix, r.URL.Path, err)
+	}
+}
+
+// The graph holds tipset keys as strings, as GraphQL serves them
+func decodeTipSetKey(key []string) []cid.Cid {
+	ret := make([]cid.Cid, 0, len(key))
+	for _, c := range key {
+		if parsed, err := cid.Decode(c); err == nil {
+			ret = append(ret, parsed)
+		}
+	}
+	return ret
+}
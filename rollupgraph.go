@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// Requests are queries, they have no business being large
+const maxGraphQLRequestSize = 1 << 20
+
+// The main documents of a served rollup, decoded and indexed for GraphQL queries, so
+// that frontends can select exactly the fields and deal ranges they need instead of
+// downloading whole deal lists. Lists keep the order of their source documents.
+type rollupGraph struct {
+	epoch         int64
+	tipSetKey     []string
+	schemaVersion string
+	totals        competitionTotal
+	projects      []*projectAggregateStats // by project id
+	deals         map[string][]*individualDeal
+	providers     []*graphProvider // largest first
+	providerDeals map[string][]*individualDeal
+	recovered     []*recoveredDeal
+	miners        map[string]*minerStats // as published in miner_stats.json, by miner id
+
+	sortedMu sync.Mutex
+	sorted   map[string][]*individualDeal // deal lists in the orders asked for, by project and order
+}
+
+// Aggregated over the deal lists of all projects, pending deals not included
+type graphProvider struct {
+	MinerID     string `json:"miner_id"`
+	DataSize    int64  `json:"total_data_size"`
+	NumDeals    int    `json:"total_num_deals"`
+	NumClients  int    `json:"total_num_clients"`
+	NumProjects int    `json:"total_num_projects"`
+
+	clients  map[string]bool
+	projects map[string]bool
+}
+
+// Built on the first query against a rollup: most sites never receive any
+type servedGraph struct {
+	once  sync.Once
+	graph *rollupGraph
+	err   error
+}
+
+func (sg *servedGraph) load(docs map[string]*servedDocument) (*rollupGraph, error) {
+	sg.once.Do(func() {
+		sg.graph, sg.err = newRollupGraph(docs)
+	})
+	return sg.graph, sg.err
+}
+
+func newRollupGraph(docs map[string]*servedDocument) (*rollupGraph, error) {
+	g := &rollupGraph{
+		projects:      []*projectAggregateStats{},
+		providers:     []*graphProvider{},
+		recovered:     []*recoveredDeal{},
+		deals:         make(map[string][]*individualDeal),
+		providerDeals: make(map[string][]*individualDeal),
+		miners:        make(map[string]*minerStats),
+		sorted:        make(map[string][]*individualDeal),
+	}
+
+	basic, found := docs["basic_stats"]
+	if !found {
+		return nil, xerrors.New("rollup has no basic_stats.json")
+	}
+	var totals competitionTotalOutput
+	if err := json.Unmarshal(basic.body, &totals); err != nil {
+		return nil, xerrors.Errorf("decoding %s: %w", basic.file, err)
+	}
+	g.epoch, g.tipSetKey, g.schemaVersion = totals.Epoch, cidStrings(totals.TipSetKey), totals.SchemaVersion
+	g.totals = totals.Payload
+
+	if doc, found := docs["client_stats"]; found {
+		var clientStats projectAggregateStatsOutput
+		if err := json.Unmarshal(doc.body, &clientStats); err != nil {
+			return nil, xerrors.Errorf("decoding %s: %w", doc.file, err)
+		}
+		for _, ps := range clientStats.Payload {
+			g.projects = append(g.projects, ps)
+		}
+		sort.Slice(g.projects, func(i, j int) bool { return g.projects[i].ProjectID < g.projects[j].ProjectID })
+	}
+
+	if doc, found := docs["miner_stats"]; found {
+		var minerStats minerStatsOutput
+		if err := json.Unmarshal(doc.body, &minerStats); err != nil {
+			return nil, xerrors.Errorf("decoding %s: %w", doc.file, err)
+		}
+		for _, ms := range minerStats.Payload {
+			g.miners[ms.MinerID] = ms
+		}
+	}
+
+	if doc, found := docs["recovery"]; found {
+		if err := decodeServedList(doc, &g.recovered); err != nil {
+			return nil, err
+		}
+	}
+
+	providers := make(map[string]*graphProvider)
+	for apiPath, doc := range docs {
+		if !strings.HasPrefix(apiPath, "deals/") {
+			continue
+		}
+		var dl []*individualDeal
+		if err := decodeServedList(doc, &dl); err != nil {
+			return nil, err
+		}
+		g.deals[strings.TrimPrefix(apiPath, "deals/")] = dl
+
+		for _, d := range dl {
+			if d.Pending {
+				continue
+			}
+			gp, seen := providers[d.MinerID]
+			if !seen {
+				gp = &graphProvider{MinerID: d.MinerID, clients: make(map[string]bool), projects: make(map[string]bool)}
+				providers[d.MinerID] = gp
+			}
+			gp.DataSize += d.PaddedSize
+			gp.NumDeals++
+			gp.clients[d.Client] = true
+			gp.projects[d.ProjectID] = true
+			g.providerDeals[d.MinerID] = append(g.providerDeals[d.MinerID], d)
+		}
+	}
+
+	for _, gp := range providers {
+		gp.NumClients, gp.NumProjects = len(gp.clients), len(gp.projects)
+		g.providers = append(g.providers, gp)
+
+		// the per-project lists are merged in map order
+		pd := g.providerDeals[gp.MinerID]
+		sort.Slice(pd, func(i, j int) bool {
+			if pd[i].PaddedSize != pd[j].PaddedSize {
+				return pd[i].PaddedSize > pd[j].PaddedSize
+			}
+			return pd[i].DealID < pd[j].DealID
+		})
+	}
+	sort.Slice(g.providers, func(i, j int) bool {
+		if g.providers[i].DataSize != g.providers[j].DataSize {
+			return g.providers[i].DataSize > g.providers[j].DataSize
+		}
+		return g.providers[i].MinerID < g.providers[j].MinerID
+	})
+
+	return g, nil
+}
+
+// Decodes the payload of a list document into list, whether written as a JSON
+// envelope or as NDJSON holding one record per line
+func decodeServedList(doc *servedDocument, list interface{}) error {
+	if filepath.Ext(doc.file) != ".ndjson" {
+		envelope := struct {
+			Payload interface{} `json:"payload"`
+		}{list}
+		if err := json.Unmarshal(doc.body, &envelope); err != nil {
+			return xerrors.Errorf("decoding %s: %w", doc.file, err)
+		}
+		return nil
+	}
+
+	lv := reflect.ValueOf(list).Elem()
+	dec := json.NewDecoder(bytes.NewReader(doc.body))
+	for {
+		rec := reflect.New(lv.Type().Elem().Elem())
+		if err := dec.Decode(rec.Interface()); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return xerrors.Errorf("decoding %s: %w", doc.file, err)
+		}
+		lv.Set(reflect.Append(lv, rec))
+	}
+}
+
+// The query type
+type graphRoot struct {
+	g *rollupGraph
+}
+
+var rollupGraphSchema = newRollupGraphSchema()
+
+func newRollupGraphSchema() *gqlSchema {
+	s := newGQLSchema()
+
+	paging := []gqlArg{{"first", "Int"}, {"offset", "Int"}}
+	graph := func(root interface{}) *rollupGraph { return root.(*graphRoot).g }
+
+	// deal lists narrowed down by the client, provider and pending arguments given
+	filterDeals := func(list []*individualDeal, args map[string]interface{}) ([]*individualDeal, error) {
+		client, byClient := args["client"].(string)
+		provider, byProvider := args["provider"].(string)
+		projID, byProject := args["project"].(string)
+		pending, byPending := args["pending"].(bool)
+		if byClient || byProvider || byProject || byPending {
+			filtered := make([]*individualDeal, 0, len(list))
+			for _, d := range list {
+				if (!byClient || d.Client == client) &&
+					(!byProvider || d.MinerID == provider) &&
+					(!byProject || d.ProjectID == projID) &&
+					(!byPending || d.Pending == pending) {
+					filtered = append(filtered, d)
+				}
+			}
+			list = filtered
+		}
+		lo, hi, err := gqlPage(len(list), args)
+		if err != nil {
+			return nil, err
+		}
+		if list == nil {
+			return []*individualDeal{}, nil
+		}
+		return list[lo:hi], nil
+	}
+
+	s.addType("Deal", "An entry of a project deal list", &individualDeal{})
+	s.addType("RecoveredDeal", "An entry of the recovery deal list", &recoveredDeal{})
+	s.addType("Client", "The totals of a single client within a project", &clientAggregateStats{})
+	s.addType("Warning", "Deals of a project left out of its totals, by reason", &projectWarning{})
+	s.addType("Totals", "The program wide totals of basic_stats.json", &competitionTotal{})
+
+	s.addType("Provider", "A storage provider's share of the deal lists, pending deals not included", &graphProvider{},
+		&gqlField{
+			name: "deals",
+			typ:  "[Deal!]!",
+			doc:  "Largest first",
+			args: append([]gqlArg{{"project", "String"}, {"client", "String"}}, paging...),
+			resolve: func(root, parent interface{}, args map[string]interface{}) (interface{}, error) {
+				return filterDeals(graph(root).providerDeals[parent.(*graphProvider).MinerID], args)
+			},
+		},
+	)
+
+	s.addType("Project", "The totals of a project as in client_stats.json", &projectAggregateStats{},
+		&gqlField{
+			name: "clients",
+			typ:  "[Client!]!",
+			doc:  "Largest first",
+			args: paging,
+			resolve: func(_, parent interface{}, args map[string]interface{}) (interface{}, error) {
+				ps := parent.(*projectAggregateStats)
+				clients := make([]*clientAggregateStats, 0, len(ps.ClientStats))
+				for _, ca := range ps.ClientStats {
+					clients = append(clients, ca)
+				}
+				sort.Slice(clients, func(i, j int) bool {
+					if clients[i].DataSize != clients[j].DataSize {
+						return clients[i].DataSize > clients[j].DataSize
+					}
+					return clients[i].Client < clients[j].Client
+				})
+				lo, hi, err := gqlPage(len(clients), args)
+				if err != nil {
+					return nil, err
+				}
+				return clients[lo:hi], nil
+			},
+		},
+		&gqlField{
+			name: "deals",
+			typ:  "[Deal!]!",
+			doc:  "The deal list of the project",
+			args: append([]gqlArg{{"client", "String"}, {"provider", "String"}, {"pending", "Boolean"}}, paging...),
+			resolve: func(root, parent interface{}, args map[string]interface{}) (interface{}, error) {
+				return filterDeals(graph(root).deals[parent.(*projectAggregateStats).ProjectID], args)
+			},
+		},
+	)
+
+	s.query = s.addType("Query", "", graphRoot{},
+		&gqlField{name: "epoch", typ: "Int64!", resolve: func(root, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			return graph(root).epoch, nil
+		}},
+		&gqlField{name: "tipset_key", typ: "[String!]!", resolve: func(root, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			return graph(root).tipSetKey, nil
+		}},
+		&gqlField{name: "schema_version", typ: "String!", resolve: func(root, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			return graph(root).schemaVersion, nil
+		}},
+		&gqlField{name: "totals", typ: "Totals!", resolve: func(root, _ interface{}, _ map[string]interface{}) (interface{}, error) {
+			return &graph(root).totals, nil
+		}},
+		&gqlField{
+			name: "projects",
+			typ:  "[Project!]!",
+			args: paging,
+			resolve: func(root, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				projects := graph(root).projects
+				lo, hi, err := gqlPage(len(projects), args)
+				if err != nil {
+					return nil, err
+				}
+				return projects[lo:hi], nil
+			},
+		},
+		&gqlField{
+			name: "project",
+			typ:  "Project",
+			args: []gqlArg{{"id", "String!"}},
+			resolve: func(root, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				projects, id := graph(root).projects, args["id"].(string)
+				i := sort.Search(len(projects), func(i int) bool { return projects[i].ProjectID >= id })
+				if i == len(projects) || projects[i].ProjectID != id {
+					return nil, nil
+				}
+				return projects[i], nil
+			},
+		},
+		&gqlField{
+			name: "providers",
+			typ:  "[Provider!]!",
+			doc:  "Largest first",
+			args: paging,
+			resolve: func(root, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				providers := graph(root).providers
+				lo, hi, err := gqlPage(len(providers), args)
+				if err != nil {
+					return nil, err
+				}
+				return providers[lo:hi], nil
+			},
+		},
+		&gqlField{
+			name: "provider",
+			typ:  "Provider",
+			args: []gqlArg{{"id", "String!"}},
+			resolve: func(root, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				for _, gp := range graph(root).providers {
+					if gp.MinerID == args["id"].(string) {
+						return gp, nil
+					}
+				}
+				return nil, nil
+			},
+		},
+		&gqlField{
+			name: "deals",
+			typ:  "[Deal!]!",
+			doc:  "Across the deal lists of all projects",
+			args: append([]gqlArg{{"project", "String"}, {"client", "String"}, {"provider", "String"}, {"pending", "Boolean"}}, paging...),
+			resolve: func(root, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				g := graph(root)
+				if projID, given := args["project"].(string); given {
+					return filterDeals(g.deals[projID], args)
+				}
+				var all []*individualDeal
+				for _, ps := range g.projects {
+					all = append(all, g.deals[ps.ProjectID]...)
+				}
+				return filterDeals(all, args)
+			},
+		},
+		&gqlField{
+			name: "recovered_deals",
+			typ:  "[RecoveredDeal!]!",
+			args: paging,
+			resolve: func(root, _ interface{}, args map[string]interface{}) (interface{}, error) {
+				recovered := graph(root).recovered
+				lo, hi, err := gqlPage(len(recovered), args)
+				if err != nil {
+					return nil, err
+				}
+				return recovered[lo:hi], nil
+			},
+		},
+	)
+
+	return s
+}
+
+// Answers GraphQL queries over POST, or GET with the query in the URL. A GET without
+// a query returns the schema.
+func (s *site) serveGraphQL(w http.ResponseWriter, r *http.Request, cur *servedRollup) {
+	var req struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// the answer only changes with the rollup
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.interval.Seconds())))
+
+		q := r.URL.Query()
+		if q.Get("query") == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, rollupGraphSchema.sdl()) //nolint:errcheck
+			return
+		}
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "invalid variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+	case http.MethodPost:
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxGraphQLRequestSize)).Decode(&req); err != nil {
+			http.Error(w, "invalid GraphQL request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	g, err := cur.graph.load(cur.docs)
+	if err != nil {
+		log.Errorf("%s: loading rollup '%s' for GraphQL failed: %s", s.prefix, cur.dir, err)
+		http.Error(w, "rollup not available", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(rollupGraphSchema.execute(&graphRoot{g}, req.Query, req.OperationName, req.Variables))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if acceptsGzip(r) && len(body) >= minGzipSize {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		gz.Write(body) //nolint:errcheck
+		gz.Close()     //nolint:errcheck
+		return
+	}
+	w.Write(body) //nolint:errcheck
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/filecoin-project/lotus/api"
+	"golang.org/x/xerrors"
+)
+
+// Counts the calls made through a node API client per method, against optional total
+// and per-method budgets. Meant for runs against metered public gateways, where a
+// runaway retry loop can otherwise burn through the quota unnoticed.
+type rpcBudget struct {
+	abort     bool
+	total     int64
+	perMethod map[string]int64
+
+	mu       sync.Mutex
+	calls    map[string]int64
+	errors   map[string]int64 // calls that returned an error, refused ones included
+	numCalls int64
+	exceeded map[string]bool // budgets warned about already
+}
+
+// Per-method budgets are given as Method=calls, e.g. StateMarketDeals=2
+func newRPCBudget(total int64, perMethod []string, action string) (*rpcBudget, error) {
+	b := &rpcBudget{
+		total:     total,
+		perMethod: make(map[string]int64, len(perMethod)),
+		calls:     make(map[string]int64),
+		errors:    make(map[string]int64),
+		exceeded:  make(map[string]bool),
+	}
+
+	switch action {
+	case "warn":
+	case "abort":
+		b.abort = true
+	default:
+		return nil, xerrors.Errorf("unknown budget action '%s': expected warn or abort", action)
+	}
+
+	for _, spec := range perMethod {
+		eq := strings.IndexByte(spec, '=')
+		if eq <= 0 {
+			return nil, xerrors.Errorf("invalid method budget '%s': expected Method=calls", spec)
+		}
+		n, err := strconv.ParseInt(spec[eq+1:], 10, 64)
+		if err != nil || n <= 0 {
+			return nil, xerrors.Errorf("invalid call count in method budget '%s'", spec)
+		}
+		b.perMethod[spec[:eq]] = n
+	}
+
+	return b, nil
+}
+
+// Records a call about to be made. Exceeding a budget is warned about once, and
+// refuses the call when aborting.
+func (b *rpcBudget) spend(method string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls[method]++
+	b.numCalls++
+
+	var err error
+	if limit, limited := b.perMethod[method]; limited && b.calls[method] > limit {
+		err = b.exceed(method, xerrors.Errorf("call budget of %d for %s exceeded", limit, method))
+	}
+	if b.total > 0 && b.numCalls > b.total && err == nil {
+		err = b.exceed("", xerrors.Errorf("total call budget of %d exceeded at %s", b.total, method))
+	}
+	return err
+}
+
+func (b *rpcBudget) exceed(budget string, err error) error {
+	if b.abort {
+		return err
+	}
+	if !b.exceeded[budget] {
+		b.exceeded[budget] = true
+		log.Warnf("node API %s, continuing", err)
+	}
+	return nil
+}
+
+func (b *rpcBudget) failed(method string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errors[method]++
+}
+
+// Copies of the per-method call and error counts
+func (b *rpcBudget) counts() (calls, errors map[string]int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	calls = make(map[string]int64, len(b.calls))
+	for m, n := range b.calls {
+		calls[m] = n
+	}
+	errors = make(map[string]int64, len(b.errors))
+	for m, n := range b.errors {
+		errors[m] = n
+	}
+	return calls, errors
+}
+
+// Logs the calls made, most frequent first
+func (b *rpcBudget) report() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	methods := make([]string, 0, len(b.calls))
+	for m := range b.calls {
+		methods = append(methods, m)
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		if b.calls[methods[i]] != b.calls[methods[j]] {
+			return b.calls[methods[i]] > b.calls[methods[j]]
+		}
+		return methods[i] < methods[j]
+	})
+
+	counts := make([]string, len(methods))
+	for i, m := range methods {
+		counts[i] = m + "=" + strconv.FormatInt(b.calls[m], 10)
+	}
+	log.Infof("node API calls made: %d (%s)", b.numCalls, strings.Join(counts, " "))
+}
+
+// Routes every method of the RPC client through the budget. The lotus client is a
+// struct of function fields filled in by the JSON-RPC machinery, so each of them can
+// be wrapped in place without listing the methods.
+func meterFullNode(node api.FullNode, b *rpcBudget) api.FullNode {
+	fns, isClient := node.(*api.FullNodeStruct)
+	if !isClient {
+		log.Warnf("node API calls are not metered: unexpected client type %T", node)
+		return node
+	}
+
+	for _, internal := range api.GetInternalStructs(fns) {
+		meterInternal(reflect.ValueOf(internal).Elem(), b)
+	}
+	return fns
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func meterInternal(internal reflect.Value, b *rpcBudget) {
+	for i := 0; i < internal.NumField(); i++ {
+		f := internal.Field(i)
+		if f.Kind() != reflect.Func || f.IsNil() {
+			continue
+		}
+
+		method := internal.Type().Field(i).Name
+		orig := reflect.ValueOf(f.Interface())
+		ft := f.Type()
+		returnsErr := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+
+		f.Set(reflect.MakeFunc(ft, func(args []reflect.Value) []reflect.Value {
+			if err := b.spend(method); err != nil && returnsErr {
+				b.failed(method)
+				out := make([]reflect.Value, ft.NumOut())
+				for j := range out {
+					out[j] = reflect.Zero(ft.Out(j))
+				}
+				out[len(out)-1] = reflect.ValueOf(&err).Elem()
+				return out
+			}
+
+			var out []reflect.Value
+			if ft.IsVariadic() {
+				out = orig.CallSlice(args)
+			} else {
+				out = orig.Call(args)
+			}
+			if returnsErr && !out[len(out)-1].IsNil() {
+				b.failed(method)
+			}
+			return out
+		}))
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/lotus/api"
+	"golang.org/x/xerrors"
+)
+
+// Node API calls are retried when they fail on the way to the node or back, or run
+// out of their time, with the wait between attempts doubling from minBackoff up to
+// maxBackoff. Errors the node itself answers with are returned right away: asking
+// again would only get the same answer.
+type rpcRetryPolicy struct {
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration // per attempt, 0 for none
+	timeouts   map[string]time.Duration
+}
+
+// Per-method timeouts are given as Method=duration, e.g. StateMarketDeals=30m
+func newRPCRetryPolicy(retries int, minBackoff, maxBackoff, timeout time.Duration, perMethod []string) (*rpcRetryPolicy, error) {
+	if retries < 0 {
+		return nil, xerrors.Errorf("invalid number of retries %d", retries)
+	}
+	if minBackoff <= 0 || maxBackoff < minBackoff {
+		return nil, xerrors.Errorf("invalid retry backoff between %s and %s", minBackoff, maxBackoff)
+	}
+
+	p := &rpcRetryPolicy{
+		retries:    retries,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		timeout:    timeout,
+		timeouts:   make(map[string]time.Duration, len(perMethod)),
+	}
+	for _, spec := range perMethod {
+		eq := strings.IndexByte(spec, '=')
+		if eq <= 0 {
+			return nil, xerrors.Errorf("invalid method timeout '%s': expected Method=duration", spec)
+		}
+		d, err := time.ParseDuration(spec[eq+1:])
+		if err != nil || d < 0 {
+			return nil, xerrors.Errorf("invalid duration in method timeout '%s'", spec)
+		}
+		p.timeouts[spec[:eq]] = d
+	}
+
+	return p, nil
+}
+
+func (p *rpcRetryPolicy) timeoutOf(method string) time.Duration {
+	if d, set := p.timeouts[method]; set {
+		return d
+	}
+	return p.timeout
+}
+
+func (p *rpcRetryPolicy) backoff(attempt int) time.Duration {
+	d := p.minBackoff
+	for i := 0; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+// Whether err, returned by an attempt made under callCtx within ctx, is worth another
+func retryableRPCError(ctx, callCtx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if callCtx.Err() == context.DeadlineExceeded {
+		return true
+	}
+	var clientErr *jsonrpc.ErrClient
+	return errors.As(err, &clientErr)
+}
+
+// Applies the policy to every method of the RPC client taking a context, in the same
+// way meterFullNode does, which node should already be wrapped by so that each
+// attempt is counted against the budget.
+func retryFullNode(node api.FullNode, p *rpcRetryPolicy) api.FullNode {
+	fns, isClient := node.(*api.FullNodeStruct)
+	if !isClient {
+		log.Warnf("node API calls are not retried: unexpected client type %T", node)
+		return node
+	}
+
+	for _, internal := range api.GetInternalStructs(fns) {
+		retryInternal(reflect.ValueOf(internal).Elem(), p)
+	}
+	return fns
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+func retryInternal(internal reflect.Value, p *rpcRetryPolicy) {
+	for i := 0; i < internal.NumField(); i++ {
+		f := internal.Field(i)
+		if f.Kind() != reflect.Func || f.IsNil() {
+			continue
+		}
+		ft := f.Type()
+		// without a context there is nothing to time out, and without an error
+		// nothing to retry on. Channel results can not be replayed either.
+		if ft.NumIn() == 0 || ft.In(0) != contextType || ft.NumOut() == 0 || ft.Out(ft.NumOut()-1) != errorType {
+			continue
+		}
+		if ft.NumOut() > 1 && ft.Out(0).Kind() == reflect.Chan {
+			continue
+		}
+
+		method := internal.Type().Field(i).Name
+		orig := reflect.ValueOf(f.Interface())
+		timeout := p.timeoutOf(method)
+
+		f.Set(reflect.MakeFunc(ft, func(args []reflect.Value) []reflect.Value {
+			ctx := args[0].Interface().(context.Context)
+			callArgs := make([]reflect.Value, len(args))
+			copy(callArgs, args)
+
+			for attempt := 0; ; attempt++ {
+				callCtx, cancel := ctx, context.CancelFunc(func() {})
+				if timeout > 0 {
+					callCtx, cancel = context.WithTimeout(ctx, timeout)
+				}
+				callArgs[0] = reflect.ValueOf(&callCtx).Elem()
+
+				var out []reflect.Value
+				if ft.IsVariadic() {
+					out = orig.CallSlice(callArgs)
+				} else {
+					out = orig.Call(callArgs)
+				}
+				errOut := out[len(out)-1]
+				if errOut.IsNil() {
+					cancel()
+					return out
+				}
+
+				err := errOut.Interface().(error)
+				if attempt >= p.retries || !retryableRPCError(ctx, callCtx, err) {
+					cancel()
+					return out
+				}
+				cancel()
+
+				wait := p.backoff(attempt)
+				log.Warnf("node API %s failed, retrying in %s (%d/%d): %s", method, wait, attempt+1, p.retries, err)
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return out
+				}
+			}
+		}))
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// The eligibility rules every deal of a registered project goes through, in the order
+// they apply. Their parameters default to those of the --network, and the "rules"
+// section of the rollup config changes them without a new release:
+//
+//	"rules": [
+//		{ "rule": "min_duration", "days": 540 },
+//		{ "rule": "max_deals_per_piece", "limit": 6, "per_provider": true },
+//		{ "rule": "recovery", "start_epoch": 1381920, "days": 499 },
+//		{ "rule": "exclusion_list", "disabled": true },
+//		{ "rule": "sector_start_window", "disabled": true }
+//	]
+//
+// Rules left out of the section apply with their defaults.
+const (
+	ruleExclusionList    = "exclusion_list"
+	ruleRecovery         = "recovery"
+	rulePhaseWindow      = "sector_start_window"
+	ruleMinDuration      = "min_duration"
+	ruleMaxDealsPerPiece = "max_deals_per_piece"
+)
+
+// One entry of the "rules" section of the rollup config
+type ruleDefinition struct {
+	Rule        string `json:"rule"`
+	Disabled    bool   `json:"disabled,omitempty"`
+	Days        int64  `json:"days,omitempty"`         // min_duration, recovery
+	Limit       int    `json:"limit,omitempty"`        // max_deals_per_piece
+	PerProvider bool   `json:"per_provider,omitempty"` // max_deals_per_piece
+	StartEpoch  int64  `json:"start_epoch,omitempty"`  // recovery
+}
+
+const (
+	// rules applying to every deal of a registered project
+	ruleStageCompetition = iota
+	// rules applying once the deal counts towards the deals made of its piece
+	ruleStageQualifying
+)
+
+// A deal of a registered project, as the rules see it
+type dealCandidate struct {
+	dealID         string
+	deal           *api.MarketDeal
+	client         address.Address
+	isRecovery     bool
+	timesSeenPiece int // deals of the piece the project made so far, this one included
+}
+
+// What the piece CID cap counts deals by within a project: the provider is only set
+// when the cap is per provider
+type pieceCapKey struct {
+	piece    cid.Cid
+	provider address.Address
+}
+
+func newPieceCapKey(piece cid.Cid, provider address.Address) pieceCapKey {
+	if !pieceCapPerProvider {
+		provider = address.Undef
+	}
+	return pieceCapKey{piece: piece, provider: provider}
+}
+
+type eligibilityRule struct {
+	name     string
+	stage    int
+	disabled bool
+
+	// the exclusion reason when the deal fails the rule, "" when it passes
+	check func(c *dealCandidate) string
+	// the values the rule looks at, as explain prints them
+	describe func(c *dealCandidate) string
+
+	warning     string // attached to the project of every deal failing the rule, if any
+	seesProject bool   // deals failing the rule still make their project show up in the totals
+
+	hits int64
+}
+
+type eligibilityRules []*eligibilityRule
+
+// Sets up the rules, applying the definitions of the rollup config over the defaults.
+// The recovery rule changes recovery in place, as the recovery list follows it too.
+// The exclusion list is set once loaded, as its default depends on the recovery rule.
+func newEligibilityRules(defs []ruleDefinition, recovery *recoveryRules) (eligibilityRules, error) {
+	rules := eligibilityRules{
+		{
+			name:     ruleExclusionList,
+			stage:    ruleStageCompetition,
+			check:    func(*dealCandidate) string { return "" },
+			describe: func(*dealCandidate) string { return "no exclusion list loaded" },
+			warning:  warnListExcluded,
+		},
+		{
+			name:  ruleRecovery,
+			stage: ruleStageCompetition,
+			check: func(c *dealCandidate) string {
+				if recovery.excludedFromCompetition(c.isRecovery) {
+					return exclusionRecovery
+				}
+				return ""
+			},
+			describe: func(c *dealCandidate) string {
+				return fmt.Sprintf("recovery list deals excluded: %t", recovery.ExcludeFromCompetition)
+			},
+			warning: warnRecoveryExcluded,
+		},
+		{
+			name:  rulePhaseWindow,
+			stage: ruleStageQualifying,
+			check: func(c *dealCandidate) string {
+				if c.deal.State.SectorStartEpoch < currentPhaseStart {
+					return exclusionBeforePhase
+				}
+				if currentPhaseEnd > 0 && c.deal.State.SectorStartEpoch >= currentPhaseEnd {
+					return exclusionAfterPhase
+				}
+				return ""
+			},
+			describe: func(c *dealCandidate) string {
+				windowEnd := "open-ended"
+				if currentPhaseEnd > 0 {
+					windowEnd = fmt.Sprintf("up to %d", currentPhaseEnd)
+				}
+				return fmt.Sprintf("sector start epoch %d, phase from %d %s", c.deal.State.SectorStartEpoch, currentPhaseStart, windowEnd)
+			},
+		},
+		{
+			name:  ruleMinDuration,
+			stage: ruleStageQualifying,
+			check: func(c *dealCandidate) string {
+				if c.deal.Proposal.EndEpoch-c.deal.Proposal.StartEpoch < builtin.EpochsInDay*abi.ChainEpoch(minQualifyingDealDurationDays) {
+					return exclusionShortDuration
+				}
+				return ""
+			},
+			describe: func(c *dealCandidate) string {
+				duration := c.deal.Proposal.EndEpoch - c.deal.Proposal.StartEpoch
+				return fmt.Sprintf("%d epochs (%.1f days), at least %d days required", duration, float64(duration)/float64(builtin.EpochsInDay), minQualifyingDealDurationDays)
+			},
+			warning: warnShortDuration,
+		},
+		{
+			name:  ruleMaxDealsPerPiece,
+			stage: ruleStageQualifying,
+			check: func(c *dealCandidate) string {
+				if maxQualifyingDealsPerPiece > 0 && c.timesSeenPiece >= maxQualifyingDealsPerPiece {
+					return exclusionReplicaLimit
+				}
+				return ""
+			},
+			describe: func(c *dealCandidate) string {
+				if pieceCapPerProvider {
+					return fmt.Sprintf("only the first %d deals of piece %s with provider %s within a project count", maxQualifyingDealsPerPiece, c.deal.Proposal.PieceCID, c.deal.Proposal.Provider)
+				}
+				return fmt.Sprintf("only the first %d deals of piece %s within a project count", maxQualifyingDealsPerPiece, c.deal.Proposal.PieceCID)
+			},
+			warning:     warnReplicaLimit,
+			seesProject: true,
+		},
+	}
+
+	seen := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		r := rules.lookup(def.Rule)
+		if r == nil {
+			return nil, xerrors.Errorf("unknown rule '%s': expected one of %s", def.Rule, strings.Join(rules.names(), ", "))
+		}
+		if seen[def.Rule] {
+			return nil, xerrors.Errorf("rule '%s' defined more than once", def.Rule)
+		}
+		seen[def.Rule] = true
+		r.disabled = def.Disabled
+
+		unexpected := func(param string) error {
+			return xerrors.Errorf("rule '%s' takes no %s", def.Rule, param)
+		}
+		switch def.Rule {
+		case ruleExclusionList:
+			if def.Days != 0 || def.Limit != 0 || def.StartEpoch != 0 || def.PerProvider {
+				return nil, xerrors.Errorf("rule '%s' takes no parameters: the list is given with --exclusion-list", def.Rule)
+			}
+		case ruleRecovery:
+			if def.Limit != 0 {
+				return nil, unexpected("limit")
+			}
+			if def.PerProvider {
+				return nil, unexpected("per_provider")
+			}
+			if def.StartEpoch < 0 {
+				return nil, xerrors.Errorf("rule '%s' takes a positive start_epoch, got %d", def.Rule, def.StartEpoch)
+			}
+			if def.Days != 0 {
+				if err := checkMinDurationDays("rule '"+def.Rule+"'", def.Days, true); err != nil {
+					return nil, err
+				}
+				recovery.MinDuration = recoveryMinDurationEpochs(def.Days)
+			}
+			if def.StartEpoch > 0 {
+				recovery.StartEpoch = abi.ChainEpoch(def.StartEpoch)
+				recoveryStart = recovery.StartEpoch
+			}
+		case rulePhaseWindow:
+			if def.Days != 0 || def.Limit != 0 || def.StartEpoch != 0 || def.PerProvider {
+				return nil, xerrors.Errorf("rule '%s' takes no parameters: the window is that of the phase", def.Rule)
+			}
+		case ruleMinDuration:
+			if def.Limit != 0 {
+				return nil, unexpected("limit")
+			}
+			if def.PerProvider {
+				return nil, unexpected("per_provider")
+			}
+			if def.StartEpoch != 0 {
+				return nil, unexpected("start_epoch")
+			}
+			if def.Days != 0 {
+				if err := checkMinDurationDays("rule '"+def.Rule+"'", def.Days, false); err != nil {
+					return nil, err
+				}
+				minQualifyingDealDurationDays = def.Days
+			}
+		case ruleMaxDealsPerPiece:
+			if def.Days != 0 {
+				return nil, unexpected("days")
+			}
+			if def.StartEpoch != 0 {
+				return nil, unexpected("start_epoch")
+			}
+			if def.Limit < 0 {
+				return nil, xerrors.Errorf("rule '%s' takes a positive limit, got %d", def.Rule, def.Limit)
+			}
+			if def.Limit > 0 {
+				maxQualifyingDealsPerPiece = def.Limit
+			}
+			pieceCapPerProvider = def.PerProvider
+		}
+	}
+
+	// the rules other than the window are also applied outside of the engine, to the
+	// phase breakdown, which goes by these
+	if rules.lookup(ruleMinDuration).disabled {
+		minQualifyingDealDurationDays = 0
+	}
+	if rules.lookup(ruleMaxDealsPerPiece).disabled {
+		maxQualifyingDealsPerPiece = 0
+	}
+
+	return rules, nil
+}
+
+// The longest deals the market actor accepts: a longer minimum would exclude them all
+const maxDealDurationDays = 540
+
+// Checks a minimum duration in days, which deals must reach or, when strict, exceed
+func checkMinDurationDays(what string, days int64, strict bool) error {
+	if days <= 0 {
+		return xerrors.Errorf("%s must be a positive amount of days, got %d", what, days)
+	}
+	if days > maxDealDurationDays || (strict && days == maxDealDurationDays) {
+		return xerrors.Errorf("%s of %d days leaves no deal qualifying: the market actor accepts deals of up to %d days", what, days, maxDealDurationDays)
+	}
+	return nil
+}
+
+// Applies the flags setting the parameters of rules, which leave each rule to the
+// rollup config when it has it
+func applyRuleFlags(cctx *cli.Context, cfg *rollupConfig) error {
+	if cctx.IsSet("min-deal-duration-days") {
+		if cfg.definesRule(ruleMinDuration) {
+			return xerrors.Errorf("the %s rule is set in the rollup config: drop --min-deal-duration-days", ruleMinDuration)
+		}
+		if err := checkMinDurationDays("--min-deal-duration-days", cctx.Int64("min-deal-duration-days"), false); err != nil {
+			return err
+		}
+		minQualifyingDealDurationDays = cctx.Int64("min-deal-duration-days")
+	}
+	if cfg.definesRule(ruleRecovery) && (cctx.IsSet("recovery-start-epoch") || cctx.IsSet("recovery-min-duration-days")) {
+		return xerrors.Errorf("the %s rule is set in the rollup config: drop --recovery-start-epoch and --recovery-min-duration-days", ruleRecovery)
+	}
+
+	if !cctx.IsSet("max-deals-per-piece") && !cctx.IsSet("piece-cap-per-provider") {
+		return nil
+	}
+	if cfg.definesRule(ruleMaxDealsPerPiece) {
+		return xerrors.Errorf("the %s rule is set in the rollup config: drop --max-deals-per-piece and --piece-cap-per-provider", ruleMaxDealsPerPiece)
+	}
+	if cctx.IsSet("max-deals-per-piece") {
+		if cctx.Int("max-deals-per-piece") <= 0 {
+			return xerrors.Errorf("--max-deals-per-piece must be positive, got %d", cctx.Int("max-deals-per-piece"))
+		}
+		maxQualifyingDealsPerPiece = cctx.Int("max-deals-per-piece")
+	}
+	pieceCapPerProvider = cctx.Bool("piece-cap-per-provider")
+	return nil
+}
+
+// Hands the exclusion list to its rule
+func (er eligibilityRules) useExclusionList(el *exclusionList) {
+	r := er.lookup(ruleExclusionList)
+	r.check = func(c *dealCandidate) string {
+		return el.excludes(c.dealID, c.client, c.deal)
+	}
+	r.describe = func(c *dealCandidate) string {
+		from, listed := el.clients[c.client]
+		if !listed {
+			return fmt.Sprintf("deal listed: %t, client listed: false", el.deals[c.dealID])
+		}
+		return fmt.Sprintf("deal listed: %t, client listed from epoch %d, sector start epoch %d", el.deals[c.dealID], from, c.deal.State.SectorStartEpoch)
+	}
+}
+
+func (er eligibilityRules) lookup(name string) *eligibilityRule {
+	for _, r := range er {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func (er eligibilityRules) names() []string {
+	ret := make([]string, 0, len(er))
+	for _, r := range er {
+		ret = append(ret, r.name)
+	}
+	return ret
+}
+
+// The first rule of the stage the deal fails along with the reason, counting the hit,
+// or nil when it passes them all
+func (er eligibilityRules) evaluate(stage int, c *dealCandidate) (*eligibilityRule, string) {
+	r, reason := er.firstFailed(stage, c)
+	if r != nil {
+		r.hits++
+	}
+	return r, reason
+}
+
+// As evaluate, without counting the hit: for the pending deals, which stay out of the
+// totals either way
+func (er eligibilityRules) firstFailed(stage int, c *dealCandidate) (*eligibilityRule, string) {
+	for _, r := range er {
+		if r.stage != stage || r.disabled {
+			continue
+		}
+		if reason := r.check(c); reason != "" {
+			return r, reason
+		}
+	}
+	return nil, ""
+}
+
+// How many deals of registered projects each rule kept out of the totals
+func (er eligibilityRules) hitCounts() []*ruleHits {
+	ret := make([]*ruleHits, 0, len(er))
+	for _, r := range er {
+		ret = append(ret, &ruleHits{Rule: r.name, Enabled: !r.disabled, Hits: r.hits})
+	}
+	return ret
+}
+
+func (er eligibilityRules) logHits() {
+	counts := make([]string, 0, len(er))
+	for _, r := range er {
+		if !r.disabled {
+			counts = append(counts, r.name+"="+strconv.FormatInt(r.hits, 10))
+		}
+	}
+	sort.Strings(counts)
+	log.Infof("deals of registered projects excluded by rule: %s", strings.Join(counts, " "))
+}
+
+type ruleHits struct {
+	Rule    string `json:"rule"`
+	Enabled bool   `json:"enabled"`
+	Hits    int64  `json:"hits"` // deals of registered projects kept out of the totals
+}
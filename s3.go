@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Uploads through plain PUT Object requests signed with AWS Signature Version 4, which
+// avoids pulling in the AWS SDK. Single PUTs are limited to 5GiB per object, far above
+// the size of any rollup output.
+//
+// Credentials and region come from the usual AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN and AWS_REGION (or AWS_DEFAULT_REGION) environment variables.
+// AWS_ENDPOINT_URL selects an S3 compatible service instead, addressed path-style.
+type s3Uploader struct {
+	bucket       string
+	region       string
+	endpoint     string // scheme://host, without the bucket
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Uploader(bucket string) (*s3Uploader, error) {
+	s := &s3Uploader{
+		bucket:       bucket,
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, xerrors.New("uploading to S3 requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set")
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	if ep := os.Getenv("AWS_ENDPOINT_URL"); ep != "" {
+		s.endpoint = strings.TrimRight(ep, "/")
+		s.pathStyle = true
+	} else {
+		s.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, s.region)
+	}
+
+	return s, nil
+}
+
+func (s *s3Uploader) put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType string) error {
+	// the payload hash is part of the signature: read everything twice rather than
+	// buffering possibly hundreds of MB
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	uriPath := "/" + s3EscapePath(key)
+	if s.pathStyle {
+		uriPath = "/" + s3EscapePath(s.bucket) + uriPath
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint+uriPath, ioutil.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, uriPath, payloadHash, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return xerrors.Errorf("PUT %s: non-2xx response %d: %s", req.URL, resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+func (s *s3Uploader) sign(req *http.Request, uriPath, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// every header set so far gets signed, sorted by lowercase name as required
+	signedNames := []string{"host"}
+	for name := range req.Header {
+		signedNames = append(signedNames, strings.ToLower(name))
+	}
+	sort.Strings(signedNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range signedNames {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(signedNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriPath,
+		"", // no query
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data)) //nolint:errcheck
+	return m.Sum(nil)
+}
+
+// URI-encodes every byte but the RFC 3986 unreserved characters, keeping slashes
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// The JSON documents a rollup writes, along with the endpoint their envelope carries
+var schemaDocuments = map[string]struct {
+	endpoint string
+	envelope reflect.Type
+}{
+	"basic_stats.json":              {"COMPETITION_TOTALS", reflect.TypeOf(competitionTotalOutput{})},
+	"client_stats.json":             {"PROJECT_DEAL_STATS", reflect.TypeOf(projectAggregateStatsOutput{})},
+	"deals_list_{projid}.json":      {"DEAL_LIST", reflect.TypeOf(dealListOutput{})},
+	"recovery_deallist.json":        {"RECOVERED_DEALS_LIST", reflect.TypeOf(recoveryListOutput{})},
+	"removed_deals.json":            {"REMOVED_DEALS", reflect.TypeOf(removedDealsOutput{})},
+	"provider_faults.json":          {"PROVIDER_FAULT_HISTORY", reflect.TypeOf(providerFaultHistoryOutput{})},
+	"datacap_stats.json":            {"DATACAP_STATS", reflect.TypeOf(datacapStatsOutput{})},
+	"parameters.json":               {"ROLLUP_PARAMETERS", reflect.TypeOf(rollupParametersOutput{})},
+	"burst_report.json":             {"ONBOARDING_BURSTS", reflect.TypeOf(onboardingBurstOutput{})},
+	"miner_stats.json":              {"MINER_STATS", reflect.TypeOf(minerStatsOutput{})},
+	"provider_stats.json":           {"PROVIDER_STATS", reflect.TypeOf(providerStatsOutput{})},
+	"geo_distribution.json":         {"GEO_DISTRIBUTION", reflect.TypeOf(geoDistributionOutput{})},
+	"cid_index.json":                {"CID_INDEX", reflect.TypeOf(cidIndexOutput{})},
+	"terminated_deals.json":         {"TERMINATED_DEALS", reflect.TypeOf(terminatedDealsOutput{})},
+	"dataset_stats.json":            {"DATASET_STATS", reflect.TypeOf(datasetStatsOutput{})},
+	"timeseries_stats.json":         {"DAILY_TIMESERIES", reflect.TypeOf(timeseriesStatsOutput{})},
+	"expiring_deals.json":           {"EXPIRING_DEALS", reflect.TypeOf(expiringDealsOutput{})},
+	"phase_stats.json":              {"PHASE_STATS", reflect.TypeOf(phaseStatsOutput{})},
+	"deals_by_miner_{minerid}.json": {"MINER_DEAL_LIST", reflect.TypeOf(minerDealListOutput{})},
+}
+
+var schema = &cli.Command{
+	Usage:     "Emit JSON Schema documents describing the rollup outputs",
+	Name:      "schema",
+	ArgsUsage: "  [<document name>...]",
+	Description: `Without arguments, prints a single JSON object holding the schema of every
+output document keyed by its file name. With arguments, only the named documents
+are included. Known documents:
+
+   ` + strings.Join(schemaDocumentNames(), "\n   ") + `
+
+With --proto, prints the protobuf definition of the gRPC API of serve instead.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "proto",
+			Usage: "Print the .proto of the gRPC API",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Bool("proto") {
+			_, err := os.Stdout.WriteString(rollupProtoSource())
+			return err
+		}
+
+		names := cctx.Args().Slice()
+		if len(names) == 0 {
+			names = schemaDocumentNames()
+		}
+
+		ret, err := outputSchemas(names)
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ret)
+	},
+}
+
+// Every rollup carries the schema of its outputs, for later compatibility checks
+const schemaFileName = "schema.json"
+
+// The complete schema documents of the named outputs, keyed by name. Each carries the
+// schema version it describes as x-schema-version.
+func outputSchemas(names []string) (map[string]interface{}, error) {
+	ret := make(map[string]interface{}, len(names))
+	for _, n := range names {
+		doc, known := schemaDocuments[n]
+		if !known {
+			return nil, xerrors.Errorf("unknown output document '%s'", n)
+		}
+		s := jsonSchemaOf(doc.envelope)
+		s["$schema"] = "http://json-schema.org/draft-07/schema#"
+		s["title"] = n
+		s["x-schema-version"] = outputSchemaVersion
+		s["properties"].(map[string]interface{})["endpoint"] = map[string]interface{}{
+			"type":  "string",
+			"const": doc.endpoint,
+		}
+		ret[n] = s
+	}
+	return ret, nil
+}
+
+func writeSchemaFile(outDirName string) error {
+	all, err := outputSchemas(schemaDocumentNames())
+	if err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outDirName, schemaFileName), append(raw, '\n'), 0644)
+}
+
+func schemaDocumentNames() []string {
+	ret := make([]string, 0, len(schemaDocuments))
+	for n := range schemaDocuments {
+		ret = append(ret, n)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+var (
+	cidType     = reflect.TypeOf(cid.Cid{})
+	addressType = reflect.TypeOf(address.Address{})
+)
+
+// Derives a JSON Schema from the same json tags encoding/json goes by, so that the
+// schema can not drift from what is actually written
+func jsonSchemaOf(t reflect.Type) map[string]interface{} {
+	switch t {
+	case cidType:
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"/": map[string]interface{}{"type": "string"}},
+			"required":   []string{"/"},
+		}
+	case addressType:
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// nil slices are encoded as null
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": jsonSchemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": []string{"object", "null"}, "additionalProperties": jsonSchemaOf(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		required := make([]string, 0)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchemaOf(f.Type)
+
+			omitEmpty := false
+			for _, opt := range tag[1:] {
+				omitEmpty = omitEmpty || opt == "omitempty"
+			}
+			if !omitEmpty {
+				required = append(required, name)
+			}
+		}
+		sort.Strings(required)
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+			"required":   required,
+		}
+	default:
+		// anything else is unconstrained
+		return map[string]interface{}{}
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var serve = &cli.Command{
+	Usage:     "Serve the latest completed rollups of one or more programs over HTTP",
+	Name:      "serve",
+	ArgsUsage: "  <site> [<site>...]",
+	Description: `Each site is specified as  /prefix=/rollup/root[@refresh-interval]
+
+The rollup root is a directory holding the output directories of successive
+rollup runs: the completed one with the highest epoch is served under the
+prefix, and the root is rescanned for newer rollups every refresh-interval
+(default 5m). Example:
+
+   serve /slingshot=/data/slingshot@10m  /restore=/data/restore@1h
+
+Every file of the rollup is available under its own name. The main documents are
+additionally held in memory and served at
+
+   /prefix/basic_stats
+   /prefix/client_stats
+   /prefix/miner_stats
+   /prefix/recovery
+   /prefix/deals/<project id>
+
+and can be queried with GraphQL at /prefix/graphql, by POST or by GET with the
+query in the query parameter. A GET without a query returns the schema. Queries
+may descend 12 levels into objects and resolve 500000 fields at most, each field
+selected on a list counting once per element.
+
+The deal list of a project can also be paged through at
+
+   /prefix/projects/<project id>/deals?limit=&offset=&sort=
+
+with limit defaulting to 100 deals, and sort naming one of data_size, deal_id,
+deal_start_epoch, miner_id, client or payload_cid, prefixed with - to sort
+descending. Without sort, deals are in the order of the deal list. The stats of
+a single storage provider are at
+
+   /prefix/miners/<miner id>
+
+Every field of the totals in basic_stats can be followed over the rollups under
+the root, up to --history of them, as a time series by epoch at
+
+   /prefix/history?metric=<field, e.g. total_stored_data_size>
+
+How many rollups the root holds is up to daemon --keep.
+
+The openapi command describes the HTTP API. With --grpc-listen the same data is
+also served over gRPC, see schema --proto.
+
+With --metrics, /metrics exposes the epoch and totals of the rollup served under
+every prefix, along with when it was last refreshed, as Prometheus metrics.
+
+To be exposed publicly, serve can require a bearer token from --auth-tokens for
+the expensive endpoints: GraphQL, the paged deal lists and the gRPC calls listing
+deals. Clients pass it as "Authorization: Bearer <token>", in gRPC metadata
+alike. With --rate-limit, each client IP without a valid token is held to that
+many requests per second, and answered 429 beyond it.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "listen",
+			Usage: "Address to listen on",
+			Value: ":8080",
+		},
+		&cli.StringFlag{
+			Name:  "grpc-listen",
+			Usage: "Address to also serve the gRPC API on",
+		},
+		&cli.BoolFlag{
+			Name:  "metrics",
+			Usage: "Expose Prometheus metrics of the served rollups at /metrics",
+		},
+		&cli.StringFlag{
+			Name:  "deal-list-name",
+			Usage: "Name of the per-project deal lists without extension, as passed to rollup",
+			Value: defaultDealListName,
+		},
+		&cli.IntFlag{
+			Name:  "history",
+			Usage: "Number of the newest rollups under each root whose totals /history serves, 0 for all",
+			Value: defaultHistoryLength,
+		},
+		&cli.StringFlag{
+			Name:  "auth-tokens",
+			Usage: "File of bearer tokens, one per line, of which GraphQL, the paged deal lists and the gRPC deal listings then require one",
+		},
+		&cli.Float64Flag{
+			Name:  "rate-limit",
+			Usage: "Requests per second allowed from each client IP without a bearer token, 0 for no limit",
+		},
+		&cli.IntFlag{
+			Name:  "rate-burst",
+			Usage: "Requests a client IP may make at once before --rate-limit applies",
+			Value: 20,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() == 0 {
+			return xerrors.New("must supply at least one site to serve")
+		}
+
+		mux := http.NewServeMux()
+		sites := make(map[string]*site)
+
+		dealLists, err := dealListPattern(cctx.String("deal-list-name"), "")
+		if err != nil {
+			return err
+		}
+		guard, err := newServeGuard(cctx.String("auth-tokens"), cctx.Float64("rate-limit"), cctx.Int("rate-burst"))
+		if err != nil {
+			return err
+		}
+
+		for _, spec := range cctx.Args().Slice() {
+			s, err := parseSiteSpec(spec)
+			if err != nil {
+				return err
+			}
+			s.dealLists = dealLists
+			s.guard = guard
+			s.historyLength = cctx.Int("history")
+			if _, seen := sites[s.prefix]; seen {
+				return xerrors.Errorf("prefix '%s' specified more than once", s.prefix)
+			}
+			sites[s.prefix] = s
+
+			if err := s.refresh(); err != nil {
+				return err
+			}
+			go s.refreshLoop(cctx.Context)
+
+			mux.Handle(s.prefix+"/", http.StripPrefix(s.prefix, s))
+			log.Infof("serving rollups from '%s' under %s/ (refresh every %s)", s.root, s.prefix, s.interval)
+		}
+
+		if cctx.Bool("metrics") {
+			mux.Handle("/metrics", servedMetrics(sites))
+		}
+
+		if addr := cctx.String("grpc-listen"); addr != "" {
+			grpcSrv, err := newRollupGRPCServer(sites, guard)
+			if err != nil {
+				return err
+			}
+			lis, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			go func() {
+				<-cctx.Context.Done()
+				grpcSrv.Stop()
+			}()
+			go func() {
+				if err := grpcSrv.Serve(lis); err != nil {
+					log.Errorf("gRPC server on %s stopped: %s", addr, err)
+				}
+			}()
+			log.Infof("serving gRPC on %s", addr)
+		}
+
+		srv := &http.Server{Addr: cctx.String("listen"), Handler: guard.wrap(mux)}
+		go func() {
+			<-cctx.Context.Done()
+			srv.Close() //nolint:errcheck
+		}()
+
+		log.Infof("listening on %s", cctx.String("listen"))
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+// A single served program/phase: a rollup root and the latest rollup found in it
+type site struct {
+	prefix   string
+	root     string
+	interval time.Duration
+
+	dealLists     *regexp.Regexp
+	guard         *serveGuard
+	historyLength int
+
+	mu              sync.RWMutex
+	current         *servedRollup
+	lastRefresh     time.Time // of the latest successful one
+	refreshFailures int64
+}
+
+// contents of the root of a site
+type siteIndex struct {
+	Epoch     int64    `json:"epoch"`
+	Files     []string `json:"files"`
+	Documents []string `json:"documents"` // API paths of the documents held in memory
+}
+
+type servedRollup struct {
+	dir    string
+	epoch  int64
+	digest string // of the run fingerprint, doubles as the ETag base of every file
+	files  []string
+	docs   map[string]*servedDocument // API path => document held in memory
+	graph  *servedGraph
+
+	history []*historyEntry // of the rollups under the root, latest included
+}
+
+type servedDocument struct {
+	file    string
+	body    []byte
+	modTime time.Time
+}
+
+// The in-memory API paths of the fixed documents. The .ndjson variants are written
+// instead of the .json ones by --format ndjson.
+var servedDocumentPaths = map[string]string{
+	"basic_stats.json":         "basic_stats",
+	"client_stats.json":        "client_stats",
+	"miner_stats.json":         "miner_stats",
+	"recovery_deallist.json":   "recovery",
+	"recovery_deallist.ndjson": "recovery",
+}
+
+func parseSiteSpec(spec string) (*site, error) {
+	eq := strings.IndexByte(spec, '=')
+	if eq <= 0 || !strings.HasPrefix(spec, "/") {
+		return nil, xerrors.Errorf("invalid site spec '%s': expected /prefix=/rollup/root[@interval]", spec)
+	}
+
+	s := &site{
+		prefix:   strings.TrimRight(spec[:eq], "/"),
+		root:     spec[eq+1:],
+		interval: 5 * time.Minute,
+	}
+
+	if at := strings.LastIndexByte(s.root, '@'); at > 0 {
+		var err error
+		if s.interval, err = time.ParseDuration(s.root[at+1:]); err != nil {
+			return nil, xerrors.Errorf("invalid refresh interval in site spec '%s': %w", spec, err)
+		}
+		s.root = s.root[:at]
+	}
+
+	if s.prefix == "" {
+		return nil, xerrors.Errorf("invalid site spec '%s': the root prefix / can not be used", spec)
+	}
+	if s.interval <= 0 {
+		return nil, xerrors.Errorf("invalid site spec '%s': refresh interval must be positive", spec)
+	}
+
+	return s, nil
+}
+
+func (s *site) refreshLoop(ctx context.Context) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.refresh(); err != nil {
+				log.Warnf("refreshing %s from '%s' failed, continuing to serve the previous rollup: %s", s.prefix, s.root, err)
+				s.mu.Lock()
+				s.refreshFailures++
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Finds the completed rollup with the highest epoch within the site root. The root
+// itself is also considered, so a single rollup output directory can be served as-is.
+func (s *site) refresh() error {
+	candidates := []string{s.root}
+	entries, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// hidden directories hold rollups still being assembled
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			candidates = append(candidates, filepath.Join(s.root, e.Name()))
+		}
+	}
+
+	var latest *servedRollup
+	var history []*historyEntry
+	for _, dir := range candidates {
+		// the fingerprint is written last: without it the rollup is incomplete
+		rawFp, err := ioutil.ReadFile(filepath.Join(dir, runFingerprintName))
+		if err != nil {
+			continue
+		}
+		var fp runFingerprint
+		if err := json.Unmarshal(rawFp, &fp); err != nil || len(fp.Digest) < 16 {
+			log.Warnf("skipping rollup '%s' with unparseable %s", dir, runFingerprintName)
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(dir, "basic_stats.json"))
+		if err != nil {
+			continue
+		}
+		var basic competitionTotalOutput
+		if err := json.Unmarshal(raw, &basic); err != nil {
+			log.Warnf("skipping rollup '%s' with unparseable basic_stats.json: %s", dir, err)
+			continue
+		}
+		history = append(history, &historyEntry{epoch: basic.Epoch, totals: basic.Payload})
+
+		if latest == nil || basic.Epoch > latest.epoch {
+			latest = &servedRollup{dir: dir, epoch: basic.Epoch, digest: fp.Digest}
+		}
+	}
+
+	if latest == nil {
+		return xerrors.Errorf("no completed rollup found in '%s'", s.root)
+	}
+	latest.history = trimHistory(history, s.historyLength)
+
+	files, err := ioutil.ReadDir(latest.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			latest.files = append(latest.files, f.Name())
+		}
+	}
+	sort.Strings(latest.files)
+
+	s.mu.RLock()
+	prev := s.current
+	s.mu.RUnlock()
+
+	// a rollup never changes once complete, there is nothing to reload
+	if prev != nil && prev.dir == latest.dir && prev.digest == latest.digest {
+		latest.docs, latest.graph = prev.docs, prev.graph
+	} else if latest.docs, err = s.loadDocuments(latest); err != nil {
+		return xerrors.Errorf("loading rollup '%s': %w", latest.dir, err)
+	} else {
+		latest.graph = &servedGraph{}
+	}
+
+	s.mu.Lock()
+	s.current = latest
+	s.lastRefresh = time.Now()
+	s.mu.Unlock()
+
+	if prev == nil || prev.dir != latest.dir {
+		log.Infof("%s now serving rollup at epoch %d from '%s'", s.prefix, latest.epoch, latest.dir)
+	}
+	return nil
+}
+
+func (s *site) loadDocuments(sr *servedRollup) (map[string]*servedDocument, error) {
+	docs := make(map[string]*servedDocument)
+	for _, name := range sr.files {
+		apiPath, fixed := servedDocumentPaths[name]
+		if !fixed {
+			ext := filepath.Ext(name)
+			if ext != ".json" && ext != ".ndjson" {
+				continue
+			}
+			m := s.dealLists.FindStringSubmatch(strings.TrimSuffix(name, ext))
+			if m == nil {
+				continue
+			}
+			apiPath = "deals/" + m[1]
+		}
+
+		path := filepath.Join(sr.dir, name)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		docs[apiPath] = &servedDocument{file: name, body: body, modTime: fi.ModTime()}
+	}
+	return docs, nil
+}
+
+func (s *site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	cur := s.current
+	s.mu.RUnlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+
+	if (name == "graphql" || strings.HasPrefix(name, "projects/")) && !s.guard.requireToken(w, r) {
+		return
+	}
+
+	if name == "graphql" {
+		s.serveGraphQL(w, r, cur)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if name == "" {
+		docs := make([]string, 0, len(cur.docs))
+		for p := range cur.docs {
+			docs = append(docs, p)
+		}
+		sort.Strings(docs)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(siteIndex{cur.epoch, cur.files, docs}) //nolint:errcheck
+		return
+	}
+
+	// Until the next refresh, clients may use what they have without asking again
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.interval.Seconds())))
+
+	if parts := strings.Split(name, "/"); len(parts) == 3 && parts[0] == "projects" && parts[2] == "deals" {
+		s.serveProjectDeals(w, r, cur, parts[1])
+		return
+	}
+	if name == "history" {
+		s.serveHistory(w, r, cur)
+		return
+	}
+	if parts := strings.Split(name, "/"); len(parts) == 2 && parts[0] == "miners" {
+		s.serveMiner(w, r, cur, parts[1])
+		return
+	}
+
+	if doc, inMemory := cur.docs[name]; inMemory {
+		s.serveContent(w, r, cur, doc.file, doc.modTime, int64(len(doc.body)), bytes.NewReader(doc.body))
+		return
+	}
+
+	idx := sort.SearchStrings(cur.files, name)
+	if idx == len(cur.files) || cur.files[idx] != name {
+		http.NotFound(w, r)
+		return
+	}
+
+	fh, err := os.Open(filepath.Join(cur.dir, name))
+	if err != nil {
+		http.Error(w, "file not available", http.StatusInternalServerError)
+		return
+	}
+	defer fh.Close() //nolint:errcheck
+	fi, err := fh.Stat()
+	if err != nil {
+		http.Error(w, "file not available", http.StatusInternalServerError)
+		return
+	}
+
+	s.serveContent(w, r, cur, name, fi.ModTime(), fi.Size(), fh)
+}
+
+// Serves one file of the rollup, whether from disk or from memory
+func (s *site) serveContent(w http.ResponseWriter, r *http.Request, cur *servedRollup, name string, modTime time.Time, size int64, content io.ReadSeeker) {
+	// A rollup directory never changes once its fingerprint is written, so the
+	// fingerprint digest identifies the contents of every file within it
+	etagBase := cur.digest[:16] + "-" + name
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if filepath.Ext(name) == ".ndjson" {
+		ctype = "application/x-ndjson"
+	}
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+
+	// Range requests are always answered from the identity encoding, so that
+	// interrupted downloads of large deal lists can be resumed
+	if r.Header.Get("Range") == "" && acceptsGzip(r) && size >= minGzipSize {
+		etag := `"` + etagBase + `.gz"`
+		w.Header().Set("ETag", etag)
+		if etagListMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		if _, err := io.Copy(gz, content); err != nil {
+			log.Warnf("sending %s%s failed: %s", s.prefix, r.URL.Path, err)
+			return
+		}
+		gz.Close() //nolint:errcheck
+		return
+	}
+
+	// ServeContent takes care of If-None-Match, If-Range and Range based on the ETag
+	w.Header().Set("ETag", `"`+etagBase+`"`)
+	http.ServeContent(w, r, name, modTime, content)
+}
+
+// Small files are not worth the compression overhead
+const minGzipSize = 1024
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if q := strings.TrimSpace(p); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Weak comparison as mandated for If-None-Match
+func etagListMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
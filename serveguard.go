@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Buckets idle for this long are full again and can be forgotten
+const rateLimitIdleExpiry = 10 * time.Minute
+
+// Lets serve be exposed publicly without a proxy in front: the endpoints that are
+// expensive to answer (GraphQL, the paged deal lists, the gRPC deal listings) can be
+// restricted to holders of a bearer token, and every client IP can be rate limited.
+// Requests with a valid token are never rate limited. All methods are no-ops on a
+// nil guard.
+type serveGuard struct {
+	tokens [][]byte // none: no authentication
+
+	rate  float64 // requests per second, 0 for no limit
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket // by client IP
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil when neither authentication nor rate limiting is asked for
+func newServeGuard(tokensFile string, rate float64, burst int) (*serveGuard, error) {
+	if rate < 0 || (rate > 0 && burst < 1) {
+		return nil, xerrors.Errorf("invalid rate limit of %g requests per second with a burst of %d", rate, burst)
+	}
+	if tokensFile == "" && rate == 0 {
+		return nil, nil
+	}
+
+	g := &serveGuard{rate: rate, burst: float64(burst), buckets: make(map[string]*rateBucket)}
+	if tokensFile != "" {
+		var err error
+		if g.tokens, err = readAuthTokens(tokensFile); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// One token per line, blank lines and lines starting with # are ignored
+func readAuthTokens(path string) ([][]byte, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	var tokens [][]byte
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, []byte(line))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, xerrors.Errorf("reading auth tokens from '%s': %w", path, err)
+	}
+	if len(tokens) == 0 {
+		return nil, xerrors.Errorf("no auth tokens in '%s'", path)
+	}
+	return tokens, nil
+}
+
+// Whether the value of an Authorization header carries one of the tokens
+func (g *serveGuard) validToken(authorization string) bool {
+	if g == nil || len(g.tokens) == 0 {
+		return false
+	}
+	const scheme = "bearer "
+	if len(authorization) <= len(scheme) || !strings.EqualFold(authorization[:len(scheme)], scheme) {
+		return false
+	}
+	given := []byte(strings.TrimSpace(authorization[len(scheme):]))
+
+	valid := false
+	for _, t := range g.tokens {
+		if subtle.ConstantTimeCompare(given, t) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// Whether an expensive endpoint may be answered
+func (g *serveGuard) authorized(authorization string) bool {
+	return g == nil || len(g.tokens) == 0 || g.validToken(authorization)
+}
+
+// Takes a request off the bucket of ip, returning how long to wait when it is empty
+func (g *serveGuard) allow(ip string, now time.Time) (bool, time.Duration) {
+	if g == nil || g.rate == 0 {
+		return true, 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.lastSweep) > rateLimitIdleExpiry {
+		for k, b := range g.buckets {
+			if now.Sub(b.last) > rateLimitIdleExpiry {
+				delete(g.buckets, k)
+			}
+		}
+		g.lastSweep = now
+	}
+
+	b, seen := g.buckets[ip]
+	if !seen {
+		b = &rateBucket{tokens: g.burst, last: now}
+		g.buckets[ip] = b
+	}
+	b.tokens = math.Min(g.burst, b.tokens+now.Sub(b.last).Seconds()*g.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / g.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Rate limits every request to h by client IP, unless it carries a valid token
+func (g *serveGuard) wrap(h http.Handler) http.Handler {
+	if g == nil || g.rate == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.validToken(r.Header.Get("Authorization")) {
+			if ok, wait := g.allow(remoteIP(r.RemoteAddr), time.Now()); !ok {
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Answers 401 unless the request may use an expensive endpoint
+func (g *serveGuard) requireToken(w http.ResponseWriter, r *http.Request) bool {
+	if g.authorized(r.Header.Get("Authorization")) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="slingshot-stats"`)
+	http.Error(w, "bearer token required", http.StatusUnauthorized)
+	return false
+}
+
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Applies the guard to a gRPC call: every method but the totals lists deals
+func (g *serveGuard) checkGRPC(ctx context.Context, fullMethod string) error {
+	var authorization string
+	if md, found := metadata.FromIncomingContext(ctx); found {
+		if vals := md.Get("authorization"); len(vals) > 0 {
+			authorization = vals[0]
+		}
+	}
+
+	if !g.validToken(authorization) {
+		if p, found := peer.FromContext(ctx); found {
+			if ok, wait := g.allow(remoteIP(p.Addr.String()), time.Now()); !ok {
+				return status.Errorf(codes.ResourceExhausted, "too many requests, retry in %s", wait.Round(time.Millisecond))
+			}
+		}
+	}
+	if !strings.HasSuffix(fullMethod, "/GetCompetitionTotals") && !g.authorized(authorization) {
+		return status.Error(codes.Unauthenticated, "bearer token required")
+	}
+	return nil
+}
+
+func (g *serveGuard) grpcOptions() []grpc.ServerOption {
+	if g == nil {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := g.checkGRPC(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := g.checkGRPC(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	_ "github.com/filecoin-project/lotus/lib/sigs/secp" // registers the secp256k1 signer
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+const outputSignatureName = "signature.json"
+
+// Sidecar vouching for the outputs of a run. Signed holds the exact JSON document
+// the signature covers, a signedOutputs listing the SHA-256 of every output file.
+//
+// For secp256k1 wallet keys Signature is in the format of `lotus wallet sign`, so
+// that `lotus wallet verify <signer> <hex of signed> <signature>` checks it. For
+// ed25519 keys it is the plain 64 byte signature, and the signer is given as
+// ed25519:<hex public key>.
+type outputSignature struct {
+	Signer    string `json:"signer"`
+	KeyType   string `json:"key_type"`
+	Signed    string `json:"signed"`
+	Signature string `json:"signature"` // hex
+}
+
+type signedOutputs struct {
+	Epoch     int64             `json:"epoch"`
+	TipSetKey []cid.Cid         `json:"tipset_key"`
+	RunDigest string            `json:"run_digest"`
+	Files     map[string]string `json:"files"` // name => sha256
+}
+
+type outputSigner struct {
+	signer  string
+	keyType string
+	sign    func(msg []byte) ([]byte, error)
+}
+
+// Accepts either a Filecoin wallet key as written by `lotus wallet export`, or a PEM
+// encoded PKCS#8 ed25519 private key as written by `openssl genpkey -algorithm ed25519`
+func loadOutputSigner(path string) (*outputSigner, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(raw); block != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing private key in %s: %w", path, err)
+		}
+		key, isEd25519 := parsed.(ed25519.PrivateKey)
+		if !isEd25519 {
+			return nil, xerrors.Errorf("PEM private key in %s is not an ed25519 key", path)
+		}
+		return &outputSigner{
+			signer:  "ed25519:" + hex.EncodeToString(key.Public().(ed25519.PublicKey)),
+			keyType: "ed25519",
+			sign:    func(msg []byte) ([]byte, error) { return ed25519.Sign(key, msg), nil },
+		}, nil
+	}
+
+	kiJSON, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, xerrors.Errorf("%s is neither a PEM ed25519 key nor a hex encoded wallet export", path)
+	}
+	var ki types.KeyInfo
+	if err := json.Unmarshal(kiJSON, &ki); err != nil {
+		return nil, xerrors.Errorf("parsing wallet key in %s: %w", path, err)
+	}
+	if ki.Type != types.KTSecp256k1 {
+		return nil, xerrors.Errorf("wallet key in %s is of type %s: only secp256k1 keys are supported", path, ki.Type)
+	}
+
+	pub, err := sigs.ToPublic(crypto.SigTypeSecp256k1, ki.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := address.NewSecp256k1Address(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &outputSigner{
+		signer:  addr.String(),
+		keyType: string(ki.Type),
+		sign: func(msg []byte) ([]byte, error) {
+			sig, err := sigs.Sign(crypto.SigTypeSecp256k1, ki.PrivateKey, msg)
+			if err != nil {
+				return nil, err
+			}
+			return sig.MarshalBinary()
+		},
+	}, nil
+}
+
+// Signs every file in the output directory. Runs right before the fingerprint is
+// written, which is covered through the run digest instead.
+func writeOutputSignature(outDirName string, epoch int64, fp *runFingerprint, signer *outputSigner) error {
+	names, err := rollupFileNames(outDirName)
+	if err != nil {
+		return err
+	}
+
+	so := signedOutputs{
+		Epoch:     epoch,
+		TipSetKey: fp.TipSetKey,
+		RunDigest: fp.Digest,
+		Files:     make(map[string]string, len(names)),
+	}
+	for _, name := range names {
+		if name == outputSignatureName || name == runFingerprintName {
+			continue
+		}
+		if so.Files[name], err = sha256File(filepath.Join(outDirName, name)); err != nil {
+			return err
+		}
+	}
+
+	signed, err := json.Marshal(so)
+	if err != nil {
+		return err
+	}
+	sig, err := signer.sign(signed)
+	if err != nil {
+		return xerrors.Errorf("signing outputs: %w", err)
+	}
+
+	out, err := json.MarshalIndent(outputSignature{
+		Signer:    signer.signer,
+		KeyType:   signer.keyType,
+		Signed:    string(signed),
+		Signature: hex.EncodeToString(sig),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(outDirName, "."+outputSignatureName+".tmp")
+	if err := ioutil.WriteFile(tmp, append(out, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(outDirName, outputSignatureName))
+}
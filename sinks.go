@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+)
+
+// Receives the results of a rollup as they are produced: sinks append them to some
+// external store, and only make them visible (where supported) on Commit
+type rollupSink interface {
+	addDeals(dl []*individualDeal) error
+	addRecoveredDeals(rl []recoveredDeal) error
+	addTotals(totals *competitionTotal) error
+	addProjectStats(projStats map[string]*projectAggregateStats, clients *clientSpill) error
+	Commit() error
+	Close() error
+}
+
+// The tables every sink writes. Just like the CSV and parquet outputs, columns are
+// derived from the json tags of the output structs.
+type sinkTable struct {
+	name    string
+	keyCols []string // columns in front of the struct-derived ones, making up the primary key together with pkCols
+	pkCols  []string // struct-derived columns that are part of the primary key
+	rowType reflect.Type
+}
+
+var (
+	sinkCompetitionTotals = sinkTable{"competition_totals", []string{"epoch"}, nil, reflect.TypeOf(competitionTotal{})}
+	sinkProjectStats      = sinkTable{"project_stats", []string{"epoch"}, []string{"project_id"}, reflect.TypeOf(projectAggregateStats{})}
+	sinkClientStats       = sinkTable{"client_stats", []string{"epoch", "project_id"}, []string{"client"}, reflect.TypeOf(clientAggregateStats{})}
+	sinkDeals             = sinkTable{"deals", []string{"epoch"}, []string{"deal_id"}, reflect.TypeOf(individualDeal{})}
+	sinkRecoveredDeals    = sinkTable{"recovered_deals", []string{"epoch"}, []string{"deal_id"}, reflect.TypeOf(recoveredDeal{})}
+
+	sinkTables = []sinkTable{sinkCompetitionTotals, sinkProjectStats, sinkClientStats, sinkDeals, sinkRecoveredDeals}
+)
+
+func (t *sinkTable) columns() []string {
+	return append(append([]string{}, t.keyCols...), csvColumns(t.rowType)...)
+}
+
+// Key columns are strings, except for the epoch
+func (t *sinkTable) columnKinds() map[string]reflect.Kind {
+	ret := make(map[string]reflect.Kind, len(t.keyCols)+t.rowType.NumField())
+	for _, k := range t.keyCols {
+		ret[k] = reflect.String
+	}
+	ret["epoch"] = reflect.Int64
+	for i := 0; i < t.rowType.NumField(); i++ {
+		f := t.rowType.Field(i)
+		if name, ok := csvFieldName(f); ok {
+			ret[name] = f.Type.Kind()
+		}
+	}
+	return ret
+}
+
+// The column values of a single row, key columns first
+func (t *sinkTable) row(keyVals []interface{}, row interface{}) ([]string, []interface{}) {
+	rv := reflect.ValueOf(row)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+
+	vals := append([]interface{}{}, keyVals...)
+	for i := 0; i < rv.NumField(); i++ {
+		if _, ok := csvFieldName(rv.Type().Field(i)); ok {
+			vals = append(vals, rv.Field(i).Interface())
+		}
+	}
+	return t.columns(), vals
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+// Bumped whenever the snapshot layout changes incompatibly
+const dealsSnapshotVersion = 1
+
+// contents of a deals snapshot, as written by export-deals
+type dealsSnapshot struct {
+	Epoch     int64     `json:"epoch"`
+	TipSetKey []cid.Cid `json:"tipset_key"`
+	Endpoint  string    `json:"endpoint"`
+	Version   int       `json:"snapshot_version"`
+	// of the tipset, which the snapshot does not otherwise carry
+	MinTimestamp uint64 `json:"min_timestamp"`
+	// the lookback the tipset was picked with, when no --tipset was given
+	Lookback int64                `json:"lookback,omitempty"`
+	Payload  dealsSnapshotPayload `json:"payload"`
+}
+type dealsSnapshotPayload struct {
+	Deals map[string]storedMarketDeal `json:"deals"`
+	// account key addresses of the deal clients by their ID address, for those with one
+	AccountKeys map[string]string `json:"account_keys"`
+}
+
+var exportDeals = &cli.Command{
+	Usage:     "Export the market deals at a tipset for rollup --deals-snapshot",
+	Name:      "export-deals",
+	ArgsUsage: "  <file.json|file.json.zst>",
+	Description: `Writes the market deals at the tipset, along with the account key addresses of
+their clients, to a snapshot file that 'rollup --deals-snapshot' runs from without
+a node. Names ending in .zst are zstd compressed.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "tipset",
+			Usage:       "Tipset to export the deals at, as comma separated array of cids or @height. Heights must be final and not fall on a null round",
+			DefaultText: fmt.Sprintf("%d epochs behind current", defaultEpochLookback),
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return xerrors.New("expected a single snapshot file to write")
+		}
+		ctx := cctx.Context
+
+		node, closer, err := getFullNodeAPI(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		ts, lookback, err := resolveRollupTipSet(ctx, node, cctx.String("tipset"))
+		if err != nil {
+			return err
+		}
+
+		deals, err := node.StateMarketDeals(ctx, ts.Key())
+		if err != nil {
+			return xerrors.Errorf("fetching market deals: %w", err)
+		}
+		labels := &chainLabels{ctx: ctx, node: node, tsk: ts.Key()}
+		stored := make(map[string]storedMarketDeal, len(deals))
+		for dealID, d := range deals {
+			if d.Proposal.Label, err = labels.label(dealID, d); err != nil {
+				return xerrors.Errorf("reading the label of deal %s: %w", dealID, err)
+			}
+			stored[dealID] = newStoredMarketDeal(d)
+		}
+
+		keys := make(map[string]string)
+		for _, d := range deals {
+			client := d.Proposal.Client
+			if _, seen := keys[client.String()]; seen {
+				continue
+			}
+			key, err := node.StateAccountKey(ctx, client, ts.Key())
+			if err != nil {
+				// not an account actor: the rollup can not resolve it from the node either
+				log.Warnf("no account key for client %s: %s", client, err)
+				keys[client.String()] = ""
+				continue
+			}
+			keys[client.String()] = key.String()
+		}
+		for id, key := range keys {
+			if key == "" {
+				delete(keys, id)
+			}
+		}
+
+		path := cctx.Args().First()
+		if err := writeDealsSnapshot(path, &dealsSnapshot{
+			Epoch:        int64(ts.Height()),
+			TipSetKey:    ts.Cids(),
+			Endpoint:     "MARKET_DEALS_SNAPSHOT",
+			Version:      dealsSnapshotVersion,
+			MinTimestamp: ts.MinTimestamp(),
+			Lookback:     int64(lookback),
+			Payload: dealsSnapshotPayload{
+				Deals:       stored,
+				AccountKeys: keys,
+			},
+		}); err != nil {
+			return xerrors.Errorf("writing deals snapshot '%s': %w", path, err)
+		}
+
+		log.Infof("exported %d deals and %d client addresses at epoch %d to %s", len(deals), len(keys), ts.Height(), path)
+		return nil
+	},
+}
+
+// Written under a temporary name and renamed into place, so that an interrupted
+// export never leaves a truncated snapshot behind
+func writeDealsSnapshot(path string, snap *dealsSnapshot) error {
+	fh, err := os.Create(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name()) //nolint:errcheck
+	defer fh.Close()           //nolint:errcheck
+
+	buf := bufio.NewWriterSize(fh, 1<<20)
+	var w io.Writer = buf
+	var zw *zstd.Encoder
+	if strings.HasSuffix(path, ".zst") {
+		if zw, err = zstd.NewWriter(buf); err != nil {
+			return err
+		}
+		w = zw
+	}
+
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), path)
+}
+
+// Stands in for the node during a rollup run offline from a deals snapshot. It only
+// knows the tipset the snapshot was taken at.
+type snapshotSource struct {
+	ts       *keyedTipSet
+	lookback abi.ChainEpoch
+	deals    map[string]*api.MarketDeal
+	keys     map[address.Address]address.Address // by ID address
+	ids      map[address.Address]address.Address // by account key address
+}
+
+func openDealsSnapshot(path string) (*snapshotSource, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	var r io.Reader = bufio.NewReaderSize(fh, 1<<20)
+	if strings.HasSuffix(path, ".zst") {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	var snap dealsSnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, xerrors.Errorf("parsing deals snapshot '%s': %w", path, err)
+	}
+	if snap.Endpoint != "MARKET_DEALS_SNAPSHOT" {
+		return nil, xerrors.Errorf("'%s' is not a deals snapshot", path)
+	}
+	if snap.Version != dealsSnapshotVersion {
+		return nil, xerrors.Errorf("deals snapshot '%s' has version %d, only version %d is supported: export it again", path, snap.Version, dealsSnapshotVersion)
+	}
+	if len(snap.TipSetKey) == 0 {
+		return nil, xerrors.Errorf("deals snapshot '%s' names no tipset", path)
+	}
+
+	ss := &snapshotSource{
+		ts: &keyedTipSet{
+			height:       abi.ChainEpoch(snap.Epoch),
+			cids:         snap.TipSetKey,
+			minTimestamp: snap.MinTimestamp,
+		},
+		lookback: abi.ChainEpoch(snap.Lookback),
+		deals:    make(map[string]*api.MarketDeal, len(snap.Payload.Deals)),
+		keys:     make(map[address.Address]address.Address, len(snap.Payload.AccountKeys)),
+		ids:      make(map[address.Address]address.Address, len(snap.Payload.AccountKeys)),
+	}
+	for dealID, sd := range snap.Payload.Deals {
+		md, err := sd.marketDeal()
+		if err != nil {
+			return nil, xerrors.Errorf("deals snapshot '%s': invalid label of deal %s: %w", path, dealID, err)
+		}
+		ss.deals[dealID] = &md
+	}
+	for id, key := range snap.Payload.AccountKeys {
+		idAddr, err := address.NewFromString(id)
+		if err != nil {
+			return nil, xerrors.Errorf("deals snapshot '%s': invalid client address '%s': %w", path, id, err)
+		}
+		keyAddr, err := address.NewFromString(key)
+		if err != nil {
+			return nil, xerrors.Errorf("deals snapshot '%s': invalid account key '%s' of %s: %w", path, key, id, err)
+		}
+		ss.keys[idAddr] = keyAddr
+		ss.ids[keyAddr] = idAddr
+	}
+
+	return ss, nil
+}
+
+// The snapshot pins the tipset: --tipset may only name the same one again
+func (ss *snapshotSource) resolveTipSet(ref string) (rollupTipSet, abi.ChainEpoch, error) {
+	ref = strings.TrimSpace(ref)
+
+	switch {
+	case ref == "":
+		return ss.ts, ss.lookback, nil
+
+	case strings.HasPrefix(ref, "@"):
+		h, err := strconv.ParseInt(ref[1:], 10, 64)
+		if err != nil || h < 0 {
+			return nil, 0, xerrors.Errorf("invalid tipset height '%s'", ref)
+		}
+		if abi.ChainEpoch(h) != ss.ts.height {
+			return nil, 0, xerrors.Errorf("the deals snapshot was taken at epoch %d, not at @%d", ss.ts.height, h)
+		}
+
+	default:
+		cids, err := parseTipSetKeyArg(ref)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !sameCidSet(cids, ss.ts.cids) {
+			return nil, 0, xerrors.Errorf("the deals snapshot was taken at tipset %s, not at %s", tipSetKeyArg(ss.ts.cids), tipSetKeyArg(cids))
+		}
+	}
+
+	return ss.ts, 0, nil
+}
+
+// The node API answered from the snapshot, for the methods a rollup reads deals and
+// clients through. All others fail, as do calls against any but the snapshot tipset.
+func (ss *snapshotSource) node() api.FullNode {
+	fns := unavailableFullNode("a deals snapshot")
+
+	fns.Internal.StateMarketDeals = func(ctx context.Context, tsk types.TipSetKey) (map[string]*api.MarketDeal, error) {
+		if err := ss.checkTipSet(tsk); err != nil {
+			return nil, err
+		}
+		return ss.deals, nil
+	}
+	fns.Internal.StateMarketStorageDeal = func(ctx context.Context, dealID abi.DealID, tsk types.TipSetKey) (*api.MarketDeal, error) {
+		if err := ss.checkTipSet(tsk); err != nil {
+			return nil, err
+		}
+		md, found := ss.deals[strconv.FormatUint(uint64(dealID), 10)]
+		if !found {
+			return nil, xerrors.Errorf("deal %d not found", dealID)
+		}
+		return md, nil
+	}
+	fns.Internal.StateLookupID = func(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+		if err := ss.checkTipSet(tsk); err != nil {
+			return address.Undef, err
+		}
+		if addr.Protocol() == address.ID {
+			return addr, nil
+		}
+		if id, found := ss.ids[addr]; found {
+			return id, nil
+		}
+		return address.Undef, xerrors.Errorf("address %s is not the client of any deal in the snapshot", addr)
+	}
+	fns.Internal.StateAccountKey = func(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+		if err := ss.checkTipSet(tsk); err != nil {
+			return address.Undef, err
+		}
+		if addr.Protocol() == address.BLS || addr.Protocol() == address.SECP256K1 || addr.Protocol() == address.Delegated {
+			return addr, nil
+		}
+		if key, found := ss.keys[addr]; found {
+			return key, nil
+		}
+		return address.Undef, xerrors.Errorf("no account key recorded for %s in the snapshot", addr)
+	}
+	return fns
+}
+
+func (ss *snapshotSource) checkTipSet(tsk types.TipSetKey) error {
+	if tsk != ss.ts.Key() {
+		return xerrors.Errorf("a deals snapshot only holds the state at tipset %s, not at %s", ss.ts.Key(), tsk)
+	}
+	return nil
+}
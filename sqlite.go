@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+	"golang.org/x/xerrors"
+)
+
+// Appends the results of a rollup to a SQLite database, one row set per rollup epoch.
+// Columns added in newer versions are added to existing tables as well.
+//
+// A rerun at the same epoch replaces the rows previously written for that epoch.
+type sqliteSink struct {
+	db    *sql.DB
+	tx    *sql.Tx
+	epoch int64
+}
+
+func openSQLiteSink(path string, ts rollupTipSet) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, xerrors.Errorf("opening sqlite database '%s': %w", path, err)
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS rollups ( epoch INTEGER PRIMARY KEY, tipset_key TEXT NOT NULL )`); err != nil {
+		db.Close() //nolint:errcheck
+		return nil, err
+	}
+	for _, t := range sinkTables {
+		if err := t.ensureSQLite(db); err != nil {
+			db.Close() //nolint:errcheck
+			return nil, xerrors.Errorf("preparing table %s: %w", t.name, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	s := &sqliteSink{db: db, tx: tx, epoch: int64(ts.Height())}
+
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO rollups ( epoch, tipset_key ) VALUES ( ?, ? )`, s.epoch, ts.Key().String()); err != nil {
+		s.Close() //nolint:errcheck
+		return nil, err
+	}
+	for _, t := range sinkTables {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE epoch = ?`, t.name), s.epoch); err != nil {
+			s.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (t *sinkTable) ensureSQLite(db *sql.DB) error {
+	cols := t.columns()
+	colTypes := make(map[string]string, len(cols))
+	for name, kind := range t.columnKinds() {
+		switch kind {
+		case reflect.String:
+			colTypes[name] = "TEXT"
+		case reflect.Float32, reflect.Float64:
+			colTypes[name] = "REAL"
+		default:
+			colTypes[name] = "INTEGER"
+		}
+	}
+
+	defs := make([]string, 0, len(cols)+1)
+	for _, c := range cols {
+		defs = append(defs, c+" "+colTypes[c])
+	}
+	defs = append(defs, "PRIMARY KEY ( "+strings.Join(append(append([]string{}, t.keyCols...), t.pkCols...), ", ")+" )")
+
+	if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s ( %s )`, t.name, strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+
+	// add columns introduced since the table was created
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info( %s )`, t.name))
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close() //nolint:errcheck
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, c := range cols {
+		if !existing[c] {
+			if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, t.name, c, colTypes[c])); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *sqliteSink) insert(t sinkTable, keyVals []interface{}, row interface{}) error {
+	cols, vals := t.row(keyVals, row)
+	_, err := s.tx.Exec(
+		fmt.Sprintf(`INSERT INTO %s ( %s ) VALUES ( %s )`, t.name, strings.Join(cols, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")),
+		vals...,
+	)
+	return err
+}
+
+func (s *sqliteSink) addDeals(dl []*individualDeal) error {
+	for _, d := range dl {
+		if err := s.insert(sinkDeals, []interface{}{s.epoch}, d); err != nil {
+			return xerrors.Errorf("inserting deal %s: %w", d.DealID, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSink) addRecoveredDeals(rl []recoveredDeal) error {
+	for _, d := range rl {
+		if err := s.insert(sinkRecoveredDeals, []interface{}{s.epoch}, d); err != nil {
+			return xerrors.Errorf("inserting recovered deal %s: %w", d.DealID, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSink) addTotals(totals *competitionTotal) error {
+	return s.insert(sinkCompetitionTotals, []interface{}{s.epoch}, totals)
+}
+
+func (s *sqliteSink) addProjectStats(projStats map[string]*projectAggregateStats, clients *clientSpill) error {
+	for projID, ps := range projStats {
+		if err := s.insert(sinkProjectStats, []interface{}{s.epoch}, ps); err != nil {
+			return xerrors.Errorf("inserting stats of project %s: %w", projID, err)
+		}
+		if err := clients.ForEachClient(ps, func(cs *clientAggregateStats) error {
+			if err := s.insert(sinkClientStats, []interface{}{s.epoch, projID}, cs); err != nil {
+				return xerrors.Errorf("inserting stats of client %s: %w", cs.Client, err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSink) Commit() error {
+	if err := s.tx.Commit(); err != nil {
+		return err
+	}
+	s.tx = nil
+	return s.db.Close()
+}
+
+// Discards everything not yet committed
+func (s *sqliteSink) Close() error {
+	if s.tx != nil {
+		s.tx.Rollback() //nolint:errcheck
+		s.tx = nil
+	}
+	return s.db.Close()
+}
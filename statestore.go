@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/xerrors"
+)
+
+// Persistent store carrying all-time counters across runs, so that deals which have
+// since expired or otherwise vanished from chain state keep counting towards them.
+//
+// Buckets:
+//
+//	deals:               dealID   => storedDeal (every project deal ever observed)
+//	project_bytes:       projID   => uint64 lifetime bytes
+//	provider_first_seen: provider => uint64 earliest sector start epoch
+//	account_keys:        client ID address => resolved key address
+//	market_deals:        dealID   => storedMarketDeal (the whole market state, for --incremental)
+//	market_meta:         "tipset" => key of the tipset market_deals is taken at
+type stateStore struct {
+	db *bolt.DB
+}
+
+var (
+	bucketDeals             = []byte("deals")
+	bucketProjectBytes      = []byte("project_bytes")
+	bucketProviderFirstSeen = []byte("provider_first_seen")
+	bucketAccountKeys       = []byte("account_keys")
+	bucketMarketDeals       = []byte("market_deals")
+	bucketMarketMeta        = []byte("market_meta")
+
+	marketMetaTipSet = []byte("tipset")
+)
+
+type storedDeal struct {
+	ProjectID   string  `json:"p"`
+	PieceCID    cid.Cid `json:"c"`
+	Provider    string  `json:"m,omitempty"` // missing from deals recorded by older versions
+	SectorStart int64   `json:"s,omitempty"` // likewise
+}
+
+// A project deal seen during the current run, regardless of phase qualification
+type observedDeal struct {
+	DealID      string
+	ProjectID   string
+	PieceCID    cid.Cid
+	Size        int64
+	Provider    address.Address
+	SectorStart abi.ChainEpoch
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, xerrors.Errorf("opening state store '%s': %w", path, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketDeals, bucketProjectBytes, bucketProviderFirstSeen, bucketAccountKeys, bucketMarketDeals, bucketMarketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) Close() error { return s.db.Close() }
+
+// Counts, per project and piece CID, or piece CID and provider with the cap per
+// provider, the previously observed deals which are no longer part of the current
+// market state. These seed the all-time piece CID counters. Deals activated after
+// height, as seen by runs at later tipsets than a backfill, do not exist yet at it and
+// are left out; those recorded by older versions without their sector start count.
+func (s *stateStore) vanishedPieceCounts(current map[string]struct{}, height abi.ChainEpoch) (map[string]map[pieceCapKey]int, error) {
+	ret := make(map[string]map[pieceCapKey]int)
+
+	return ret, s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDeals).ForEach(func(k, v []byte) error {
+			if _, stillPresent := current[string(k)]; stillPresent {
+				return nil
+			}
+
+			var sd storedDeal
+			if err := json.Unmarshal(v, &sd); err != nil {
+				return xerrors.Errorf("corrupt state store entry for deal %s: %w", k, err)
+			}
+			if abi.ChainEpoch(sd.SectorStart) > height {
+				return nil
+			}
+			// with the cap per provider, deals recorded without theirs count towards none
+			provider := address.Undef
+			if sd.Provider != "" {
+				var err error
+				if provider, err = address.NewFromString(sd.Provider); err != nil {
+					return xerrors.Errorf("corrupt state store entry for deal %s: %w", k, err)
+				}
+			}
+			if ret[sd.ProjectID] == nil {
+				ret[sd.ProjectID] = make(map[pieceCapKey]int)
+			}
+			ret[sd.ProjectID][newPieceCapKey(sd.PieceCID, provider)]++
+			return nil
+		})
+	})
+}
+
+// Folds the deals observed in this run into the all-time counters. Recording the same
+// deal repeatedly is a no-op, making re-runs and out-of-order backfills safe.
+func (s *stateStore) record(observed []observedDeal) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		dealsB := tx.Bucket(bucketDeals)
+		bytesB := tx.Bucket(bucketProjectBytes)
+		providersB := tx.Bucket(bucketProviderFirstSeen)
+
+		for _, od := range observed {
+			if dealsB.Get([]byte(od.DealID)) != nil {
+				continue
+			}
+
+			sd, err := json.Marshal(storedDeal{ProjectID: od.ProjectID, PieceCID: od.PieceCID, Provider: od.Provider.String(), SectorStart: int64(od.SectorStart)})
+			if err != nil {
+				return err
+			}
+			if err := dealsB.Put([]byte(od.DealID), sd); err != nil {
+				return err
+			}
+
+			if err := bytesB.Put([]byte(od.ProjectID), encodeUint64(decodeUint64(bytesB.Get([]byte(od.ProjectID)))+uint64(od.Size))); err != nil {
+				return err
+			}
+
+			if prev := providersB.Get([]byte(od.Provider.String())); prev == nil || decodeUint64(prev) > uint64(od.SectorStart) {
+				if err := providersB.Put([]byte(od.Provider.String()), encodeUint64(uint64(od.SectorStart))); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// The earliest sector start of a project deal with each provider, over the recorded
+// deals and those observed in this run
+func (s *stateStore) providerFirstSeen(observed []observedDeal) (map[address.Address]abi.ChainEpoch, error) {
+	ret := make(map[address.Address]abi.ChainEpoch)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketProviderFirstSeen).ForEach(func(k, v []byte) error {
+			provider, err := address.NewFromString(string(k))
+			if err != nil {
+				return xerrors.Errorf("corrupt state store entry for provider %s: %w", k, err)
+			}
+			ret[provider] = abi.ChainEpoch(decodeUint64(v))
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, od := range observed {
+		if first, seen := ret[od.Provider]; !seen || od.SectorStart < first {
+			ret[od.Provider] = od.SectorStart
+		}
+	}
+	return ret, nil
+}
+
+func (s *stateStore) projectLifetimeBytes() (map[string]int64, error) {
+	ret := make(map[string]int64)
+	return ret, s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketProjectBytes).ForEach(func(k, v []byte) error {
+			ret[string(k)] = int64(decodeUint64(v))
+			return nil
+		})
+	})
+}
+
+// Returns address.Undef when the ID address was never resolved before
+func (s *stateStore) accountKey(id address.Address) (address.Address, error) {
+	ret := address.Undef
+	return ret, s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketAccountKeys).Get(id.Bytes())
+		if v == nil {
+			return nil
+		}
+		var err error
+		ret, err = address.NewFromBytes(v)
+		return err
+	})
+}
+
+func (s *stateStore) putAccountKeys(keys map[address.Address]address.Address) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAccountKeys)
+		for id, key := range keys {
+			if err := b.Put(id.Bytes(), key.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The tipset the stored market deals were taken at, nil when none are stored yet
+func (s *stateStore) marketDealsTipSet() (*types.TipSetKey, error) {
+	var ret *types.TipSetKey
+	return ret, s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketMarketMeta).Get(marketMetaTipSet)
+		if v == nil {
+			return nil
+		}
+		tsk, err := types.TipSetKeyFromBytes(v)
+		if err != nil {
+			return xerrors.Errorf("corrupt state store market tipset: %w", err)
+		}
+		ret = &tsk
+		return nil
+	})
+}
+
+func (s *stateStore) marketDeals() (map[string]*api.MarketDeal, error) {
+	var ret map[string]*api.MarketDeal
+	return ret, s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMarketDeals)
+		ret = make(map[string]*api.MarketDeal, b.Stats().KeyN)
+		return b.ForEach(func(k, v []byte) error {
+			var sd storedMarketDeal
+			if err := json.Unmarshal(v, &sd); err != nil {
+				return xerrors.Errorf("corrupt state store market deal %s: %w", k, err)
+			}
+			md, err := sd.marketDeal()
+			if err != nil {
+				return xerrors.Errorf("corrupt state store market deal %s: %w", k, err)
+			}
+			ret[string(k)] = &md
+			return nil
+		})
+	})
+}
+
+// Records the market deals at tsk. With replace all previously stored deals are
+// dropped first, otherwise only the given deals are updated and the removed ones
+// deleted.
+func (s *stateStore) putMarketDeals(tsk types.TipSetKey, deals map[string]*api.MarketDeal, removed []string, replace bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if replace {
+			if err := tx.DeleteBucket(bucketMarketDeals); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(bucketMarketDeals); err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket(bucketMarketDeals)
+		for _, dealID := range removed {
+			if err := b.Delete([]byte(dealID)); err != nil {
+				return err
+			}
+		}
+		for dealID, md := range deals {
+			v, err := json.Marshal(newStoredMarketDeal(md))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(dealID), v); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketMarketMeta).Put(marketMetaTipSet, tsk.Bytes())
+	})
+}
+
+func encodeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func decodeUint64(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The JSON outputs making up the --stdout stream, in order. Each of them is a single
+// line holding an envelope with an `endpoint` discriminator, so concatenating them
+// yields NDJSON.
+var stdoutStreamFiles = []string{
+	"parameters.json",
+	"basic_stats.json",
+	"client_stats.json",
+	"recovery_deallist.json",
+	"removed_deals.json",
+	"provider_faults.json",
+	"datacap_stats.json",
+	"burst_report.json",
+	"miner_stats.json",
+	"provider_stats.json",
+	"geo_distribution.json",
+	"terminated_deals.json",
+	"dataset_stats.json",
+	"cid_index.json",
+	"timeseries_stats.json",
+	"expiring_deals.json",
+	"phase_stats.json",
+	"deals_by_miner_*.json",
+}
+
+// The deal lists, matched by dealListGlob, come last
+func streamOutputs(outDirName, dealListGlob string, w io.Writer) error {
+	bw := bufio.NewWriterSize(w, 1<<20)
+
+	for _, pattern := range append(stdoutStreamFiles, dealListGlob) {
+		names, err := filepath.Glob(filepath.Join(outDirName, pattern))
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fh, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(bw, fh)
+			fh.Close() //nolint:errcheck
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/go-address"
+	"golang.org/x/xerrors"
+)
+
+// How many projects / providers the summary ranks
+const summaryTopN = 20
+
+// A human readable digest of a rollup for program managers: grand totals, the largest
+// projects and providers, and how all of these moved since a previous rollup. It is
+// rendered both as markdown and, optionally, as a standalone HTML page.
+type rollupSummary struct {
+	Title    string
+	Subtitle string
+	Tables   []summaryTable
+}
+
+type summaryTable struct {
+	Title  string
+	Header []string
+	Rows   [][]string
+}
+
+// The totals of a previous rollup, for computing deltas
+type previousTotals struct {
+	epoch    int64
+	totals   competitionTotal
+	projects map[string]*projectAggregateStats
+}
+
+func loadPreviousTotals(dir string) (*previousTotals, error) {
+	var basic competitionTotalOutput
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "basic_stats.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &basic); err != nil {
+		return nil, xerrors.Errorf("parsing previous basic_stats.json: %w", err)
+	}
+
+	var clients projectAggregateStatsOutput
+	raw, err = ioutil.ReadFile(filepath.Join(dir, "client_stats.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &clients); err != nil {
+		return nil, xerrors.Errorf("parsing previous client_stats.json: %w", err)
+	}
+
+	return &previousTotals{
+		epoch:    basic.Epoch,
+		totals:   basic.Payload,
+		projects: clients.Payload,
+	}, nil
+}
+
+func newRollupSummary(epoch int64, totals *competitionTotal, projStats map[string]*projectAggregateStats, prev *previousTotals) *rollupSummary {
+	sum := &rollupSummary{
+		Title: fmt.Sprintf("Rollup summary at epoch %d", epoch),
+	}
+	if currentPhaseID != 0 {
+		sum.Title = fmt.Sprintf("Phase %d rollup summary at epoch %d", currentPhaseID, epoch)
+	}
+	if prev != nil {
+		sum.Subtitle = fmt.Sprintf("Changes are relative to the rollup at epoch %d.", prev.epoch)
+	}
+
+	//
+	// grand totals
+	totalsTable := summaryTable{Title: "Totals", Header: []string{"", "Value"}}
+	if prev != nil {
+		totalsTable.Header = append(totalsTable.Header, "Change")
+	}
+	for _, line := range []struct {
+		name      string
+		cur, prev int64
+		bytes     bool
+	}{
+		{"Stored data", totals.TotalBytes, prev.totalsOrZero().TotalBytes, true},
+		{"Deals", int64(totals.TotalDeals), int64(prev.totalsOrZero().TotalDeals), false},
+		{"FIL+ stored data", totals.FilplusTotalBytes, prev.totalsOrZero().FilplusTotalBytes, true},
+		{"FIL+ deals", int64(totals.FilplusTotalDeals), int64(prev.totalsOrZero().FilplusTotalDeals), false},
+		{"Quality-adjusted data", totals.QATotalBytes, prev.totalsOrZero().QATotalBytes, true},
+		{"Unique piece CIDs", int64(totals.UniqueCids), int64(prev.totalsOrZero().UniqueCids), false},
+		{"Projects", int64(totals.UniqueProjects), int64(prev.totalsOrZero().UniqueProjects), false},
+		{"Clients", int64(totals.UniqueClients), int64(prev.totalsOrZero().UniqueClients), false},
+		{"Providers", int64(totals.UniqueProviders), int64(prev.totalsOrZero().UniqueProviders), false},
+	} {
+		row := []string{line.name, summaryQuantity(line.cur, line.bytes)}
+		if prev != nil {
+			row = append(row, summaryDelta(line.cur-line.prev, line.bytes))
+		}
+		totalsTable.Rows = append(totalsTable.Rows, row)
+	}
+	sum.Tables = append(sum.Tables, totalsTable)
+
+	//
+	// top projects
+	projIDs := make([]string, 0, len(projStats))
+	for projID, ps := range projStats {
+		if ps.DataSize > 0 {
+			projIDs = append(projIDs, projID)
+		}
+	}
+	sort.Slice(projIDs, func(i, j int) bool {
+		if projStats[projIDs[i]].DataSize != projStats[projIDs[j]].DataSize {
+			return projStats[projIDs[i]].DataSize > projStats[projIDs[j]].DataSize
+		}
+		return projIDs[i] < projIDs[j]
+	})
+
+	projTable := summaryTable{
+		Title:  fmt.Sprintf("Top %d projects by stored data", summaryTopN),
+		Header: []string{"#", "Project", "Stored data", "Quality-adjusted", "Deals", "Providers"},
+	}
+	if prev != nil {
+		projTable.Header = append(projTable.Header, "Change")
+	}
+	for i, projID := range projIDs {
+		if i == summaryTopN {
+			break
+		}
+		ps := projStats[projID]
+		row := []string{fmt.Sprint(i + 1), projID, summaryQuantity(ps.DataSize, true), summaryQuantity(ps.QADataSize, true), fmt.Sprint(ps.NumDeals), fmt.Sprint(ps.NumProviders)}
+		if prev != nil {
+			if pps, seen := prev.projects[projID]; seen {
+				row = append(row, summaryDelta(ps.DataSize-pps.DataSize, true))
+			} else {
+				row = append(row, "new")
+			}
+		}
+		projTable.Rows = append(projTable.Rows, row)
+	}
+	sum.Tables = append(sum.Tables, projTable)
+
+	//
+	// top providers
+	type providerTotal struct {
+		provider address.Address
+		bytes    int64
+		projects int
+	}
+	byProvider := make(map[address.Address]*providerTotal)
+	for _, ps := range projStats {
+		for p, bytes := range ps.dataPerProvider {
+			pt, seen := byProvider[p]
+			if !seen {
+				pt = &providerTotal{provider: p}
+				byProvider[p] = pt
+			}
+			pt.bytes += bytes
+			pt.projects++
+		}
+	}
+	providers := make([]*providerTotal, 0, len(byProvider))
+	for _, pt := range byProvider {
+		providers = append(providers, pt)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		if providers[i].bytes != providers[j].bytes {
+			return providers[i].bytes > providers[j].bytes
+		}
+		return providers[i].provider.String() < providers[j].provider.String()
+	})
+
+	provTable := summaryTable{
+		Title:  fmt.Sprintf("Top %d providers by stored data", summaryTopN),
+		Header: []string{"#", "Provider", "Stored data", "Projects"},
+	}
+	for i, pt := range providers {
+		if i == summaryTopN {
+			break
+		}
+		provTable.Rows = append(provTable.Rows, []string{fmt.Sprint(i + 1), pt.provider.String(), summaryQuantity(pt.bytes, true), fmt.Sprint(pt.projects)})
+	}
+	sum.Tables = append(sum.Tables, provTable)
+
+	//
+	// projects that dropped out entirely
+	if prev != nil {
+		goneTable := summaryTable{
+			Title:  "Projects no longer present",
+			Header: []string{"Project", "Stored data previously"},
+		}
+		var gone []string
+		for projID, pps := range prev.projects {
+			if ps, still := projStats[projID]; (!still || ps.DataSize == 0) && pps.DataSize > 0 {
+				gone = append(gone, projID)
+			}
+		}
+		sort.Strings(gone)
+		for _, projID := range gone {
+			goneTable.Rows = append(goneTable.Rows, []string{projID, summaryQuantity(prev.projects[projID].DataSize, true)})
+		}
+		if len(goneTable.Rows) > 0 {
+			sum.Tables = append(sum.Tables, goneTable)
+		}
+	}
+
+	return sum
+}
+
+func (prev *previousTotals) totalsOrZero() *competitionTotal {
+	if prev == nil {
+		return &competitionTotal{}
+	}
+	return &prev.totals
+}
+
+func summaryQuantity(v int64, bytes bool) string {
+	if bytes {
+		return humanize.IBytes(uint64(v))
+	}
+	return humanize.Comma(v)
+}
+
+func summaryDelta(d int64, bytes bool) string {
+	switch {
+	case d == 0:
+		return "±0"
+	case d < 0:
+		return "-" + summaryQuantity(-d, bytes)
+	default:
+		return "+" + summaryQuantity(d, bytes)
+	}
+}
+
+func (sum *rollupSummary) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", sum.Title)
+	if sum.Subtitle != "" {
+		fmt.Fprintf(&b, "%s\n\n", sum.Subtitle)
+	}
+
+	escape := strings.NewReplacer("|", `\|`, "\n", " ")
+	for _, t := range sum.Tables {
+		fmt.Fprintf(&b, "## %s\n\n", t.Title)
+		if len(t.Rows) == 0 {
+			b.WriteString("_none_\n\n")
+			continue
+		}
+
+		b.WriteString("|")
+		for _, h := range t.Header {
+			fmt.Fprintf(&b, " %s |", escape.Replace(h))
+		}
+		b.WriteString("\n|")
+		for i := range t.Header {
+			// everything but the leading name column is numeric
+			if i == 0 || (i == 1 && t.Header[0] == "#") {
+				b.WriteString(" --- |")
+			} else {
+				b.WriteString(" ---: |")
+			}
+		}
+		b.WriteString("\n")
+		for _, row := range t.Rows {
+			b.WriteString("|")
+			for _, cell := range row {
+				fmt.Fprintf(&b, " %s |", escape.Replace(cell))
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var summaryHTMLTemplate = template.Must(template.New("summary").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; }
+td { text-align: right; font-variant-numeric: tabular-nums; }
+td:first-child, td:nth-child(2) { text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+{{ if .Subtitle }}<p>{{ .Subtitle }}</p>
+{{ end }}{{ range .Tables }}<h2>{{ .Title }}</h2>
+{{ if .Rows }}<table>
+<tr>{{ range .Header }}<th>{{ . }}</th>{{ end }}</tr>
+{{ range .Rows }}<tr>{{ range . }}<td>{{ . }}</td>{{ end }}</tr>
+{{ end }}</table>
+{{ else }}<p><em>none</em></p>
+{{ end }}{{ end }}</body>
+</html>
+`))
+
+func (sum *rollupSummary) writeHTML(w io.Writer) error {
+	return summaryHTMLTemplate.Execute(w, sum)
+}
+
+func writeSummary(outDirName string, sum *rollupSummary, withHTML bool) error {
+	fh, err := os.Create(filepath.Join(outDirName, "summary.md"))
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+	if err := sum.writeMarkdown(fh); err != nil {
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	if !withHTML {
+		return nil
+	}
+
+	fhHTML, err := os.Create(filepath.Join(outDirName, "summary.html"))
+	if err != nil {
+		return err
+	}
+	defer fhHTML.Close() //nolint:errcheck
+	if err := sum.writeHTML(fhHTML); err != nil {
+		return err
+	}
+	return fhHTML.Close()
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"golang.org/x/xerrors"
+)
+
+// A config-defined deal tag: every qualifying deal for which Expr evaluates to true
+// is counted towards the tag in the stats of its project. Expressions look like:
+//
+//	size >= 32GiB && verified
+//	duration > 500days || provider == "f01234"
+//	!(start_epoch < 1500000)
+//
+// Available identifiers are listed in tagVars, numbers can carry a KiB/MiB/GiB/TiB/PiB
+// size suffix or a `days` suffix (converted to epochs).
+type tagDefinition struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+
+	compiled tagExpr
+}
+
+type tagStats struct {
+	NumDeals int   `json:"total_num_deals"`
+	DataSize int64 `json:"total_data_size"`
+}
+
+// What a tag expression evaluates against
+type tagEnv struct {
+	deal   *api.MarketDeal
+	client address.Address
+}
+
+var tagVars = map[string]func(*tagEnv) interface{}{
+	"size":        func(e *tagEnv) interface{} { return int64(e.deal.Proposal.PieceSize) },
+	"verified":    func(e *tagEnv) interface{} { return e.deal.Proposal.VerifiedDeal },
+	"duration":    func(e *tagEnv) interface{} { return int64(e.deal.Proposal.EndEpoch - e.deal.Proposal.StartEpoch) },
+	"start_epoch": func(e *tagEnv) interface{} { return int64(e.deal.State.SectorStartEpoch) },
+	"end_epoch":   func(e *tagEnv) interface{} { return int64(e.deal.Proposal.EndEpoch) },
+	"provider":    func(e *tagEnv) interface{} { return e.deal.Proposal.Provider.String() },
+	"client":      func(e *tagEnv) interface{} { return e.client.String() },
+	"piece_cid":   func(e *tagEnv) interface{} { return e.deal.Proposal.PieceCID.String() },
+	"label":       func(e *tagEnv) interface{} { return labelText(e.deal.Proposal.Label) },
+}
+
+var tagNumSuffixes = map[string]int64{
+	"KiB":  1 << 10,
+	"MiB":  1 << 20,
+	"GiB":  1 << 30,
+	"TiB":  1 << 40,
+	"PiB":  1 << 50,
+	"days": int64(builtin.EpochsInDay),
+}
+
+func compileTags(defs []*tagDefinition) error {
+	seen := make(map[string]bool, len(defs))
+	for _, td := range defs {
+		if td.Name == "" {
+			return xerrors.Errorf("tag with expression '%s' has no name", td.Expr)
+		}
+		if seen[td.Name] {
+			return xerrors.Errorf("tag '%s' defined more than once", td.Name)
+		}
+		seen[td.Name] = true
+
+		var err error
+		if td.compiled, err = parseTagExpr(td.Expr); err != nil {
+			return xerrors.Errorf("invalid expression for tag '%s': %w", td.Name, err)
+		}
+	}
+	return nil
+}
+
+func (td *tagDefinition) matches(env *tagEnv) (bool, error) {
+	v, err := td.compiled.eval(env)
+	if err != nil {
+		return false, xerrors.Errorf("evaluating tag '%s': %w", td.Name, err)
+	}
+	b, isBool := v.(bool)
+	if !isBool {
+		return false, xerrors.Errorf("tag '%s' evaluated to %T instead of a boolean", td.Name, v)
+	}
+	return b, nil
+}
+
+// AST
+type tagExpr interface {
+	eval(*tagEnv) (interface{}, error)
+}
+
+type tagLiteral struct{ val interface{} }
+type tagVar struct{ name string }
+type tagNot struct{ operand tagExpr }
+type tagBinary struct {
+	op          string
+	left, right tagExpr
+}
+
+func (l *tagLiteral) eval(*tagEnv) (interface{}, error) { return l.val, nil }
+func (v *tagVar) eval(e *tagEnv) (interface{}, error)   { return tagVars[v.name](e), nil }
+
+func (n *tagNot) eval(e *tagEnv) (interface{}, error) {
+	v, err := n.operand.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	b, isBool := v.(bool)
+	if !isBool {
+		return nil, xerrors.Errorf("operator ! applied to non-boolean %v", v)
+	}
+	return !b, nil
+}
+
+func (b *tagBinary) eval(e *tagEnv) (interface{}, error) {
+	l, err := b.left.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	// short-circuit
+	if b.op == "&&" || b.op == "||" {
+		lb, isBool := l.(bool)
+		if !isBool {
+			return nil, xerrors.Errorf("operator %s applied to non-boolean %v", b.op, l)
+		}
+		if (b.op == "&&" && !lb) || (b.op == "||" && lb) {
+			return lb, nil
+		}
+		r, err := b.right.eval(e)
+		if err != nil {
+			return nil, err
+		}
+		rb, isBool := r.(bool)
+		if !isBool {
+			return nil, xerrors.Errorf("operator %s applied to non-boolean %v", b.op, r)
+		}
+		return rb, nil
+	}
+
+	r, err := b.right.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b.op {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	}
+
+	ln, lok := l.(int64)
+	rn, rok := r.(int64)
+	if !lok || !rok {
+		return nil, xerrors.Errorf("operator %s requires numbers, got %v and %v", b.op, l, r)
+	}
+	switch b.op {
+	case "<":
+		return ln < rn, nil
+	case "<=":
+		return ln <= rn, nil
+	case ">":
+		return ln > rn, nil
+	case ">=":
+		return ln >= rn, nil
+	}
+
+	return nil, xerrors.Errorf("unknown operator %s", b.op)
+}
+
+// Parser: plain recursive descent, precedence from loosest to tightest is
+// ||, &&, comparisons, unary !
+type tagParser struct {
+	toks []string
+	pos  int
+}
+
+func parseTagExpr(src string) (tagExpr, error) {
+	toks, err := tokenizeTagExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, xerrors.New("empty expression")
+	}
+
+	p := &tagParser{toks: toks}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, xerrors.Errorf("unexpected '%s'", p.toks[p.pos])
+	}
+	return e, nil
+}
+
+func (p *tagParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *tagParser) parseOr() (tagExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagBinary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *tagParser) parseAnd() (tagExpr, error) {
+	left, err := p.parseCmp()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseCmp()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagBinary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *tagParser) parseCmp() (tagExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &tagBinary{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *tagParser) parseUnary() (tagExpr, error) {
+	tok := p.peek()
+	p.pos++
+
+	switch {
+	case tok == "":
+		return nil, xerrors.New("unexpected end of expression")
+
+	case tok == "!":
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &tagNot{operand: operand}, nil
+
+	case tok == "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, xerrors.New("missing closing parenthesis")
+		}
+		p.pos++
+		return e, nil
+
+	case tok == "true" || tok == "false":
+		return &tagLiteral{val: tok == "true"}, nil
+
+	case tok[0] == '"':
+		s, err := strconv.Unquote(tok)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid string literal %s: %w", tok, err)
+		}
+		return &tagLiteral{val: s}, nil
+
+	case tok[0] >= '0' && tok[0] <= '9':
+		digits := strings.TrimRightFunc(tok, unicode.IsLetter)
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid number '%s': %w", tok, err)
+		}
+		if suffix := tok[len(digits):]; suffix != "" {
+			mult, known := tagNumSuffixes[suffix]
+			if !known {
+				return nil, xerrors.Errorf("unknown unit '%s' in '%s'", suffix, tok)
+			}
+			n *= mult
+		}
+		return &tagLiteral{val: n}, nil
+
+	default:
+		if _, known := tagVars[tok]; !known {
+			return nil, xerrors.Errorf("unknown identifier '%s'", tok)
+		}
+		return &tagVar{name: tok}, nil
+	}
+}
+
+func tokenizeTagExpr(src string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(' || c == ')':
+			toks = append(toks, string(c))
+			i++
+
+		case strings.HasPrefix(src[i:], "&&") || strings.HasPrefix(src[i:], "||") ||
+			strings.HasPrefix(src[i:], "==") || strings.HasPrefix(src[i:], "!=") ||
+			strings.HasPrefix(src[i:], "<=") || strings.HasPrefix(src[i:], ">="):
+			toks = append(toks, src[i:i+2])
+			i += 2
+
+		case c == '<' || c == '>' || c == '!':
+			toks = append(toks, string(c))
+			i++
+
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, xerrors.Errorf("unterminated string starting at offset %d", i)
+			}
+			toks = append(toks, src[i:j+1])
+			i = j + 1
+
+		case c == '_' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+
+		default:
+			return nil, xerrors.Errorf("unexpected character '%c' at offset %d", c, i)
+		}
+	}
+	return toks, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-cid"
+)
+
+type terminatedDealsOutput struct {
+	Epoch         int64                 `json:"epoch"`
+	TipSetKey     []cid.Cid             `json:"tipset_key"`
+	Endpoint      string                `json:"endpoint"`
+	Phase         int                   `json:"phase,omitempty"`
+	SchemaVersion string                `json:"schema_version"`
+	Payload       terminatedDealsReport `json:"payload"`
+}
+
+type terminatedDealsReport struct {
+	Deals     []*terminatedDeal       `json:"deals"`     // by deal id
+	Providers []*providerTerminations `json:"providers"` // most data lost first
+}
+
+// A deal of a registered project whose sector got terminated: it is still in market
+// state at the rollup tipset, but no longer counts and soon disappears altogether
+type terminatedDeal struct {
+	DealID           string `json:"deal_id"`
+	ProjectID        string `json:"project_id"`
+	Client           string `json:"client"` // ID address
+	ProviderID       string `json:"provider_id"`
+	PieceCID         string `json:"piece_cid"`
+	SectorStartEpoch int64  `json:"sector_start_epoch"`
+	SlashEpoch       int64  `json:"slash_epoch"`
+	DataSizeLost     int64  `json:"data_size_lost"`
+
+	client   address.Address
+	provider address.Address
+}
+
+type providerTerminations struct {
+	ProviderID         string  `json:"provider_id"`
+	NumDeals           int     `json:"num_terminated_deals"`
+	DataSizeLost       int64   `json:"data_size_lost"`
+	QualifyingDataSize int64   `json:"qualifying_data_size"` // still stored, as in provider_stats.json
+	TerminationRate    float64 `json:"termination_rate"`     // data lost out of that and the qualifying data, between 0 and 1
+}
+
+// Holds on to the terminated deals in market state until their clients can be told
+// apart: there are few of them, as they only linger until the next cron tick
+type terminationCollector []*terminatedDeal
+
+func (tc *terminationCollector) observe(dealID string, d *api.MarketDeal) {
+	// deals slashed before ever starting were never stored to begin with
+	if d.State.SlashEpoch <= -1 || d.State.SectorStartEpoch <= 0 {
+		return
+	}
+	*tc = append(*tc, &terminatedDeal{
+		DealID:           dealID,
+		Client:           d.Proposal.Client.String(),
+		ProviderID:       d.Proposal.Provider.String(),
+		PieceCID:         d.Proposal.PieceCID.String(),
+		SectorStartEpoch: int64(d.State.SectorStartEpoch),
+		SlashEpoch:       int64(d.State.SlashEpoch),
+		DataSizeLost:     int64(d.Proposal.PieceSize),
+		client:           d.Proposal.Client,
+		provider:         d.Proposal.Provider,
+	})
+}
+
+// Keeps the deals of registered projects, and sets the losses of their providers off
+// against the qualifying data they store
+func (tc terminationCollector) report(projByClientID map[address.Address]string, providers providerStatsCollector) terminatedDealsReport {
+	rep := terminatedDealsReport{
+		Deals:     make([]*terminatedDeal, 0),
+		Providers: make([]*providerTerminations, 0),
+	}
+	byProvider := make(map[address.Address]*providerTerminations)
+	for _, td := range tc {
+		projID, known := projByClientID[td.client]
+		if !known {
+			continue
+		}
+		td.ProjectID = projID
+		rep.Deals = append(rep.Deals, td)
+
+		pt, ok := byProvider[td.provider]
+		if !ok {
+			pt = &providerTerminations{ProviderID: td.ProviderID}
+			if ps, stores := providers[td.provider]; stores {
+				pt.QualifyingDataSize = ps.DataSize
+			}
+			byProvider[td.provider] = pt
+			rep.Providers = append(rep.Providers, pt)
+		}
+		pt.NumDeals++
+		pt.DataSizeLost += td.DataSizeLost
+	}
+
+	for _, pt := range rep.Providers {
+		pt.TerminationRate = float64(pt.DataSizeLost) / float64(pt.DataSizeLost+pt.QualifyingDataSize)
+	}
+
+	sort.Slice(rep.Deals, func(i, j int) bool {
+		didi, _ := strconv.ParseInt(rep.Deals[i].DealID, 10, 64)
+		didj, _ := strconv.ParseInt(rep.Deals[j].DealID, 10, 64)
+		return didi < didj
+	})
+	sort.Slice(rep.Providers, func(i, j int) bool {
+		if rep.Providers[i].DataSizeLost != rep.Providers[j].DataSizeLost {
+			return rep.Providers[i].DataSizeLost > rep.Providers[j].DataSizeLost
+		}
+		return rep.Providers[i].ProviderID < rep.Providers[j].ProviderID
+	})
+	return rep
+}
+
+// One row per deal, the provider totals are left to the reader
+func writeTerminatedDealsCSV(path string, epoch int64, rep terminatedDealsReport) error {
+	rows := make([][]string, 0, len(rep.Deals))
+	for _, td := range rep.Deals {
+		rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(td))...))
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(terminatedDeal{}))...), rows)
+}
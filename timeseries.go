@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/ipfs/go-cid"
+)
+
+type timeseriesStatsOutput struct {
+	Epoch         int64         `json:"epoch"`
+	TipSetKey     []cid.Cid     `json:"tipset_key"`
+	Endpoint      string        `json:"endpoint"`
+	Phase         int           `json:"phase,omitempty"`
+	SchemaVersion string        `json:"schema_version"`
+	Payload       []*dailyStats `json:"payload"`
+}
+
+// The qualifying deals activated on one UTC day. Every day from the start of the
+// phase up to the rollup is listed, quiet ones included, so the series charts as is.
+type dailyStats struct {
+	Date          string `json:"date"`
+	DataSize      int64  `json:"data_size"`
+	NumDeals      int    `json:"num_deals"`
+	NewClients    int    `json:"new_clients"`   // clients whose first qualifying deal was activated this day
+	NewProviders  int    `json:"new_providers"` // same for providers
+	TotalDataSize int64  `json:"total_data_size"`
+}
+
+// Buckets qualifying deals by the day of their sector activation. Days are told from
+// the rollup tipset's timestamp, epochs before it being EpochDurationSeconds apart.
+type timeseriesCollector struct {
+	ts         rollupTipSet
+	phaseStart abi.ChainEpoch
+
+	days          map[int64]*dailyStats
+	firstClient   map[address.Address]abi.ChainEpoch
+	firstProvider map[address.Address]abi.ChainEpoch
+}
+
+func newTimeseriesCollector(ts rollupTipSet, phaseStart abi.ChainEpoch) *timeseriesCollector {
+	return &timeseriesCollector{
+		ts:            ts,
+		phaseStart:    phaseStart,
+		days:          make(map[int64]*dailyStats),
+		firstClient:   make(map[address.Address]abi.ChainEpoch),
+		firstProvider: make(map[address.Address]abi.ChainEpoch),
+	}
+}
+
+// Days since the unix epoch
+func (tc *timeseriesCollector) day(epoch abi.ChainEpoch) int64 {
+	secs := int64(tc.ts.MinTimestamp()) - int64(tc.ts.Height()-epoch)*int64(builtin.EpochDurationSeconds)
+	if secs < 0 {
+		return (secs+1)/86400 - 1
+	}
+	return secs / 86400
+}
+
+func (tc *timeseriesCollector) bucket(day int64) *dailyStats {
+	ds, ok := tc.days[day]
+	if !ok {
+		ds = &dailyStats{Date: time.Unix(day*86400, 0).UTC().Format("2006-01-02")}
+		tc.days[day] = ds
+	}
+	return ds
+}
+
+func (tc *timeseriesCollector) observe(client, provider address.Address, sectorStart abi.ChainEpoch, size int64) {
+	ds := tc.bucket(tc.day(sectorStart))
+	ds.DataSize += size
+	ds.NumDeals++
+
+	if first, seen := tc.firstClient[client]; !seen || sectorStart < first {
+		tc.firstClient[client] = sectorStart
+	}
+	if first, seen := tc.firstProvider[provider]; !seen || sectorStart < first {
+		tc.firstProvider[provider] = sectorStart
+	}
+}
+
+// Lists the days in order, from the phase start or the earliest activation when
+// that is before it
+func (tc *timeseriesCollector) list() []*dailyStats {
+	for _, first := range tc.firstClient {
+		tc.bucket(tc.day(first)).NewClients++
+	}
+	for _, first := range tc.firstProvider {
+		tc.bucket(tc.day(first)).NewProviders++
+	}
+
+	from, to := tc.day(tc.phaseStart), tc.day(tc.ts.Height())
+	for day := range tc.days {
+		if day < from {
+			from = day
+		}
+		if day > to {
+			to = day
+		}
+	}
+
+	ret := make([]*dailyStats, 0)
+	var total int64
+	for day := from; day <= to; day++ {
+		ds := tc.bucket(day)
+		total += ds.DataSize
+		ds.TotalDataSize = total
+		ret = append(ret, ds)
+	}
+	return ret
+}
+
+func writeTimeseriesStatsCSV(path string, epoch int64, dl []*dailyStats) error {
+	rows := make([][]string, 0, len(dl))
+	for _, d := range dl {
+		rows = append(rows, append([]string{fmt.Sprint(epoch)}, csvValues(reflect.ValueOf(d))...))
+	}
+	return writeCSV(path, append([]string{"epoch"}, csvColumns(reflect.TypeOf(dailyStats{}))...), rows)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/policy"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// The tipset a rollup is taken at. A *types.TipSet is one, as is a keyedTipSet, which
+// knows its blocks by CID only.
+type rollupTipSet interface {
+	Height() abi.ChainEpoch
+	Cids() []cid.Cid
+	Key() types.TipSetKey
+	MinTimestamp() uint64
+}
+
+// A tipset known by height and block CIDs only, as read from a Lily database or a
+// deals snapshot
+type keyedTipSet struct {
+	height       abi.ChainEpoch
+	cids         []cid.Cid
+	minTimestamp uint64
+}
+
+func (ts *keyedTipSet) Height() abi.ChainEpoch { return ts.height }
+func (ts *keyedTipSet) Cids() []cid.Cid        { return ts.cids }
+func (ts *keyedTipSet) Key() types.TipSetKey   { return types.NewTipSetKey(ts.cids...) }
+func (ts *keyedTipSet) MinTimestamp() uint64   { return ts.minTimestamp }
+
+// Resolves the --tipset argument to the tipset a rollup is taken at, along with the
+// lookback applied when none was given. Only a full tipset key pins a rollup exactly:
+// a height either may not yet be final, or may fall on a null round and silently
+// resolve to an earlier tipset, so such heights are refused rather than guessed at.
+func resolveRollupTipSet(ctx context.Context, api api.FullNode, ref string) (*types.TipSet, abi.ChainEpoch, error) {
+	ref = strings.TrimSpace(ref)
+
+	if ref == "" {
+		head, err := api.ChainHead(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		ts, err := api.ChainGetTipSetByHeight(ctx, head.Height()-defaultEpochLookback, head.Key())
+		if err != nil {
+			return nil, 0, err
+		}
+		log.Infof("rolling up at epoch %d, pass --tipset '%s' to reproduce this run exactly", ts.Height(), tipSetKeyArg(ts.Cids()))
+		return ts, defaultEpochLookback, nil
+	}
+
+	if strings.HasPrefix(ref, "@") {
+		ts, err := resolveTipSetHeight(ctx, api, ref[1:])
+		return ts, 0, err
+	}
+
+	cids, err := parseTipSetKeyArg(ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	ts, err := api.ChainGetTipSet(ctx, types.NewTipSetKey(cids...))
+	if err != nil {
+		return nil, 0, xerrors.Errorf("loading tipset %s: %w", tipSetKeyArg(cids), err)
+	}
+	if ts.Key() != types.NewTipSetKey(cids...) {
+		return nil, 0, xerrors.Errorf("node returned tipset %s when asked for %s", ts.Key(), tipSetKeyArg(cids))
+	}
+	return ts, 0, nil
+}
+
+func resolveTipSetHeight(ctx context.Context, api api.FullNode, height string) (*types.TipSet, error) {
+	head, err := api.ChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if height == "head" {
+		return nil, xerrors.Errorf("refusing to roll up at @head (epoch %d): it is not final, specify a height at least %d epochs back or the full tipset key", head.Height(), policy.ChainFinality)
+	}
+
+	h, err := strconv.ParseInt(height, 10, 64)
+	if err != nil || h < 0 {
+		return nil, xerrors.Errorf("invalid tipset height '@%s'", height)
+	}
+	if head.Height()-abi.ChainEpoch(h) < policy.ChainFinality {
+		return nil, xerrors.Errorf("refusing to roll up at @%d: it is within %d epochs of the current head at %d and may still be reorganized, specify the full tipset key instead", h, policy.ChainFinality, head.Height())
+	}
+
+	ts, err := api.ChainGetTipSetByHeight(ctx, abi.ChainEpoch(h), head.Key())
+	if err != nil {
+		return nil, err
+	}
+	if ts.Height() != abi.ChainEpoch(h) {
+		return nil, xerrors.Errorf("epoch %d is a null round and resolves to the tipset at %d, pass --tipset '%s' to roll up at that tipset", h, ts.Height(), tipSetKeyArg(ts.Cids()))
+	}
+
+	log.Infof("epoch %d resolved to tipset %s", h, tipSetKeyArg(ts.Cids()))
+	return ts, nil
+}
+
+// Accepts either comma separated CIDs, or the tipset_key array exactly as it
+// appears in any of the outputs
+func parseTipSetKeyArg(ref string) ([]cid.Cid, error) {
+	var cids []cid.Cid
+
+	if strings.HasPrefix(ref, "[") {
+		if err := json.Unmarshal([]byte(ref), &cids); err != nil {
+			var strs []string
+			if err := json.Unmarshal([]byte(ref), &strs); err != nil {
+				return nil, xerrors.Errorf("unparseable tipset key '%s': expected a JSON array of CIDs", ref)
+			}
+			ref = strings.Join(strs, ",")
+			cids = nil
+		}
+	}
+
+	if cids == nil {
+		for _, s := range strings.Split(ref, ",") {
+			c, err := cid.Parse(strings.TrimSpace(s))
+			if err != nil {
+				return nil, xerrors.Errorf("invalid CID '%s' in tipset key: %w", s, err)
+			}
+			cids = append(cids, c)
+		}
+	}
+
+	if len(cids) == 0 {
+		return nil, xerrors.New("empty tipset key")
+	}
+	return cids, nil
+}
+
+func tipSetKeyArg(cids []cid.Cid) string {
+	return strings.Join(cidStrings(cids), ",")
+}
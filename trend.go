@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var trend = &cli.Command{
+	Usage:     "Consolidate per-project time series across several rollups",
+	Name:      "trend",
+	ArgsUsage: "  <rollup directory> <rollup directory> [<rollup directory>...]",
+	Description: `Reads the client_stats.json of every given rollup and prints the data size,
+deal count and provider count of each project across them, ordered by epoch.
+
+As JSON, every series holds one entry per rollup, null where the project had no
+qualifying deals. As CSV, there is one row per project and rollup it appears in.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Output format: json or csv",
+			Value: "json",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		dirs := cctx.Args().Slice()
+		if len(dirs) < 2 {
+			return xerrors.New("expected at least two rollup directories")
+		}
+		format := cctx.String("format")
+		if format != "json" && format != "csv" {
+			return xerrors.Errorf("unknown format '%s': expected json or csv", format)
+		}
+
+		points := make([]*trendPoint, 0, len(dirs))
+		for _, dir := range dirs {
+			tp, err := loadTrendPoint(dir)
+			if err != nil {
+				return err
+			}
+			points = append(points, tp)
+		}
+		sort.SliceStable(points, func(i, j int) bool { return points[i].epoch < points[j].epoch })
+		for i := 1; i < len(points); i++ {
+			if points[i].epoch == points[i-1].epoch {
+				return xerrors.Errorf("rollups '%s' and '%s' are both at epoch %d", points[i-1].dir, points[i].dir, points[i].epoch)
+			}
+		}
+
+		if format == "csv" {
+			return writeTrendCSV(points)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newTrendOutput(points))
+	},
+}
+
+// The project totals of a single rollup
+type trendPoint struct {
+	dir      string
+	epoch    int64
+	projects map[string]*trendTotals
+}
+
+type trendTotals struct {
+	DataSize     int64 `json:"total_data_size"`
+	NumDeals     int   `json:"total_num_deals"`
+	NumProviders int   `json:"total_num_providers"`
+}
+
+// contents of the trend command output
+type trendOutput struct {
+	Endpoint      string                   `json:"endpoint"`
+	SchemaVersion string                   `json:"schema_version"`
+	Rollups       []trendRollup            `json:"rollups"`
+	Payload       map[string]*projectTrend `json:"payload"`
+}
+type trendRollup struct {
+	Epoch int64  `json:"epoch"`
+	Dir   string `json:"dir"`
+}
+type projectTrend struct {
+	DataSize     []*int64 `json:"total_data_size"`
+	NumDeals     []*int64 `json:"total_num_deals"`
+	NumProviders []*int64 `json:"total_num_providers"`
+}
+
+func loadTrendPoint(dir string) (*trendPoint, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "client_stats.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Epoch         int64                   `json:"epoch"`
+		SchemaVersion string                  `json:"schema_version"`
+		Payload       map[string]*trendTotals `json:"payload"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, xerrors.Errorf("parsing client_stats.json of '%s': %w", dir, err)
+	}
+	// rollups predating schema versioning carry none, and are laid out the same as 1.0
+	if out.SchemaVersion != "" && !schemaVersionCompatible(out.SchemaVersion, "1.0") {
+		return nil, xerrors.Errorf("client_stats.json of '%s' has incompatible schema version %s", dir, out.SchemaVersion)
+	}
+
+	return &trendPoint{dir: dir, epoch: out.Epoch, projects: out.Payload}, nil
+}
+
+func newTrendOutput(points []*trendPoint) *trendOutput {
+	out := &trendOutput{
+		Endpoint:      "TREND",
+		SchemaVersion: outputSchemaVersion,
+		Rollups:       make([]trendRollup, len(points)),
+		Payload:       make(map[string]*projectTrend),
+	}
+
+	for i, tp := range points {
+		out.Rollups[i] = trendRollup{Epoch: tp.epoch, Dir: tp.dir}
+		for projID, t := range tp.projects {
+			pt, seen := out.Payload[projID]
+			if !seen {
+				pt = &projectTrend{
+					DataSize:     make([]*int64, len(points)),
+					NumDeals:     make([]*int64, len(points)),
+					NumProviders: make([]*int64, len(points)),
+				}
+				out.Payload[projID] = pt
+			}
+			dataSize, numDeals, numProviders := t.DataSize, int64(t.NumDeals), int64(t.NumProviders)
+			pt.DataSize[i], pt.NumDeals[i], pt.NumProviders[i] = &dataSize, &numDeals, &numProviders
+		}
+	}
+
+	return out
+}
+
+func writeTrendCSV(points []*trendPoint) error {
+	w := csv.NewWriter(os.Stdout)
+	if err := w.Write([]string{"epoch", "project_id", "total_data_size", "total_num_deals", "total_num_providers"}); err != nil {
+		return err
+	}
+
+	for _, tp := range points {
+		projIDs := make([]string, 0, len(tp.projects))
+		for p := range tp.projects {
+			projIDs = append(projIDs, p)
+		}
+		sort.Strings(projIDs)
+
+		for _, projID := range projIDs {
+			t := tp.projects[projID]
+			if err := w.Write([]string{
+				strconv.FormatInt(tp.epoch, 10),
+				projID,
+				strconv.FormatInt(t.DataSize, 10),
+				strconv.Itoa(t.NumDeals),
+				strconv.Itoa(t.NumProviders),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const latestPointerName = "latest.json"
+
+// Object storage a completed rollup gets published to
+type rollupUploader interface {
+	// Stores the contents of body under key, replacing any previous object as a whole
+	put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType string) error
+}
+
+// Where latest.json at the upload prefix points to once a rollup is published
+type latestPointer struct {
+	Epoch         int64  `json:"epoch"`
+	Path          string `json:"path"` // relative to the upload prefix
+	Digest        string `json:"digest"`
+	SchemaVersion string `json:"schema_version"`
+}
+
+// Parses an --upload target such as s3://bucket/prefix or gs://bucket/prefix
+func newRollupUploader(target, gcsCredentialsFile string) (rollupUploader, string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, "", xerrors.Errorf("invalid upload target '%s': %w", target, err)
+	}
+	if u.Host == "" {
+		return nil, "", xerrors.Errorf("invalid upload target '%s': no bucket", target)
+	}
+	prefix := strings.Trim(u.Path, "/")
+
+	switch u.Scheme {
+	case "s3":
+		up, err := newS3Uploader(u.Host)
+		return up, prefix, err
+	case "gs":
+		up, err := newGCSUploader(u.Host, gcsCredentialsFile)
+		return up, prefix, err
+	default:
+		return nil, "", xerrors.Errorf("unsupported upload target '%s': expected s3://bucket/prefix or gs://bucket/prefix", target)
+	}
+}
+
+// Uploads every file of a completed rollup to <prefix>/<epoch>/, the run fingerprint
+// last just like locally, and only then replaces <prefix>/latest.json. Consumers
+// following the pointer thus never see a partial upload, even when an earlier attempt
+// died half way.
+func uploadRollup(ctx context.Context, up rollupUploader, prefix, outDirName string, epoch int64, fp *runFingerprint) error {
+	entries, err := ioutil.ReadDir(outDirName)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Mode().IsRegular() && !strings.HasPrefix(e.Name(), ".") && e.Name() != runFingerprintName {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	names = append(names, runFingerprintName)
+
+	rollupPath := strconv.FormatInt(epoch, 10)
+	for _, name := range names {
+		if err := uploadFile(ctx, up, path.Join(prefix, rollupPath, name), filepath.Join(outDirName, name)); err != nil {
+			return xerrors.Errorf("uploading %s: %w", name, err)
+		}
+	}
+
+	pointer, err := json.Marshal(latestPointer{
+		Epoch:         epoch,
+		Path:          rollupPath,
+		Digest:        fp.Digest,
+		SchemaVersion: outputSchemaVersion,
+	})
+	if err != nil {
+		return err
+	}
+	if err := up.put(ctx, path.Join(prefix, latestPointerName), strings.NewReader(string(pointer)), int64(len(pointer)), "application/json"); err != nil {
+		return xerrors.Errorf("updating %s: %w", latestPointerName, err)
+	}
+
+	log.Infof("published rollup at epoch %d to %s", epoch, path.Join(prefix, rollupPath))
+	return nil
+}
+
+func uploadFile(ctx context.Context, up rollupUploader, key, localPath string) error {
+	fh, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close() //nolint:errcheck
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	ctype := mime.TypeByExtension(filepath.Ext(localPath))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	return up.put(ctx, key, fh, fi.Size(), ctype)
+}
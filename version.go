@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Every output envelope carries schema_version as MAJOR.MINOR. The policy:
+//
+//   - MINOR is bumped for backwards compatible changes: added fields, added
+//     documents, added enum values such as warning codes
+//   - MAJOR is bumped for anything else: removed or renamed fields, changed types,
+//     changed meaning of existing fields
+//
+// Consumers built against X.Y can thus safely read any X.Z with Z >= Y, see
+// schemaVersionCompatible.
+//
+// Each version is recorded along with the digest of the JSON Schema of all outputs
+// at that version, and the tests fail when the structs no longer match the latest
+// digest: changing an output struct requires appending a version here.
+var outputSchemaHistory = []struct {
+	Version string
+	Digest  string
+}{
+	{"1.0", "398722c33d56906a"},
+	{"1.1", "4bef666b201469d0"},
+	{"1.2", "b1e3ee463f5f7a75"},
+	{"1.3", "6b2085908a742718"},
+	{"1.4", "a41455cbf4d69706"},
+	{"1.5", "dc8eaaec678ec697"},
+	{"1.6", "a47c6ace7431b7c4"},
+	{"1.7", "91d4e315ea8ab2f6"},
+	{"1.8", "db144537308497bd"},
+	{"1.9", "6ece080333bfd4d2"},
+	{"1.10", "27011d887f51f129"},
+	{"1.11", "6203ca0d2a5c1483"},
+	{"1.12", "7ecf2185b23816b4"},
+	{"1.13", "ab073094ed5a74cb"},
+	{"1.14", "19fd21e174ea647a"},
+	{"1.15", "284c17e85a0d56b4"},
+	{"1.16", "380d436b0b7c51b9"},
+	{"1.17", "7804871f514036ee"},
+	{"1.18", "9b961eee3f03e77e"},
+	{"1.19", "f847af25328cb385"},
+	{"1.20", "f6c6d64d123c94b0"},
+	{"1.21", "c14fed2d73f9dd51"},
+	{"1.22", "02dff8cae8da1a68"},
+	{"1.23", "9e860d007c092776"},
+	{"1.24", "f6d47bb5733754ef"},
+	{"1.25", "1312b1bb2521a498"},
+	{"1.26", "7ba1656faa0dab62"},
+	{"1.27", "b1969d6100521e1e"},
+	{"1.28", "7614392788c45586"},
+	{"1.29", "bccf6423b1a7ca97"},
+	{"1.30", "954787302f6a84cc"},
+	{"1.31", "4d261838def53499"},
+	{"1.32", "87b8da8367fdd823"},
+}
+
+var outputSchemaVersion = outputSchemaHistory[len(outputSchemaHistory)-1].Version
+
+func outputSchemaDigest() string {
+	all := make(map[string]interface{}, len(schemaDocuments))
+	for name, doc := range schemaDocuments {
+		all[name] = jsonSchemaOf(doc.envelope)
+	}
+	canon, err := json.Marshal(all)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(canon)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Whether output at version produced can be read by a consumer built against required
+func schemaVersionCompatible(produced, required string) bool {
+	pMaj, pMin, err := parseSchemaVersion(produced)
+	if err != nil {
+		return false
+	}
+	rMaj, rMin, err := parseSchemaVersion(required)
+	if err != nil {
+		return false
+	}
+	return pMaj == rMaj && pMin >= rMin
+}
+
+func parseSchemaVersion(v string) (int, int, error) {
+	parts := strings.Split(v, ".")
+	if len(parts) != 2 {
+		return 0, 0, xerrors.Errorf("malformed schema version '%s'", v)
+	}
+	maj, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	min, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return maj, min, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestOutputSchemaVersioned(t *testing.T) {
+	if d := outputSchemaDigest(); d != outputSchemaHistory[len(outputSchemaHistory)-1].Digest {
+		t.Fatalf("output structs changed without a schema version bump: append a new entry with digest %s to outputSchemaHistory", d)
+	}
+}
+
+func TestOutputSchemaHistoryAscends(t *testing.T) {
+	for i := 1; i < len(outputSchemaHistory); i++ {
+		prev, cur := outputSchemaHistory[i-1], outputSchemaHistory[i]
+		pMaj, pMin, err := parseSchemaVersion(prev.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		maj, min, err := parseSchemaVersion(cur.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(maj == pMaj && min == pMin+1) && !(maj == pMaj+1 && min == 0) {
+			t.Errorf("schema version %s does not follow %s", cur.Version, prev.Version)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+)
+
+// Data-quality caveats attached to a project's stats, so that consumers can tell
+// incomplete numbers apart from authoritative ones
+type projectWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+const (
+	warnUnresolvedClient = "UNRESOLVED_CLIENT"
+	warnUnparsableLabel  = "UNPARSABLE_LABEL"
+	warnRecoveryExcluded = "RECOVERY_EXCLUDED"
+	warnListExcluded     = "EXCLUSION_LIST_EXCLUDED"
+	warnShortDuration    = "SHORT_DURATION_EXCLUDED"
+	warnReplicaLimit     = "REPLICA_LIMIT_EXCLUDED"
+)
+
+var projectWarningMessages = map[string]string{
+	warnUnresolvedClient: "deals whose client could not be resolved to a wallet address are missing from all numbers",
+	warnUnparsableLabel:  "deals whose label is not a valid CID are listed with an unknown payload CID",
+	warnRecoveryExcluded: "deals excluded from the competition by the recovery rules",
+	warnListExcluded:     "deals excluded by client or deal id in the exclusion list",
+}
+
+// The minimum duration depends on the --network and both limits on the rollup config,
+// so their messages are only known at run time
+func projectWarningMessage(code string) string {
+	switch code {
+	case warnShortDuration:
+		return fmt.Sprintf("deals excluded for a duration under %d days", minQualifyingDealDurationDays)
+	case warnReplicaLimit:
+		if pieceCapPerProvider {
+			return fmt.Sprintf("deals excluded for exceeding %d deals of the same piece with the same provider", maxQualifyingDealsPerPiece)
+		}
+		return fmt.Sprintf("deals excluded for exceeding %d deals of the same piece", maxQualifyingDealsPerPiece)
+	}
+	return projectWarningMessages[code]
+}
+
+// projID => code => warning
+type projectWarnings map[string]map[string]*projectWarning
+
+func (pw projectWarnings) add(projID, code string) {
+	byCode, ok := pw[projID]
+	if !ok {
+		byCode = make(map[string]*projectWarning)
+		pw[projID] = byCode
+	}
+	w, ok := byCode[code]
+	if !ok {
+		w = &projectWarning{Code: code, Message: projectWarningMessage(code)}
+		byCode[code] = w
+	}
+	w.Count++
+}
+
+// Never nil, so that the array is always present in the output
+func (pw projectWarnings) list(projID string) []*projectWarning {
+	ret := make([]*projectWarning, 0, len(pw[projID]))
+	for _, w := range pw[projID] {
+		ret = append(ret, w)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Code < ret[j].Code })
+	return ret
+}
+
+// Maps the ID addresses of all known project wallets back to their project, so that
+// deals whose client fails to resolve can still be attributed
+func projectsByClientID(ctx context.Context, api api.FullNode, ts rollupTipSet, knownAddrMap map[address.Address]string) map[address.Address]string {
+	ret := make(map[address.Address]string, len(knownAddrMap))
+	for addr, projID := range knownAddrMap {
+		idAddr, err := api.StateLookupID(ctx, addr, ts.Key())
+		if err != nil {
+			// not on chain (yet): can not be the client of any deal either
+			continue
+		}
+		ret[idAddr] = projID
+	}
+	return ret
+}
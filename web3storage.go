@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+const web3StorageTokenEnv = "WEB3_STORAGE_TOKEN"
+
+// Uploads a completed rollup directory through the /upload endpoint of web3.storage
+// (or any pinning service exposing the same API), which stores it on IPFS and
+// Filecoin and returns the root CID of the directory.
+func uploadRollupToWeb3Storage(ctx context.Context, apiBase, outDirName string, epoch int64) (cid.Cid, error) {
+	token := os.Getenv(web3StorageTokenEnv)
+	if token == "" {
+		return cid.Undef, xerrors.Errorf("no API token: %s is not set", web3StorageTokenEnv)
+	}
+
+	names, err := rollupFileNames(outDirName)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	dirName := strconv.FormatInt(epoch, 10)
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeDirectoryMultipart(mw, outDirName, dirName, names, false)) //nolint:errcheck
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(apiBase, "/")+"/upload", pr)
+	if err != nil {
+		pr.Close() //nolint:errcheck
+		return cid.Undef, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+mw.Boundary())
+	req.Header.Set("X-Name", "slingshot-stats-rollup-"+dirName)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return cid.Undef, xerrors.Errorf("non-2xx response %d from %s: %s", resp.StatusCode, apiBase, respBody)
+	}
+
+	var stored struct {
+		CID string `json:"cid"`
+	}
+	if err := json.Unmarshal(respBody, &stored); err != nil {
+		return cid.Undef, xerrors.Errorf("unexpected response from %s: %w", apiBase, err)
+	}
+	return cid.Parse(stored.CID)
+}